@@ -0,0 +1,208 @@
+package archiver
+
+import (
+	"bytes"
+	uuidlib "code.google.com/p/go-uuid/uuid"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"time"
+)
+
+// how long a driver's callback has to accept an actuation
+const actuationCallbackTimeout = 10 * time.Second
+
+// An Actuation is sent to the CallbackURL of an actuator as JSON, e.g.
+//
+//    {"uuid": "...", "Path": "/room/light", "Value": 1, "Time": 1420185600000}
+//
+// Time is in milliseconds.
+type Actuation struct {
+	UUID  string `json:"uuid"`
+	Path  string
+	Value interface{}
+	Time  uint64
+}
+
+// Returned by Actuate when the actuation is refused rather than failed: the
+// API key may not actuate the stream (Forbidden), or the stream is not an
+// actuator or does not take the value. The handlers turn it into an HTTP
+// 403 or 400
+type ActuationError struct {
+	Forbidden bool
+	Reason    string
+}
+
+func (e *ActuationError) Error() string {
+	return e.Reason
+}
+
+// The model of an actuator, from the Actuator metadata of its stream, e.g.
+//
+//    "Actuator": {"Model": "binary"}
+//    "Actuator": {"Model": "discrete", "Values": ["heat", "cool", "off"]}
+//    "Actuator": {"Model": "continuous", "MinValue": 55, "MaxValue": 85}
+//
+// Binary actuators take 0 or 1 (or true or false), discrete actuators one of
+// their Values (or States), and continuous actuators any number between
+// MinValue and MaxValue, where they are given. If the actuator has a
+// CallbackURL, actuations are POSTed there for the driver to carry out.
+type actuatorModel struct {
+	model    string
+	values   []interface{}
+	min, max *float64
+	callback string
+}
+
+func parseActuatorModel(actuator bson.M) (*actuatorModel, error) {
+	am := &actuatorModel{}
+	am.model, _ = actuator["Model"].(string)
+	am.callback, _ = actuator["CallbackURL"].(string)
+	switch am.model {
+	case "binary":
+	case "discrete":
+		values, ok := actuator["Values"].([]interface{})
+		if !ok {
+			values, ok = actuator["States"].([]interface{})
+		}
+		if !ok || len(values) == 0 {
+			return nil, errors.New("Discrete actuator has no Values")
+		}
+		am.values = values
+	case "continuous":
+		if min, ok := actuatorNumber(actuator["MinValue"]); ok {
+			am.min = &min
+		}
+		if max, ok := actuatorNumber(actuator["MaxValue"]); ok {
+			am.max = &max
+		}
+	default:
+		return nil, fmt.Errorf("Unknown actuator model %v", actuator["Model"])
+	}
+	return am, nil
+}
+
+// Returns the value an actuator is set to for the requested value, or an
+// error if the actuator does not accept it
+func (am *actuatorModel) validate(value interface{}) (interface{}, error) {
+	switch am.model {
+	case "binary":
+		if b, ok := value.(bool); ok {
+			if b {
+				return float64(1), nil
+			}
+			return float64(0), nil
+		}
+		if v, ok := actuatorNumber(value); ok && (v == 0 || v == 1) {
+			return v, nil
+		}
+		return nil, fmt.Errorf("Binary actuator takes 0 or 1, not %v", value)
+	case "discrete":
+		for _, allowed := range am.values {
+			if fmt.Sprint(allowed) == fmt.Sprint(value) {
+				if v, ok := actuatorNumber(allowed); ok {
+					return v, nil
+				}
+				return fmt.Sprint(allowed), nil
+			}
+		}
+		return nil, fmt.Errorf("Discrete actuator takes one of %v, not %v", am.values, value)
+	}
+	v, ok := actuatorNumber(value)
+	if !ok {
+		return nil, fmt.Errorf("Continuous actuator takes a number, not %v", value)
+	}
+	if (am.min != nil && v < *am.min) || (am.max != nil && v > *am.max) {
+		return nil, fmt.Errorf("%v is outside the range of the actuator", v)
+	}
+	return v, nil
+}
+
+// Returns v as a number, whether it came from JSON or the metadata store
+// (which gives small integers as int)
+func actuatorNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	case int:
+		return float64(n), true
+	}
+	return readingValue(v)
+}
+
+// The reading type of the actuator's companion stream
+func (am *actuatorModel) readingType() string {
+	for _, allowed := range am.values {
+		if _, ok := actuatorNumber(allowed); !ok {
+			return READINGTYPE_STRING
+		}
+	}
+	return READINGTYPE_DOUBLE
+}
+
+// Every actuation of a stream is recorded as a reading on its companion
+// stream, whose UUID is derived from the actuator's
+func actuationStreamUUID(uuid string) string {
+	return uuidlib.NewSHA1(uuidlib.NameSpace_URL, []byte("giles/actuate/"+uuid)).String()
+}
+
+// Returns the metadata-only message for the companion stream of the actuator
+// described by msg. The companion stream is tagged with Metadata/Actuates,
+// so drivers without a CallbackURL can subscribe to their actuations with
+// e.g. "Metadata/Actuates = '<uuid>'"
+func actuationStream(msg *SmapMessage) (*SmapMessage, error) {
+	am, err := parseActuatorModel(msg.Actuator)
+	if err != nil {
+		return nil, err
+	}
+	// not below the actuator's path, whose metadata it would inherit
+	return &SmapMessage{UUID: actuationStreamUUID(msg.UUID), Path: "/actuations" + msg.Path,
+		Metadata:   bson.M{"Actuates": msg.UUID},
+		Properties: bson.M{"UnitofTime": "ms", "ReadingType": am.readingType()}}, nil
+}
+
+// Adds the companion streams of the actuators among the messages, so that
+// their metadata is saved along with the actuators'
+func withActuationStreams(messages map[string]*SmapMessage) map[string]*SmapMessage {
+	var companions []*SmapMessage
+	for _, msg := range messages {
+		if msg.UUID == "" || msg.Actuator == nil {
+			continue
+		}
+		if companion, err := actuationStream(msg); err == nil {
+			companions = append(companions, companion)
+		}
+	}
+	if len(companions) == 0 {
+		return messages
+	}
+	all := make(map[string]*SmapMessage, len(messages)+len(companions))
+	for path, msg := range messages {
+		all[path] = msg
+	}
+	for _, companion := range companions {
+		all[companion.Path] = companion
+	}
+	return all
+}
+
+// POSTs the actuation to the driver's callback URL
+func sendActuation(url string, act *Actuation) error {
+	body, err := json.Marshal(act)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: actuationCallbackTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Driver refused actuation: %v", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package archiver
+
+import (
+	"encoding/json"
+	"gopkg.in/mgo.v2/bson"
+	"testing"
+)
+
+func TestActuatorModel(t *testing.T) {
+	for _, tt := range []struct {
+		actuator bson.M
+		valid    []interface{}
+		invalid  []interface{}
+	}{
+		{bson.M{"Model": "binary"}, []interface{}{float64(0), int64(1), true}, []interface{}{float64(2), "on"}},
+		{bson.M{"Model": "discrete", "Values": []interface{}{"heat", "cool", "off"}},
+			[]interface{}{"heat", "off"}, []interface{}{"dry", float64(1)}},
+		{bson.M{"Model": "continuous", "MinValue": json.Number("55"), "MaxValue": 85},
+			[]interface{}{float64(55), int64(70), float64(85)}, []interface{}{float64(54.9), float64(86), "warm"}},
+	} {
+		am, err := parseActuatorModel(tt.actuator)
+		if err != nil {
+			t.Error(tt.actuator, "should be a valid actuator but gave", err)
+			continue
+		}
+		for _, value := range tt.valid {
+			if _, err := am.validate(value); err != nil {
+				t.Error(value, "should be valid for", tt.actuator, "but gave", err)
+			}
+		}
+		for _, value := range tt.invalid {
+			if _, err := am.validate(value); err == nil {
+				t.Error(value, "should not be valid for", tt.actuator)
+			}
+		}
+	}
+
+	for _, actuator := range []bson.M{{}, {"Model": "dial"}, {"Model": "discrete"}} {
+		if _, err := parseActuatorModel(actuator); err == nil {
+			t.Error(actuator, "should give an error")
+		}
+	}
+}
+
+func TestWithActuationStreams(t *testing.T) {
+	messages := map[string]*SmapMessage{
+		"/room/light": &SmapMessage{UUID: "a", Path: "/room/light", Actuator: bson.M{"Model": "binary"}},
+		"/room/temp":  &SmapMessage{UUID: "b", Path: "/room/temp"},
+	}
+	all := withActuationStreams(messages)
+	companion := all["/actuations/room/light"]
+	if len(all) != 3 || companion == nil {
+		t.Fatal("Should add a companion stream for /room/light but got", all)
+	}
+	if companion.UUID != actuationStreamUUID("a") || companion.Metadata["Actuates"] != "a" || companion.Properties["ReadingType"] != READINGTYPE_DOUBLE {
+		t.Error("Wrong companion stream", companion)
+	}
+	if len(messages) != 2 {
+		t.Error("The original messages should be left alone")
+	}
+}
@@ -0,0 +1,489 @@
+package archiver
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Apply queries run the results of a data query through a pipeline of
+// operators, as in the original sMAP archiver:
+//
+//    apply window(mean, field='minute', width=15) to data in (now -1d, now) where Metadata/Type = 'Temp'
+//    apply nansum < paste < units to data before now limit 10 where Metadata/Panel = 'A'
+//
+// Operators are composed with "<" and applied right to left, so the last
+// operator sees the data first. The supported operators are
+//
+//    window(op, field='minute', width=1)
+//        groups each stream's readings into windows of width fields (second,
+//        minute, hour or day) and reduces each window with op (mean, min, max,
+//        sum, count, first, last or median). Readings are stamped with the
+//        start of their window
+//    subsample(period)
+//        keeps the first reading of each stream in every period seconds
+//    interpolate[(period)]
+//        linearly interpolates each stream onto a common set of timestamps:
+//        every period seconds if a period is given, otherwise the timestamps
+//        of all of the streams. A period that would give more than
+//        maxInterpolatePoints timestamps is an error
+//    units
+//        converts readings to canonical units based on Properties/UnitofMeasure
+//        (e.g. F to C, kW to W)
+//    paste
+//        joins the streams into one result whose rows are
+//        [timestamp, value1, value2, ...]. Only timestamps present in every
+//        stream are kept (use interpolate first to fill gaps). The uuid of the
+//        result lists the pasted streams, in column order
+//    nansum
+//        sums across streams (or across the columns of pasted data) at each
+//        timestamp, skipping missing and NaN values
+type operatorCall struct {
+	name   string
+	args   []string
+	kwargs map[string]string
+}
+
+// The information the operators need besides the data itself
+type applyContext struct {
+	// unit of time of the timestamps in the data
+	uot UnitOfTime
+	// UnitofMeasure of each stream, for the units operator
+	units map[string]string
+}
+
+type operator func(call *operatorCall, ctx *applyContext, data []SmapResponse) ([]SmapResponse, error)
+
+var operators = map[string]operator{
+	"window":      windowOperator,
+	"subsample":   subsampleOperator,
+	"interpolate": interpolateOperator,
+	"units":       unitsOperator,
+	"paste":       pasteOperator,
+	"nansum":      nansumOperator,
+}
+
+// Parses a pipeline such as "nansum < paste < window(mean, width=5)". The
+// calls are returned in the order they should be applied
+func parseOperators(pipeline string) ([]*operatorCall, error) {
+	parts := splitOutsideQuotes(pipeline, '<')
+	calls := make([]*operatorCall, 0, len(parts))
+	for i := len(parts) - 1; i >= 0; i-- {
+		call, err := parseOperatorCall(strings.TrimSpace(parts[i]))
+		if err != nil {
+			return nil, err
+		}
+		op, found := operators[call.name]
+		if !found {
+			return nil, errors.New("Unknown operator " + call.name)
+		}
+		// operators check their arguments before looking at the data
+		if _, err := op(call, &applyContext{}, nil); err != nil {
+			return nil, err
+		}
+		calls = append(calls, call)
+	}
+	return calls, nil
+}
+
+// parses name or name(arg, ..., key=value, ...)
+func parseOperatorCall(s string) (*operatorCall, error) {
+	call := &operatorCall{kwargs: make(map[string]string)}
+	paren := strings.Index(s, "(")
+	if paren < 0 {
+		call.name = s
+	} else {
+		if !strings.HasSuffix(s, ")") {
+			return nil, errors.New("Missing ) in operator " + s)
+		}
+		call.name = strings.TrimSpace(s[:paren])
+		inner := strings.TrimSpace(s[paren+1 : len(s)-1])
+		if inner != "" {
+			for _, arg := range splitOutsideQuotes(inner, ',') {
+				arg = strings.TrimSpace(arg)
+				if eq := strings.Index(arg, "="); eq > 0 && !strings.ContainsAny(arg[:eq], "'\"") {
+					call.kwargs[strings.TrimSpace(arg[:eq])] = unquote(arg[eq+1:])
+				} else {
+					call.args = append(call.args, unquote(arg))
+				}
+			}
+		}
+	}
+	if call.name == "" {
+		return nil, errors.New("Missing operator")
+	}
+	return call, nil
+}
+
+// splits s at each sep that is not inside quotes or parentheses
+func splitOutsideQuotes(s string, sep byte) []string {
+	var (
+		parts []string
+		quote byte
+		depth int
+		start int
+	)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == sep && depth == 0:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// Runs data through the operators in order
+func applyOperators(calls []*operatorCall, ctx *applyContext, data []SmapResponse) ([]SmapResponse, error) {
+	var err error
+	for _, call := range calls {
+		if data, err = operators[call.name](call, ctx, data); err != nil {
+			return nil, fmt.Errorf("%v: %v", call.name, err)
+		}
+	}
+	return data, nil
+}
+
+// returns the named argument, or the positional argument at pos, or def
+func (call *operatorCall) arg(name string, pos int, def string) string {
+	if val, found := call.kwargs[name]; found {
+		return val
+	}
+	if pos >= 0 && pos < len(call.args) {
+		return call.args[pos]
+	}
+	return def
+}
+
+// the number of timestamp units in one second
+func unitsPerSecond(uot UnitOfTime) float64 {
+	return float64(convertTime(1, UOT_S, uot))
+}
+
+var windowFields = map[string]float64{"second": 1, "minute": 60, "hour": 3600, "day": 86400}
+
+func windowOperator(call *operatorCall, ctx *applyContext, data []SmapResponse) ([]SmapResponse, error) {
+	reduce, found := reducers[call.arg("op", 0, "mean")]
+	if !found {
+		return nil, errors.New("Unknown window operation " + call.arg("op", 0, "mean"))
+	}
+	field, found := windowFields[call.arg("field", 1, "minute")]
+	if !found {
+		return nil, errors.New("Window field must be second, minute, hour or day")
+	}
+	width, err := strconv.ParseFloat(call.arg("width", 2, "1"), 64)
+	if err != nil || width <= 0 {
+		return nil, errors.New("Window width must be a positive number")
+	}
+	size := uint64(field * width * unitsPerSecond(ctx.uot))
+	if size == 0 {
+		size = 1
+	}
+	result := make([]SmapResponse, 0, len(data))
+	for _, resp := range data {
+		out := SmapResponse{UUID: resp.UUID, Readings: [][]float64{}}
+		var (
+			values []float64
+			start  uint64
+		)
+		for _, rdg := range sortedReadings(resp.Readings) {
+			ts := uint64(rdg[0])
+			bucket := ts - ts%size
+			if len(values) > 0 && bucket != start {
+				out.Readings = append(out.Readings, []float64{float64(start), reduce(values)})
+				values = values[:0]
+			}
+			start = bucket
+			values = append(values, rdg[1])
+		}
+		if len(values) > 0 {
+			out.Readings = append(out.Readings, []float64{float64(start), reduce(values)})
+		}
+		result = append(result, out)
+	}
+	return result, nil
+}
+
+var reducers = map[string]func([]float64) float64{
+	"mean": func(v []float64) float64 { return sumOf(v) / float64(len(v)) },
+	"sum":  sumOf,
+	"count": func(v []float64) float64 {
+		return float64(len(v))
+	},
+	"first": func(v []float64) float64 { return v[0] },
+	"last":  func(v []float64) float64 { return v[len(v)-1] },
+	"min": func(v []float64) float64 {
+		min := v[0]
+		for _, x := range v[1:] {
+			min = math.Min(min, x)
+		}
+		return min
+	},
+	"max": func(v []float64) float64 {
+		max := v[0]
+		for _, x := range v[1:] {
+			max = math.Max(max, x)
+		}
+		return max
+	},
+	"median": func(v []float64) float64 {
+		sorted := append([]float64{}, v...)
+		sort.Float64s(sorted)
+		if len(sorted)%2 == 1 {
+			return sorted[len(sorted)/2]
+		}
+		return (sorted[len(sorted)/2-1] + sorted[len(sorted)/2]) / 2
+	},
+}
+
+func sumOf(v []float64) float64 {
+	var sum float64
+	for _, x := range v {
+		sum += x
+	}
+	return sum
+}
+
+// returns the readings ordered by timestamp, leaving the input untouched
+func sortedReadings(readings [][]float64) [][]float64 {
+	sorted := make([][]float64, 0, len(readings))
+	for _, rdg := range readings {
+		if len(rdg) >= 2 {
+			sorted = append(sorted, rdg)
+		}
+	}
+	sort.Sort(byTimestamp(sorted))
+	return sorted
+}
+
+type byTimestamp [][]float64
+
+func (b byTimestamp) Len() int           { return len(b) }
+func (b byTimestamp) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byTimestamp) Less(i, j int) bool { return b[i][0] < b[j][0] }
+
+func subsampleOperator(call *operatorCall, ctx *applyContext, data []SmapResponse) ([]SmapResponse, error) {
+	period, err := strconv.ParseFloat(call.arg("period", 0, ""), 64)
+	if err != nil || period <= 0 {
+		return nil, errors.New("subsample needs a positive period in seconds")
+	}
+	size := uint64(period * unitsPerSecond(ctx.uot))
+	if size == 0 {
+		size = 1
+	}
+	result := make([]SmapResponse, 0, len(data))
+	for _, resp := range data {
+		out := SmapResponse{UUID: resp.UUID, Readings: [][]float64{}}
+		var last uint64
+		for i, rdg := range sortedReadings(resp.Readings) {
+			bucket := uint64(rdg[0]) - uint64(rdg[0])%size
+			if i == 0 || bucket != last {
+				out.Readings = append(out.Readings, rdg)
+				last = bucket
+			}
+		}
+		result = append(result, out)
+	}
+	return result, nil
+}
+
+// the most timestamps interpolate will generate for a period
+const maxInterpolatePoints = 1000000
+
+func interpolateOperator(call *operatorCall, ctx *applyContext, data []SmapResponse) ([]SmapResponse, error) {
+	var size uint64
+	if p := call.arg("period", 0, ""); p != "" {
+		period, err := strconv.ParseFloat(p, 64)
+		if err != nil || period <= 0 {
+			return nil, errors.New("interpolate needs a positive period in seconds")
+		}
+		if size = uint64(period * unitsPerSecond(ctx.uot)); size == 0 {
+			size = 1
+		}
+	}
+	if len(data) == 0 {
+		return data, nil
+	}
+
+	// the timestamps we interpolate onto
+	var timestamps []float64
+	if size > 0 {
+		first, last := math.Inf(1), math.Inf(-1)
+		for _, resp := range data {
+			for _, rdg := range resp.Readings {
+				first, last = math.Min(first, rdg[0]), math.Max(last, rdg[0])
+			}
+		}
+		if math.IsInf(first, 0) {
+			return data, nil
+		}
+		start := uint64(first) - uint64(first)%size
+		if start < uint64(first) {
+			start += size
+		}
+		if float64(start) <= last && (uint64(last)-start)/size >= maxInterpolatePoints {
+			return nil, fmt.Errorf("period %v gives more than %v timestamps over the data; use a longer period", call.arg("period", 0, ""), maxInterpolatePoints)
+		}
+		for ts := start; float64(ts) <= last; ts += size {
+			timestamps = append(timestamps, float64(ts))
+		}
+	} else {
+		seen := make(map[float64]bool)
+		for _, resp := range data {
+			for _, rdg := range resp.Readings {
+				if !seen[rdg[0]] {
+					seen[rdg[0]] = true
+					timestamps = append(timestamps, rdg[0])
+				}
+			}
+		}
+		sort.Float64s(timestamps)
+	}
+
+	result := make([]SmapResponse, 0, len(data))
+	for _, resp := range data {
+		readings := sortedReadings(resp.Readings)
+		out := SmapResponse{UUID: resp.UUID, Readings: [][]float64{}}
+		i := 0
+		for _, ts := range timestamps {
+			// only interpolate inside the range of the stream's own data
+			if len(readings) == 0 || ts < readings[0][0] || ts > readings[len(readings)-1][0] {
+				continue
+			}
+			for i < len(readings)-1 && readings[i+1][0] <= ts {
+				i++
+			}
+			value := readings[i][1]
+			if readings[i][0] != ts && i < len(readings)-1 {
+				before, after := readings[i], readings[i+1]
+				value = before[1] + (after[1]-before[1])*(ts-before[0])/(after[0]-before[0])
+			}
+			out.Readings = append(out.Readings, []float64{ts, value})
+		}
+		result = append(result, out)
+	}
+	return result, nil
+}
+
+// canonical unit and conversion for the units operator
+type unitConversion struct {
+	unit    string
+	convert func(float64) float64
+}
+
+var unitConversions = map[string]unitConversion{
+	"F":     {"C", func(v float64) float64 { return (v - 32) * 5 / 9 }},
+	"deg F": {"C", func(v float64) float64 { return (v - 32) * 5 / 9 }},
+	"K":     {"C", func(v float64) float64 { return v - 273.15 }},
+	"kW":    {"W", func(v float64) float64 { return v * 1000 }},
+	"MW":    {"W", func(v float64) float64 { return v * 1000000 }},
+	"kWh":   {"Wh", func(v float64) float64 { return v * 1000 }},
+	"MWh":   {"Wh", func(v float64) float64 { return v * 1000000 }},
+	"mA":    {"A", func(v float64) float64 { return v / 1000 }},
+	"kVA":   {"VA", func(v float64) float64 { return v * 1000 }},
+}
+
+func unitsOperator(call *operatorCall, ctx *applyContext, data []SmapResponse) ([]SmapResponse, error) {
+	result := make([]SmapResponse, 0, len(data))
+	for _, resp := range data {
+		conv, found := unitConversions[ctx.units[resp.UUID]]
+		if !found {
+			result = append(result, resp)
+			continue
+		}
+		out := SmapResponse{UUID: resp.UUID, Readings: make([][]float64, 0, len(resp.Readings))}
+		for _, rdg := range resp.Readings {
+			converted := append([]float64{}, rdg...)
+			for i := 1; i < len(converted); i++ {
+				converted[i] = conv.convert(converted[i])
+			}
+			out.Readings = append(out.Readings, converted)
+		}
+		result = append(result, out)
+	}
+	return result, nil
+}
+
+func pasteOperator(call *operatorCall, ctx *applyContext, data []SmapResponse) ([]SmapResponse, error) {
+	if len(data) == 0 {
+		return data, nil
+	}
+	streams := append([]SmapResponse{}, data...)
+	sort.Sort(byUUID(streams))
+	uuids := make([]string, len(streams))
+	values := make([]map[float64]float64, len(streams))
+	for i, resp := range streams {
+		uuids[i] = resp.UUID
+		values[i] = make(map[float64]float64, len(resp.Readings))
+		for _, rdg := range resp.Readings {
+			if len(rdg) >= 2 {
+				values[i][rdg[0]] = rdg[1]
+			}
+		}
+	}
+	out := SmapResponse{UUID: strings.Join(uuids, ","), Readings: [][]float64{}}
+	for _, rdg := range sortedReadings(streams[0].Readings) {
+		row := []float64{rdg[0]}
+		for _, vals := range values {
+			v, found := vals[rdg[0]]
+			if !found {
+				row = nil
+				break
+			}
+			row = append(row, v)
+		}
+		if row != nil {
+			out.Readings = append(out.Readings, row)
+		}
+	}
+	return []SmapResponse{out}, nil
+}
+
+type byUUID []SmapResponse
+
+func (b byUUID) Len() int           { return len(b) }
+func (b byUUID) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byUUID) Less(i, j int) bool { return b[i].UUID < b[j].UUID }
+
+func nansumOperator(call *operatorCall, ctx *applyContext, data []SmapResponse) ([]SmapResponse, error) {
+	if len(data) == 0 {
+		return data, nil
+	}
+	sums := make(map[float64]float64)
+	uuids := make([]string, 0, len(data))
+	for _, resp := range data {
+		uuids = append(uuids, resp.UUID)
+		for _, rdg := range resp.Readings {
+			if len(rdg) < 2 {
+				continue
+			}
+			sum := sums[rdg[0]]
+			for _, v := range rdg[1:] {
+				if !math.IsNaN(v) {
+					sum += v
+				}
+			}
+			sums[rdg[0]] = sum
+		}
+	}
+	out := SmapResponse{UUID: strings.Join(uuids, ","), Readings: make([][]float64, 0, len(sums))}
+	for ts, sum := range sums {
+		out.Readings = append(out.Readings, []float64{ts, sum})
+	}
+	sort.Sort(byTimestamp(out.Readings))
+	return []SmapResponse{out}, nil
+}
@@ -0,0 +1,115 @@
+package archiver
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestParseOperators(t *testing.T) {
+	calls, err := parseOperators("nansum < paste < window(mean, field='minute', width=15)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, call := range calls {
+		names = append(names, call.name)
+	}
+	if !isStringSliceEqual(names, []string{"window", "paste", "nansum"}) {
+		t.Error("Operators should be applied right to left but are", names)
+	}
+	if calls[0].arg("op", 0, "") != "mean" || calls[0].arg("field", 1, "") != "minute" || calls[0].arg("width", 2, "") != "15" {
+		t.Error("Wrong window arguments", calls[0])
+	}
+
+	for _, pipeline := range []string{"", "frobnicate", "window(avg)", "window(mean, field='fortnight')",
+		"subsample", "subsample(-1)", "window(mean", "paste <"} {
+		if _, err := parseOperators(pipeline); err == nil {
+			t.Error(pipeline, "\nshould give an error")
+		}
+	}
+}
+
+func TestApplyQuery(t *testing.T) {
+	ast, err := parseQuery("apply window(mean, field='minute', width=15) to data in (now -1d, now) where Metadata/Type = 'Temp'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ast.QueryType != APPLY_TYPE || ast.TargetType != DATA_TARGET || len(ast.Apply) != 1 {
+		t.Error("Wrong AST for apply query", ast)
+	}
+	if ast.Where.ToBson()["Metadata.Type"] != "Temp" {
+		t.Error("Wrong where clause for apply query", ast.Where.ToBson())
+	}
+
+	for _, q := range []string{"", "apply window(mean)", "apply frobnicate to data before now where uuid = 'a'",
+		"apply window(mean) to * where uuid = 'a'"} {
+		if _, err := parseQuery(q); err == nil {
+			t.Error(q, "\nshould give an error")
+		}
+	}
+}
+
+func runOperators(t *testing.T, pipeline string, ctx *applyContext, data []SmapResponse) []SmapResponse {
+	calls, err := parseOperators(pipeline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := applyOperators(calls, ctx, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestOperators(t *testing.T) {
+	ctx := &applyContext{uot: UOT_MS}
+	data := []SmapResponse{{UUID: "b", Readings: [][]float64{{0, 1}, {30000, 3}, {60000, 5}, {90000, 9}}},
+		{UUID: "a", Readings: [][]float64{{0, 10}, {60000, 20}, {120000, 30}}}}
+
+	res := runOperators(t, "window(mean, field='minute')", ctx, data)
+	if !reflect.DeepEqual(res[0].Readings, [][]float64{{0, 2}, {60000, 7}}) {
+		t.Error("Wrong window mean", res[0].Readings)
+	}
+	res = runOperators(t, "window(count, width=2)", ctx, data)
+	if !reflect.DeepEqual(res[1].Readings, [][]float64{{0, 2}, {120000, 1}}) {
+		t.Error("Wrong window count", res[1].Readings)
+	}
+
+	res = runOperators(t, "subsample(60)", ctx, data)
+	if !reflect.DeepEqual(res[0].Readings, [][]float64{{0, 1}, {60000, 5}}) {
+		t.Error("Wrong subsample", res[0].Readings)
+	}
+
+	res = runOperators(t, "interpolate", ctx, data)
+	if !reflect.DeepEqual(res[1].Readings, [][]float64{{0, 10}, {30000, 15}, {60000, 20}, {90000, 25}, {120000, 30}}) {
+		t.Error("Wrong interpolation", res[1].Readings)
+	}
+
+	calls, _ := parseOperators("interpolate(0.001)")
+	year := []SmapResponse{{UUID: "a", Readings: [][]float64{{0, 1}, {365 * 86400000, 2}}}}
+	if _, err := applyOperators(calls, ctx, year); err == nil {
+		t.Error("Interpolating a year every millisecond should give an error")
+	}
+
+	res = runOperators(t, "paste < interpolate", ctx, data)
+	if len(res) != 1 || res[0].UUID != "a,b" {
+		t.Fatal("Paste should give one result for a,b", res)
+	}
+	if !reflect.DeepEqual(res[0].Readings, [][]float64{{0, 10, 1}, {30000, 15, 3}, {60000, 20, 5}, {90000, 25, 9}}) {
+		t.Error("Wrong paste", res[0].Readings)
+	}
+
+	res = runOperators(t, "nansum", ctx, []SmapResponse{{UUID: "a", Readings: [][]float64{{0, 1}, {1, 2}}},
+		{UUID: "b", Readings: [][]float64{{0, math.NaN()}, {1, 3}}}})
+	if !reflect.DeepEqual(res[0].Readings, [][]float64{{0, 1}, {1, 5}}) {
+		t.Error("Wrong nansum", res[0].Readings)
+	}
+
+	ctx.units = map[string]string{"a": "F", "b": "kW"}
+	res = runOperators(t, "units", ctx, []SmapResponse{{UUID: "a", Readings: [][]float64{{0, 212}}},
+		{UUID: "b", Readings: [][]float64{{0, 1.5}}}, {UUID: "c", Readings: [][]float64{{0, 4}}}})
+	if res[0].Readings[0][1] != 100 || res[1].Readings[0][1] != 1500 || res[2].Readings[0][1] != 4 {
+		t.Error("Wrong unit conversion", res)
+	}
+}
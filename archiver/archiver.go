@@ -21,9 +21,12 @@ package archiver
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/op/go-logging"
 	"gopkg.in/mgo.v2/bson"
+	"io"
 	"net"
+	"net/url"
 	"os"
 	"time"
 )
@@ -51,7 +54,19 @@ type Archiver struct {
 	incomingcounter      *counter
 	pendingwritescounter *counter
 	coalescer            *Coalescer
+	lastvalues           *LastValueCache
+	rules                *RuleEngine
+	webhooks             *WebhookManager
+	virtual              *VirtualStreams
+	rollups              *RollupService
+	expiry               *ExpiryJob
+	objects              *ObjectStore
+	replicator           *Replicator
+	cluster              *Cluster
+	validator            *validator
+	imports              *importLocks
 	sshscs               *SSHConfigServer
+	listeners            *listenerStatus
 	enforceKeys          bool
 }
 
@@ -88,15 +103,164 @@ func NewArchiver(c *Config) *Archiver {
 		log.Fatal("Error connection to MongoDB instance")
 	}
 
+	backlogsize := defaultWriteBacklog
+	if c.Archiver.WriteBacklog != nil {
+		backlogsize = *c.Archiver.WriteBacklog
+	}
+	backlogsize *= 1 << 20
+
+	tsdb := newTSDB(*c.Archiver.TSDB, c, store, backlogsize)
+	var backends *MultiTSDB
+	if len(c.Archiver.MirrorTSDB) > 0 {
+		backends = NewMultiTSDB(*c.Archiver.TSDB, tsdb)
+		for _, name := range c.Archiver.MirrorTSDB {
+			if err := backends.AddMirror(name, newTSDB(name, c, store, backlogsize)); err != nil {
+				log.Fatal("Error adding mirror: %v", err)
+			}
+		}
+		tsdb = backends
+	}
+	tsdb = instrumentedTSDB{tsdb}
+	if err := tsdb.Ping(healthCheckTimeout); err != nil {
+		// not fatal: /readyz reports the TSDB until it can be reached
+		log.Error("Timeseries database is not reachable: %v", err)
+	} else {
+		log.Notice("...connected!")
+	}
+
+	duplicates := DUPLICATES_KEEP_ALL
+	if c.Archiver.DuplicatePolicy != nil && *c.Archiver.DuplicatePolicy != "" {
+		duplicates = *c.Archiver.DuplicatePolicy
+		if !validDuplicatePolicy(duplicates) {
+			log.Fatal("Invalid DuplicatePolicy %v", duplicates)
+		}
+	}
+
+	validator, err := newValidator(c)
+	if err != nil {
+		log.Fatal("Error in validation configuration: %v", err)
+	}
+
+	republisher := NewRepublisher()
+	republisher.store = store
+	republisher.tsdb = tsdb
+
+	lastvalues := NewLastValueCache()
+	go lastvalues.warm(tsdb, store)
+
+	rules := NewRuleEngine(store)
+	webhooks := NewWebhookManager(store, republisher)
+	go webhooks.start()
+	virtual := NewVirtualStreams(store, lastvalues)
+	objects := NewObjectStore(store)
+
+	var rollups *RollupService
+	if c.Rollups.Enabled {
+		if rollups, err = NewRollupService(store, tsdb, c); err != nil {
+			log.Fatal("Error in rollup configuration: %v", err)
+		}
+		go rollups.run()
+	}
+
+	var expiry *ExpiryJob
+	if c.Expiry.Enabled {
+		interval := time.Hour
+		if c.Expiry.Interval != nil {
+			if interval, err = parseRetention(*c.Expiry.Interval); err != nil || interval == 0 {
+				log.Fatal("Invalid expiry interval %v", *c.Expiry.Interval)
+			}
+		}
+		rate := 10
+		if c.Expiry.Rate != nil {
+			rate = *c.Expiry.Rate
+		}
+		expiry = NewExpiryJob(store, tsdb, interval, rate)
+		expiry.rollups = rollups
+		expiry.objects = objects
+		expiry.lastvalues = lastvalues
+		go expiry.run()
+	}
+
+	var replicator *Replicator
+	if c.Replication.Enabled {
+		if c.Replication.Upstream == nil || c.Replication.Key == nil {
+			log.Fatal("Replication needs an Upstream and a Key")
+		}
+		if replicator, err = NewReplicator(store, *c.Replication.Upstream, *c.Replication.Key); err != nil {
+			log.Fatal("Error starting replication: %v", err)
+		}
+		go replicator.run()
+	}
+
+	var cluster *Cluster
+	if c.Cluster.Enabled {
+		if c.Cluster.Self == nil {
+			log.Fatal("Cluster needs the name of this node (Self)")
+		}
+		nodes := make(map[string]string, len(c.Node))
+		for name, node := range c.Node {
+			nodes[name] = node.Address
+		}
+		if cluster, err = NewCluster(*c.Cluster.Self, nodes); err != nil {
+			log.Fatal("Error in cluster configuration: %v", err)
+		}
+	}
+
+	sshscs := NewSSHConfigServer(store, *c.SSH.Port, *c.SSH.PrivateKey,
+		*c.SSH.AuthorizedKeysFile,
+		*c.SSH.User, *c.SSH.Pass,
+		c.SSH.PasswordEnabled, c.SSH.KeyAuthEnabled)
+	sshscs.rules = rules
+	sshscs.webhooks = webhooks
+	sshscs.virtual = virtual
+	sshscs.expiry = expiry
+	sshscs.backfill = NewBackfillJob(store, backends)
+	sshscs.replicator = replicator
+	sshscs.cluster = cluster
+
+	a := &Archiver{tsdb: tsdb,
+		store:                store,
+		republisher:          republisher,
+		incomingcounter:      newCounter(),
+		pendingwritescounter: newCounter(),
+		coalescer:            NewCoalescer(&tsdb, duplicates),
+		lastvalues:           lastvalues,
+		rules:                rules,
+		webhooks:             webhooks,
+		virtual:              virtual,
+		rollups:              rollups,
+		expiry:               expiry,
+		objects:              objects,
+		replicator:           replicator,
+		cluster:              cluster,
+		validator:            validator,
+		imports:              newImportLocks(),
+		sshscs:               sshscs,
+		listeners:            newListenerStatus(),
+		enforceKeys:          c.Archiver.EnforceKeys}
+	republisher.coalescer = a.coalescer
+	// alerts are written to their streams without an API key
+	rules.emit = a.emit
+	go rules.run()
+	// as are the readings of virtual streams
+	virtual.emit = a.emit
+	go virtual.run()
+	go sshscs.Listen()
+	a.registerGauges()
+	return a
+}
+
+// Connects to the named timeseries database ("readingdb" or "quasar")
+func newTSDB(name string, c *Config, store *Store, backlogsize int) TSDB {
 	var tsdb TSDB
-	switch *c.Archiver.TSDB {
+	switch name {
 	/** connect to ReadingDB */
 	case "readingdb":
 		rdbaddr, err := net.ResolveTCPAddr("tcp4", *c.ReadingDB.Address+":"+*c.ReadingDB.Port)
 		if err != nil {
 			log.Fatal("Error parsing ReadingDB address: %v", err)
 		}
-		tsdb = NewReadingDB(rdbaddr, *c.Archiver.Keepalive)
+		tsdb = NewReadingDB(rdbaddr, *c.Archiver.Keepalive, backlogsize, storageUnitOfTime(name, c.ReadingDB.StorageUnitofTime))
 		tsdb.AddStore(store)
 		if tsdb == nil {
 			log.Fatal("Error connecting to ReadingDB instance")
@@ -107,50 +271,197 @@ func NewArchiver(c *Config) *Archiver {
 		if err != nil {
 			log.Fatal("Error parsing Quasar address: %v", err)
 		}
-		tsdb = NewQuasar(qsraddr, *c.Archiver.Keepalive)
+		tsdb = NewQuasar(qsraddr, *c.Archiver.Keepalive, backlogsize, storageUnitOfTime(name, c.Quasar.StorageUnitofTime))
 		tsdb.AddStore(store)
 		if tsdb == nil {
 			log.Fatal("Error connecting to Quasar instance")
 		}
 	default:
-		log.Fatal(c.Archiver.TSDB, " is not a valid timeseries database")
+		log.Fatal(name, " is not a valid timeseries database")
 	}
+	return tsdb
+}
 
-	republisher := NewRepublisher()
-	republisher.store = store
+// Returns the unit of time the named timeseries database keeps timestamps
+// in, from its StorageUnitofTime setting. Microseconds by default
+func storageUnitOfTime(name string, setting *string) UnitOfTime {
+	if setting == nil || *setting == "" {
+		return UOT_US
+	}
+	uot, err := parseUnitOfTime(*setting)
+	if err != nil {
+		log.Fatal("Invalid StorageUnitofTime for %v: %v", name, err)
+	}
+	return uot
+}
 
-	sshscs := NewSSHConfigServer(store, *c.SSH.Port, *c.SSH.PrivateKey,
-		*c.SSH.AuthorizedKeysFile,
-		*c.SSH.User, *c.SSH.Pass,
-		c.SSH.PasswordEnabled, c.SSH.KeyAuthEnabled)
-	go sshscs.Listen()
-	return &Archiver{tsdb: tsdb,
-		store:                store,
-		republisher:          republisher,
-		incomingcounter:      newCounter(),
-		pendingwritescounter: newCounter(),
-		coalescer:            NewCoalescer(&tsdb),
-		sshscs:               sshscs,
-		enforceKeys:          c.Archiver.EnforceKeys}
+// Adds the gauges for the archiver's buffers and queues to the metrics
+func (a *Archiver) registerGauges() {
+	for _, gauge := range []*gaugeFunc{
+		newGaugeFunc("giles_coalescer_buffered_readings", "Readings waiting in the coalescer to be written.",
+			func() float64 { _, readings := a.coalescer.Buffered(); return float64(readings) }),
+		newGaugeFunc("giles_coalescer_buffered_streams", "Streams with readings waiting in the coalescer.",
+			func() float64 { streams, _ := a.coalescer.Buffered(); return float64(streams) }),
+		newGaugeFunc("giles_republish_clients", "Subscribed republish clients.",
+			func() float64 { return float64(a.republisher.NumClients()) }),
+		newGaugeFunc("giles_republish_pending_messages", "Live messages held for republish clients that are being replayed.",
+			func() float64 { return float64(a.republisher.Pending()) }),
+		newGaugeFunc("giles_webhook_queued_batches", "Batches waiting for delivery to webhooks.",
+			func() float64 { return float64(a.webhooks.Queued()) }),
+		newGaugeFunc("giles_tsdb_live_connections", "Live connections to the timeseries database.",
+			func() float64 { return float64(a.tsdb.LiveConnections()) }),
+		newGaugeFunc("giles_tsdb_backlog_bytes", "Writes held while the timeseries database cannot be reached.",
+			func() float64 { size, _ := a.tsdb.Backlog(); return float64(size) }),
+	} {
+		metrics.register(gauge)
+	}
+	if a.replicator != nil {
+		metrics.register(newGaugeFunc("giles_replication_pending_entries", "Journal entries waiting to be forwarded upstream.",
+			func() float64 { return float64(a.replicator.Pending()) }))
+	}
+}
 
+// Writes the archiver's metrics in the Prometheus text format (see metrics.go)
+func (a *Archiver) WriteMetrics(w io.Writer) {
+	metrics.Write(w)
 }
 
 // Takes a map of string/SmapMessage (path, sMAP JSON object) and commits them to
 // the underlying databases. First, checks that write permission is granted with the accompanied
 // apikey (generated with the gilescmd CLI tool), then saves the metadata, pushes the readings
-// out to any concerned republish clients, and commits the reading to the timeseries database.
-// Returns an error, which is nil if all went well
+// out to any concerned republish clients, evaluates alerting rules, computes virtual streams,
+// and commits the reading to the timeseries database. Returns an error, which is nil if all went well,
+// ErrBacklogFull if the timeseries database is down and no more readings can be held for it, an
+// error if the readings of string or object streams could not be saved, and an *IngestError
+// listing the messages that were not valid (see validate.go), in which case the others have
+// been taken
 func (a *Archiver) AddData(readings map[string]*SmapMessage, apikey string) error {
+	return a.AddDataFrom("", readings, apikey)
+}
+
+// AddData for readings that arrived over the named protocol (e.g. "http"),
+// which they are counted under in the metrics
+func (a *Archiver) AddDataFrom(protocol string, readings map[string]*SmapMessage, apikey string) error {
+	report := newIngestError()
+	if a.cluster != nil {
+		// the owners of the other streams check and validate them themselves
+		local := a.cluster.forward("", readings, apikey, report)
+		if len(local) == 0 {
+			return report.err()
+		}
+		readings = local
+	}
+	return a.validateAndAccept(protocol, readings, apikey, report)
+}
+
+// AddData for readings forwarded by another node of the cluster (see
+// cluster.go), which this node takes whether or not it owns their streams
+func (a *Archiver) AddClusterData(node string, readings map[string]*SmapMessage, apikey string) error {
+	log.Debug("Taking %v messages forwarded by node %v", len(readings), node)
+	return a.validateAndAccept("cluster", readings, apikey, newIngestError())
+}
+
+// Takes the valid messages and adds those that are not to report, which is
+// returned if there are any
+func (a *Archiver) validateAndAccept(protocol string, readings map[string]*SmapMessage, apikey string, report *IngestError) error {
+	if err := a.checkIncoming(readings, apikey); err != nil {
+		return err
+	}
+	a.validate(protocol, readings, report)
+	if len(readings) == 0 {
+		return report.err()
+	}
+	err := a.accept(protocol, readings, apikey)
+	if (err == nil || err == ErrDuplicateReadings) && len(report.Rejected) > 0 {
+		return report
+	}
+	return err
+}
+
+// AddData for readings forwarded by another archiver (see replication.go).
+// Readings that are already stored with the same UUID and timestamp are
+// dropped first, as batches are sent again when their acknowledgement is lost.
+// In a cluster, the readings of streams owned by other nodes are forwarded
+// to them, and the batch fails if one of them could not take its share, so
+// that it is sent again
+func (a *Archiver) AddReplicated(source string, readings map[string]*SmapMessage, apikey string) error {
+	if a.cluster == nil {
+		return a.addReplicated(source, readings, apikey)
+	}
+	forwarded := newIngestError()
+	local := a.cluster.forward(source, readings, apikey, forwarded)
+	if len(local) > 0 {
+		if err := a.addReplicated(source, local, apikey); err != nil {
+			return err
+		}
+	}
+	if len(forwarded.Rejected) > 0 {
+		return forwarded
+	}
+	return nil
+}
+
+// AddReplicated for readings from the named source that another node of the
+// cluster forwarded, which this node takes whether or not it owns their
+// streams
+func (a *Archiver) AddClusterReplicated(node, source string, readings map[string]*SmapMessage, apikey string) error {
+	return a.addReplicated(source+" via node "+node, readings, apikey)
+}
+
+func (a *Archiver) addReplicated(source string, readings map[string]*SmapMessage, apikey string) error {
+	if err := a.checkIncoming(readings, apikey); err != nil {
+		return err
+	}
+	// not refused, or the batch would be sent again forever
+	report := newIngestError()
+	if a.validate("replication", readings, report); len(report.Rejected) > 0 {
+		log.Error("Dropped messages from %v that are not valid: %v", source, report)
+	}
+	dropped, err := a.dropStored(readings)
+	if err != nil {
+		return err
+	}
+	if dropped > 0 {
+		log.Info("Dropped %v readings from %v that are already stored", dropped, source)
+		replicationDuplicates.Add(float64(dropped))
+	}
+	return a.accept("replication", readings, apikey)
+}
+
+// Checks that the API key may write the messages, and that readings can be
+// taken at all
+func (a *Archiver) checkIncoming(readings map[string]*SmapMessage, apikey string) error {
 	if a.enforceKeys {
 		ok, err := a.store.CheckKey(apikey, readings)
 		if err != nil {
 			log.Error("Error checking API key %v: %v", apikey, err)
+			errorCount.Inc("auth")
 			return err
 		}
 		if !ok {
+			errorCount.Inc("auth")
 			return errors.New("Unauthorized api key " + apikey)
 		}
 	}
+	// refuse readings rather than lose them while the TSDB is down
+	if _, full := a.tsdb.Backlog(); full {
+		return ErrBacklogFull
+	}
+	return nil
+}
+
+// Counts, journals and ingests messages that have passed checkIncoming
+func (a *Archiver) accept(protocol string, readings map[string]*SmapMessage, apikey string) error {
+	if protocol == "" {
+		protocol = "unknown"
+	}
+	// keys are labelled by the name of their owner, as the key is a secret
+	keyname := a.store.keyName(apikey)
+	for _, msg := range readings {
+		if len(msg.Readings) > 0 {
+			readingsReceived.Add(float64(len(msg.Readings)), protocol, keyname)
+		}
+	}
 	for _, rdg := range readings {
 		// for Metadata, Properties, Contents and Actuator,
 		// if we don't have an entry, replace it with nil
@@ -167,16 +478,187 @@ func (a *Archiver) AddData(readings map[string]*SmapMessage, apikey string) erro
 			rdg.Actuator = nil
 		}
 	}
-	go a.store.SaveMetadata(readings)
+	// nothing is acknowledged that could not be journaled for the upstream
+	if a.replicator != nil {
+		if err := a.replicator.Journal(readings); err != nil {
+			log.Error("Error journaling readings for replication: %v", err)
+			return err
+		}
+	}
+	return a.ingest(readings)
+}
+
+// Removes from the messages the readings of double streams that the TSDB
+// already has at the same timestamp, and returns how many were removed.
+// Object and string readings are kept by UUID and timestamp anyway (see
+// ObjectStore.Add), so sending them again does not duplicate them
+func (a *Archiver) dropStored(readings map[string]*SmapMessage) (int, error) {
+	dropped := 0
+	for _, msg := range readings {
+		if msg.UUID == "" || len(msg.Readings) == 0 {
+			continue
+		}
+		props := a.storageProperties(msg)
+		if props.readingType != READINGTYPE_DOUBLE {
+			continue
+		}
+		valid := toStorage(msg, props).Readings
+		if len(valid) == 0 {
+			continue
+		}
+		first, last := valid[0][0].(uint64), valid[0][0].(uint64)
+		for _, rdg := range valid {
+			if ts := rdg[0].(uint64); ts < first {
+				first = ts
+			} else if ts > last {
+				last = ts
+			}
+		}
+		data, err := a.tsdb.GetData([]string{msg.UUID}, first, last, UOT_STORAGE)
+		if err != nil {
+			return dropped, err
+		}
+		stored := make(map[uint64]bool)
+		for _, resp := range data {
+			for _, rdg := range resp.Readings {
+				stored[uint64(rdg[0])] = true
+			}
+		}
+		dropped += dropStoredReadings(msg, props.uot, stored)
+	}
+	return dropped, nil
+}
+
+// Saves, republishes and stores readings that have already been authorized.
+// Returns an error if the readings of a string or object stream could not be
+// saved, or else ErrDuplicateReadings if any were rejected by their stream's
+// duplicate policy (see coalesce.go)
+func (a *Archiver) ingest(readings map[string]*SmapMessage) error {
+	go func() {
+		if a.store.SaveMetadata(withActuationStreams(readings)) {
+			a.republisher.MetadataChanged()
+		}
+	}()
+	var err, saveErr error
 	for _, msg := range readings {
-		go a.republisher.Republish(msg)
 		a.incomingcounter.Mark()
 		if msg.Readings == nil {
+			go a.republisher.Republish(msg)
+			continue
+		}
+		// rules and virtual streams work in the stream's own unit of time
+		// and skip the readings that are not numbers
+		props := a.storageProperties(msg)
+		stored := toStorage(msg, props)
+		if dropped := len(msg.Readings) - len(stored.Readings); dropped > 0 {
+			log.Warning("Dropped %v readings of %v that are not valid %v readings", dropped, msg.UUID, props.readingType)
+		}
+		if props.readingType == READINGTYPE_DOUBLE {
+			// duplicates are settled first, so that dropped readings are
+			// not republished or seen by rules and virtual streams
+			policy := props.duplicates
+			if policy == "" {
+				policy = a.coalescer.policy
+			}
+			if dropped := a.coalescer.Add(stored, policy); len(dropped) > 0 {
+				dropLastReadings(msg, props.uot, dropped)
+				if policy == DUPLICATES_REJECT {
+					err = ErrDuplicateReadings
+				}
+			}
+		}
+		go a.republisher.Republish(msg)
+		a.rules.Evaluate(msg)
+		a.virtual.Evaluate(msg)
+		if props.readingType != READINGTYPE_DOUBLE {
+			if oerr := a.objects.Add(stored); oerr != nil {
+				log.Error("Error saving readings of %v: %v", msg.UUID, oerr)
+				errorCount.Inc("objectstore")
+				saveErr = fmt.Errorf("Could not save readings of %v: %v", msg.UUID, oerr)
+			}
 			continue
 		}
-		a.coalescer.Add(msg)
+		a.lastvalues.Update(stored)
+		a.pendingwritescounter.Mark()
 	}
-	return nil
+	if saveErr != nil {
+		return saveErr
+	}
+	return err
+}
+
+// Takes readings generated by the archiver itself (alerts and virtual
+// streams), which do not need an API key
+func (a *Archiver) emit(readings map[string]*SmapMessage) {
+	if err := a.ingest(readings); err != nil {
+		log.Error("Error storing generated readings: %v", err)
+	}
+}
+
+// Removes from msg, whose timestamps are in uot, the given number of
+// readings at each timestamp (in UOT_STORAGE), starting from the last
+func dropLastReadings(msg *SmapMessage, uot UnitOfTime, dropped map[uint64]int) {
+	remaining := make(map[uint64]int, len(dropped))
+	for ts, n := range dropped {
+		remaining[ts] = n
+	}
+	keep := make([]bool, len(msg.Readings))
+	for i := len(msg.Readings) - 1; i >= 0; i-- {
+		keep[i] = true
+		if len(msg.Readings[i]) == 0 {
+			continue
+		}
+		if ts, ok := readingTime(msg.Readings[i][0]); ok {
+			if ts = convertTime(ts, uot, UOT_STORAGE); remaining[ts] > 0 {
+				remaining[ts]--
+				keep[i] = false
+			}
+		}
+	}
+	kept := msg.Readings[:0]
+	for i, rdg := range msg.Readings {
+		if keep[i] {
+			kept = append(kept, rdg)
+		}
+	}
+	msg.Readings = kept
+}
+
+// Returns the unit of time and reading type of msg's stream. They come from
+// the message's own Properties, or else from the stream's metadata
+func (a *Archiver) storageProperties(msg *SmapMessage) streamProps {
+	if msg.Properties != nil {
+		return a.store.updateStreamProperties(msg.UUID, msg.Properties)
+	}
+	return a.store.streamProperties(msg.UUID)
+}
+
+// Returns a copy of msg whose readings have their timestamps converted from
+// the stream's unit of time to UOT_STORAGE and their values to the stream's
+// reading type (see storedValue). Readings without a valid timestamp or
+// value are left out
+func toStorage(msg *SmapMessage, props streamProps) *SmapMessage {
+	stored := *msg
+	stored.Readings = make([][]interface{}, 0, len(msg.Readings))
+	for _, rdg := range msg.Readings {
+		if len(rdg) < 2 {
+			continue
+		}
+		ts, ok := readingTime(rdg[0])
+		if !ok {
+			continue
+		}
+		value, ok := storedValue(rdg[1], props.readingType)
+		if !ok {
+			continue
+		}
+		converted := make([]interface{}, len(rdg))
+		copy(converted, rdg)
+		converted[0] = convertTime(ts, props.uot, UOT_STORAGE)
+		converted[1] = value
+		stored.Readings = append(stored.Readings, converted)
+	}
+	return &stored
 }
 
 // Takes the body of the query and the apikey that accompanies the query. First parses
@@ -187,15 +669,80 @@ func (a *Archiver) AddData(readings map[string]*SmapMessage, apikey string) erro
 // generated AST. Any actual computation is done as calls to the Archiver API, so if you want
 // to use your own query language or handle queries in some external handler, then you shouldn't
 // need to use any of this method; just use the Archiver API
-//
-//TODO: expand the query language to allow the specification of units of time
 func (a *Archiver) HandleQuery(querystring, apikey string) ([]byte, error) {
+	if a.cluster != nil {
+		return a.gatherQuery(querystring, apikey)
+	}
+	return a.handleQuery(querystring, apikey, false)
+}
+
+// Answers a query from another node of the cluster from this node's streams.
+// Apply queries only go through their per-stream operators, as the asking
+// node runs the rest on what it gathers from all of the nodes
+func (a *Archiver) HandleClusterQuery(querystring, apikey string) ([]byte, error) {
+	return a.handleQuery(querystring, apikey, true)
+}
+
+// Runs the query on every node of the cluster and merges the results
+func (a *Archiver) gatherQuery(querystring, apikey string) ([]byte, error) {
+	ast, err := parseQuery(querystring)
+	if err != nil {
+		return nil, err
+	}
+	var remote [][]byte
+	var remoteErr error
+	gathered := make(chan bool)
+	go func() {
+		remote, remoteErr = a.cluster.scatter("/api/cluster/query?key="+url.QueryEscape(apikey), []byte(querystring))
+		close(gathered)
+	}()
+	local, err := a.handleQuery(querystring, apikey, true)
+	<-gathered
+	if err != nil {
+		return nil, err
+	}
+	if remoteErr != nil {
+		return nil, remoteErr
+	}
+	answers := append([][]byte{local}, remote...)
+	switch ast.TargetType {
+	case TAGS_TARGET:
+		return mergeTagResults(answers, ast.Target.(*tagsTarget).Distinct)
+	case SET_TARGET:
+		return mergeSetResults(answers)
+	case DATA_TARGET:
+		target := ast.Target.(*dataTarget)
+		if ast.QueryType != APPLY_TYPE {
+			return mergeDataResults(answers, target.Streamlimit)
+		}
+		merged, err := mergeDataResults(answers, target.Streamlimit)
+		if err != nil {
+			return nil, err
+		}
+		var data []SmapResponse
+		if err := json.Unmarshal(merged, &data); err != nil {
+			return nil, err
+		}
+		if data, err = a.applyOperators(ast.Apply[perStreamOperators(ast.Apply):], data, target.UnitOfTime); err != nil {
+			return nil, err
+		}
+		return json.Marshal(data)
+	}
+	return nil, nil
+}
+
+// Evaluates the query against this node's streams. If partial is true, apply
+// queries only go through their per-stream operators (see HandleClusterQuery)
+func (a *Archiver) handleQuery(querystring, apikey string, partial bool) ([]byte, error) {
 	if apikey != "" {
 		log.Info("query with key: %v", apikey)
 	}
 	log.Info(querystring)
 	var data []byte
-	ast := parse(querystring)
+	ast, err := parseQuery(querystring)
+	if err != nil {
+		return data, err
+	}
 	where := ast.Where.ToBson()
 	switch ast.TargetType {
 	// if we are fetching tags
@@ -214,6 +761,7 @@ func (a *Archiver) HandleQuery(querystring, apikey string) ([]byte, error) {
 		if err != nil {
 			return data, err
 		}
+		a.republisher.MetadataChanged()
 		data, _ = json.Marshal(res)
 	// if we are fetching data
 	case DATA_TARGET:
@@ -222,30 +770,177 @@ func (a *Archiver) HandleQuery(querystring, apikey string) ([]byte, error) {
 		if err != nil {
 			return data, err
 		}
-		if target.Streamlimit > -1 {
+		if target.Streamlimit > -1 && target.Streamlimit < len(uuids) {
 			uuids = uuids[:target.Streamlimit] // limit number of streams
 		}
+		if target.Timezone == "" {
+			if err = a.resolveInStreamTimezone(target, uuids); err != nil {
+				return data, err
+			}
+		}
+		uuids, objectuuids, err := a.splitByReadingType(uuids)
+		if err != nil {
+			return data, err
+		}
 		var response []SmapResponse
+		uot := target.UnitOfTime
 		switch target.Type {
 		case IN:
-			start := uint64(target.Start.Unix())
-			end := uint64(target.End.Unix())
+			start := timeToUnit(target.Start, uot)
+			end := timeToUnit(target.End, uot)
 			log.Debug("start %v end %v", start, end)
-			response, err = a.GetData(uuids, start, end, UOT_MS)
+			if ast.QueryType == APPLY_TYPE && a.rollups != nil {
+				// aggregations are answered from the rollups when they can be
+				var rolledup bool
+				response, rolledup, err = a.rollups.windowQuery(uuids, start, end, uot, ast.Apply[0])
+				if rolledup {
+					ast.Apply = ast.Apply[1:]
+					break
+				}
+				if err != nil {
+					return data, err
+				}
+			}
+			response, err = a.GetData(uuids, start, end, uot)
 		case AFTER:
-			ref := uint64(target.Ref.Unix())
+			ref := timeToUnit(target.Ref, uot)
 			log.Debug("after %v", ref)
-			response, err = a.NextData(uuids, ref, target.Limit, UOT_MS)
+			response, err = a.NextData(uuids, ref, target.Limit, uot)
 		case BEFORE:
-			ref := uint64(target.Ref.Unix())
+			if target.RefIsNow && target.Limit == 1 {
+				response, err = a.LatestData(uuids, uot)
+				break
+			}
+			ref := timeToUnit(target.Ref, uot)
 			log.Debug("before %v", ref)
-			response, err = a.PrevData(uuids, ref, target.Limit, UOT_MS)
+			response, err = a.PrevData(uuids, ref, target.Limit, uot)
+		}
+		if err != nil {
+			return data, err
+		}
+		if ast.QueryType == APPLY_TYPE {
+			calls := ast.Apply
+			if partial {
+				// a rollup answers the first operator, which is per-stream
+				calls = calls[:perStreamOperators(calls)]
+			}
+			if response, err = a.applyOperators(calls, response, uot); err != nil {
+				return data, err
+			}
+			// operators only make sense for double streams, so the
+			// streams in the object store are left out
+			objectuuids = nil
+		}
+		objects, err := a.objectData(target, objectuuids)
+		if err != nil {
+			return data, err
 		}
-		data, _ = json.Marshal(response)
+		data, _ = json.Marshal(mergeResponses(response, objects))
 	}
 	return data, nil
 }
 
+// Splits the given UUIDs into the double streams, which are kept in the
+// timeseries database, and the streams kept in the object store
+func (a *Archiver) splitByReadingType(uuids []string) ([]string, []string, error) {
+	return a.store.splitByReadingType(uuids)
+}
+
+// Fetches the readings of the data query target for streams kept in the
+// object store
+func (a *Archiver) objectData(target *dataTarget, uuids []string) ([]SmapObjectResponse, error) {
+	if len(uuids) == 0 {
+		return nil, nil
+	}
+	uot := target.UnitOfTime
+	switch target.Type {
+	case IN:
+		return a.objects.GetData(uuids, timeToUnit(target.Start, uot), timeToUnit(target.End, uot), uot)
+	case AFTER:
+		return a.objects.Next(uuids, timeToUnit(target.Ref, uot), target.Limit, uot)
+	}
+	return a.objects.Prev(uuids, timeToUnit(target.Ref, uot), target.Limit, uot)
+}
+
+// Returns the responses of the timeseries database followed by those of the
+// object store, for marshaling
+func mergeResponses(responses []SmapResponse, objects []SmapObjectResponse) interface{} {
+	if len(objects) == 0 {
+		return responses
+	}
+	merged := make([]interface{}, 0, len(responses)+len(objects))
+	for _, resp := range responses {
+		merged = append(merged, resp)
+	}
+	for _, resp := range objects {
+		merged = append(merged, resp)
+	}
+	return merged
+}
+
+// Without a tz clause, the times of a data query are read in the time zone
+// of the streams it covers (their Properties/Timezone, or the server's time
+// zone if they have none). If the streams are in different time zones that
+// would give different times, the query must say which zone it means.
+func (a *Archiver) resolveInStreamTimezone(target *dataTarget, uuids []string) error {
+	zones, err := a.store.GetTimezones(uuids)
+	if err != nil {
+		return err
+	}
+	distinct := make(map[string]bool)
+	for _, uuid := range uuids {
+		distinct[zones[uuid]] = true
+	}
+	if len(distinct) == 1 && distinct[""] {
+		// already resolved in the server's time zone
+		return nil
+	}
+	now := time.Now()
+	var resolved *dataTarget
+	for zone := range distinct {
+		loc := time.Local
+		if zone != "" {
+			if loc, err = time.LoadLocation(zone); err != nil {
+				return errors.New("Stream has unknown Properties/Timezone " + zone)
+			}
+		}
+		candidate := *target
+		if err = candidate.resolveTimes(loc, now); err != nil {
+			return err
+		}
+		if resolved != nil && (!candidate.Start.Equal(resolved.Start) || !candidate.End.Equal(resolved.End) || !candidate.Ref.Equal(resolved.Ref)) {
+			return errors.New("The streams are in different time zones; add a tz clause, e.g. tz 'America/Los_Angeles'")
+		}
+		resolved = &candidate
+	}
+	if resolved != nil {
+		*target = *resolved
+	}
+	return nil
+}
+
+// Runs the results of an apply query through its operators. The timestamps
+// of the data are in units of uot
+func (a *Archiver) applyOperators(calls []*operatorCall, data []SmapResponse, uot UnitOfTime) ([]SmapResponse, error) {
+	ctx := &applyContext{uot: uot}
+	for _, call := range calls {
+		if call.name != "units" {
+			continue
+		}
+		uuids := make([]string, len(data))
+		for i, resp := range data {
+			uuids[i] = resp.UUID
+		}
+		units, err := a.store.GetUnitsOfMeasure(uuids)
+		if err != nil {
+			return nil, err
+		}
+		ctx.units = units
+		break
+	}
+	return applyOperators(calls, ctx, data)
+}
+
 // For each of the streamids, fetches all data between start and end (where
 // start < end). The units for start/end are given by query_uot. We give the units
 // so that each time series database can convert the incoming timestamps to whatever
@@ -267,6 +962,90 @@ func (a *Archiver) NextData(streamids []string, start uint64, limit int32, query
 	return a.tsdb.Next(streamids, start, limit, query_uot)
 }
 
+// For each of the streamids, fetches the most recent reading, with its timestamp in units of uot.
+// Readings are served from the last value cache maintained by AddData; only streams we have
+// nothing cached for are fetched from the timeseries database
+func (a *Archiver) LatestData(streamids []string, uot UnitOfTime) ([]SmapResponse, error) {
+	hits, misses := a.lastvalues.lookup(streamids)
+	for _, resp := range hits {
+		for _, rdg := range resp.Readings {
+			rdg[0] = float64(convertTime(uint64(rdg[0]), UOT_STORAGE, uot))
+		}
+	}
+	if len(misses) > 0 {
+		fetched, err := a.tsdb.Prev(misses, timeToUnit(time.Now(), uot), 1, uot)
+		if err != nil {
+			return nil, err
+		}
+		for _, resp := range fetched {
+			hits[resp.UUID] = resp
+		}
+	}
+	response := make([]SmapResponse, 0, len(streamids))
+	for _, uuid := range streamids {
+		if resp, found := hits[uuid]; found {
+			response = append(response, resp)
+		}
+	}
+	return response, nil
+}
+
+// Takes a where clause (e.g. "Metadata/Type = 'Temperature'", optionally prefixed with
+// "where") and returns the most recent reading for every matching stream as marshaled JSON.
+// See Archiver.LatestData. A where clause that cannot be parsed gives a *WhereError
+func (a *Archiver) HandleLatest(wherestring, apikey string) ([]byte, error) {
+	// refused here rather than by every node
+	if _, err := parseWhereString(wherestring); err != nil {
+		return nil, err
+	}
+	if a.cluster == nil {
+		return a.HandleClusterLatest(wherestring, apikey)
+	}
+	var remote [][]byte
+	var remoteErr error
+	gathered := make(chan bool)
+	go func() {
+		remote, remoteErr = a.cluster.scatter("/api/cluster/latest?key="+url.QueryEscape(apikey), []byte(wherestring))
+		close(gathered)
+	}()
+	local, err := a.HandleClusterLatest(wherestring, apikey)
+	<-gathered
+	if err != nil {
+		return nil, err
+	}
+	if remoteErr != nil {
+		return nil, remoteErr
+	}
+	return mergeDataResults(append([][]byte{local}, remote...), -1)
+}
+
+// HandleLatest for this node's streams only, for another node of the cluster
+func (a *Archiver) HandleClusterLatest(wherestring, apikey string) ([]byte, error) {
+	where, err := parseWhereString(wherestring)
+	if err != nil {
+		return nil, err
+	}
+	uuids, err := a.GetUUIDs(where.ToBson())
+	if err != nil {
+		return nil, err
+	}
+	uuids, objectuuids, err := a.splitByReadingType(uuids)
+	if err != nil {
+		return nil, err
+	}
+	response, err := a.LatestData(uuids, UOT_MS)
+	if err != nil {
+		return nil, err
+	}
+	var objects []SmapObjectResponse
+	if len(objectuuids) > 0 {
+		if objects, err = a.objects.Prev(objectuuids, timeToUnit(time.Now(), UOT_MS), 1, UOT_MS); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(mergeResponses(response, objects))
+}
+
 // For all streams that match the provided where clause in where_tags, returns the values of the requested
 // tags. where_tags is a bson.M object that follows the same syntax as a MongoDB query. select_tags is
 // a map[string]int corresponding to which tags we wish returned. A value of 1 means the tag will be
@@ -286,16 +1065,51 @@ func (a *Archiver) GetUUIDs(where_tags bson.M) ([]string, error) {
 
 // Returns all tags for the stream with the provided UUID
 func (a *Archiver) TagsUUID(uuid string) ([]bson.M, error) {
+	if a.cluster != nil {
+		if owner := a.cluster.Owner(uuid); owner != a.cluster.self {
+			data, err := a.cluster.request("GET", owner, "/api/tags/uuid/"+url.QueryEscape(uuid), nil)
+			if err != nil {
+				return nil, err
+			}
+			var tags []bson.M
+			err = json.Unmarshal(data, &tags)
+			return tags, err
+		}
+	}
 	return a.store.TagsUUID(uuid)
 }
 
 // For all streams that match the WHERE clause in the provided query string,
 // will push all subsequent incoming information (data and tags) on those streams
-// to the client associated with the provided http.ResponseWriter.
+// to the client associated with the provided http.ResponseWriter. The query may ask for
+// a replay of recent history (e.g. "replay 1h where Metadata/Site = 'Soda Hall'"), which
+// is sent before any live data.
 //
 // For now, this query is evaluated only once at the time of subscription.
 //TODO: fix that ^^
 func (a *Archiver) HandleSubscriber(s Subscriber, query, apikey string) {
+	if a.cluster != nil {
+		// tag subscriptions are not federated
+		if sub, err := parseSubscription(query); err == nil && sub.tags == nil {
+			a.cluster.federate(s, query, apikey, a.republisher)
+			return
+		}
+	}
+	a.republisher.HandleSubscriber(s, query, apikey)
+}
+
+// Returns what is wrong with query if it is not a valid republish query (see
+// Republisher.HandleSubscriber). HandleSubscriber reports this to the
+// subscriber itself, but protocols that have to answer before the
+// subscription starts can use this to refuse the query instead
+func (a *Archiver) CheckSubscription(query string) error {
+	_, err := parseSubscription(query)
+	return err
+}
+
+// HandleSubscriber for this node's streams only, for another node of the
+// cluster
+func (a *Archiver) HandleClusterSubscriber(s Subscriber, query, apikey string) {
 	a.republisher.HandleSubscriber(s, query, apikey)
 }
 
@@ -303,7 +1117,155 @@ func (a *Archiver) HandleSubscriber(s Subscriber, query, apikey string) {
 // pairs specified in update_tags.
 func (a *Archiver) SetTags(update_tags, where_tags map[string]interface{}, apikey string) (int, error) {
 	res, err := a.store.SetTags(update_tags, apikey, where_tags)
-	return res["Updated"].(int), err
+	if err != nil {
+		return 0, err
+	}
+	a.republisher.MetadataChanged()
+	return res["Updated"].(int), nil
+}
+
+// Sets the actuator of the stream with the given UUID to value. The API key
+// must have the actuation permission (see the actuation command of the SSH
+// interface) and be the key the stream was written with, and the value must
+// be valid for the stream's Actuator model (see actuatorModel). Refused
+// actuations give an *ActuationError. The actuation is POSTed to the actuator's CallbackURL if it
+// has one, and is then recorded as a reading on the actuator's companion
+// stream, which also carries it to drivers subscribed to that stream. In a
+// cluster, the actuation is handed to the node that owns the stream
+func (a *Archiver) Actuate(uuid string, value interface{}, apikey string) error {
+	if a.cluster != nil {
+		if owner := a.cluster.Owner(uuid); owner != a.cluster.self {
+			body, err := json.Marshal(map[string]interface{}{"Value": value})
+			if err != nil {
+				return err
+			}
+			_, err = a.cluster.request("POST", owner, "/api/actuate/"+url.QueryEscape(uuid)+"?key="+url.QueryEscape(apikey), body)
+			// keep the owner's refusal a refusal
+			if nerr, ok := err.(*nodeError); ok && (nerr.status == 400 || nerr.status == 403) {
+				return &ActuationError{Forbidden: nerr.status == 403, Reason: string(nerr.body)}
+			}
+			return err
+		}
+	}
+	if ok, err := a.store.CanActuate(apikey); !ok {
+		if err != nil {
+			return err
+		}
+		return &ActuationError{Forbidden: true, Reason: "API key " + apikey + " may not actuate"}
+	}
+	path, actuator, err := a.store.GetActuator(uuid)
+	if err != nil {
+		return err
+	}
+	if ok, err := a.store.CanWrite(apikey, uuid); !ok {
+		reason := "API key " + apikey + " may not actuate " + uuid
+		if err != nil {
+			reason = err.Error()
+		}
+		return &ActuationError{Forbidden: true, Reason: reason}
+	}
+	am, err := parseActuatorModel(actuator)
+	if err != nil {
+		return &ActuationError{Reason: err.Error()}
+	}
+	if value, err = am.validate(value); err != nil {
+		return &ActuationError{Reason: err.Error()}
+	}
+	act := &Actuation{UUID: uuid, Path: path, Value: value, Time: timeToUnit(time.Now(), UOT_MS)}
+	if am.callback != "" {
+		if err = sendActuation(am.callback, act); err != nil {
+			return err
+		}
+	}
+	log.Notice("Actuating %v (%v) to %v", path, uuid, value)
+	companion, err := actuationStream(&SmapMessage{UUID: uuid, Path: path, Actuator: actuator})
+	if err != nil {
+		return err
+	}
+	companion.Readings = [][]interface{}{{act.Time, value}}
+	// save the metadata first so that subscribers to the companion stream
+	// see the reading
+	if a.store.SaveMetadata(map[string]*SmapMessage{companion.Path: companion}) {
+		a.republisher.MetadataChanged()
+	}
+	a.emit(map[string]*SmapMessage{companion.Path: companion})
+	return nil
+}
+
+// Registers a new alerting rule (see Rule). When the archiver enforces API keys,
+// the provided apikey must be a valid key
+func (a *Archiver) AddRule(rule Rule, apikey string) error {
+	if err := a.checkManagementKey(apikey); err != nil {
+		return err
+	}
+	return a.rules.AddRule(rule)
+}
+
+// Deletes the alerting rule with the given name
+func (a *Archiver) RemoveRule(name, apikey string) error {
+	if err := a.checkManagementKey(apikey); err != nil {
+		return err
+	}
+	return a.rules.RemoveRule(name)
+}
+
+// Returns all registered alerting rules
+func (a *Archiver) Rules() []Rule {
+	return a.rules.Rules()
+}
+
+// Registers a new webhook that pushes matching readings to a URL (see Webhook).
+// When the archiver enforces API keys, the provided apikey must be a valid key
+func (a *Archiver) AddWebhook(hook Webhook, apikey string) error {
+	if err := a.checkManagementKey(apikey); err != nil {
+		return err
+	}
+	return a.webhooks.AddWebhook(hook)
+}
+
+// Stops and deletes the webhook with the given name
+func (a *Archiver) RemoveWebhook(name, apikey string) error {
+	if err := a.checkManagementKey(apikey); err != nil {
+		return err
+	}
+	return a.webhooks.RemoveWebhook(name)
+}
+
+// Returns all registered webhooks, without their secrets
+func (a *Archiver) Webhooks() []Webhook {
+	return a.webhooks.Webhooks()
+}
+
+// Defines a new virtual stream computed from other streams (see VirtualStream).
+// When the archiver enforces API keys, the provided apikey must be a valid key
+func (a *Archiver) AddVirtualStream(def VirtualStream, apikey string) error {
+	if err := a.checkManagementKey(apikey); err != nil {
+		return err
+	}
+	return a.virtual.Add(def)
+}
+
+// Stops computing the named virtual stream. Its readings are kept
+func (a *Archiver) RemoveVirtualStream(name, apikey string) error {
+	if err := a.checkManagementKey(apikey); err != nil {
+		return err
+	}
+	return a.virtual.Remove(name)
+}
+
+// Returns the definitions of all virtual streams
+func (a *Archiver) VirtualStreams() []VirtualStream {
+	return a.virtual.List()
+}
+
+func (a *Archiver) checkManagementKey(apikey string) error {
+	if !a.enforceKeys {
+		return nil
+	}
+	if _, err := a.store.apikeyexists(apikey); err != nil {
+		return errors.New("Unauthorized api key " + apikey)
+	}
+	return nil
 }
 
 func (a *Archiver) PrintStatus() {
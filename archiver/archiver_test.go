@@ -4,6 +4,7 @@ import (
 	UUID "code.google.com/p/go-uuid/uuid"
 	"fmt"
 	"gopkg.in/mgo.v2/bson"
+	"sort"
 	"sync"
 	"testing"
 )
@@ -17,7 +18,7 @@ var SmapMsgPool1Path = &sync.Pool{
 		return map[string]*SmapMessage{
 			"/sensor1": &SmapMessage{
 				Readings: [][]interface{}{
-					[]interface{}{uint64(100), float64(1)},
+					[]interface{}{uint64(1429000000000), float64(1)},
 				},
 				Metadata: bson.M{},
 			},
@@ -32,7 +33,7 @@ var SmapMsgPool10Path = &sync.Pool{
 			ret[fmt.Sprintf("/sensor%s", i)] = &SmapMessage{
 				UUID: UUID.New(),
 				Readings: [][]interface{}{
-					[]interface{}{uint64(100), float64(1)},
+					[]interface{}{uint64(1429000000000), float64(1)},
 				},
 				Metadata: bson.M{},
 			}
@@ -48,7 +49,7 @@ var SmapMsgPool10PathMetadata = &sync.Pool{
 			ret[fmt.Sprintf("/sensor%s", i)] = &SmapMessage{
 				UUID: UUID.New(),
 				Readings: [][]interface{}{
-					[]interface{}{uint64(100), float64(1)},
+					[]interface{}{uint64(1429000000000), float64(1)},
 				},
 				Metadata: bson.M{"key1": "val1", "key2": "val2"},
 			}
@@ -130,3 +131,29 @@ func BenchmarkArchiverAddData10WithMetadata(b *testing.B) {
 		SmapMsgPool10PathMetadata.Put(msgs)
 	}
 }
+
+func TestRangeQueryStringMetadata(t *testing.T) {
+	site := UUID.New()
+	floors := map[string]string{"3": UUID.New(), "10": UUID.New(), "2": UUID.New(), "x": UUID.New()}
+	msgs := map[string]*SmapMessage{}
+	for floor, uuid := range floors {
+		msgs["/floor"+floor] = &SmapMessage{UUID: uuid, Metadata: bson.M{"Site": site, "Floor": floor}}
+	}
+	a.store.SaveMetadata(msgs)
+	uuids, err := a.GetUUIDs(parse("select * where Metadata/Site = '" + site + "' and Metadata/Floor >= 3").Where.ToBson())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isStringSliceEqual(sortedStrings(uuids), sortedStrings([]string{floors["3"], floors["10"]})) {
+		t.Error("Floors 3 and 10 should match Metadata/Floor >= 3 but got", uuids)
+	}
+	uuids, _ = a.GetUUIDs(parse("select * where Metadata/Site = '" + site + "' and Metadata/Floor < 3").Where.ToBson())
+	if !isStringSliceEqual(uuids, []string{floors["2"]}) {
+		t.Error("Only floor 2 should match Metadata/Floor < 3 but got", uuids)
+	}
+}
+
+func sortedStrings(s []string) []string {
+	sort.Strings(s)
+	return s
+}
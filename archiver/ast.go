@@ -5,6 +5,7 @@ import (
 	"gopkg.in/mgo.v2/bson"
 	"strconv"
 	"strings"
+	"time"
 )
 
 /*
@@ -19,7 +20,9 @@ func addtoken(tokens *[]string, token *[]rune) {
 }
 
 /*
-  returns a slice of tokens, inserting whitespace where necessary
+  returns a slice of tokens, inserting whitespace where necessary.
+  Quoted strings are kept together, quotes included, so that the parser
+  can tell the string '3' from the number 3 (see parseLiteral)
 */
 func tokenize(q string) []string {
 	if !strings.HasSuffix(q, ";") {
@@ -28,7 +31,8 @@ func tokenize(q string) []string {
 	var tokens []string
 	var token []rune
 
-	inquotes := false
+	// the quote character of the string we are in, if any
+	var quote rune
 
 	pos := 0
 	for {
@@ -36,35 +40,42 @@ func tokenize(q string) []string {
 			break
 		}
 		char := rune(q[pos])
+		if quote != 0 {
+			token = append(token, char)
+			if char == quote {
+				quote = 0
+			}
+			pos++
+			continue
+		}
 		switch char {
 		case '\'', '"':
-			inquotes = !inquotes
+			quote = char
+			token = append(token, char)
 		case ',':
 			token = append(token, char)
-			if !inquotes {
-				addtoken(&tokens, &token)
-			}
+			addtoken(&tokens, &token)
 		case '!':
-			if !inquotes {
-				addtoken(&tokens, &token)
-			}
+			addtoken(&tokens, &token)
 			token = append(token, char)
 		case '~', '=':
-			if !inquotes {
-				if len(token) > 0 && token[0] == '!' {
-					token = append(token, char)
-					addtoken(&tokens, &token)
-				} else {
-					addtoken(&tokens, &token)
-					tokens = append(tokens, string(char))
-				}
-			}
-		case ';', ' ':
-			if !inquotes {
+			if len(token) > 0 && token[0] == '!' {
+				token = append(token, char)
 				addtoken(&tokens, &token)
 			} else {
-				token = append(token, char)
+				addtoken(&tokens, &token)
+				tokens = append(tokens, string(char))
 			}
+		case '<', '>':
+			addtoken(&tokens, &token)
+			if pos+1 < len(q) && q[pos+1] == '=' {
+				tokens = append(tokens, string(char)+"=")
+				pos++
+			} else {
+				tokens = append(tokens, string(char))
+			}
+		case ';', ' ':
+			addtoken(&tokens, &token)
 		default:
 			token = append(token, char)
 		}
@@ -74,14 +85,23 @@ func tokenize(q string) []string {
 	return tokens
 }
 
+// strips the quotes from the tokens of a time specification
+var timeQuotes = strings.NewReplacer("'", "", "\"", "")
+
 /**
- * Handles parsing the data range queries like "data in (start ref, end ref) [limit]"
+ * Handles parsing the data range queries like
+ * "data in (start ref, end ref) [limit] [streamlimit] [tz 'zone'] [units ms]"
+ * See parseTime for the time expressions. units is the unit of time (ns, us,
+ * ms or s) of the timestamps of the results, ms by default
 **/
 func parsedataTarget(tokens *[]string) (target_T, error) {
-	var dt = &dataTarget{Streamlimit: -1, Limit: 1}
+	var dt = &dataTarget{Streamlimit: -1, Limit: 1, UnitOfTime: UOT_MS}
 	if len(*tokens) == 0 {
 		return dt, nil
 	}
+	if len(*tokens) < 2 {
+		return dt, errors.New("Data queries must be data in, data before or data after")
+	}
 	// pos = 0 is the word 'data', pos = 1 is our dataquery type
 	switch (*tokens)[1] {
 	case "in":
@@ -101,6 +121,12 @@ func parsedataTarget(tokens *[]string) (target_T, error) {
 		}
 		val := (*tokens)[pos]
 		switch val {
+		case "limit", "streamlimit", "tz", "units":
+			if pos+1 >= len(*tokens) {
+				return dt, errors.New("Missing value for " + val)
+			}
+		}
+		switch val {
 		case "limit":
 			limit, err := strconv.ParseUint((*tokens)[pos+1], 10, 64)
 			if err != nil {
@@ -117,40 +143,39 @@ func parsedataTarget(tokens *[]string) (target_T, error) {
 			dt.Streamlimit = int(limit)
 			pos += 2
 			continue
+		case "tz":
+			dt.Timezone = unquote((*tokens)[pos+1])
+			pos += 2
+			continue
+		case "units":
+			uot, err := parseUnitOfTime(unquote((*tokens)[pos+1]))
+			if err != nil {
+				return dt, err
+			}
+			dt.UnitOfTime = uot
+			pos += 2
+			continue
 		case "where": // terminating cases
 			(*tokens) = (*tokens)[pos+1:]
 			goto ReturndataTarget
-		default: // parse a time specification
-			timetokens = append(timetokens, val)
-			if strings.HasSuffix(val, ",") || strings.HasSuffix(val, ")") {
-				time, err := handleTime(timetokens)
-				if err != nil {
-					return dt, err
-				}
-				switch dt.Type {
-				case IN:
-					if dt.End.IsZero() {
-						dt.End = time
-					} else if dt.Start.IsZero() {
-						dt.Start = time
-					}
-				case AFTER, BEFORE:
-					dt.Ref = time
-				}
-				timetokens = []string{}
-			} else {
-				time, err := handleTime(timetokens)
-				if err != nil {
-					return dt, err
-				}
-				dt.Ref = time
-			}
+		default: // part of a time specification
+			timetokens = append(timetokens, timeQuotes.Replace(val))
 		}
 		pos++ //advance to next token
 	}
 	(*tokens) = []string{}
 ReturndataTarget:
-	return dt, nil
+	if err := dt.splitTimes(strings.Join(timetokens, " ")); err != nil {
+		return dt, err
+	}
+	loc := time.Local
+	if dt.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(dt.Timezone); err != nil {
+			return dt, errors.New("Unknown time zone " + dt.Timezone)
+		}
+	}
+	return dt, dt.resolveTimes(loc, time.Now())
 }
 
 /*
@@ -182,7 +207,7 @@ func parsetagsTarget(tokens *[]string) (target_T, error) {
 		}
 		// adds the token to the list of contents,
 		// removing a trailing comma if there is one
-		tmp := strings.TrimSuffix(val, ",")
+		tmp := unquote(strings.TrimSuffix(val, ","))
 		tmp = strings.Replace(tmp, "/", ".", -1)
 		tt.Contents = append(tt.Contents, tmp)
 	}
@@ -207,7 +232,7 @@ func parsesetTarget(tokens *[]string) (target_T, error) {
 		if (*tokens)[pos+1] != "=" {
 			return st, errors.New("Invalid syntax for setting tag")
 		}
-		value := (*tokens)[pos+2]
+		value := unquote((*tokens)[pos+2])
 		token = cleantagstring(token)
 		st.Updates[token] = value
 		pos += 3
@@ -216,7 +241,20 @@ func parsesetTarget(tokens *[]string) (target_T, error) {
 	return st, nil
 }
 
-func parseWhere(tokens *[]string) *node {
+// Returned when a where clause cannot be parsed. The handlers turn it into
+// an HTTP 400
+type WhereError struct {
+	Reason string
+}
+
+func (e *WhereError) Error() string {
+	return "Invalid where clause: " + e.Reason
+}
+
+// Parses a where clause, without the "where". Returns a *WhereError if the
+// clause is incomplete or uses an unknown operator, e.g. "Metadata/Site" or
+// "Metadata/Site ="
+func parseWhere(tokens *[]string) (*node, error) {
 	var stack = [](node){}
 	pos := 0
 	for {
@@ -224,53 +262,111 @@ func parseWhere(tokens *[]string) *node {
 			break
 		}
 		switch (*tokens)[pos] {
-		case "and":
-			left := stack[len(stack)-1]            // last item off stack
-			stack = stack[:len(stack)-1]           // pop it off
-			right, num := getnodeAt(pos+1, tokens) // next node
-			node := node{Type: AND_NODE, Left: left, Right: right}
-			stack = append(stack, node)
-			pos += 1 + num
-			continue
-		case "or":
-			left := stack[len(stack)-1]            // last item off stack
-			stack = stack[:len(stack)-1]           // pop it off
-			right, num := getnodeAt(pos+1, tokens) // next node
-			node := node{Type: OR_NODE, Left: left, Right: right}
+		case "and", "or":
+			if len(stack) == 0 {
+				return nil, &WhereError{Reason: "Missing condition before " + (*tokens)[pos]}
+			}
+			left := stack[len(stack)-1]                 // last item off stack
+			stack = stack[:len(stack)-1]                // pop it off
+			right, num, err := getnodeAt(pos+1, tokens) // next node
+			if err != nil {
+				return nil, err
+			}
+			node := node{Type: getnodeType((*tokens)[pos]), Left: left, Right: right}
 			stack = append(stack, node)
 			pos += 1 + num
 			continue
 		default:
-			node, num := getnodeAt(pos, tokens)
+			node, num, err := getnodeAt(pos, tokens)
+			if err != nil {
+				return nil, err
+			}
 			stack = append(stack, node)
 			pos += num
 			continue
 		}
 		pos++
 	}
+	if len(stack) > 1 {
+		return nil, &WhereError{Reason: "Conditions must be joined with and or or"}
+	}
 	if len(stack) > 0 {
-		return &stack[0]
+		return &stack[0], nil
 	}
-	return &node{Type: DEF_NODE}
+	return &node{Type: DEF_NODE}, nil
 }
 
-func getnodeAt(index int, tokens *[]string) (node, int) {
+// Parses a where clause that may start with "where"
+func parseWhereString(wherestring string) (*node, error) {
+	tokens := tokenize(wherestring)
+	if len(tokens) > 0 && tokens[0] == "where" {
+		tokens = tokens[1:]
+	}
+	return parseWhere(&tokens)
+}
+
+func getnodeAt(index int, tokens *[]string) (node, int, error) {
 	var node = node{}
 	var numtokens = 0
+	if index >= len(*tokens) {
+		return node, 0, &WhereError{Reason: "Missing condition at the end of the where clause"}
+	}
 	if (*tokens)[index] == "has" {
+		if index+1 >= len(*tokens) {
+			return node, 0, &WhereError{Reason: "Missing tag after has"}
+		}
 		node.Left = (*tokens)[index+1]
 		node.Type = getnodeType((*tokens)[index])
 		node.Right = ""
 		numtokens = 2
 	} else {
-		node.Left = (*tokens)[index]
+		if index+1 >= len(*tokens) {
+			return node, 0, &WhereError{Reason: "Missing operator after " + (*tokens)[index]}
+		}
+		node.Left = unquote((*tokens)[index])
 		node.Type = getnodeType((*tokens)[index+1])
-		node.Right = (*tokens)[index+2]
-		numtokens = 3
+		if index+2 >= len(*tokens) {
+			return node, 0, &WhereError{Reason: "Missing value after " + (*tokens)[index] + " " + (*tokens)[index+1]}
+		}
+		switch node.Type {
+		case LIKE_NODE, REGEX_NODE:
+			node.Right = unquote((*tokens)[index+2])
+			numtokens = 3
+		case IN_NODE:
+			var num int
+			node.Right, num = parseInList((*tokens)[index+2:])
+			numtokens = 2 + num
+		case EQ_NODE, NEQ_NODE, LT_NODE, GT_NODE, LE_NODE, GE_NODE:
+			node.Right = parseLiteral((*tokens)[index+2])
+			numtokens = 3
+		default:
+			return node, 0, &WhereError{Reason: "Unknown operator " + (*tokens)[index+1] + " after " + (*tokens)[index]}
+		}
 	}
 	node.Left = strings.Replace(node.Left.(string), "/", ".", -1)
 	//node.Right = strings.Replace(node.Right.(string), "/", ".", -1)
-	return node, numtokens
+	return node, numtokens, nil
+}
+
+// Parses the parenthesized list of an "in" clause, e.g. ('W', 'kW'), from the
+// start of tokens. Returns the values and the number of tokens used
+func parseInList(tokens []string) ([]literal, int) {
+	var list []string
+	for _, token := range tokens {
+		list = append(list, token)
+		if strings.HasSuffix(strings.TrimSuffix(token, ","), ")") {
+			break
+		}
+	}
+	inner := strings.TrimSpace(strings.Join(list, " "))
+	inner = strings.TrimSuffix(strings.TrimPrefix(inner, "("), ")")
+	var values []literal
+	for _, item := range splitOutsideQuotes(inner, ',') {
+		if item = strings.TrimSpace(item); item != "" {
+			values = append(values, parseLiteral(item))
+		}
+	}
+	return values, len(list)
 }
 
 func makeAST(tokens []string) (*AST, error) {
@@ -307,8 +403,12 @@ func makeAST(tokens []string) (*AST, error) {
 		}
 	}
 
+	if err != nil {
+		return ast, err
+	}
+
 	/* Where */
-	ast.Where = parseWhere(&tokens)
+	ast.Where, err = parseWhere(&tokens)
 
 	return ast, err
 }
@@ -318,3 +418,36 @@ func parse(q string) *AST {
 	ast, _ := makeAST(tokens)
 	return ast
 }
+
+// Like parse, but returns any error encountered. Also handles apply queries
+// of the form "apply <operators> to data ... where ...". The operators are
+// split off before tokenizing because their arguments do not follow the
+// tokenization rules of the rest of the query
+func parseQuery(q string) (*AST, error) {
+	q = strings.TrimSpace(q)
+	if strings.HasPrefix(q, "apply ") {
+		to := strings.Index(q, " to ")
+		if to < 0 {
+			return nil, errors.New("Apply queries must look like apply <operators> to data ... where ...")
+		}
+		calls, err := parseOperators(q[len("apply "):to])
+		if err != nil {
+			return nil, err
+		}
+		ast, err := makeAST(tokenize("select " + q[to+len(" to "):]))
+		if err != nil {
+			return ast, err
+		}
+		if ast.TargetType != DATA_TARGET {
+			return ast, errors.New("Operators can only be applied to data")
+		}
+		ast.QueryType = APPLY_TYPE
+		ast.Apply = calls
+		return ast, nil
+	}
+	tokens := tokenize(q)
+	if len(tokens) == 0 {
+		return nil, errors.New("Empty query")
+	}
+	return makeAST(tokens)
+}
@@ -1,8 +1,10 @@
 package archiver
 
 import (
+	"errors"
 	"fmt"
 	"gopkg.in/mgo.v2/bson"
+	"strings"
 	"time"
 )
 
@@ -15,6 +17,7 @@ const (
 	SELECT_TYPE = iota
 	DELETE_TYPE
 	SET_TYPE
+	APPLY_TYPE
 )
 
 /*
@@ -53,10 +56,55 @@ type setTarget struct {
 type dataTarget struct {
 	Type        dataqueryType_T
 	Ref         time.Time
+	RefIsNow    bool // true if Ref was given as just "now"
 	Start       time.Time
 	End         time.Time
 	Limit       int32
 	Streamlimit int
+	// the zone given with "tz", if any
+	Timezone string
+	// the unit of time of the timestamps of the results
+	UnitOfTime UnitOfTime
+	// the time expressions the times above were resolved from
+	times []string
+}
+
+// Splits the time specification of a data query, e.g. "(now -1d, now)" for
+// data in or "now -1h" for data before, into its time expressions
+func (dt *dataTarget) splitTimes(spec string) error {
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(spec, "(") && strings.HasSuffix(spec, ")") {
+		spec = spec[1 : len(spec)-1]
+	}
+	dt.times = nil
+	for _, expr := range splitOutsideQuotes(spec, ',') {
+		if expr = strings.TrimSpace(expr); expr != "" {
+			dt.times = append(dt.times, expr)
+		}
+	}
+	switch {
+	case dt.Type == IN && len(dt.times) != 2:
+		return errors.New("data in needs a start and an end time, e.g. data in (now -1d, now)")
+	case dt.Type != IN && len(dt.times) != 1:
+		return errors.New("data before and data after need one time, e.g. data before now")
+	}
+	return nil
+}
+
+// Resolves the time expressions of the query in the given time zone
+func (dt *dataTarget) resolveTimes(loc *time.Location, now time.Time) error {
+	var err error
+	switch dt.Type {
+	case IN:
+		if dt.Start, err = parseTime(dt.times[0], loc, now); err != nil {
+			return err
+		}
+		dt.End, err = parseTime(dt.times[1], loc, now)
+	case BEFORE, AFTER:
+		dt.Ref, err = parseTime(dt.times[0], loc, now)
+		dt.RefIsNow = dt.times[0] == "now"
+	}
+	return err
 }
 
 func (tt tagsTarget) ToBson() bson.M {
@@ -77,6 +125,8 @@ type AST struct {
 	TargetType targetType_T
 	Target     target_T
 	Where      *node
+	// for APPLY_TYPE queries, the operators to apply in order
+	Apply []*operatorCall
 }
 
 func (ast *AST) Repr() {
@@ -0,0 +1,207 @@
+package archiver
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// how much of a stream's history a backfill copies at a time
+const backfillWindow = 24 * time.Hour
+
+// A Backfill copies the readings of the streams matching Where between Start
+// and End (in milliseconds) from one timeseries database to another
+type Backfill struct {
+	From  string
+	To    string
+	Where string
+	Start uint64
+	End   uint64
+	// progress
+	Streams     int
+	StreamsDone int
+	Readings    uint64
+	// the stream being copied and how far it has got
+	Current   string
+	CurrentAt uint64
+	Began     time.Time
+	Finished  time.Time
+	Error     string
+}
+
+// The BackfillJob runs one Backfill at a time in the background, e.g. to copy
+// the history kept in ReadingDB into Quasar after Quasar has been added as a
+// MirrorTSDB. Readings are read from the source through the TSDB interface,
+// a day of each stream at a time, and written to the destination in batches
+// of at most COALESCE_MAX readings. The SSH shell starts backfills and
+// reports their progress.
+type BackfillJob struct {
+	sync.Mutex
+	store    *Store
+	backends *MultiTSDB
+	current  *Backfill
+	stop     chan bool
+}
+
+func NewBackfillJob(store *Store, backends *MultiTSDB) *BackfillJob {
+	return &BackfillJob{store: store, backends: backends}
+}
+
+// Starts a backfill, unless one is already running. The where clause is
+// checked before anything else
+func (bj *BackfillJob) Start(bf Backfill) error {
+	tokens := tokenize(bf.Where)
+	where, err := parseWhere(&tokens)
+	if err != nil {
+		return err
+	}
+	if bj.backends == nil {
+		return errors.New("Backfills need more than one timeseries database (see MirrorTSDB in giles.cfg)")
+	}
+	from, err := bj.backends.Backend(bf.From)
+	if err != nil {
+		return err
+	}
+	to, err := bj.backends.Backend(bf.To)
+	if err != nil {
+		return err
+	}
+	if bf.From == bf.To {
+		return errors.New("Cannot backfill a timeseries database from itself")
+	}
+	if bf.Start > bf.End {
+		bf.Start, bf.End = bf.End, bf.Start
+	}
+	uuids, err := bj.store.GetUUIDs(where.ToBson())
+	if err != nil {
+		return err
+	}
+	uuids, _, err = bj.store.splitByReadingType(uuids)
+	if err != nil {
+		return err
+	}
+
+	bj.Lock()
+	defer bj.Unlock()
+	if bj.current != nil && bj.current.Finished.IsZero() {
+		return errors.New("A backfill is already running")
+	}
+	bf.Streams = len(uuids)
+	bf.Began = time.Now()
+	bj.current = &bf
+	bj.stop = make(chan bool, 1)
+	go bj.run(bj.current, bj.stop, from, to, uuids)
+	return nil
+}
+
+// Stops the running backfill
+func (bj *BackfillJob) Stop() error {
+	bj.Lock()
+	defer bj.Unlock()
+	if bj.current == nil || !bj.current.Finished.IsZero() {
+		return errors.New("No backfill is running")
+	}
+	select {
+	case bj.stop <- true:
+	default:
+	}
+	return nil
+}
+
+// Returns a copy of the running or last backfill, or nil if there has not
+// been one
+func (bj *BackfillJob) Status() *Backfill {
+	bj.Lock()
+	defer bj.Unlock()
+	if bj.current == nil {
+		return nil
+	}
+	bf := *bj.current
+	return &bf
+}
+
+func (bj *BackfillJob) run(bf *Backfill, stop chan bool, from, to TSDB, uuids []string) {
+	log.Notice("Backfilling %v streams from %v to %v", len(uuids), bf.From, bf.To)
+	err := bj.copyStreams(bf, stop, from, to, uuids)
+	bj.Lock()
+	if err != nil {
+		bf.Error = err.Error()
+	}
+	bf.Current = ""
+	bf.Finished = time.Now()
+	bj.Unlock()
+	if err != nil {
+		log.Error("Backfill from %v to %v stopped: %v", bf.From, bf.To, err)
+		return
+	}
+	log.Notice("Backfilled %v readings of %v streams from %v to %v", bf.Readings, bf.StreamsDone, bf.From, bf.To)
+}
+
+func (bj *BackfillJob) copyStreams(bf *Backfill, stop chan bool, from, to TSDB, uuids []string) error {
+	// windows are in UOT_STORAGE, and take in all of the last millisecond
+	window := convertTime(uint64(backfillWindow/time.Millisecond), UOT_MS, UOT_STORAGE)
+	first := convertTime(bf.Start, UOT_MS, UOT_STORAGE)
+	last := convertTime(bf.End, UOT_MS, UOT_STORAGE) + convertTime(1, UOT_MS, UOT_STORAGE) - 1
+	if last < first {
+		last = math.MaxUint64
+	}
+	for _, uuid := range uuids {
+		for start := first; start <= last; start += window {
+			select {
+			case <-stop:
+				return errors.New("Stopped")
+			default:
+			}
+			end := start + window - 1
+			if end > last || end < start {
+				end = last
+			}
+			bj.Lock()
+			bf.Current, bf.CurrentAt = uuid, convertTime(start, UOT_STORAGE, UOT_MS)
+			bj.Unlock()
+			copied, err := copyReadings(from, to, uuid, start, end)
+			if err != nil {
+				return fmt.Errorf("Error copying %v: %v", uuid, err)
+			}
+			bj.Lock()
+			bf.Readings += uint64(copied)
+			bj.Unlock()
+			if end == last {
+				break
+			}
+		}
+		bj.Lock()
+		bf.StreamsDone++
+		bj.Unlock()
+	}
+	return nil
+}
+
+// Copies the readings of one stream between (and including) start and end,
+// in UOT_STORAGE, and returns how many were copied
+func copyReadings(from, to TSDB, uuid string, start, end uint64) (int, error) {
+	data, err := from.GetData([]string{uuid}, start, end, UOT_STORAGE)
+	if err != nil {
+		return 0, err
+	}
+	copied := 0
+	for _, resp := range data {
+		for i := 0; i < len(resp.Readings); i += COALESCE_MAX {
+			batch := resp.Readings[i:]
+			if len(batch) > COALESCE_MAX {
+				batch = batch[:COALESCE_MAX]
+			}
+			sb := &StreamBuf{uuid: uuid, readings: make([][]interface{}, len(batch))}
+			for j, rdg := range batch {
+				sb.readings[j] = []interface{}{uint64(rdg[0]), rdg[1]}
+			}
+			if !to.Add(sb) {
+				return copied, errors.New("Could not write to the destination")
+			}
+			copied += len(batch)
+		}
+	}
+	return copied, nil
+}
@@ -0,0 +1,102 @@
+package archiver
+
+import (
+	"errors"
+	"sync"
+)
+
+// Returned when readings cannot be taken because the timeseries database is
+// unreachable and the write backlog is full. The handlers turn it into an
+// HTTP 503 or a MsgPack error, so that clients hold on to their readings and
+// try again later
+var ErrBacklogFull = errors.New("Timeseries database is unavailable and the write backlog is full")
+
+// default size of the write backlog, in megabytes
+const defaultWriteBacklog = 256
+
+// The writeBacklog holds the writes for the timeseries database, in order,
+// while it cannot be reached. It is bounded by the total size of the writes
+type writeBacklog struct {
+	sync.Mutex
+	writes []*[]byte
+	size   int
+	max    int
+	// true from the first write that is held until the backlog has been
+	// replayed, so that new writes queue up behind it
+	replaying bool
+}
+
+func newWriteBacklog(max int) *writeBacklog {
+	return &writeBacklog{max: max}
+}
+
+// Returns true while writes must go through the backlog
+func (wb *writeBacklog) active() bool {
+	wb.Lock()
+	defer wb.Unlock()
+	return wb.replaying
+}
+
+// Adds writes to the end of the backlog. Writes that do not fit are dropped
+// and give ErrBacklogFull. Returns true if the backlog was not replaying
+// before, in which case the caller has to start the replay
+func (wb *writeBacklog) push(writes ...*[]byte) (bool, error) {
+	wb.Lock()
+	defer wb.Unlock()
+	var err error
+	for _, data := range writes {
+		if wb.size+len(*data) > wb.max {
+			err = ErrBacklogFull
+			errorCount.Inc("backlog")
+			continue
+		}
+		wb.writes = append(wb.writes, data)
+		wb.size += len(*data)
+	}
+	started := !wb.replaying
+	wb.replaying = true
+	return started, err
+}
+
+// Returns the oldest write, or nil if the backlog is empty
+func (wb *writeBacklog) peek() *[]byte {
+	wb.Lock()
+	defer wb.Unlock()
+	if len(wb.writes) == 0 {
+		return nil
+	}
+	return wb.writes[0]
+}
+
+// Removes the oldest write, once it has been sent
+func (wb *writeBacklog) pop() {
+	wb.Lock()
+	defer wb.Unlock()
+	if len(wb.writes) == 0 {
+		return
+	}
+	wb.size -= len(*wb.writes[0])
+	wb.writes[0] = nil
+	wb.writes = wb.writes[1:]
+}
+
+// Ends the replay if the backlog is empty, and returns whether it did
+func (wb *writeBacklog) finish() bool {
+	wb.Lock()
+	defer wb.Unlock()
+	if len(wb.writes) > 0 {
+		return false
+	}
+	wb.replaying = false
+	wb.writes = nil
+	return true
+}
+
+// Returns the number of bytes in the backlog and whether new readings should
+// be refused. The backlog counts as full once it is nine tenths full, which
+// leaves room for the readings that were already taken
+func (wb *writeBacklog) status() (int, bool) {
+	wb.Lock()
+	defer wb.Unlock()
+	return wb.size, wb.size >= wb.max-wb.max/10
+}
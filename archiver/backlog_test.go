@@ -0,0 +1,101 @@
+package archiver
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWriteBacklog(t *testing.T) {
+	wb := newWriteBacklog(8)
+	first, second, big := []byte("abcd"), []byte("efgh"), []byte("ijkl")
+	if started, err := wb.push(&first); !started || err != nil || !wb.active() {
+		t.Error("The first push should start the replay")
+	}
+	if started, err := wb.push(&second, &big); started || err != ErrBacklogFull {
+		t.Error("Writes past the size of the backlog should give ErrBacklogFull, not", err)
+	}
+	if size, full := wb.status(); size != 8 || !full {
+		t.Error("Backlog should hold 8 bytes and be full, not", size, full)
+	}
+	if data := wb.peek(); string(*data) != "abcd" {
+		t.Error("Writes should be replayed in order")
+	}
+	wb.pop()
+	if wb.finish() {
+		t.Error("The replay should not finish while there are writes left")
+	}
+	wb.pop()
+	if !wb.finish() || wb.active() || wb.peek() != nil {
+		t.Error("The replay should finish once the backlog is empty")
+	}
+}
+
+// A TSDB that can be taken down and brought back
+type flakyTSDB struct {
+	TSDB
+	sync.Mutex
+	addr string
+	down bool
+}
+
+func (f *flakyTSDB) GetConnection() (net.Conn, error) {
+	f.Lock()
+	defer f.Unlock()
+	if f.down {
+		return nil, errors.New("connection refused")
+	}
+	return net.Dial("tcp", f.addr)
+}
+
+func TestConnectionMapReplaysBacklog(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("Cannot listen:", err)
+	}
+	defer listener.Close()
+	received := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				data, _ := ioutil.ReadAll(conn)
+				received <- string(data)
+			}(conn)
+		}
+	}()
+
+	tsdb := &flakyTSDB{addr: listener.Addr().String(), down: true}
+	cm := NewConnectionMap(30, 1<<20)
+	one, two := []byte("one"), []byte("two")
+	if err := cm.Add("a", &one, tsdb); err != nil {
+		t.Fatal("Writes should be held while the TSDB is down, but gave", err)
+	}
+	if err := cm.Add("a", &two, tsdb); err != nil {
+		t.Fatal("Writes should be held while the TSDB is down, but gave", err)
+	}
+	if size, _ := cm.Backlog(); size != 6 {
+		t.Error("Backlog should hold 6 bytes, not", size)
+	}
+
+	tsdb.Lock()
+	tsdb.down = false
+	tsdb.Unlock()
+	select {
+	case data := <-received:
+		if data != "onetwo" {
+			t.Error("The backlog should be replayed in order, but got", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The backlog was not replayed")
+	}
+	if cm.backlog.active() {
+		t.Error("The backlog should be done once it is replayed")
+	}
+}
@@ -0,0 +1,546 @@
+package archiver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HTTP header that marks a request as coming from another node of the
+// cluster. Its value names the node. Nodes answer such requests from their
+// own streams only, rather than forwarding them again
+const ClusterHeader = "X-Giles-Cluster"
+
+// how many points each node has on the hash ring. More points spread the
+// streams more evenly
+const ringReplicas = 128
+
+// how long a node waits on another node before giving up on a request
+const clusterTimeout = 30 * time.Second
+
+// A consistent hash ring: a key belongs to the first point at or after its
+// hash. Adding or removing a node only moves the keys next to its points
+type hashRing struct {
+	points []uint32
+	owners map[uint32]string
+}
+
+func newHashRing(nodes []string) *hashRing {
+	sorted := make([]string, len(nodes))
+	copy(sorted, nodes)
+	sort.Strings(sorted)
+	r := &hashRing{owners: make(map[uint32]string)}
+	for _, node := range sorted {
+		for i := 0; i < ringReplicas; i++ {
+			h := crc32.ChecksumIEEE([]byte(node + "#" + strconv.Itoa(i)))
+			// on a collision the point stays with the first node by name,
+			// so that every node builds the same ring
+			if _, found := r.owners[h]; found {
+				continue
+			}
+			r.owners[h] = node
+			r.points = append(r.points, h)
+		}
+	}
+	sort.Sort(uint32Slice(r.points))
+	return r
+}
+
+func (r *hashRing) owner(key string) string {
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+type uint32Slice []uint32
+
+func (s uint32Slice) Len() int           { return len(s) }
+func (s uint32Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s uint32Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// A Cluster spreads streams over several archivers, each with its own
+// MongoDB and timeseries database:
+//
+//    [Cluster]
+//    Enabled=true
+//    Self=a
+//
+//    [Node "a"]
+//    Address=http://10.0.0.1:8079
+//    [Node "b"]
+//    Address=http://10.0.0.2:8079
+//
+// Every node has the same list of nodes. Each stream UUID is consistently
+// hashed to the node that owns it, which keeps its metadata and readings and
+// does its coalescing, rules and virtual streams. Any node takes readings
+// and queries over any protocol:
+//   - readings are forwarded to the owners of their streams over HTTP /add
+//     (messages without a UUID, i.e. collection metadata, go to every node)
+//     and are acknowledged once all of the owners have them
+//   - queries and /api/latest are run on every node and the results merged.
+//     Apply queries have their per-stream operators run on each node and the
+//     rest (e.g. paste, nansum) run on the merged data
+//   - tags of a single stream (/api/tags/uuid) and actuations are handed to
+//     the owner of the stream
+//   - republish subscriptions are federated: besides its own streams, the
+//     node follows the same subscription on every other node as Server-Sent
+//     Events. Tag subscriptions only see the node's own streams
+//
+// API keys are checked by the owners, so they have to exist on every node.
+// Changing the list of nodes moves streams to new owners, which do not have
+// their history.
+type Cluster struct {
+	self  string
+	nodes map[string]string
+	names []string
+	ring  *hashRing
+	// for requests that are answered at once
+	client *http.Client
+	// for event streams, which stay open
+	streams *http.Client
+}
+
+// Creates the cluster given this node's name and the address (base URL of
+// the HTTP interface) of every node, including this one
+func NewCluster(self string, nodes map[string]string) (*Cluster, error) {
+	if _, found := nodes[self]; !found {
+		return nil, fmt.Errorf("This node (%v) is not one of the cluster's nodes", self)
+	}
+	c := &Cluster{self: self, nodes: make(map[string]string, len(nodes)),
+		client: &http.Client{Timeout: clusterTimeout}, streams: &http.Client{}}
+	for name, address := range nodes {
+		if !strings.HasPrefix(address, "http://") && !strings.HasPrefix(address, "https://") {
+			return nil, fmt.Errorf("Address of node %v should be an http:// or https:// URL, not %v", name, address)
+		}
+		c.nodes[name] = strings.TrimRight(address, "/")
+		c.names = append(c.names, name)
+	}
+	sort.Strings(c.names)
+	c.ring = newHashRing(c.names)
+	return c, nil
+}
+
+// Returns the name of the node that owns the stream
+func (c *Cluster) Owner(uuid string) string {
+	return c.ring.owner(uuid)
+}
+
+// Returns the names of the other nodes, in order
+func (c *Cluster) peers() []string {
+	peers := make([]string, 0, len(c.names)-1)
+	for _, name := range c.names {
+		if name != c.self {
+			peers = append(peers, name)
+		}
+	}
+	return peers
+}
+
+// Splits the messages by the node that takes them
+func (c *Cluster) route(readings map[string]*SmapMessage) map[string]map[string]*SmapMessage {
+	routed := make(map[string]map[string]*SmapMessage)
+	add := func(node, path string, msg *SmapMessage) {
+		if routed[node] == nil {
+			routed[node] = make(map[string]*SmapMessage)
+		}
+		routed[node][path] = msg
+	}
+	for path, msg := range readings {
+		if msg.UUID != "" {
+			add(c.Owner(msg.UUID), path, msg)
+			continue
+		}
+		for _, node := range c.names {
+			add(node, path, msg)
+		}
+	}
+	return routed
+}
+
+// Sends the messages owned by other nodes to them, and returns the ones this
+// node takes. The messages of a node that could not take them are added to
+// report with the reason, so that only those are sent again. Readings from
+// another archiver are forwarded as coming from its source replica (see
+// replication.go), so that their owners drop the ones they already store
+func (c *Cluster) forward(source string, readings map[string]*SmapMessage, apikey string, report *IngestError) map[string]*SmapMessage {
+	routed := c.route(readings)
+	local := routed[c.self]
+	delete(routed, c.self)
+	type result struct {
+		node   string
+		msgs   map[string]*SmapMessage
+		report *IngestError
+		err    error
+	}
+	results := make(chan result, len(routed))
+	for node, msgs := range routed {
+		go func(node string, msgs map[string]*SmapMessage) {
+			body, err := encodeMessages(msgs)
+			if err == nil {
+				_, err = c.requestAs(source, "POST", node, "/add/"+apikey, body)
+			}
+			// messages the node found not valid are reported, not failed
+			if nerr, ok := err.(*nodeError); ok && nerr.status == 400 {
+				var rejected IngestError
+				if json.Unmarshal(nerr.body, &rejected) == nil && len(rejected.Rejected) > 0 {
+					results <- result{node: node, report: &rejected}
+					return
+				}
+			}
+			results <- result{node: node, msgs: msgs, err: err}
+		}(node, msgs)
+	}
+	for i := 0; i < len(routed); i++ {
+		res := <-results
+		switch {
+		case res.err != nil:
+			log.Error("Node %v did not take %v messages: %v", res.node, len(res.msgs), res.err)
+			errorCount.Inc("cluster")
+			for path := range res.msgs {
+				report.Rejected.Add(path, "Not taken by node %v of the cluster (%v)", res.node, res.err)
+			}
+		case res.report != nil:
+			report.Accepted += res.report.Accepted
+			for path, problems := range res.report.Rejected {
+				report.Rejected[path] = append(report.Rejected[path], problems...)
+			}
+		default:
+			report.Accepted += len(res.msgs)
+		}
+	}
+	return local
+}
+
+// Encodes the messages as the body of a POST to /add
+func encodeMessages(readings map[string]*SmapMessage) ([]byte, error) {
+	messages := make(map[string]replicatedMessage, len(readings))
+	for path, msg := range readings {
+		messages[path] = newReplicatedMessage(msg)
+	}
+	return json.Marshal(messages)
+}
+
+// Sends a request to the named node and returns the body of its answer, or
+// an error if it did not answer with 200
+func (c *Cluster) request(method, node, path string, body []byte) ([]byte, error) {
+	return c.requestAs("", method, node, path, body)
+}
+
+// request on behalf of the named replica if it is not empty
+func (c *Cluster) requestAs(replica, method, node, path string, body []byte) ([]byte, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, c.nodes[node]+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(ClusterHeader, c.self)
+	if replica != "" {
+		req.Header.Set(ReplicaHeader, replica)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Node %v: %v", node, err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Node %v: %v", node, err)
+	}
+	if resp.StatusCode != 200 {
+		return nil, &nodeError{node: node, status: resp.StatusCode, body: data}
+	}
+	return data, nil
+}
+
+// A node answered a request with something other than 200
+type nodeError struct {
+	node   string
+	status int
+	body   []byte
+}
+
+func (e *nodeError) Error() string {
+	return fmt.Sprintf("Node %v answered %v: %s", e.node, e.status, e.body)
+}
+
+// POSTs the body to every other node at once and returns their answers, in
+// the order of the nodes. A query is only answered if every node answers
+func (c *Cluster) scatter(path string, body []byte) ([][]byte, error) {
+	peers := c.peers()
+	answers := make([][]byte, len(peers))
+	errs := make(chan error, len(peers))
+	for i, node := range peers {
+		go func(i int, node string) {
+			var err error
+			answers[i], err = c.request("POST", node, path, body)
+			errs <- err
+		}(i, node)
+	}
+	var err error
+	for i := 0; i < len(peers); i++ {
+		if e := <-errs; e != nil {
+			errorCount.Inc("cluster")
+			err = e
+		}
+	}
+	return answers, err
+}
+
+// Merges the answers to a tags query, leaving out repeated values if the
+// query asked for distinct ones
+func mergeTagResults(answers [][]byte, distinct bool) ([]byte, error) {
+	merged := []interface{}{}
+	seen := make(map[string]bool)
+	for _, answer := range answers {
+		var values []interface{}
+		if err := json.Unmarshal(answer, &values); err != nil {
+			return nil, err
+		}
+		for _, value := range values {
+			if distinct {
+				key, _ := json.Marshal(value)
+				if seen[string(key)] {
+					continue
+				}
+				seen[string(key)] = true
+			}
+			merged = append(merged, value)
+		}
+	}
+	return json.Marshal(merged)
+}
+
+// Adds up the streams updated on each node by a set query
+func mergeSetResults(answers [][]byte) ([]byte, error) {
+	updated := 0
+	for _, answer := range answers {
+		var res struct{ Updated int }
+		if err := json.Unmarshal(answer, &res); err != nil {
+			return nil, err
+		}
+		updated += res.Updated
+	}
+	return json.Marshal(map[string]int{"Updated": updated})
+}
+
+// Concatenates the streams answered by each node, keeping at most
+// streamlimit of them if it is not -1
+func mergeDataResults(answers [][]byte, streamlimit int) ([]byte, error) {
+	merged := []json.RawMessage{}
+	for _, answer := range answers {
+		var streams []json.RawMessage
+		if err := json.Unmarshal(answer, &streams); err != nil {
+			return nil, err
+		}
+		merged = append(merged, streams...)
+	}
+	if streamlimit > -1 && streamlimit < len(merged) {
+		merged = merged[:streamlimit]
+	}
+	return json.Marshal(merged)
+}
+
+// Returns how many of the operators, from the first, work on each stream by
+// itself. Each node runs those on its own streams; the node that gathers the
+// results runs the rest
+func perStreamOperators(calls []*operatorCall) int {
+	for i, call := range calls {
+		switch call.name {
+		case "window", "subsample", "units":
+		default:
+			return i
+		}
+	}
+	return len(calls)
+}
+
+// Wraps a Subscriber so that its notification can end both the local
+// subscription and those followed on the other nodes
+type federatedSubscriber struct {
+	Subscriber
+	notify chan bool
+}
+
+func (fs *federatedSubscriber) GetNotify() <-chan bool {
+	return fs.notify
+}
+
+// Subscribes s to the query on this node and on every other node, until s
+// asks to be unsubscribed
+func (c *Cluster) federate(s Subscriber, query, apikey string, republisher *Republisher) {
+	local := &federatedSubscriber{Subscriber: s, notify: make(chan bool, 1)}
+	done := make(chan struct{})
+	for _, node := range c.peers() {
+		go c.follow(node, query, apikey, s, done)
+	}
+	go func() {
+		<-s.GetNotify()
+		close(done)
+		local.notify <- true
+	}()
+	republisher.HandleSubscriber(local, query, apikey)
+}
+
+// Follows the subscription on the named node as Server-Sent Events and
+// sends what it publishes to s, reconnecting (and resuming from the last
+// event) until done is closed
+func (c *Cluster) follow(node, query, apikey string, s Subscriber, done chan struct{}) {
+	target := c.nodes[node] + "/api/republish/sse?q=" + url.QueryEscape(query) + "&key=" + url.QueryEscape(apikey)
+	var lastid string
+	backoff := time.Second
+	for {
+		req, err := http.NewRequest("GET", target, nil)
+		if err != nil {
+			log.Error("Error following subscription on %v: %v", node, err)
+			return
+		}
+		req.Header.Set(ClusterHeader, c.self)
+		if lastid != "" {
+			req.Header.Set("Last-Event-ID", lastid)
+		}
+		req.Cancel = done
+		resp, err := c.streams.Do(req)
+		if err == nil {
+			if resp.StatusCode == 200 {
+				backoff = time.Second
+				err = readEvents(resp.Body, func(id, event, data string) {
+					if id != "" {
+						lastid = id
+					}
+					deliverEvent(s, event, data)
+				})
+			} else {
+				err = errors.New(resp.Status)
+			}
+			resp.Body.Close()
+		}
+		select {
+		case <-done:
+			return
+		default:
+		}
+		log.Error("Lost subscription on node %v (retrying in %v): %v", node, backoff, err)
+		errorCount.Inc("cluster")
+		select {
+		case <-done:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > time.Minute {
+			backoff = time.Minute
+		}
+	}
+}
+
+// Reads a text/event-stream, calling handle with the id, type and data of
+// each event, until the stream ends
+func readEvents(r io.Reader, handle func(id, event, data string)) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	var id, event string
+	var data []string
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if len(data) > 0 {
+				handle(id, event, strings.Join(data, "\n"))
+			}
+			id, event, data = "", "", nil
+		case strings.HasPrefix(line, ":"):
+			// comment, e.g. a heartbeat
+		case strings.HasPrefix(line, "id: "):
+			id = line[len("id: "):]
+		case strings.HasPrefix(line, "event: "):
+			event = line[len("event: "):]
+		case strings.HasPrefix(line, "data: "):
+			data = append(data, line[len("data: "):])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+// Sends an event from another node's subscription to s. Data events hold
+// the JSON written by /republish; metadata events are not federated
+func deliverEvent(s Subscriber, event, data string) {
+	switch event {
+	case "":
+	case "error":
+		s.SendError(fmt.Errorf("%v", data))
+		return
+	default:
+		return
+	}
+	decoder := json.NewDecoder(strings.NewReader(data))
+	decoder.UseNumber()
+	var published map[string]struct {
+		Readings [][]interface{}
+		UUID     string `json:"uuid"`
+	}
+	if err := decoder.Decode(&published); err != nil {
+		log.Error("Error decoding event from another node: %v", err)
+		return
+	}
+	for path, rdg := range published {
+		msg := &SmapMessage{Path: path, UUID: rdg.UUID, Readings: make([][]interface{}, 0, len(rdg.Readings))}
+		for _, reading := range rdg.Readings {
+			if len(reading) < 2 {
+				continue
+			}
+			number, ok := reading[0].(json.Number)
+			if !ok {
+				continue
+			}
+			ts, err := strconv.ParseUint(string(number), 10, 64)
+			if err != nil {
+				continue
+			}
+			value, err := ParseReadingValue(reading[1], "")
+			if err != nil {
+				continue
+			}
+			msg.Readings = append(msg.Readings, []interface{}{ts, value})
+		}
+		s.Send(msg)
+	}
+}
+
+// Describes the nodes of the cluster and whether they answer, for the SSH
+// shell
+func (c *Cluster) Status() string {
+	lines := []string{}
+	for _, node := range c.names {
+		line := node + " " + c.nodes[node]
+		if node == c.self {
+			lines = append(lines, line+" (this node)")
+			continue
+		}
+		if _, err := c.request("GET", node, "/healthz", nil); err != nil {
+			line += " -- " + err.Error()
+		} else {
+			line += " -- ok"
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,246 @@
+package archiver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHashRing(t *testing.T) {
+	ring := newHashRing([]string{"c", "a", "b"})
+	same := newHashRing([]string{"a", "b", "c"})
+	counts := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		uuid := fmt.Sprintf("stream-%d", i)
+		owner := ring.owner(uuid)
+		if same.owner(uuid) != owner {
+			t.Fatal("Every node should build the same ring, whatever the order of the nodes")
+		}
+		counts[owner]++
+	}
+	for _, node := range []string{"a", "b", "c"} {
+		if counts[node] < 600 {
+			t.Error("Streams should be spread evenly, but", node, "owns", counts[node], "of 3000")
+		}
+	}
+
+	grown := newHashRing([]string{"a", "b", "c", "d"})
+	for i := 0; i < 3000; i++ {
+		uuid := fmt.Sprintf("stream-%d", i)
+		if owner := grown.owner(uuid); owner != ring.owner(uuid) && owner != "d" {
+			t.Fatal("Adding a node should only move streams to it, but", uuid, "moved to", owner)
+		}
+	}
+}
+
+func TestClusterRoute(t *testing.T) {
+	c, err := NewCluster("a", map[string]string{"a": "http://a", "b": "http://b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewCluster("z", map[string]string{"a": "http://a"}); err == nil {
+		t.Error("This node should have to be one of the nodes")
+	}
+	readings := map[string]*SmapMessage{
+		"/":   &SmapMessage{Path: "/", Metadata: map[string]interface{}{"Site": "x"}},
+		"/s1": &SmapMessage{Path: "/s1", UUID: "uuid-1"},
+		"/s2": &SmapMessage{Path: "/s2", UUID: "uuid-2"},
+	}
+	routed := c.route(readings)
+	for _, node := range []string{"a", "b"} {
+		if routed[node]["/"] == nil {
+			t.Error("Collection metadata should go to every node, but not to", node)
+		}
+	}
+	for _, path := range []string{"/s1", "/s2"} {
+		uuid := readings[path].UUID
+		if routed[c.Owner(uuid)][path] == nil {
+			t.Error("Stream", uuid, "should go to its owner", c.Owner(uuid))
+		}
+	}
+}
+
+// A node of the cluster that records what it is sent
+type fakeNode struct {
+	sync.Mutex
+	server   *httptest.Server
+	added    map[string]*SmapMessage
+	answer   string
+	fromnode string
+	replica  string
+}
+
+func newFakeNode(answer string) *fakeNode {
+	fn := &fakeNode{added: make(map[string]*SmapMessage), answer: answer}
+	fn.server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		fn.Lock()
+		defer fn.Unlock()
+		fn.fromnode = req.Header.Get(ClusterHeader)
+		fn.replica = req.Header.Get(ReplicaHeader)
+		if req.URL.Path == "/add/key" {
+			added, _, _ := handleJSON(req.Body)
+			for path, msg := range added {
+				fn.added[path] = msg
+			}
+			return
+		}
+		ioutil.ReadAll(req.Body)
+		rw.Write([]byte(fn.answer))
+	}))
+	return fn
+}
+
+func TestClusterForwardAndScatter(t *testing.T) {
+	b, c := newFakeNode(`[{"uuid": "b1", "Readings": [[1, 2]]}]`), newFakeNode(`[{"uuid": "c1", "Readings": []}]`)
+	defer b.server.Close()
+	defer c.server.Close()
+	cluster, err := NewCluster("a", map[string]string{"a": "http://localhost:1", "b": b.server.URL, "c": c.server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readings := map[string]*SmapMessage{"/": &SmapMessage{Path: "/", Metadata: map[string]interface{}{"Site": "x"}}}
+	owned := make(map[string]string)
+	for i := 0; len(owned) < 3; i++ {
+		uuid := fmt.Sprintf("stream-%d", i)
+		if owner := cluster.Owner(uuid); owned[owner] == "" {
+			owned[owner] = uuid
+			readings["/"+owner] = &SmapMessage{Path: "/" + owner, UUID: uuid, Readings: [][]interface{}{{uint64(1000), float64(1)}}}
+		}
+	}
+	report := newIngestError()
+	local := cluster.forward("", readings, "key", report)
+	if report.Accepted != 4 || len(report.Rejected) != 0 {
+		t.Error("The other nodes should have taken 4 messages, not", report)
+	}
+	if len(local) != 2 || local["/a"] == nil || local["/"] == nil {
+		t.Error("This node should keep its own streams and the collection metadata, not", local)
+	}
+	for name, node := range map[string]*fakeNode{"b": b, "c": c} {
+		if msg := node.added["/"+name]; msg == nil || msg.UUID != owned[name] || len(msg.Readings) != 1 {
+			t.Error("Node", name, "should be sent its stream, but got", node.added)
+		}
+		if node.added["/"] == nil {
+			t.Error("Node", name, "should be sent the collection metadata")
+		}
+		if node.fromnode != "a" {
+			t.Error("Requests should name the node they come from, not", node.fromnode)
+		}
+		if node.replica != "" {
+			t.Error("Readings from drivers should not be forwarded as replicated, but were from", node.replica)
+		}
+	}
+
+	// replicated readings are forwarded as such, so that owners drop those
+	// they already store
+	cluster.forward("upstream", map[string]*SmapMessage{"/b": readings["/b"]}, "key", newIngestError())
+	if b.replica != "upstream" {
+		t.Error("Replicated readings should name their source, not", b.replica)
+	}
+
+	answers, err := cluster.scatter("/api/cluster/query", []byte("select data before now where uuid like '%'"))
+	if err != nil {
+		t.Fatal("Scatter failed:", err)
+	}
+	merged, err := mergeDataResults(append([][]byte{[]byte(`[{"uuid": "a1", "Readings": []}]`)}, answers...), 2)
+	if err != nil || string(merged) != `[{"uuid":"a1","Readings":[]},{"uuid":"b1","Readings":[[1,2]]}]` {
+		t.Error("Wrong merged data", string(merged), err)
+	}
+
+	c.server.Close()
+	if _, err := cluster.scatter("/api/cluster/query", []byte("select *")); err == nil {
+		t.Error("A query should fail if a node does not answer")
+	}
+
+	report = newIngestError()
+	local = cluster.forward("", readings, "key", report)
+	if len(local) != 2 || local["/a"] == nil {
+		t.Error("This node should still keep its own streams when a node is down, not", local)
+	}
+	if report.Accepted != 2 || len(report.Rejected) != 2 || report.Rejected["/c"] == nil || report.Rejected["/"] == nil {
+		t.Error("Only the messages for the node that is down should be reported, not", report)
+	}
+}
+
+func TestMergeResults(t *testing.T) {
+	tags, err := mergeTagResults([][]byte{[]byte(`["x", "y"]`), []byte(`["y", "z"]`)}, true)
+	if err != nil || string(tags) != `["x","y","z"]` {
+		t.Error("Distinct values should be merged without repeats, not", string(tags), err)
+	}
+	tags, _ = mergeTagResults([][]byte{[]byte(`[{"uuid": "a"}]`), []byte(`[{"uuid": "a"}]`)}, false)
+	if string(tags) != `[{"uuid":"a"},{"uuid":"a"}]` {
+		t.Error("Documents should all be kept, not", string(tags))
+	}
+	set, err := mergeSetResults([][]byte{[]byte(`{"Updated": 2}`), []byte(`{"Updated": 3}`)})
+	if err != nil || string(set) != `{"Updated":5}` {
+		t.Error("Updated streams should be added up, not", string(set), err)
+	}
+}
+
+func TestPerStreamOperators(t *testing.T) {
+	calls := []*operatorCall{{name: "units"}, {name: "window"}, {name: "paste"}, {name: "window"}}
+	if n := perStreamOperators(calls); n != 2 {
+		t.Error("Only the operators before paste work on each stream alone, not", n)
+	}
+}
+
+// A Subscriber that records what it is sent
+type recordingSubscriber struct {
+	sync.Mutex
+	messages []*SmapMessage
+	notify   chan bool
+}
+
+func (rs *recordingSubscriber) Send(msg *SmapMessage) {
+	rs.Lock()
+	rs.messages = append(rs.messages, msg)
+	rs.Unlock()
+}
+
+func (rs *recordingSubscriber) SendError(err error) {}
+
+func (rs *recordingSubscriber) GetNotify() <-chan bool {
+	return rs.notify
+}
+
+func TestClusterFollow(t *testing.T) {
+	lastids := make(chan string, 10)
+	node := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		lastids <- req.Header.Get("Last-Event-ID")
+		rw.Header().Set("Content-Type", "text/event-stream")
+		rw.Write([]byte(": heartbeat\n\nid: 1-1\ndata: {\"/s\": {\"Readings\": [[1429000000123456, 1.5]], \"uuid\": \"b1\"}}\n\n"))
+	}))
+	defer node.Close()
+	cluster, err := NewCluster("a", map[string]string{"a": "http://localhost:1", "b": node.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := &recordingSubscriber{notify: make(chan bool)}
+	done := make(chan struct{})
+	go cluster.follow("b", "Metadata/Site = 'x'", "key", sub, done)
+	if id := <-lastids; id != "" {
+		t.Error("The first subscription should not resume, but sent", id)
+	}
+	select {
+	case id := <-lastids:
+		if id != "1-1" {
+			t.Error("Reconnects should resume from the last event, not", id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Did not reconnect")
+	}
+	close(done)
+	sub.Lock()
+	defer sub.Unlock()
+	if len(sub.messages) == 0 {
+		t.Fatal("Events should be sent to the subscriber")
+	}
+	msg := sub.messages[0]
+	if msg.UUID != "b1" || msg.Path != "/s" || msg.Readings[0][0] != uint64(1429000000123456) || msg.Readings[0][1] != float64(1.5) {
+		t.Error("Wrong message", msg, msg.Readings)
+	}
+}
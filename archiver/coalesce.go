@@ -1,6 +1,8 @@
 package archiver
 
 import (
+	"errors"
+	"sort"
 	"sync"
 	"time"
 )
@@ -28,21 +30,95 @@ const (
 	COALESCE_MAX     = 4000
 )
 
+/**
+What happens to a reading with the same timestamp as one we already took for
+its stream (e.g. from a driver that retried after a timeout) is decided by the
+stream's duplicate policy: its Properties/DuplicatePolicy, or else the
+DuplicatePolicy in giles.cfg.
+	keep-all: the duplicate is stored as well (how Giles has always behaved)
+	last-write-wins: the duplicate replaces the earlier reading
+	first-write-wins: the duplicate is dropped
+	reject: the duplicate is dropped and AddData returns ErrDuplicateReadings
+Duplicates are found among the buffered readings of the stream and the last
+duplicateHistory timestamps committed for it; older duplicates are not
+noticed. Readings are sorted by timestamp before they are committed.
+Duplicates are counted in giles_duplicate_readings_total, and readings older
+than the newest one taken for their stream in giles_late_readings_total.
+**/
+const (
+	DUPLICATES_KEEP_ALL = "keep-all"
+	DUPLICATES_LAST     = "last-write-wins"
+	DUPLICATES_FIRST    = "first-write-wins"
+	DUPLICATES_REJECT   = "reject"
+)
+
+// how many of the newest committed timestamps of each stream are kept to
+// find duplicates
+const duplicateHistory = 64
+
+// Returned by AddData when readings were dropped by the reject duplicate
+// policy. The other readings are still taken
+var ErrDuplicateReadings = errors.New("Readings with the timestamp of a reading already taken for their stream were rejected")
+
+func validDuplicatePolicy(policy string) bool {
+	switch policy {
+	case DUPLICATES_KEEP_ALL, DUPLICATES_LAST, DUPLICATES_FIRST, DUPLICATES_REJECT:
+		return true
+	}
+	return false
+}
+
 type StreamBuf struct {
 	sync.Mutex
 	readings [][]interface{}
 	abort    chan bool
 	uuid     string
+	// position of each buffered timestamp in readings, and the newest
+	times  map[uint64]int
+	newest uint64
+	// timestamps that were committed before and are written again under
+	// last-write-wins, so the committed readings are deleted first
+	overwrites []uint64
+}
+
+// The newest timestamps committed for a stream, newest last
+type streamHistory struct {
+	times  []uint64
+	newest uint64
+}
+
+func (h *streamHistory) contains(ts uint64) bool {
+	for _, t := range h.times {
+		if t == ts {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *streamHistory) add(ts uint64) {
+	if len(h.times) == duplicateHistory {
+		h.times = append(h.times[:0], h.times[1:]...)
+	}
+	h.times = append(h.times, ts)
+	if ts > h.newest {
+		h.newest = ts
+	}
 }
 
 type Coalescer struct {
 	tsdb *TSDB
 	sync.Mutex
 	streams map[string]*StreamBuf
+	// the duplicate policy of streams that do not have their own
+	policy      string
+	history     map[string]*streamHistory
+	historylock sync.Mutex
 }
 
-func NewCoalescer(tsdb *TSDB) *Coalescer {
-	return &Coalescer{tsdb: tsdb, streams: make(map[string]*StreamBuf, 100)}
+func NewCoalescer(tsdb *TSDB, policy string) *Coalescer {
+	return &Coalescer{tsdb: tsdb, streams: make(map[string]*StreamBuf, 100),
+		policy: policy, history: make(map[string]*streamHistory)}
 }
 
 func (c *Coalescer) GetStreamBuf(uuid string) *StreamBuf {
@@ -51,26 +127,126 @@ func (c *Coalescer) GetStreamBuf(uuid string) *StreamBuf {
 	if sm, found := c.streams[uuid]; found {
 		return sm
 	}
-	sm := &StreamBuf{uuid: uuid, readings: make([][]interface{}, 0, 100)}
+	sm := &StreamBuf{uuid: uuid, readings: make([][]interface{}, 0, 100), times: make(map[uint64]int, 100)}
 	c.streams[uuid] = sm
 	return sm
 }
 
-func (c *Coalescer) Add(sm *SmapMessage) {
+// Returns the number of streams with buffered readings and the number of
+// readings buffered across them
+func (c *Coalescer) Buffered() (streams, readings int) {
+	c.Lock()
+	bufs := make([]*StreamBuf, 0, len(c.streams))
+	for _, sb := range c.streams {
+		bufs = append(bufs, sb)
+	}
+	c.Unlock()
+	// commit locks the StreamBuf before the Coalescer, so don't hold both
+	for _, sb := range bufs {
+		sb.Lock()
+		readings += len(sb.readings)
+		sb.Unlock()
+	}
+	return len(bufs), readings
+}
+
+// Returns a copy of the readings buffered for each of the given streams.
+// They have been taken, but are not in the TSDB yet
+func (c *Coalescer) Pending(uuids []string) map[string][][]interface{} {
+	c.Lock()
+	bufs := make([]*StreamBuf, 0, len(uuids))
+	for _, uuid := range uuids {
+		if sb, found := c.streams[uuid]; found {
+			bufs = append(bufs, sb)
+		}
+	}
+	c.Unlock()
+	pending := make(map[string][][]interface{}, len(bufs))
+	for _, sb := range bufs {
+		sb.Lock()
+		if len(sb.readings) > 0 {
+			readings := make([][]interface{}, len(sb.readings))
+			copy(readings, sb.readings)
+			pending[sb.uuid] = readings
+		}
+		sb.Unlock()
+	}
+	return pending
+}
+
+// Buffers the readings of sm, whose timestamps are in UOT_STORAGE, applying
+// the given duplicate policy ("" for the Coalescer's). Readings that are
+// dropped are removed from sm, and the number dropped at each timestamp is
+// returned
+func (c *Coalescer) Add(sm *SmapMessage, policy string) map[uint64]int {
 	if sm.Readings == nil || len(sm.Readings) == 0 {
-		return
+		return nil
 	} // return early
 
 	if len(sm.UUID) == 0 {
 		log.Error("Reading has no UUID!")
-		return
+		return nil
+	}
+	if policy == "" {
+		policy = c.policy
 	}
 
 	sb := c.GetStreamBuf(sm.UUID)
 
 	sb.Lock()
-	sb.readings = append(sb.readings, sm.Readings...)
-	if len(sb.readings) == len(sm.Readings) { // empty! start afresh
+	c.historylock.Lock()
+	history := c.history[sm.UUID]
+	if history == nil {
+		history = &streamHistory{}
+		c.history[sm.UUID] = history
+	}
+	var dropped map[uint64]int
+	kept := sm.Readings[:0]
+	wasempty := len(sb.readings) == 0
+	for _, rdg := range sm.Readings {
+		ts := rdg[0].(uint64)
+		if ts < history.newest || ts < sb.newest {
+			lateReadings.Inc()
+		} else {
+			sb.newest = ts
+		}
+		idx, buffered := sb.times[ts]
+		committed := !buffered && history.contains(ts)
+		if !buffered && !committed {
+			sb.times[ts] = len(sb.readings)
+			sb.readings = append(sb.readings, rdg)
+			kept = append(kept, rdg)
+			continue
+		}
+		duplicateReadings.Inc(policy)
+		switch policy {
+		case DUPLICATES_LAST:
+			if buffered {
+				sb.readings[idx] = rdg
+			} else {
+				sb.overwrites = append(sb.overwrites, ts)
+				sb.times[ts] = len(sb.readings)
+				sb.readings = append(sb.readings, rdg)
+			}
+			kept = append(kept, rdg)
+		case DUPLICATES_FIRST, DUPLICATES_REJECT:
+			if dropped == nil {
+				dropped = make(map[uint64]int)
+			}
+			dropped[ts]++
+		default:
+			sb.readings = append(sb.readings, rdg)
+			kept = append(kept, rdg)
+		}
+	}
+	c.historylock.Unlock()
+	sm.Readings = kept
+	if len(sb.readings) == 0 {
+		// everything was dropped, so there is nothing to commit
+		sb.Unlock()
+		return dropped
+	}
+	if wasempty { // empty! start afresh
 		sb.abort = make(chan bool, 1)
 		go func(abort chan bool, uuid string) {
 			timeout := time.After(time.Duration(COALESCE_TIMEOUT) * time.Millisecond)
@@ -92,13 +268,36 @@ func (c *Coalescer) Add(sm *SmapMessage) {
 		c.commit(sm.UUID)
 	}
 	sb.Unlock()
-
+	return dropped
 }
 
 func (c *Coalescer) commit(uuid string) {
 	sb := c.GetStreamBuf(uuid)
+	for _, ts := range sb.overwrites {
+		if err := (*c.tsdb).Delete([]string{uuid}, ts, ts, UOT_STORAGE); err != nil {
+			log.Error("Error deleting the reading of %v at %v to overwrite it: %v", uuid, ts, err)
+		}
+	}
+	sort.Stable(readingsByTime(sb.readings))
+	c.historylock.Lock()
+	history := c.history[uuid]
+	if history == nil {
+		history = &streamHistory{}
+		c.history[uuid] = history
+	}
+	for _, rdg := range sb.readings {
+		history.add(rdg[0].(uint64))
+	}
+	c.historylock.Unlock()
 	c.Lock()
 	(*c.tsdb).Add(sb)
 	delete(c.streams, uuid)
 	c.Unlock()
 }
+
+// Sorts readings, whose timestamps are uint64s, by timestamp
+type readingsByTime [][]interface{}
+
+func (r readingsByTime) Len() int           { return len(r) }
+func (r readingsByTime) Less(i, j int) bool { return r[i][0].(uint64) < r[j][0].(uint64) }
+func (r readingsByTime) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
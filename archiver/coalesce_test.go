@@ -0,0 +1,71 @@
+package archiver
+
+import (
+	"testing"
+)
+
+func readingsOf(uuid string, readings ...[]interface{}) *SmapMessage {
+	return &SmapMessage{UUID: uuid, Readings: readings}
+}
+
+// Commits the buffered readings of the stream now rather than on the timer
+func flush(c *Coalescer, uuid string) {
+	sb := c.GetStreamBuf(uuid)
+	sb.Lock()
+	if sb.abort != nil {
+		sb.abort <- true
+	}
+	c.commit(uuid)
+	sb.Unlock()
+}
+
+func TestCoalescerDuplicatePolicies(t *testing.T) {
+	mem := newMemTSDB()
+	var tsdb TSDB = mem
+	c := NewCoalescer(&tsdb, DUPLICATES_KEEP_ALL)
+
+	c.Add(readingsOf("keep", []interface{}{uint64(2), float64(1)}, []interface{}{uint64(1), float64(1)}), "")
+	c.Add(readingsOf("keep", []interface{}{uint64(2), float64(2)}), "")
+	c.Add(readingsOf("last", []interface{}{uint64(1), float64(1)}), DUPLICATES_LAST)
+	c.Add(readingsOf("last", []interface{}{uint64(1), float64(2)}), DUPLICATES_LAST)
+	c.Add(readingsOf("first", []interface{}{uint64(1), float64(1)}), DUPLICATES_FIRST)
+	msg := readingsOf("first", []interface{}{uint64(1), float64(2)}, []interface{}{uint64(3), float64(3)})
+	if dropped := c.Add(msg, DUPLICATES_FIRST); dropped[1] != 1 || len(dropped) != 1 {
+		t.Error("The duplicate should be reported as dropped, not", dropped)
+	}
+	if len(msg.Readings) != 1 || msg.Readings[0][0] != uint64(3) {
+		t.Error("The duplicate should be removed from the message, leaving", msg.Readings)
+	}
+	for _, uuid := range []string{"keep", "last", "first"} {
+		flush(c, uuid)
+	}
+
+	if keep := mem.readings["keep"]; len(keep) != 3 || keep[0][0] != 1 || keep[1][0] != 2 || keep[2][0] != 2 {
+		t.Error("keep-all should store every reading, sorted by timestamp, not", keep)
+	}
+	if last := mem.readings["last"]; len(last) != 1 || last[0][1] != 2 {
+		t.Error("last-write-wins should keep the later reading, not", last)
+	}
+	if first := mem.readings["first"]; len(first) != 2 || first[0][1] != 1 {
+		t.Error("first-write-wins should keep the earlier reading, not", first)
+	}
+
+	// duplicates of readings that were already committed
+	c.Add(readingsOf("last", []interface{}{uint64(1), float64(3)}), DUPLICATES_LAST)
+	flush(c, "last")
+	if last := mem.readings["last"]; len(last) != 1 || last[0][1] != 3 {
+		t.Error("last-write-wins should replace the committed reading, not", last)
+	}
+	if dropped := c.Add(readingsOf("first", []interface{}{uint64(3), float64(4)}), DUPLICATES_REJECT); dropped[3] != 1 {
+		t.Error("reject should drop a duplicate of a committed reading, not", dropped)
+	}
+}
+
+func TestDropLastReadings(t *testing.T) {
+	msg := readingsOf("a", []interface{}{uint64(1), float64(1)}, []interface{}{uint64(2), float64(2)},
+		[]interface{}{uint64(1), float64(3)}, []interface{}{uint64(1), float64(4)})
+	dropLastReadings(msg, UOT_MS, map[uint64]int{convertTime(1, UOT_MS, UOT_STORAGE): 2})
+	if len(msg.Readings) != 2 || msg.Readings[0][1] != float64(1) || msg.Readings[1][1] != float64(2) {
+		t.Error("The last readings at the timestamp should be dropped, leaving", msg.Readings)
+	}
+}
@@ -11,16 +11,26 @@ type Config struct {
 		Keepalive   *int
 		EnforceKeys bool
 		LogLevel    *string
+		// megabytes of writes held while the TSDB cannot be reached
+		WriteBacklog *int
+		// timeseries databases that every write is also sent to
+		MirrorTSDB []string
+		// what happens to readings with the timestamp of one already taken
+		DuplicatePolicy *string
 	}
 
 	ReadingDB struct {
 		Port    *string
 		Address *string
+		// the unit of time of the timestamps kept in ReadingDB
+		StorageUnitofTime *string
 	}
 
 	Quasar struct {
 		Port    *string
 		Address *string
+		// the unit of time of the timestamps kept in Quasar
+		StorageUnitofTime *string
 	}
 
 	Mongo struct {
@@ -57,6 +67,54 @@ type Config struct {
 		KeyAuthEnabled     bool
 	}
 
+	Rollups struct {
+		Enabled         bool
+		RawRetention    *string
+		RollupRetention *string
+	}
+
+	// per where-clause overrides of the rollup retention periods
+	Retention map[string]*struct {
+		Where   string
+		Raw     string
+		Rollups string
+	}
+
+	Expiry struct {
+		Enabled  bool
+		Interval *string
+		Rate     *int
+	}
+
+	// checks on incoming messages (see validate.go)
+	Validation struct {
+		// readings from before this date (YYYY-MM-DD) are refused
+		Earliest *string
+		// how far ahead of the archiver's clock readings may be
+		MaxFuture *string
+		// what happens to NaN and infinite values: reject, drop or keep
+		NonFinite *string
+	}
+
+	// forwarding to an upstream archiver
+	Replication struct {
+		Enabled  bool
+		Upstream *string
+		Key      *string
+	}
+
+	// sharding streams over several archivers (see cluster.go)
+	Cluster struct {
+		Enabled bool
+		// the name of this node among the Node sections
+		Self *string
+	}
+
+	// the nodes of the cluster, by name
+	Node map[string]*struct {
+		Address string
+	}
+
 	Profile struct {
 		CpuProfile     *string
 		MemProfile     *string
@@ -93,6 +151,39 @@ func PrintConfig(c *Config) {
 		fmt.Println("	at address", *c.Quasar.Address, ":", *c.Quasar.Port)
 	}
 	fmt.Println("	with keepalive", *c.Archiver.Keepalive)
+	for _, mirror := range c.Archiver.MirrorTSDB {
+		fmt.Println("	mirrored to", mirror)
+	}
+	if c.Archiver.WriteBacklog != nil {
+		fmt.Println("	with write backlog of", *c.Archiver.WriteBacklog, "MB")
+	}
+	if c.ReadingDB.StorageUnitofTime != nil {
+		fmt.Println("ReadingDB timestamps in", *c.ReadingDB.StorageUnitofTime)
+	}
+	if c.Quasar.StorageUnitofTime != nil {
+		fmt.Println("Quasar timestamps in", *c.Quasar.StorageUnitofTime)
+	}
+	if c.Archiver.DuplicatePolicy != nil {
+		fmt.Println("Duplicate readings:", *c.Archiver.DuplicatePolicy)
+	}
+
+	if c.Validation.Earliest != nil {
+		fmt.Println("Readings refused before", *c.Validation.Earliest)
+	}
+	if c.Validation.MaxFuture != nil {
+		fmt.Println("Readings refused more than", *c.Validation.MaxFuture, "ahead")
+	}
+	if c.Validation.NonFinite != nil {
+		fmt.Println("NaN and infinite values:", *c.Validation.NonFinite)
+	}
+
+	if c.Replication.Enabled {
+		fmt.Println("Forwarding to", *c.Replication.Upstream)
+	}
+
+	if c.Cluster.Enabled {
+		fmt.Println("Node", *c.Cluster.Self, "of a cluster of", len(c.Node))
+	}
 
 	if c.Profile.Enabled {
 		fmt.Println("Profiling enabled for", *c.Profile.BenchmarkTimer, "seconds!")
@@ -0,0 +1,176 @@
+package archiver
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// how long the metadata store and timeseries database have to answer a
+// health check
+const healthCheckTimeout = 5 * time.Second
+
+// The result of checking one part of the archiver
+type HealthCheck struct {
+	Name    string
+	Healthy bool
+	// why the check failed
+	Error string `json:",omitempty"`
+	// how long the check took, in milliseconds
+	Latency float64
+	// anything else worth knowing, e.g. the depth of the buffers
+	Details map[string]interface{} `json:",omitempty"`
+}
+
+// A HealthReport is returned as JSON by the /healthz and /readyz endpoints,
+// e.g.
+//
+//    {"Status": "ok", "Checks": [{"Name": "mongo", "Healthy": true, "Latency": 0.4}, ...]}
+//
+// Status is "ok" if all checks are healthy and "failing" otherwise.
+type HealthReport struct {
+	Status string
+	Checks []HealthCheck
+}
+
+func (hr *HealthReport) Healthy() bool {
+	return hr.Status == "ok"
+}
+
+func newHealthReport(checks []HealthCheck) *HealthReport {
+	report := &HealthReport{Status: "ok", Checks: checks}
+	for _, check := range checks {
+		if !check.Healthy {
+			report.Status = "failing"
+		}
+	}
+	return report
+}
+
+// Runs a check, timing it and turning its error into a HealthCheck
+func runCheck(name string, check func() (map[string]interface{}, error)) HealthCheck {
+	start := time.Now()
+	details, err := check()
+	hc := HealthCheck{Name: name, Healthy: err == nil, Details: details,
+		Latency: float64(time.Since(start)) / float64(time.Millisecond)}
+	if err != nil {
+		hc.Error = err.Error()
+	}
+	return hc
+}
+
+// The handlers (HTTP, WebSockets, CapnProto, MsgPack) report whether they
+// are listening, so that a handler whose listener failed shows up in the
+// health checks instead of going quietly missing
+type listenerStatus struct {
+	sync.Mutex
+	listening map[string]bool
+	errors    map[string]string
+}
+
+func newListenerStatus() *listenerStatus {
+	return &listenerStatus{listening: make(map[string]bool), errors: make(map[string]string)}
+}
+
+// Records that the named listener is accepting connections
+func (a *Archiver) ListenerStarted(name string) {
+	a.listeners.Lock()
+	defer a.listeners.Unlock()
+	a.listeners.listening[name] = true
+	delete(a.listeners.errors, name)
+}
+
+// Records that the named listener could not start or has stopped
+func (a *Archiver) ListenerFailed(name string, err error) {
+	a.listeners.Lock()
+	defer a.listeners.Unlock()
+	a.listeners.listening[name] = false
+	if err != nil {
+		a.listeners.errors[name] = err.Error()
+	} else {
+		a.listeners.errors[name] = "stopped"
+	}
+}
+
+func (a *Archiver) checkListeners() (map[string]interface{}, error) {
+	a.listeners.Lock()
+	defer a.listeners.Unlock()
+	details := make(map[string]interface{}, len(a.listeners.listening))
+	var failed []string
+	for name, listening := range a.listeners.listening {
+		if listening {
+			details[name] = "listening"
+		} else {
+			details[name] = a.listeners.errors[name]
+			failed = append(failed, name)
+		}
+	}
+	if len(failed) > 0 {
+		return details, fmt.Errorf("Listeners are down: %v", failed)
+	}
+	return details, nil
+}
+
+// Reports the readings and messages buffered in the archiver on their way
+// to the timeseries database and subscribers
+func (a *Archiver) checkBacklog() (map[string]interface{}, error) {
+	streams, readings := a.coalescer.Buffered()
+	return map[string]interface{}{
+		"CoalescerStreams":  streams,
+		"CoalescerReadings": readings,
+		"RepublishPending":  a.republisher.Pending(),
+		"WebhookBatches":    a.webhooks.Queued(),
+	}, nil
+}
+
+func (a *Archiver) checkMongo() (map[string]interface{}, error) {
+	return nil, a.store.Ping(healthCheckTimeout)
+}
+
+func (a *Archiver) checkTSDB() (map[string]interface{}, error) {
+	backlog, full := a.tsdb.Backlog()
+	details := map[string]interface{}{"LiveConnections": a.tsdb.LiveConnections(), "BacklogBytes": backlog}
+	if err := a.tsdb.Ping(healthCheckTimeout); err != nil {
+		return details, err
+	}
+	if full {
+		return details, ErrBacklogFull
+	}
+	return details, nil
+}
+
+// Liveness: reports whether the archiver itself is working, i.e. its
+// listeners are up. It does not check the databases, as restarting Giles
+// would not bring them back
+func (a *Archiver) Health() *HealthReport {
+	return newHealthReport([]HealthCheck{
+		runCheck("listeners", a.checkListeners),
+		runCheck("backlog", a.checkBacklog),
+	})
+}
+
+// Readiness: reports whether the archiver can take readings and queries,
+// i.e. it is healthy and the metadata store and timeseries database answer.
+// The databases are checked concurrently, so this takes at most
+// healthCheckTimeout
+func (a *Archiver) Ready() *HealthReport {
+	checks := make([]HealthCheck, 4)
+	var wg sync.WaitGroup
+	for i, check := range []struct {
+		name string
+		run  func() (map[string]interface{}, error)
+	}{
+		{"mongo", a.checkMongo},
+		{"tsdb", a.checkTSDB},
+		{"listeners", a.checkListeners},
+		{"backlog", a.checkBacklog},
+	} {
+		wg.Add(1)
+		go func(i int, name string, run func() (map[string]interface{}, error)) {
+			defer wg.Done()
+			checks[i] = runCheck(name, run)
+		}(i, check.name, check.run)
+	}
+	wg.Wait()
+	return newHealthReport(checks)
+}
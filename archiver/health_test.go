@@ -0,0 +1,30 @@
+package archiver
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestListenerHealth(t *testing.T) {
+	a := &Archiver{listeners: newListenerStatus()}
+	a.ListenerStarted("http")
+	a.ListenerStarted("msgpack-udp")
+	if check := runCheck("listeners", a.checkListeners); !check.Healthy || check.Details["http"] != "listening" {
+		t.Error("Listeners should be healthy but gave", check)
+	}
+
+	a.ListenerFailed("msgpack-udp", errors.New("address already in use"))
+	check := runCheck("listeners", a.checkListeners)
+	if check.Healthy || check.Details["msgpack-udp"] != "address already in use" {
+		t.Error("A failed listener should be reported but gave", check)
+	}
+	report := newHealthReport([]HealthCheck{check, HealthCheck{Name: "backlog", Healthy: true}})
+	if report.Healthy() || report.Status != "failing" {
+		t.Error("The report should be failing but gave", report)
+	}
+
+	a.ListenerStarted("msgpack-udp")
+	if check := runCheck("listeners", a.checkListeners); !check.Healthy {
+		t.Error("A restarted listener should be healthy but gave", check)
+	}
+}
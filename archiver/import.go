@@ -0,0 +1,609 @@
+package archiver
+
+import (
+	"bufio"
+	uuidlib "code.google.com/p/go-uuid/uuid"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Formats of imported data
+const (
+	IMPORT_CSV  = "csv"
+	IMPORT_JSON = "json"
+)
+
+// at most this many problems are reported for a refused chunk
+const maxImportProblems = 20
+
+// Returned when an import is asked for that does not exist
+var ErrNoSuchImport = errors.New("No such import")
+
+// Returned when the API key may not write the streams of an import, or is
+// not the key the import was started with
+var ErrImportForbidden = errors.New("API key may not write to this import")
+
+// Returned by ImportChunk while writes to the timeseries database are held
+// in the write backlog. The chunk should be sent again later
+var ErrImportHeld = errors.New("Timeseries database is unavailable; send the chunk again later")
+
+// Returned by ImportChunk when a chunk starts after the last line of the
+// import that was written. The Import returned with it says where to resume
+var ErrImportGap = errors.New("Chunk starts after the last line imported")
+
+// A stream that imported readings are written to, and the metadata it is
+// saved with
+type ImportStream struct {
+	Path       string
+	UUID       string `json:"uuid"`
+	Metadata   bson.M `json:",omitempty"`
+	Properties bson.M `json:",omitempty"`
+}
+
+// An Import loads historic readings of double streams, e.g. years of BMS
+// trend logs, straight into the timeseries database. It is started with
+// POST /api/import, whose body describes the data:
+//
+//    {
+//      "Format": "csv",
+//      "Columns": ["time", "AHU-1 SAT", "AHU-1 RAT"],
+//      "TimeFormat": "2006-01-02 15:04:05",
+//      "Timezone": "America/Los_Angeles",
+//      "Streams": {
+//        "AHU-1 SAT": {"Path": "/ahu1/sat", "uuid": "...", "Metadata": {...}},
+//        "AHU-1 RAT": {"Path": "/ahu1/rat", "uuid": "...", "Properties": {...}}
+//      }
+//    }
+//
+// For csv, the first column holds the timestamps and the others the values
+// of the streams named by Streams; columns without a stream and empty cells
+// are skipped. Timestamps are read with TimeFormat (a Go time layout) in
+// Timezone (the archiver's own by default) if it is given, and are otherwise
+// integers in UnitofTime (ms by default). For json, each line is a sMAP
+// object as sent to /add, and Streams, keyed by path, gives the UUIDs and
+// metadata of the paths that do not carry their own.
+//
+// The data is then POSTed in chunks of lines to /api/import/<ID>, each with
+// the offset of its first line. Chunks are checked like incoming messages
+// (see validate.go) and refused as a whole if any line is wrong, and each
+// chunk's readings are sorted and written in batches of COALESCE_MAX, without
+// going through the Coalescer, republishing, rules, virtual streams or the
+// last value cache. Chunks are refused while the timeseries database cannot
+// be reached, and a chunk whose writes ended up in the write backlog is not
+// counted, so that it is sent again. How many lines have been written is
+// kept in MongoDB after every chunk, so an import can be resumed from there
+// after a disconnect or a restart of either end. A chunk that was written
+// but not recorded is written again when it is resent.
+//
+// Resuming is best effort: ReadingDB and Quasar do not acknowledge writes,
+// so the readings of a chunk that was sent as the timeseries database went
+// down can be lost although the chunk was counted. Check the streams with a
+// data query after such an outage, and import what is missing again.
+//
+// Imported readings are not forwarded by replication. The rollups of the
+// windows they fall in are deleted and computed again (see rewindRollups).
+// In a cluster, streams must be imported on the node that owns them.
+type Import struct {
+	ID     string
+	Format string
+	// csv only
+	Columns   []string `json:",omitempty"`
+	Delimiter string   `json:",omitempty"`
+	// of integer timestamps
+	UnitofTime string `json:",omitempty"`
+	TimeFormat string `json:",omitempty"`
+	Timezone   string `json:",omitempty"`
+	// by column name for csv, and by path for json
+	Streams map[string]*ImportStream `json:",omitempty"`
+	// progress: how many lines (csv records) and readings have been written
+	Lines    uint64
+	Readings uint64
+	Began    time.Time
+	Updated  time.Time
+}
+
+// Returned by ImportChunk when a chunk is refused because of what is in it
+type ImportError struct {
+	Problems []string
+}
+
+func (e *ImportError) Error() string {
+	return "Chunk refused: " + strings.Join(e.Problems, "; ")
+}
+
+// An import as it is kept in MongoDB
+type importRecord struct {
+	ID  string `bson:"id"`
+	Key string `bson:"key"`
+	// the Import as JSON, as column names and paths are not always valid
+	// MongoDB keys
+	Spec     string    `bson:"spec"`
+	Lines    uint64    `bson:"lines"`
+	Readings uint64    `bson:"readings"`
+	Began    time.Time `bson:"began"`
+	Updated  time.Time `bson:"updated"`
+}
+
+func (rec *importRecord) toImport() (*Import, error) {
+	var imp Import
+	if err := json.Unmarshal([]byte(rec.Spec), &imp); err != nil {
+		return nil, err
+	}
+	imp.ID, imp.Lines, imp.Readings, imp.Began, imp.Updated = rec.ID, rec.Lines, rec.Readings, rec.Began, rec.Updated
+	return &imp, nil
+}
+
+// Chunks of the same import are taken one at a time
+type importLocks struct {
+	sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+func newImportLocks() *importLocks {
+	return &importLocks{locks: make(map[string]*sync.Mutex)}
+}
+
+func (il *importLocks) get(id string) *sync.Mutex {
+	il.Lock()
+	defer il.Unlock()
+	lock, found := il.locks[id]
+	if !found {
+		lock = &sync.Mutex{}
+		il.locks[id] = lock
+	}
+	return lock
+}
+
+// Starts an import (see Import) and returns it with its ID. The metadata of
+// its streams is saved, which the API key must be allowed to write
+func (a *Archiver) StartImport(imp Import, apikey string) (*Import, error) {
+	if err := a.checkManagementKey(apikey); err != nil {
+		return nil, err
+	}
+	if _, err := newImportParser(&imp, a.validator, nil); err != nil {
+		return nil, err
+	}
+	streams := make(map[string]*SmapMessage, len(imp.Streams))
+	now := time.Now()
+	for name, stream := range imp.Streams {
+		if stream.Path == "" && imp.Format == IMPORT_JSON {
+			stream.Path = name
+		}
+		if stream.UUID == "" {
+			return nil, fmt.Errorf("Stream %v has no uuid", name)
+		}
+		msg := &SmapMessage{Path: stream.Path, UUID: stream.UUID, Metadata: stream.Metadata, Properties: stream.Properties}
+		props := a.store.streamProperties(stream.UUID).update(stream.Properties)
+		if problems := a.validator.check(stream.Path, msg, props, now); len(problems) > 0 {
+			return nil, fmt.Errorf("Stream %v: %v", name, strings.Join(problems, "; "))
+		}
+		if props.readingType != READINGTYPE_DOUBLE {
+			return nil, fmt.Errorf("Stream %v: only double streams can be imported", name)
+		}
+		if a.cluster != nil && a.cluster.Owner(stream.UUID) != a.cluster.self {
+			return nil, fmt.Errorf("Stream %v belongs to node %v, which should import it", name, a.cluster.Owner(stream.UUID))
+		}
+		streams[stream.Path] = msg
+	}
+	if a.enforceKeys {
+		if ok, err := a.store.CheckKey(apikey, streams); err != nil {
+			return nil, err
+		} else if !ok {
+			return nil, ErrImportForbidden
+		}
+	}
+	if a.store.SaveMetadata(streams) {
+		a.republisher.MetadataChanged()
+	}
+
+	imp.ID = uuidlib.New()
+	imp.Lines, imp.Readings = 0, 0
+	imp.Began, imp.Updated = now, now
+	spec, err := json.Marshal(imp)
+	if err != nil {
+		return nil, err
+	}
+	rec := &importRecord{ID: imp.ID, Key: apikey, Spec: string(spec), Began: now, Updated: now}
+	if err := a.store.saveImport(rec); err != nil {
+		return nil, err
+	}
+	log.Notice("Started %v import %v of %v streams", imp.Format, imp.ID, len(imp.Streams))
+	return &imp, nil
+}
+
+// Returns the import with the given ID, which must have been started with
+// the same API key
+func (a *Archiver) ImportStatus(id, apikey string) (*Import, error) {
+	rec, err := a.store.getImport(id)
+	if err != nil {
+		return nil, err
+	}
+	if a.enforceKeys && rec.Key != apikey {
+		return nil, ErrImportForbidden
+	}
+	return rec.toImport()
+}
+
+// Writes the lines of body, the first of which is line number offset
+// (counting from 0) of the import, and returns how far the import has got.
+// Lines before the end of the import so far are skipped, so a chunk can be
+// sent again; a chunk that starts after the end gives ErrImportGap
+func (a *Archiver) ImportChunk(id string, offset uint64, body io.Reader, apikey string) (*Import, error) {
+	lock := a.imports.get(id)
+	lock.Lock()
+	defer lock.Unlock()
+	imp, err := a.ImportStatus(id, apikey)
+	if err != nil {
+		return nil, err
+	}
+	if offset > imp.Lines {
+		return imp, ErrImportGap
+	}
+	if size, _ := a.tsdb.Backlog(); size > 0 {
+		return imp, ErrImportHeld
+	}
+	parser, err := newImportParser(imp, a.validator, a.store.streamProperties)
+	if err != nil {
+		return imp, err
+	}
+	chunk, err := parser.parse(body, offset, imp.Lines-offset)
+	if err != nil {
+		return imp, err
+	}
+	if len(chunk.problems) > 0 {
+		return imp, &ImportError{Problems: chunk.problems}
+	}
+	if a.cluster != nil {
+		for uuid := range chunk.readings {
+			if owner := a.cluster.Owner(uuid); owner != a.cluster.self {
+				return imp, fmt.Errorf("Stream %v belongs to node %v, which should import it", uuid, owner)
+			}
+		}
+	}
+	if len(chunk.metadata) > 0 {
+		if a.enforceKeys {
+			if ok, err := a.store.CheckKey(apikey, chunk.metadata); err != nil {
+				return imp, err
+			} else if !ok {
+				return imp, ErrImportForbidden
+			}
+		}
+		if a.store.SaveMetadata(chunk.metadata) {
+			a.republisher.MetadataChanged()
+		}
+	}
+
+	written, err := writeImported(a.tsdb, chunk.readings)
+	if written > 0 {
+		readingsReceived.Add(float64(written), "import", a.store.keyName(apikey))
+	}
+	// have the windows of the readings rolled up again, also after a
+	// partial write, as the chunk is sent again
+	for uuid, rdgs := range chunk.readings {
+		if len(rdgs) == 0 {
+			continue
+		}
+		since := convertTime(rdgs[0][0].(uint64), UOT_STORAGE, UOT_MS)
+		if rerr := rewindRollups(a.store, a.tsdb, uuid, since, time.Now()); rerr != nil {
+			log.Error("Could not move back the rollups of %v for import %v: %v", uuid, id, rerr)
+			errorCount.Inc("import")
+			if err == nil {
+				err = rerr
+			}
+		}
+	}
+	if err != nil {
+		errorCount.Inc("import")
+		return imp, err
+	}
+	// the writes may only be held until the TSDB can be reached again,
+	// in which case the chunk is sent again rather than counted
+	if size, _ := a.tsdb.Backlog(); size > 0 {
+		return imp, ErrImportHeld
+	}
+	if end := offset + chunk.lines; end > imp.Lines {
+		imp.Lines = end
+	}
+	imp.Readings += uint64(written)
+	imp.Updated = time.Now()
+	if err := a.store.updateImport(id, imp.Lines, imp.Readings, imp.Updated); err != nil {
+		errorCount.Inc("import")
+		return imp, err
+	}
+	return imp, nil
+}
+
+// Sorts the readings of each stream, which are in UOT_STORAGE, and writes
+// them in batches of at most COALESCE_MAX. Returns how many were written
+func writeImported(tsdb TSDB, readings map[string][][]interface{}) (int, error) {
+	written := 0
+	for uuid, rdgs := range readings {
+		sort.Stable(readingsByTime(rdgs))
+		for i := 0; i < len(rdgs); i += COALESCE_MAX {
+			batch := rdgs[i:]
+			if len(batch) > COALESCE_MAX {
+				batch = batch[:COALESCE_MAX]
+			}
+			if !tsdb.Add(&StreamBuf{uuid: uuid, readings: batch}) {
+				return written, fmt.Errorf("Could not write the readings of %v", uuid)
+			}
+			written += len(batch)
+		}
+	}
+	return written, nil
+}
+
+// Reads the chunks of an import
+type importParser struct {
+	imp       *Import
+	validator *validator
+	// csv: the UUID of each column, "" for those that are skipped
+	columns []string
+	delim   rune
+	uot     UnitOfTime
+	loc     *time.Location
+	// json: looks up the stored properties of a stream
+	properties func(uuid string) streamProps
+}
+
+// Checks the description of an import and returns a parser for its chunks
+func newImportParser(imp *Import, v *validator, properties func(string) streamProps) (*importParser, error) {
+	p := &importParser{imp: imp, validator: v, delim: ',', uot: UOT_MS, loc: time.Local, properties: properties}
+	var err error
+	if imp.UnitofTime != "" {
+		if p.uot, err = parseUnitOfTime(imp.UnitofTime); err != nil {
+			return nil, err
+		}
+	}
+	if imp.Timezone != "" {
+		if p.loc, err = time.LoadLocation(imp.Timezone); err != nil {
+			return nil, err
+		}
+	}
+	switch imp.Format {
+	case IMPORT_CSV:
+		if imp.Delimiter != "" {
+			if len([]rune(imp.Delimiter)) != 1 {
+				return nil, errors.New("Delimiter should be one character, not " + imp.Delimiter)
+			}
+			p.delim = []rune(imp.Delimiter)[0]
+		}
+		if len(imp.Columns) < 2 {
+			return nil, errors.New("A csv import needs the names of its columns, starting with the timestamp column")
+		}
+		p.columns = make([]string, len(imp.Columns))
+		mapped := 0
+		for i, name := range imp.Columns[1:] {
+			if stream, found := imp.Streams[name]; found && stream != nil {
+				p.columns[i+1] = stream.UUID
+				mapped++
+			}
+		}
+		if mapped == 0 {
+			return nil, errors.New("None of the columns has a stream in Streams")
+		}
+	case IMPORT_JSON:
+	default:
+		return nil, fmt.Errorf("Format should be %v or %v, not %v", IMPORT_CSV, IMPORT_JSON, imp.Format)
+	}
+	for name, stream := range imp.Streams {
+		if stream == nil {
+			return nil, fmt.Errorf("Stream %v is empty", name)
+		}
+	}
+	return p, nil
+}
+
+// What was read from a chunk
+type importedChunk struct {
+	// how many lines the chunk has, including those that were skipped
+	lines uint64
+	// in UOT_STORAGE, by UUID
+	readings map[string][][]interface{}
+	// json: the streams the chunk has readings or metadata for, by path
+	metadata map[string]*SmapMessage
+	problems []string
+}
+
+func (c *importedChunk) problem(line uint64, format string, args ...interface{}) {
+	if len(c.problems) < maxImportProblems {
+		c.problems = append(c.problems, fmt.Sprintf("line %v: ", line)+fmt.Sprintf(format, args...))
+	}
+}
+
+func (c *importedChunk) add(uuid string, ts uint64, value float64) {
+	c.readings[uuid] = append(c.readings[uuid], []interface{}{ts, value})
+}
+
+// Reads a chunk whose first line is line number offset of the import,
+// skipping its first skip lines
+func (p *importParser) parse(body io.Reader, offset, skip uint64) (*importedChunk, error) {
+	chunk := &importedChunk{readings: make(map[string][][]interface{}), metadata: make(map[string]*SmapMessage)}
+	earliest, latest := p.validator.bounds(UOT_STORAGE, time.Now())
+	if p.imp.Format == IMPORT_CSV {
+		reader := csv.NewReader(body)
+		reader.Comma = p.delim
+		reader.FieldsPerRecord = -1
+		for ; ; chunk.lines++ {
+			record, err := reader.Read()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				chunk.problem(offset+chunk.lines, "%v", err)
+				break
+			}
+			if chunk.lines >= skip {
+				p.csvRecord(chunk, offset+chunk.lines, record, earliest, latest)
+			}
+		}
+		return chunk, nil
+	}
+	reader := bufio.NewReader(body)
+	for ; ; chunk.lines++ {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF && line == "" {
+			break
+		} else if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if chunk.lines >= skip && strings.TrimSpace(line) != "" {
+			p.jsonLine(chunk, offset+chunk.lines, line, earliest, latest)
+		}
+		if err == io.EOF {
+			chunk.lines++
+			break
+		}
+	}
+	return chunk, nil
+}
+
+func (p *importParser) csvRecord(chunk *importedChunk, lineno uint64, record []string, earliest, latest uint64) {
+	if len(record) != len(p.columns) {
+		chunk.problem(lineno, "has %v columns instead of %v", len(record), len(p.columns))
+		return
+	}
+	field := strings.TrimSpace(record[0])
+	var ts uint64
+	if p.imp.TimeFormat != "" {
+		t, err := time.ParseInLocation(p.imp.TimeFormat, field, p.loc)
+		if err != nil {
+			chunk.problem(lineno, "timestamp %q does not match the TimeFormat", field)
+			return
+		}
+		ts = timeToUnit(t, UOT_STORAGE)
+	} else {
+		t, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			chunk.problem(lineno, "timestamp %q is not a non-negative integer", field)
+			return
+		}
+		ts = convertTime(t, p.uot, UOT_STORAGE)
+	}
+	if ts < earliest || ts > latest {
+		chunk.problem(lineno, "timestamp %q is out of range", field)
+		return
+	}
+	for i, uuid := range p.columns {
+		if i == 0 || uuid == "" {
+			continue
+		}
+		field := strings.TrimSpace(record[i])
+		if field == "" {
+			continue
+		}
+		value, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			chunk.problem(lineno, "%v value %q is not a number", p.imp.Columns[i], field)
+			continue
+		}
+		if p.keep(chunk, lineno, value) {
+			chunk.add(uuid, ts, value)
+		}
+	}
+}
+
+func (p *importParser) jsonLine(chunk *importedChunk, lineno uint64, line string, earliest, latest uint64) {
+	messages, invalid, err := handleJSON(strings.NewReader(line))
+	if err != nil {
+		chunk.problem(lineno, "%v", err)
+		return
+	}
+	for path, problems := range invalid {
+		chunk.problem(lineno, "%v: %v", path, strings.Join(problems, "; "))
+	}
+	for path, msg := range messages {
+		if stream := p.imp.Streams[path]; stream != nil {
+			if msg.UUID == "" {
+				msg.UUID = stream.UUID
+			}
+			msg.Metadata = overlayDocument(stream.Metadata, msg.Metadata)
+			msg.Properties = overlayDocument(stream.Properties, msg.Properties)
+		}
+		if msg.UUID == "" {
+			if len(msg.Readings) > 0 {
+				chunk.problem(lineno, "%v has readings but no uuid", path)
+			}
+			continue
+		}
+		props := streamProps{uot: UOT_MS, readingType: READINGTYPE_DOUBLE}
+		if p.properties != nil {
+			props = p.properties(msg.UUID)
+		}
+		props = props.update(msg.Properties)
+		withoutReadings := &SmapMessage{Path: path, UUID: msg.UUID, Metadata: msg.Metadata, Properties: msg.Properties, Actuator: msg.Actuator}
+		if problems := p.validator.check(path, withoutReadings, props, time.Now()); len(problems) > 0 {
+			chunk.problem(lineno, "%v: %v", path, strings.Join(problems, "; "))
+			continue
+		}
+		if props.readingType != READINGTYPE_DOUBLE {
+			chunk.problem(lineno, "%v: only double streams can be imported", path)
+			continue
+		}
+		if prev, found := chunk.metadata[path]; found {
+			prev.Metadata = mergeDocument(prev.Metadata, withoutReadings.Metadata)
+			prev.Properties = mergeDocument(prev.Properties, withoutReadings.Properties)
+			prev.Actuator = mergeDocument(prev.Actuator, withoutReadings.Actuator)
+		} else {
+			chunk.metadata[path] = withoutReadings
+		}
+		for i, rdg := range msg.Readings {
+			ts, ok := readingTime(rdg[0])
+			if !ok {
+				chunk.problem(lineno, "%v reading %v: timestamp %v is not a number", path, i, rdg[0])
+				continue
+			}
+			if ts = convertTime(ts, props.uot, UOT_STORAGE); ts < earliest || ts > latest {
+				chunk.problem(lineno, "%v reading %v: timestamp %v is out of range", path, i, rdg[0])
+				continue
+			}
+			value, ok := readingValue(rdg[1])
+			if !ok {
+				chunk.problem(lineno, "%v reading %v: value %v is not a number", path, i, rdg[1])
+				continue
+			}
+			if p.keep(chunk, lineno, value) {
+				chunk.add(msg.UUID, ts, value)
+			}
+		}
+	}
+}
+
+// Returns a new document with the keys of base, overridden by those of over
+func overlayDocument(base, over bson.M) bson.M {
+	if base == nil {
+		return over
+	}
+	doc := make(bson.M, len(base)+len(over))
+	for k, v := range base {
+		doc[k] = v
+	}
+	for k, v := range over {
+		doc[k] = v
+	}
+	return doc
+}
+
+// Applies the NonFinite policy to a value
+func (p *importParser) keep(chunk *importedChunk, lineno uint64, value float64) bool {
+	if !math.IsNaN(value) && !math.IsInf(value, 0) {
+		return true
+	}
+	switch p.validator.nonFinite {
+	case NONFINITE_REJECT:
+		chunk.problem(lineno, "value %v is not finite", value)
+		return false
+	case NONFINITE_DROP:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,107 @@
+package archiver
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestImportCSV(t *testing.T) {
+	v, _ := newValidator(&Config{})
+	imp := &Import{Format: IMPORT_CSV, Columns: []string{"time", "SAT", "notes", "RAT"}, UnitofTime: "s",
+		Streams: map[string]*ImportStream{"SAT": {UUID: "sat"}, "RAT": {UUID: "rat"}}}
+	p, err := newImportParser(imp, v, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := "1429000002,55.5,x,70\n1429000001,55,y,\n1429000003,56,z,71\n"
+	chunk, err := p.parse(strings.NewReader(body), 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chunk.lines != 3 || len(chunk.problems) != 0 {
+		t.Fatal("Should read 3 lines without problems, not", chunk.lines, chunk.problems)
+	}
+	// the first line was already imported
+	sat := chunk.readings["sat"]
+	if len(sat) != 2 || sat[0][0] != convertTime(1429000001, UOT_S, UOT_STORAGE) || sat[0][1] != float64(55) {
+		t.Error("Wrong readings for SAT", sat)
+	}
+	if rat := chunk.readings["rat"]; len(rat) != 1 {
+		t.Error("Empty cells should be skipped, but RAT has", rat)
+	}
+	if len(chunk.readings) != 2 {
+		t.Error("Columns without a stream should be skipped, but got", chunk.readings)
+	}
+
+	chunk, _ = p.parse(strings.NewReader("1429000001,abc,x,1\n1429,1,x,1\n1429000001,1\n1429000001,NaN,x,1\n"), 20, 0)
+	if len(chunk.problems) != 4 || !strings.HasPrefix(chunk.problems[0], "line 20:") || !strings.HasPrefix(chunk.problems[3], "line 23:") {
+		t.Error("Every bad line should be reported with its number, not", chunk.problems)
+	}
+
+	if _, err := newImportParser(&Import{Format: IMPORT_CSV, Columns: []string{"time", "x"}}, v, nil); err == nil {
+		t.Error("An import should have to write to at least one stream")
+	}
+	if _, err := newImportParser(&Import{Format: "xml"}, v, nil); err == nil {
+		t.Error("Unknown formats should be refused")
+	}
+}
+
+func TestImportJSON(t *testing.T) {
+	v, _ := newValidator(&Config{})
+	v.nonFinite = NONFINITE_DROP
+	uuid := "b86df176-6b40-5d58-8f29-3b85f5cfbf1e"
+	imp := &Import{Format: IMPORT_JSON, Streams: map[string]*ImportStream{"/a": {Path: "/a", UUID: uuid, Metadata: map[string]interface{}{"Site": "x"}}}}
+	p, err := newImportParser(imp, v, func(string) streamProps { return streamProps{uot: UOT_MS, readingType: READINGTYPE_DOUBLE} })
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := `{"/a": {"Readings": [[1429000000000, 1], [1429000000001, 2]]}}
+
+{"/a": {"Readings": [[1429000000002, 3]], "Metadata": {"Floor": "2"}}}
+{"/b": {"Readings": [[1429000000002, 3]]}}`
+	chunk, err := p.parse(strings.NewReader(body), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chunk.lines != 4 {
+		t.Error("Blank lines should be counted, but got", chunk.lines)
+	}
+	if len(chunk.problems) != 1 || !strings.HasPrefix(chunk.problems[0], "line 3:") {
+		t.Error("A path without a uuid should be reported, not", chunk.problems)
+	}
+	if len(chunk.readings[uuid]) != 3 {
+		t.Error("Readings should go to the stream's uuid, not", chunk.readings)
+	}
+	if md := chunk.metadata["/a"]; md == nil || md.Metadata["Site"] != "x" || md.Metadata["Floor"] != "2" {
+		t.Error("Metadata should be merged with that of the stream, not", md)
+	}
+	if imp.Streams["/a"].Metadata["Floor"] != nil {
+		t.Error("The stream's own metadata should not change")
+	}
+	if !p.keep(chunk, 0, 1) || p.keep(chunk, 0, math.Inf(1)) {
+		t.Error("Only infinite values should be dropped")
+	}
+}
+
+func TestWriteImported(t *testing.T) {
+	mem := newMemTSDB()
+	readings := map[string][][]interface{}{"a": nil}
+	for i := COALESCE_MAX + 10; i > 0; i-- {
+		readings["a"] = append(readings["a"], []interface{}{uint64(i), float64(i)})
+	}
+	written, err := writeImported(mem, readings)
+	if err != nil || written != COALESCE_MAX+10 {
+		t.Fatal("Should write every reading, not", written, err)
+	}
+	stored := mem.readings["a"]
+	for i := 1; i < len(stored); i++ {
+		if stored[i][0] < stored[i-1][0] {
+			t.Fatal("Readings should be written in order of time")
+		}
+	}
+	mem.down = true
+	if _, err := writeImported(mem, readings); err == nil {
+		t.Error("A failed write should give an error")
+	}
+}
@@ -5,6 +5,7 @@ package archiver
 
 import (
 	"net"
+	"time"
 )
 
 // TSDB (or TimeSeries DataBase) is a subset of functionality expected by Giles
@@ -12,7 +13,8 @@ import (
 // SmapReading and SmapResponse and can be found in json.go and readingdb.go
 // respectively (although their locations are likely to change).
 // The UnitOfTime parameters indicate how to interpret the timesteps that are
-// given as parameters
+// given as parameters, and are also the unit of time of the timestamps that
+// are returned. Readings passed to Add are already in UOT_STORAGE
 type TSDB interface {
 	// add the following SmapReading to the timeseries database
 	Add(*StreamBuf) bool
@@ -23,10 +25,18 @@ type TSDB interface {
 	Next([]string, uint64, int32, UnitOfTime) ([]SmapResponse, error)
 	// uuids, start time, end time, unit of time
 	GetData([]string, uint64, uint64, UnitOfTime) ([]SmapResponse, error)
+	// uuids, start time, end time, unit of time
+	// delete data between (and including) start and end
+	Delete([]string, uint64, uint64, UnitOfTime) error
 	// get a new connection to the timeseries database
 	GetConnection() (net.Conn, error)
 	// return the number of live connections
 	LiveConnections() int
+	// return the number of bytes of writes held while the database cannot be
+	// reached, and whether that backlog is full
+	Backlog() (int, bool)
+	// check that the database answers a cheap query within the timeout
+	Ping(time.Duration) error
 	// Adds a pointer to metadata store for streamid/uuid conversion and the like
 	AddStore(*Store)
 }
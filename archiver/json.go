@@ -2,6 +2,7 @@ package archiver
 
 import (
 	"encoding/json"
+	"errors"
 	simplejson "github.com/bitly/go-simplejson"
 	"gopkg.in/mgo.v2/bson"
 	"io"
@@ -20,31 +21,44 @@ import (
 This should not do any fancy sMAP-related work; that's a job for the store. Here we just return the
 object-versions of all the data.
 */
-func handleJSON(r io.Reader) (map[string]*SmapMessage, error) {
+func handleJSON(r io.Reader) (map[string]*SmapMessage, ValidationErrors, error) {
 	/*
 	 * we receive a bunch of top-level keys that we don't know, so we unmarshal them into a
-	 * map, and then parse each of the internal objects individually
+	 * map, and then parse each of the internal objects individually. A path whose object
+	 * cannot be parsed is left out and its problems returned, so that the others can still
+	 * be taken
 	 */
 
 	decoder := json.NewDecoder(r)
 	decoder.UseNumber()
-	var e error
 	var rawmessage map[string]*json.RawMessage
 	var decodedjson = map[string]*SmapMessage{}
+	var invalid = ValidationErrors{}
 	err := decoder.Decode(&rawmessage)
 	if err != nil {
-		return decodedjson, err
+		return decodedjson, invalid, err
 	}
 
 	for path, reading := range rawmessage {
-
+		if reading == nil {
+			invalid.Add(path, "not a sMAP object")
+			continue
+		}
 		js, err := simplejson.NewJson([]byte(*reading))
 		if err != nil {
-			e = err
+			invalid.Add(path, "not a sMAP object: %v", err)
+			continue
+		}
+		if _, err := js.Map(); err != nil {
+			invalid.Add(path, "not a sMAP object")
+			continue
 		}
 
 		// get uuid
 		uuid := js.Get("uuid").MustString("")
+		if raw, found := js.CheckGet("uuid"); found && uuid == "" {
+			invalid.Add(path, "uuid %v is not a string", raw.Interface())
+		}
 
 		message := &SmapMessage{Path: path, UUID: uuid, Contents: []string{}}
 
@@ -56,9 +70,11 @@ func handleJSON(r io.Reader) (map[string]*SmapMessage, error) {
 
 		// get contents
 		contents := js.Get("Contents").MustArray()
-		if len(contents) > 0 {
-			for _, arg := range contents {
-				message.Contents = append(message.Contents, arg.(string))
+		for _, arg := range contents {
+			if resource, ok := arg.(string); ok {
+				message.Contents = append(message.Contents, resource)
+			} else {
+				invalid.Add(path, "Contents entry %v is not a string", arg)
 			}
 		}
 
@@ -70,18 +86,30 @@ func handleJSON(r io.Reader) (map[string]*SmapMessage, error) {
 
 		// get readings
 		readingarray := js.Get("Readings").MustArray()
-		srs := make([][]interface{}, len(readingarray))
+		srs := make([][]interface{}, 0, len(readingarray))
 		for idx, readings := range readingarray {
-			reading := readings.([]interface{})
-			ts, e := strconv.ParseUint(string(reading[0].(json.Number)), 10, 64)
+			reading, ok := readings.([]interface{})
+			if !ok || len(reading) != 2 {
+				invalid.Add(path, "reading %v is not a [time, value] pair", idx)
+				continue
+			}
+			ts_num, ok := reading[0].(json.Number)
+			if !ok {
+				invalid.Add(path, "reading %v: timestamp %v is not a number", idx, reading[0])
+				continue
+			}
+			ts, e := strconv.ParseUint(string(ts_num), 10, 64)
 			if e != nil {
-				return decodedjson, e
+				invalid.Add(path, "reading %v: timestamp %v is not a non-negative integer", idx, ts_num)
+				continue
 			}
-			val, e := strconv.ParseFloat(string(reading[1].(json.Number)), 64)
+			readingtype, _ := message.Properties["ReadingType"].(string)
+			val, e := ParseReadingValue(reading[1], readingtype)
 			if e != nil {
-				return decodedjson, e
+				invalid.Add(path, "reading %v: %v", idx, e)
+				continue
 			}
-			srs[idx] = []interface{}{ts, val}
+			srs = append(srs, []interface{}{ts, val})
 		}
 		message.Readings = srs
 
@@ -90,8 +118,61 @@ func handleJSON(r io.Reader) (map[string]*SmapMessage, error) {
 		if actuator != nil {
 			message.Actuator = bson.M(actuator)
 		}
-		decodedjson[path] = message
+		if len(invalid[path]) == 0 {
+			decodedjson[path] = message
+		}
+	}
+	return decodedjson, invalid, nil
+}
+
+// Parses the value of a reading decoded with UseNumber. readingType is the
+// Properties/ReadingType sent along with the reading, if any. Integers are
+// kept as int64, so that long readings keep their exact value, unless the
+// stream is a double stream; other numbers are float64. Strings, booleans,
+// JSON objects and arrays are kept for string and object streams (with any
+// numbers inside them made int64 or float64). Which values a stream actually
+// accepts is decided when its readings are stored.
+func ParseReadingValue(value interface{}, readingType string) (interface{}, error) {
+	switch v := value.(type) {
+	case json.Number:
+		if readingType != READINGTYPE_DOUBLE {
+			if i, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+				return i, nil
+			} else if readingType == READINGTYPE_LONG {
+				return nil, errors.New("Value of a long stream is not an integer: " + string(v))
+			}
+		}
+		f, err := strconv.ParseFloat(string(v), 64)
+		if ne, ok := err.(*strconv.NumError); ok && ne.Err == strconv.ErrRange {
+			// too large for a float64 is infinite, which is up to the
+			// archiver's NonFinite policy
+			return f, nil
+		}
+		return f, err
+	case nil:
+		return nil, errors.New("Reading has no value")
+	}
+	return plainJSON(value), nil
+}
 
+// Replaces the json.Numbers in a value decoded with UseNumber with int64 or
+// float64 values
+func plainJSON(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for key, elem := range v {
+			v[key] = plainJSON(elem)
+		}
+	case []interface{}:
+		for i, elem := range v {
+			v[i] = plainJSON(elem)
+		}
 	}
-	return decodedjson, e
+	return value
 }
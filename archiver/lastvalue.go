@@ -0,0 +1,167 @@
+package archiver
+
+import (
+	"gopkg.in/mgo.v2/bson"
+	"sync"
+	"time"
+)
+
+// how many streams we ask the TSDB about at once when warming the cache
+const lastValueWarmBatch = 100
+
+type lastValue struct {
+	timestamp uint64
+	value     float64
+	// true if this value was loaded from the TSDB on startup rather than
+	// received through AddData
+	warmed bool
+}
+
+// The LastValueCache keeps the most recent reading for every stream that
+// passes through Archiver.AddData, so that "latest value" queries (e.g.
+// select data before now where ...) can be answered without a round trip
+// to the timeseries database for each UUID. On startup, it is warmed in the
+// background with the last reading of every known stream. Timestamps are
+// kept in UOT_STORAGE.
+type LastValueCache struct {
+	sync.RWMutex
+	values map[string]*lastValue
+}
+
+func NewLastValueCache() *LastValueCache {
+	return &LastValueCache{values: make(map[string]*lastValue, 1000)}
+}
+
+// Records the newest reading contained in msg. Live readings always replace
+// values loaded from the TSDB; otherwise the reading with the greatest
+// timestamp wins.
+func (lvc *LastValueCache) Update(msg *SmapMessage) {
+	if msg.UUID == "" || len(msg.Readings) == 0 {
+		return
+	}
+	var newest *lastValue
+	for _, rdg := range msg.Readings {
+		if len(rdg) < 2 {
+			continue
+		}
+		ts, ok := readingTime(rdg[0])
+		if !ok {
+			continue
+		}
+		val, ok := readingValue(rdg[1])
+		if !ok {
+			continue
+		}
+		if newest == nil || ts >= newest.timestamp {
+			newest = &lastValue{timestamp: ts, value: val}
+		}
+	}
+	if newest == nil {
+		return
+	}
+	lvc.Lock()
+	if current, found := lvc.values[msg.UUID]; !found || current.warmed || newest.timestamp >= current.timestamp {
+		lvc.values[msg.UUID] = newest
+	}
+	lvc.Unlock()
+}
+
+// Forgets the last value of the stream with the given UUID if it is older
+// than before (in UOT_STORAGE), e.g. once it has been expired
+func (lvc *LastValueCache) evict(uuid string, before uint64) {
+	lvc.Lock()
+	defer lvc.Unlock()
+	if lv, found := lvc.values[uuid]; found && lv.timestamp < before {
+		delete(lvc.values, uuid)
+	}
+}
+
+// Returns the last known [timestamp, value] for the stream with the given UUID
+func (lvc *LastValueCache) Get(uuid string) ([]float64, bool) {
+	lvc.RLock()
+	defer lvc.RUnlock()
+	if lv, found := lvc.values[uuid]; found {
+		return []float64{float64(lv.timestamp), lv.value}, true
+	}
+	return nil, false
+}
+
+// Splits the given UUIDs into responses served from the cache and the UUIDs
+// we have nothing cached for. Timestamps of the responses are in UOT_STORAGE
+func (lvc *LastValueCache) lookup(uuids []string) (map[string]SmapResponse, []string) {
+	hits := make(map[string]SmapResponse, len(uuids))
+	misses := []string{}
+	for _, uuid := range uuids {
+		if rdg, found := lvc.Get(uuid); found {
+			hits[uuid] = SmapResponse{UUID: uuid, Readings: [][]float64{rdg}}
+		} else {
+			misses = append(misses, uuid)
+		}
+	}
+	return hits, misses
+}
+
+// Loads the last reading of every stream in the metadata store from the
+// TSDB. Values that arrive through AddData while we are warming take
+// precedence over what we load.
+func (lvc *LastValueCache) warm(tsdb TSDB, store *Store) {
+	uuids, err := store.GetUUIDs(bson.M{})
+	if err != nil {
+		log.Error("Could not warm last value cache: %v", err)
+		return
+	}
+	log.Notice("Warming last value cache with %v streams", len(uuids))
+	now := timeToUnit(time.Now(), UOT_STORAGE)
+	loaded := 0
+	for i := 0; i < len(uuids); i += lastValueWarmBatch {
+		end := i + lastValueWarmBatch
+		if end > len(uuids) {
+			end = len(uuids)
+		}
+		responses, err := tsdb.Prev(uuids[i:end], now, 1, UOT_STORAGE)
+		if err != nil {
+			log.Error("Error warming last value cache: %v", err)
+			continue
+		}
+		lvc.Lock()
+		for _, resp := range responses {
+			if len(resp.Readings) == 0 || len(resp.Readings[0]) < 2 {
+				continue
+			}
+			if _, found := lvc.values[resp.UUID]; found {
+				continue
+			}
+			rdg := resp.Readings[len(resp.Readings)-1]
+			lvc.values[resp.UUID] = &lastValue{timestamp: uint64(rdg[0]), value: rdg[1], warmed: true}
+			loaded++
+		}
+		lvc.Unlock()
+	}
+	log.Notice("Loaded %v values into the last value cache", loaded)
+}
+
+// returns the timestamp of a reading as a uint64
+func readingTime(ts interface{}) (uint64, bool) {
+	switch t := ts.(type) {
+	case uint64:
+		return t, true
+	case int64:
+		return uint64(t), true
+	case float64:
+		return uint64(t), true
+	}
+	return 0, false
+}
+
+// returns the value of a reading as a float64
+func readingValue(val interface{}) (float64, bool) {
+	switch v := val.(type) {
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	}
+	return 0, false
+}
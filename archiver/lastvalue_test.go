@@ -0,0 +1,51 @@
+package archiver
+
+import (
+	"testing"
+)
+
+func TestLastValueCacheUpdate(t *testing.T) {
+	lvc := NewLastValueCache()
+	lvc.Update(&SmapMessage{UUID: "a", Readings: [][]interface{}{
+		[]interface{}{uint64(200), float64(2)},
+		[]interface{}{uint64(100), float64(1)},
+	}})
+	rdg, found := lvc.Get("a")
+	if !found {
+		t.Fatal("Should have a value for a")
+	}
+	if rdg[0] != 200 || rdg[1] != 2 {
+		t.Error("Last value should be [200 2] but is", rdg)
+	}
+
+	// older readings do not replace newer ones
+	lvc.Update(&SmapMessage{UUID: "a", Readings: [][]interface{}{[]interface{}{uint64(150), float64(3)}}})
+	rdg, _ = lvc.Get("a")
+	if rdg[0] != 200 {
+		t.Error("Older reading replaced newer one:", rdg)
+	}
+
+	// live readings always replace warmed values
+	lvc.values["b"] = &lastValue{timestamp: 1000, value: 1, warmed: true}
+	lvc.Update(&SmapMessage{UUID: "b", Readings: [][]interface{}{[]interface{}{uint64(10), int64(5)}}})
+	rdg, _ = lvc.Get("b")
+	if rdg[0] != 10 || rdg[1] != 5 {
+		t.Error("Live reading should replace warmed value but got", rdg)
+	}
+}
+
+func TestLastValueCacheLookup(t *testing.T) {
+	lvc := NewLastValueCache()
+	lvc.Update(&SmapMessage{UUID: "a", Readings: [][]interface{}{[]interface{}{uint64(1), float64(1)}}})
+	hits, misses := lvc.lookup([]string{"a", "b"})
+	if len(hits) != 1 || hits["a"].UUID != "a" {
+		t.Error("Should have a hit for a but got", hits)
+	}
+	if !isStringSliceEqual(misses, []string{"b"}) {
+		t.Error("Should miss b but missed", misses)
+	}
+	// hits are in UOT_STORAGE, like readings returned by the TSDB
+	if rdg := hits["a"].Readings[0]; rdg[0] != 1 {
+		t.Error("Timestamp of a hit should be as stored but is", rdg[0])
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"os"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type rdbStreamId struct {
@@ -24,11 +25,26 @@ type Store struct {
 	metadata     *mgo.Collection
 	pathmetadata *mgo.Collection
 	apikeys      *mgo.Collection
+	rules        *mgo.Collection
+	webhooks     *mgo.Collection
+	hookbatches  *mgo.Collection
+	deadletters  *mgo.Collection
+	virtual      *mgo.Collection
+	rollups      *mgo.Collection
+	objects      *mgo.Collection
+	journal      *mgo.Collection
+	replication  *mgo.Collection
+	imports      *mgo.Collection
 	apikeylock   sync.Mutex
 	maxsid       *uint32
 	streamlock   sync.Mutex
 	uuidcache    *Cache
 	apikcache    *Cache
+	// the owner name of each API key, used to label metrics
+	keynamecache *Cache
+	// storage properties of each stream we have seen readings for
+	propcache map[string]streamProps
+	proplock  sync.RWMutex
 }
 
 func NewStore(address *net.TCPAddr) *Store {
@@ -45,6 +61,16 @@ func NewStore(address *net.TCPAddr) *Store {
 	metadata := db.C("metadata")
 	pathmetadata := db.C("pathmetadata")
 	apikeys := db.C("apikeys")
+	rules := db.C("rules")
+	webhooks := db.C("webhooks")
+	webhookbatches := db.C("webhookbatches")
+	deadletters := db.C("deadletters")
+	virtual := db.C("virtualstreams")
+	rollups := db.C("rollups")
+	objects := db.C("objects")
+	journal := db.C("journal")
+	replication := db.C("replication")
+	imports := db.C("imports")
 	// create indexes
 	index := mgo.Index{
 		Key:        []string{"uuid"},
@@ -75,21 +101,85 @@ func NewStore(address *net.TCPAddr) *Store {
 		log.Fatal("Could not create index on apikeys")
 	}
 
+	index.Key = []string{"name"}
+	err = rules.EnsureIndex(index)
+	if err != nil {
+		log.Fatal("Could not create index on rules")
+	}
+
+	err = webhooks.EnsureIndex(index)
+	if err != nil {
+		log.Fatal("Could not create index on webhooks")
+	}
+
+	err = virtual.EnsureIndex(index)
+	if err != nil {
+		log.Fatal("Could not create index on virtualstreams")
+	}
+
+	index.Key = []string{"upstream"}
+	err = replication.EnsureIndex(index)
+	if err != nil {
+		log.Fatal("Could not create index on replication")
+	}
+
+	index.Key = []string{"seq"}
+	err = journal.EnsureIndex(index)
+	if err != nil {
+		log.Fatal("Could not create index on journal")
+	}
+
+	index.Key = []string{"id"}
+	err = imports.EnsureIndex(index)
+	if err != nil {
+		log.Fatal("Could not create index on imports")
+	}
+
+	index.Key = []string{"uuid", "tier"}
+	err = rollups.EnsureIndex(index)
+	if err != nil {
+		log.Fatal("Could not create index on rollups")
+	}
+	err = webhookbatches.EnsureIndexKey("webhook")
+	if err != nil {
+		log.Fatal("Could not create index on webhookbatches")
+	}
+	err = deadletters.EnsureIndexKey("webhook", "-time")
+	if err != nil {
+		log.Fatal("Could not create index on deadletters")
+	}
+	err = objects.EnsureIndexKey("uuid", "time")
+	if err != nil {
+		log.Fatal("Could not create index on objects")
+	}
+
 	maxstreamid := &rdbStreamId{}
 	streams.Find(bson.M{}).Sort("-streamid").One(&maxstreamid)
 	var maxsid uint32 = 1
 	if maxstreamid != nil {
 		maxsid = maxstreamid.StreamId + 1
 	}
-	return &Store{session: session, db: db, streams: streams, metadata: metadata, pathmetadata: pathmetadata, apikeys: apikeys, maxsid: &maxsid, uuidcache: NewCache(1000), apikcache: NewCache(1000)}
+	return &Store{session: session, db: db, streams: streams, metadata: metadata, pathmetadata: pathmetadata, apikeys: apikeys, rules: rules, webhooks: webhooks, hookbatches: webhookbatches, deadletters: deadletters, virtual: virtual, rollups: rollups, objects: objects, journal: journal, replication: replication, imports: imports, maxsid: &maxsid, uuidcache: NewCache(1000), apikcache: NewCache(1000), keynamecache: NewCache(1000), propcache: make(map[string]streamProps)}
+}
+
+// Checks that MongoDB answers within the given timeout
+func (s *Store) Ping(timeout time.Duration) error {
+	session := s.session.Copy()
+	defer session.Close()
+	session.SetSyncTimeout(timeout)
+	session.SetSocketTimeout(timeout)
+	return session.Ping()
 }
 
 func (s *Store) getStreamId(uuid string) uint32 {
 	s.streamlock.Lock()
 	defer s.streamlock.Unlock()
-	if v, found := s.uuidcache.Get(uuid); found {
+	v, found := s.uuidcache.Get(uuid)
+	observeCache("uuidcache", found)
+	if found {
 		return v.(uint32)
 	}
+	defer observeMongo("get_streamid", time.Now())
 	streamid := &rdbStreamId{}
 	err := s.streams.Find(bson.M{"uuid": uuid}).One(&streamid)
 	if err != nil {
@@ -186,14 +276,71 @@ func (s *Store) owner(key string) (map[string]interface{}, error) {
 	return res, nil
 }
 
+// Returns the name of the owner of the API key, "none" if there is no key
+// and "unknown" if it cannot be found
+func (s *Store) keyName(apikey string) string {
+	if apikey == "" {
+		return "none"
+	}
+	if name, found := s.keynamecache.Get(apikey); found {
+		return name.(string)
+	}
+	name := "unknown"
+	if owner, err := s.owner(apikey); err == nil {
+		if n, ok := owner["name"].(string); ok && n != "" {
+			name = n
+		}
+	}
+	s.keynamecache.Set(apikey, name)
+	return name
+}
+
+// Gives or takes away the permission of an API key to actuate streams
+func (s *Store) setActuation(apikey string, allowed bool) (string, error) {
+	err := s.apikeys.Update(bson.M{"key": apikey}, bson.M{"$set": bson.M{"actuate": allowed}})
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("Could not set actuation permission for %v (%v)", apikey, err))
+	}
+	if allowed {
+		return "Key may now actuate", nil
+	}
+	return "Key may no longer actuate", nil
+}
+
+// Returns true if the API key has the actuation permission
+func (s *Store) CanActuate(apikey string) (bool, error) {
+	count, err := s.apikeys.Find(bson.M{"key": apikey, "actuate": true}).Count()
+	return count > 0, err
+}
+
+// Returns the Path and Actuator metadata of the stream with the given UUID
+func (s *Store) GetActuator(uuid string) (string, bson.M, error) {
+	var res struct {
+		Path     string `bson:"Path"`
+		Actuator bson.M `bson:"Actuator"`
+	}
+	err := s.metadata.Find(bson.M{"uuid": uuid}).Select(bson.M{"Path": 1, "Actuator": 1}).One(&res)
+	if err == mgo.ErrNotFound {
+		return "", nil, &ActuationError{Reason: "No stream with UUID " + uuid}
+	} else if err != nil {
+		return "", nil, errors.New(fmt.Sprintf("Could not find stream %v (%v)", uuid, err))
+	}
+	if len(res.Actuator) == 0 {
+		return "", nil, &ActuationError{Reason: "Stream " + uuid + " is not an actuator"}
+	}
+	return res.Path, res.Actuator, nil
+}
+
 func (s *Store) CanWrite(apikey, uuid string) (bool, error) {
 	var record bson.M
 	foundkey, found := s.apikcache.Get(uuid)
+	observeCache("apikcache", found)
 	if found && foundkey == apikey {
 		return true, nil
 	} else if found && foundkey != apikey {
 		return false, errors.New("API key " + apikey + " is invalid for UUID " + uuid)
 	}
+	defer observeMongo("check_key", time.Now())
 	q := s.metadata.Find(bson.M{"uuid": uuid})
 	count, _ := q.Count()
 	s.apikeylock.Lock()
@@ -240,9 +387,11 @@ func (s *Store) CheckKey(apikey string, messages map[string]*SmapMessage) (bool,
 The incoming messages will be in the form of {pathname: metadata/properties/etc}.
 Only the timeseries will have UUIDs attached. When we receive a message like this, we need
 to compress all of the prefix-path kv pairs into each of the timeseries, and then save those
-timeseries to the metadata collection
+timeseries to the metadata collection. Returns true if any stored metadata was modified
 */
-func (s *Store) SaveMetadata(messages map[string]*SmapMessage) {
+func (s *Store) SaveMetadata(messages map[string]*SmapMessage) bool {
+	defer observeMongo("save_metadata", time.Now())
+	changed := false
 	for path, msg := range messages {
 		if msg.UUID == "" { // not a timeseries
 			continue
@@ -282,17 +431,21 @@ func (s *Store) SaveMetadata(messages map[string]*SmapMessage) {
 			}
 		}
 		if len(toWrite) > 0 {
-			_, err := s.metadata.Upsert(bson.M{"uuid": msg.UUID}, bson.M{"$set": toWrite})
+			info, err := s.metadata.Upsert(bson.M{"uuid": msg.UUID}, bson.M{"$set": toWrite})
 			if err != nil {
 				log.Critical("Error saving metadata for %v: %v", msg.UUID, err)
+			} else if info.Updated > 0 || info.UpsertedId != nil {
+				changed = true
 			}
 		}
 	}
+	return changed
 }
 
 // Retrieves the tags indicated by `target` for documents that match the `where` clause. If `is_distinct` is true,
 // then it will return a list of distinct values for the tag `distinct_key`
 func (s *Store) GetTags(target bson.M, is_distinct bool, distinct_key string, where bson.M) ([]interface{}, error) {
+	defer observeMongo("get_tags", time.Now())
 	var res []interface{}
 	var err error
 	var staged *mgo.Query
@@ -327,6 +480,7 @@ func (s *Store) GetTags(target bson.M, is_distinct bool, distinct_key string, wh
 }
 
 func (s *Store) SetTags(updates bson.M, apikey string, where bson.M) (bson.M, error) {
+	defer observeMongo("set_tags", time.Now())
 	var res bson.M
 	uuids, err := s.GetUUIDs(where)
 	if err != nil {
@@ -342,12 +496,17 @@ func (s *Store) SetTags(updates bson.M, apikey string, where bson.M) (bson.M, er
 	if err2 != nil {
 		return res, err2
 	}
+	// the updates may have changed Properties/UnitofTime or ReadingType
+	s.proplock.Lock()
+	s.propcache = make(map[string]streamProps)
+	s.proplock.Unlock()
 	log.Info("Updated %v records", info.Updated)
 	return bson.M{"Updated": info.Updated}, nil
 }
 
 // Return all metadata for a certain UUID
 func (s *Store) TagsUUID(uuid string) ([]bson.M, error) {
+	defer observeMongo("tags_uuid", time.Now())
 	staged := s.metadata.Find(bson.M{"uuid": uuid}).Select(bson.M{"_id": 0, "_api": 0})
 	res := []bson.M{}
 	err := staged.All(&res)
@@ -356,6 +515,7 @@ func (s *Store) TagsUUID(uuid string) ([]bson.M, error) {
 
 // Resolve a query to a slice of UUIDs
 func (s *Store) GetUUIDs(where bson.M) ([]string, error) {
+	defer observeMongo("get_uuids", time.Now())
 	var tmp []bson.M
 	var res = []string{}
 	err := s.metadata.Find(where).Select(bson.M{"uuid": 1}).All(&tmp)
@@ -368,6 +528,76 @@ func (s *Store) GetUUIDs(where bson.M) ([]string, error) {
 	return res, nil
 }
 
+// Returns the Path of each of the given UUIDs
+func (s *Store) GetPaths(uuids []string) (map[string]string, error) {
+	var tmp []bson.M
+	var res = make(map[string]string, len(uuids))
+	err := s.metadata.Find(bson.M{"uuid": bson.M{"$in": uuids}}).Select(bson.M{"uuid": 1, "Path": 1}).All(&tmp)
+	if err != nil {
+		return res, err
+	}
+	for _, doc := range tmp {
+		if path, ok := doc["Path"].(string); ok {
+			res[doc["uuid"].(string)] = path
+		}
+	}
+	return res, nil
+}
+
+// Returns the Properties/UnitofMeasure of each of the given UUIDs that has one
+func (s *Store) GetUnitsOfMeasure(uuids []string) (map[string]string, error) {
+	return s.getProperty(uuids, "UnitofMeasure")
+}
+
+// Returns the Properties/Timezone of each of the given UUIDs that has one
+func (s *Store) GetTimezones(uuids []string) (map[string]string, error) {
+	return s.getProperty(uuids, "Timezone")
+}
+
+// Returns the Properties/ReadingType of each of the given UUIDs that has one
+func (s *Store) GetReadingTypes(uuids []string) (map[string]string, error) {
+	return s.getProperty(uuids, "ReadingType")
+}
+
+// Splits the UUIDs into those of double streams, which are kept in the
+// timeseries database, and the rest, which are kept in the ObjectStore
+func (s *Store) splitByReadingType(uuids []string) ([]string, []string, error) {
+	types, err := s.GetReadingTypes(uuids)
+	if err != nil {
+		return nil, nil, err
+	}
+	doubles := make([]string, 0, len(uuids))
+	objects := []string{}
+	for _, uuid := range uuids {
+		if readingTypeFromString(types[uuid]) == READINGTYPE_DOUBLE {
+			doubles = append(doubles, uuid)
+		} else {
+			objects = append(objects, uuid)
+		}
+	}
+	return doubles, objects, nil
+}
+
+// Returns the string value of Properties/<name> of each of the given UUIDs
+// that has one
+func (s *Store) getProperty(uuids []string, name string) (map[string]string, error) {
+	defer observeMongo("get_property", time.Now())
+	var tmp []bson.M
+	var res = make(map[string]string, len(uuids))
+	err := s.metadata.Find(bson.M{"uuid": bson.M{"$in": uuids}}).Select(bson.M{"uuid": 1, "Properties." + name: 1}).All(&tmp)
+	if err != nil {
+		return res, err
+	}
+	for _, doc := range tmp {
+		if props, ok := doc["Properties"].(bson.M); ok {
+			if value, ok := props[name].(string); ok {
+				res[doc["uuid"].(string)] = value
+			}
+		}
+	}
+	return res, nil
+}
+
 // Resolve a query to a slice of StreamIds
 func (s *Store) getStreamIds(where bson.M) []uint32 {
 	var tmp []bson.M
@@ -390,5 +620,284 @@ func (s *Store) GetUnitofTime(uuid string) string {
 	if err != nil {
 		return "ms"
 	}
-	return res["Properties"].(bson.M)["UnitofTime"].(string)
+	if props, ok := res["Properties"].(bson.M); ok {
+		if uot, ok := props["UnitofTime"].(string); ok {
+			return uot
+		}
+	}
+	return "ms"
+}
+
+// The properties of a stream that decide how its readings are stored
+type streamProps struct {
+	uot         UnitOfTime
+	readingType string
+	// "" if the stream follows the configured duplicate policy
+	duplicates string
+}
+
+// Returns the properties with UnitofTime and ReadingType taken from the
+// given stream Properties, where they are set
+func (sp streamProps) update(properties bson.M) streamProps {
+	if uot, ok := properties["UnitofTime"].(string); ok {
+		sp.uot = unitOfTimeFromString(uot)
+	}
+	if rt, ok := properties["ReadingType"].(string); ok {
+		sp.readingType = readingTypeFromString(rt)
+	}
+	if policy, ok := properties["DuplicatePolicy"].(string); ok {
+		if validDuplicatePolicy(policy) {
+			sp.duplicates = policy
+		} else {
+			log.Warning("Ignoring unknown DuplicatePolicy %v", policy)
+		}
+	}
+	return sp
+}
+
+// Returns the unit of time and reading type of the stream identified by the
+// given UUID. Answers are cached until the next SetTags
+func (s *Store) streamProperties(uuid string) streamProps {
+	s.proplock.RLock()
+	props, found := s.propcache[uuid]
+	s.proplock.RUnlock()
+	if found {
+		return props
+	}
+	props = streamProps{uot: UOT_MS, readingType: READINGTYPE_DOUBLE}
+	var res bson.M
+	err := s.metadata.Find(bson.M{"uuid": uuid}).Select(bson.M{"Properties.UnitofTime": 1, "Properties.ReadingType": 1, "Properties.DuplicatePolicy": 1}).One(&res)
+	if err == nil {
+		if stored, ok := res["Properties"].(bson.M); ok {
+			props = props.update(stored)
+		}
+	}
+	s.proplock.Lock()
+	s.propcache[uuid] = props
+	s.proplock.Unlock()
+	return props
+}
+
+// Records the storage properties found in the Properties of an incoming
+// message and returns the stream's properties
+func (s *Store) updateStreamProperties(uuid string, properties bson.M) streamProps {
+	props := s.streamProperties(uuid).update(properties)
+	s.proplock.Lock()
+	s.propcache[uuid] = props
+	s.proplock.Unlock()
+	return props
+}
+
+// Returns the unit of time of the stream identified by the given UUID
+func (s *Store) streamUnitOfTime(uuid string) UnitOfTime {
+	return s.streamProperties(uuid).uot
+}
+
+func (s *Store) saveRule(rule Rule) error {
+	return s.rules.Insert(rule)
+}
+
+func (s *Store) getRules() ([]Rule, error) {
+	var rules []Rule
+	err := s.rules.Find(bson.M{}).All(&rules)
+	return rules, err
+}
+
+func (s *Store) removeRule(name string) error {
+	return s.rules.Remove(bson.M{"name": name})
+}
+
+func (s *Store) saveWebhook(hook Webhook) error {
+	return s.webhooks.Insert(hook)
+}
+
+func (s *Store) getWebhooks() ([]Webhook, error) {
+	var hooks []Webhook
+	err := s.webhooks.Find(bson.M{}).All(&hooks)
+	return hooks, err
+}
+
+func (s *Store) removeWebhook(name string) error {
+	return s.webhooks.Remove(bson.M{"name": name})
+}
+
+func (s *Store) saveWebhookBatch(batch *webhookBatch) error {
+	return s.hookbatches.Insert(batch)
+}
+
+// Returns the batches journaled for the given webhook, oldest first
+func (s *Store) getWebhookBatches(webhook string) ([]*webhookBatch, error) {
+	var batches []*webhookBatch
+	err := s.hookbatches.Find(bson.M{"webhook": webhook}).Sort("_id").All(&batches)
+	return batches, err
+}
+
+func (s *Store) removeWebhookBatch(id bson.ObjectId) {
+	if err := s.hookbatches.RemoveId(id); err != nil && err != mgo.ErrNotFound {
+		log.Error("Could not remove journaled webhook batch %v: %v", id.Hex(), err)
+	}
+}
+
+func (s *Store) removeWebhookBatches(webhook string) error {
+	_, err := s.hookbatches.RemoveAll(bson.M{"webhook": webhook})
+	return err
+}
+
+func (s *Store) saveVirtualStream(def VirtualStream) error {
+	return s.virtual.Insert(def)
+}
+
+func (s *Store) getVirtualStreams() ([]VirtualStream, error) {
+	var defs []VirtualStream
+	err := s.virtual.Find(bson.M{}).All(&defs)
+	return defs, err
+}
+
+func (s *Store) removeVirtualStream(name string) error {
+	return s.virtual.Remove(bson.M{"name": name})
+}
+
+// Returns the streams that have a Properties/Retention
+func (s *Store) getStreamRetentions() ([]streamRetention, error) {
+	var res []streamRetention
+	err := s.metadata.Find(bson.M{"Properties.Retention": bson.M{"$exists": true}}).
+		Select(bson.M{"uuid": 1, "Path": 1, "Properties.Retention": 1}).All(&res)
+	return res, err
+}
+
+// Returns how far (in ms) the given stream has been rolled up in the named
+// tier, or 0 if it has not been rolled up yet
+func (s *Store) getRollupWatermark(uuid, tier string) (uint64, error) {
+	var res struct {
+		Watermark uint64 `bson:"watermark"`
+	}
+	err := s.rollups.Find(bson.M{"uuid": uuid, "tier": tier}).One(&res)
+	if err == mgo.ErrNotFound {
+		return 0, nil
+	}
+	return res.Watermark, err
+}
+
+// Returns the rollup watermarks of all streams, by UUID and tier
+func (s *Store) getRollupWatermarks() (map[string]map[string]uint64, error) {
+	var res []struct {
+		UUID      string `bson:"uuid"`
+		Tier      string `bson:"tier"`
+		Watermark uint64 `bson:"watermark"`
+	}
+	if err := s.rollups.Find(bson.M{}).All(&res); err != nil {
+		return nil, err
+	}
+	watermarks := make(map[string]map[string]uint64)
+	for _, mark := range res {
+		if watermarks[mark.UUID] == nil {
+			watermarks[mark.UUID] = make(map[string]uint64, len(rollupTiers))
+		}
+		watermarks[mark.UUID][mark.Tier] = mark.Watermark
+	}
+	return watermarks, nil
+}
+
+// Moves the watermark of the given stream and tier from one value to another.
+// It is left alone if it is no longer at from, as it has been moved back by
+// rewindRollupWatermark in the meantime
+func (s *Store) saveRollupWatermark(uuid, tier string, from, watermark uint64) error {
+	if from == 0 {
+		_, err := s.rollups.Upsert(bson.M{"uuid": uuid, "tier": tier}, bson.M{"$set": bson.M{"watermark": watermark}})
+		return err
+	}
+	err := s.rollups.Update(bson.M{"uuid": uuid, "tier": tier, "watermark": from}, bson.M{"$set": bson.M{"watermark": watermark}})
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// Moves the watermark of the given stream and tier back to watermark if it
+// is past it
+func (s *Store) rewindRollupWatermark(uuid, tier string, watermark uint64) error {
+	err := s.rollups.Update(bson.M{"uuid": uuid, "tier": tier, "watermark": bson.M{"$gt": watermark}}, bson.M{"$set": bson.M{"watermark": watermark}})
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+func (s *Store) saveDeadLetter(letter DeadLetter) {
+	if err := s.deadletters.Insert(letter); err != nil {
+		log.Error("Could not save dead letter for %v: %v", letter.Webhook, err)
+	}
+}
+
+// Returns the newest dead letters for the given webhook
+func (s *Store) getDeadLetters(webhook string, limit int) ([]DeadLetter, error) {
+	var letters []DeadLetter
+	err := s.deadletters.Find(bson.M{"webhook": webhook}).Sort("-time").Limit(limit).All(&letters)
+	return letters, err
+}
+
+func (s *Store) appendJournal(entries []interface{}) error {
+	defer observeMongo("append_journal", time.Now())
+	return s.journal.Insert(entries...)
+}
+
+// Returns up to limit journal entries after the given sequence number, in order
+func (s *Store) getJournal(after uint64, limit int) ([]journalEntry, error) {
+	var entries []journalEntry
+	err := s.journal.Find(bson.M{"seq": bson.M{"$gt": after}}).Sort("seq").Limit(limit).All(&entries)
+	return entries, err
+}
+
+// Removes the journal entries up to and including the given sequence number
+func (s *Store) trimJournal(upto uint64) error {
+	_, err := s.journal.RemoveAll(bson.M{"seq": bson.M{"$lte": upto}})
+	return err
+}
+
+// Returns the sequence number of the newest journal entry, or 0 if the
+// journal is empty
+func (s *Store) maxJournalSeq() (uint64, error) {
+	var entry journalEntry
+	err := s.journal.Find(bson.M{}).Sort("-seq").One(&entry)
+	if err == mgo.ErrNotFound {
+		return 0, nil
+	}
+	return entry.Seq, err
+}
+
+// Returns the sequence number of the last journal entry the given upstream
+// archiver has acknowledged
+func (s *Store) getReplicationCursor(upstream string) (uint64, error) {
+	var res struct {
+		Cursor uint64 `bson:"cursor"`
+	}
+	err := s.replication.Find(bson.M{"upstream": upstream}).One(&res)
+	if err == mgo.ErrNotFound {
+		return 0, nil
+	}
+	return res.Cursor, err
+}
+
+func (s *Store) saveReplicationCursor(upstream string, cursor uint64) error {
+	_, err := s.replication.Upsert(bson.M{"upstream": upstream}, bson.M{"$set": bson.M{"cursor": cursor}})
+	return err
+}
+
+func (s *Store) saveImport(rec *importRecord) error {
+	return s.imports.Insert(rec)
+}
+
+// Returns the import with the given ID, or ErrNoSuchImport
+func (s *Store) getImport(id string) (*importRecord, error) {
+	var rec importRecord
+	err := s.imports.Find(bson.M{"id": id}).One(&rec)
+	if err == mgo.ErrNotFound {
+		return nil, ErrNoSuchImport
+	}
+	return &rec, err
+}
+
+// Records how far an import has got
+func (s *Store) updateImport(id string, lines, readings uint64, updated time.Time) error {
+	return s.imports.Update(bson.M{"id": id}, bson.M{"$set": bson.M{"lines": lines, "readings": readings, "updated": updated}})
 }
@@ -0,0 +1,313 @@
+package archiver
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Giles keeps its own small registry of metrics and writes them in the
+// Prometheus text format
+// (https://prometheus.io/docs/instrumenting/exposition_formats/), which the
+// HTTP interface serves at /metrics. The metrics are
+//
+//    giles_readings_received_total{protocol,key}  -- readings accepted, by protocol and API key name
+//    giles_tsdb_request_duration_seconds{op}      -- latency of timeseries database writes and reads
+//    giles_mongo_operation_duration_seconds{op}   -- latency of metadata store operations
+//    giles_cache_lookups_total{cache,result}      -- hits and misses of the uuid and apikey caches
+//    giles_errors_total{component}                -- errors by the component they happened in
+//
+// along with gauges for the coalescer buffers, republish clients and queues
+// and live TSDB connections (see Archiver.registerGauges).
+type Metrics struct {
+	sync.Mutex
+	metrics []metric
+	byname  map[string]int
+}
+
+type metric interface {
+	name() string
+	write(w io.Writer)
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{byname: make(map[string]int)}
+}
+
+// Adds a metric to the registry, replacing any metric of the same name
+func (m *Metrics) register(met metric) {
+	m.Lock()
+	defer m.Unlock()
+	if i, found := m.byname[met.name()]; found {
+		m.metrics[i] = met
+		return
+	}
+	m.byname[met.name()] = len(m.metrics)
+	m.metrics = append(m.metrics, met)
+}
+
+// Writes all metrics in the Prometheus text format
+func (m *Metrics) Write(w io.Writer) {
+	m.Lock()
+	metrics := make([]metric, len(m.metrics))
+	copy(metrics, m.metrics)
+	m.Unlock()
+	for _, met := range metrics {
+		met.write(w)
+	}
+}
+
+// the metrics Giles is instrumented with
+var metrics = NewMetrics()
+
+var (
+	readingsReceived = newCounterVec("giles_readings_received_total",
+		"Readings accepted for archiving.", "protocol", "key")
+	tsdbLatency = newHistogramVec("giles_tsdb_request_duration_seconds",
+		"Latency of timeseries database requests.", latencyBuckets, "op")
+	mongoLatency = newHistogramVec("giles_mongo_operation_duration_seconds",
+		"Latency of metadata store operations.", latencyBuckets, "op")
+	cacheLookups = newCounterVec("giles_cache_lookups_total",
+		"Lookups in the metadata store caches.", "cache", "result")
+	errorCount = newCounterVec("giles_errors_total",
+		"Errors, by the component they happened in.", "component")
+	replicationDuplicates = newCounterVec("giles_replication_duplicates_total",
+		"Forwarded readings dropped because they were already stored.")
+	duplicateReadings = newCounterVec("giles_duplicate_readings_total",
+		"Readings with the timestamp of a reading already taken for their stream, by the duplicate policy applied.", "policy")
+	lateReadings = newCounterVec("giles_late_readings_total",
+		"Readings older than the newest reading taken for their stream.")
+	invalidMessages = newCounterVec("giles_invalid_messages_total",
+		"Messages refused because they were not valid, by protocol.", "protocol")
+)
+
+// in seconds
+var latencyBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+func init() {
+	for _, met := range []metric{readingsReceived, tsdbLatency, mongoLatency, cacheLookups, errorCount, replicationDuplicates, duplicateReadings, lateReadings, invalidMessages} {
+		metrics.register(met)
+	}
+}
+
+// Records the latency of a metadata store operation that started at start,
+// e.g.
+//
+//    defer observeMongo("get_uuids", time.Now())
+func observeMongo(op string, start time.Time) {
+	mongoLatency.Observe(time.Since(start).Seconds(), op)
+}
+
+// Records a lookup in one of the caches
+func observeCache(cache string, hit bool) {
+	if hit {
+		cacheLookups.Inc(cache, "hit")
+	} else {
+		cacheLookups.Inc(cache, "miss")
+	}
+}
+
+// the series of a vector are kept under their label values joined with this
+const labelSeparator = "\xff"
+
+// Returns the label set of a series, e.g. {op="write"}
+func formatLabels(names []string, key string, extra ...string) string {
+	pairs := []string{}
+	if len(names) > 0 {
+		for i, value := range strings.Split(key, labelSeparator) {
+			pairs = append(pairs, names[i]+"=\""+escapeLabel(value)+"\"")
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+"=\""+escapeLabel(extra[i+1])+"\"")
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// A counter with one series for each combination of label values
+type counterVec struct {
+	sync.Mutex
+	metricname string
+	help       string
+	labels     []string
+	values     map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{metricname: name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+func (c *counterVec) name() string {
+	return c.metricname
+}
+
+// Adds 1 to the series with the given label values
+func (c *counterVec) Inc(labelvalues ...string) {
+	c.Add(1, labelvalues...)
+}
+
+// Adds v to the series with the given label values
+func (c *counterVec) Add(v float64, labelvalues ...string) {
+	key := strings.Join(labelvalues, labelSeparator)
+	c.Lock()
+	c.values[key] += v
+	c.Unlock()
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.Lock()
+	defer c.Unlock()
+	writeHeader(w, c.metricname, c.help, "counter")
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %v\n", c.metricname, formatLabels(c.labels, key), c.values[key])
+	}
+}
+
+// A histogram with one series for each combination of label values
+type histogramVec struct {
+	sync.Mutex
+	metricname string
+	help       string
+	labels     []string
+	buckets    []float64
+	series     map[string]*histogram
+}
+
+type histogram struct {
+	// counts[i] is the number of observations in (buckets[i-1], buckets[i]];
+	// the last count is for observations above every bucket
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{metricname: name, help: help, labels: labels, buckets: buckets,
+		series: make(map[string]*histogram)}
+}
+
+func (h *histogramVec) name() string {
+	return h.metricname
+}
+
+// Records one observation in the series with the given label values
+func (h *histogramVec) Observe(v float64, labelvalues ...string) {
+	key := strings.Join(labelvalues, labelSeparator)
+	h.Lock()
+	defer h.Unlock()
+	s, found := h.series[key]
+	if !found {
+		s = &histogram{counts: make([]uint64, len(h.buckets)+1)}
+		h.series[key] = s
+	}
+	i := sort.SearchFloat64s(h.buckets, v)
+	s.counts[i]++
+	s.count++
+	s.sum += v
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.Lock()
+	defer h.Unlock()
+	writeHeader(w, h.metricname, h.help, "histogram")
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.series[key]
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricname, formatLabels(h.labels, key, "le", fmt.Sprint(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricname, formatLabels(h.labels, key, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %v\n", h.metricname, formatLabels(h.labels, key), s.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", h.metricname, formatLabels(h.labels, key), s.count)
+	}
+}
+
+// A gauge whose value is read when the metrics are written
+type gaugeFunc struct {
+	metricname string
+	help       string
+	value      func() float64
+}
+
+func newGaugeFunc(name, help string, value func() float64) *gaugeFunc {
+	return &gaugeFunc{metricname: name, help: help, value: value}
+}
+
+func (g *gaugeFunc) name() string {
+	return g.metricname
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	writeHeader(w, g.metricname, g.help, "gauge")
+	fmt.Fprintf(w, "%s %v\n", g.metricname, g.value())
+}
+
+// The instrumentedTSDB records the latency and errors of every request to
+// the timeseries database it wraps
+type instrumentedTSDB struct {
+	TSDB
+}
+
+func (t instrumentedTSDB) observe(op string, start time.Time, err error) {
+	tsdbLatency.Observe(time.Since(start).Seconds(), op)
+	if err != nil {
+		errorCount.Inc("tsdb")
+	}
+}
+
+func (t instrumentedTSDB) Add(sb *StreamBuf) bool {
+	start := time.Now()
+	ok := t.TSDB.Add(sb)
+	if !ok {
+		errorCount.Inc("tsdb")
+	}
+	tsdbLatency.Observe(time.Since(start).Seconds(), "write")
+	return ok
+}
+
+func (t instrumentedTSDB) Prev(uuids []string, ref uint64, limit int32, uot UnitOfTime) (ret []SmapResponse, err error) {
+	defer func(start time.Time) { t.observe("prev", start, err) }(time.Now())
+	return t.TSDB.Prev(uuids, ref, limit, uot)
+}
+
+func (t instrumentedTSDB) Next(uuids []string, ref uint64, limit int32, uot UnitOfTime) (ret []SmapResponse, err error) {
+	defer func(start time.Time) { t.observe("next", start, err) }(time.Now())
+	return t.TSDB.Next(uuids, ref, limit, uot)
+}
+
+func (t instrumentedTSDB) GetData(uuids []string, start, end uint64, uot UnitOfTime) (ret []SmapResponse, err error) {
+	defer func(start time.Time) { t.observe("get_data", start, err) }(time.Now())
+	return t.TSDB.GetData(uuids, start, end, uot)
+}
+
+func (t instrumentedTSDB) Delete(uuids []string, start, end uint64, uot UnitOfTime) (err error) {
+	defer func(start time.Time) { t.observe("delete", start, err) }(time.Now())
+	return t.TSDB.Delete(uuids, start, end, uot)
+}
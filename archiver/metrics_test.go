@@ -0,0 +1,45 @@
+package archiver
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestMetricsFormat(t *testing.T) {
+	m := NewMetrics()
+	requests := newCounterVec("test_requests_total", "Requests.", "protocol", "key")
+	requests.Add(3, "http", `bob "the" builder`)
+	requests.Inc("http", `bob "the" builder`)
+	latency := newHistogramVec("test_latency_seconds", "Latency.", []float64{0.1, 1}, "op")
+	latency.Observe(0.05, "write")
+	latency.Observe(0.5, "write")
+	latency.Observe(5, "write")
+	m.register(requests)
+	m.register(latency)
+	m.register(newGaugeFunc("test_depth", "Depth.", func() float64 { return 7 }))
+	m.register(newGaugeFunc("test_depth", "Depth.", func() float64 { return 8 }))
+
+	var buf bytes.Buffer
+	m.Write(&buf)
+	expected := `# HELP test_requests_total Requests.
+# TYPE test_requests_total counter
+test_requests_total{protocol="http",key="bob \"the\" builder"} 4
+# HELP test_latency_seconds Latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{op="write",le="0.1"} 1
+test_latency_seconds_bucket{op="write",le="1"} 2
+test_latency_seconds_bucket{op="write",le="+Inf"} 3
+test_latency_seconds_sum{op="write"} 5.55
+test_latency_seconds_count{op="write"} 3
+# HELP test_depth Depth.
+# TYPE test_depth gauge
+test_depth 8
+`
+	if buf.String() != expected {
+		t.Errorf("Wrong metrics output:\n%v\nexpected:\n%v", buf.String(), expected)
+	}
+	if strings.Count(buf.String(), "test_depth 8") != 1 {
+		t.Error("Registering a metric twice should replace it")
+	}
+}
@@ -0,0 +1,150 @@
+package archiver
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// how many commits may wait for a mirror before new ones are dropped
+const mirrorQueueSize = 1000
+
+// A timeseries database the MultiTSDB writes to, under the name it has in
+// the configuration (e.g. "readingdb")
+type tsdbBackend struct {
+	name string
+	tsdb TSDB
+	// commits waiting to be written to a mirror
+	queue chan *StreamBuf
+}
+
+// Writes the commits for a mirror, in order
+func (b *tsdbBackend) run() {
+	for sb := range b.queue {
+		if !b.tsdb.Add(sb) {
+			log.Error("Error writing %v readings of %v to %v", len(sb.readings), sb.uuid, b.name)
+			errorCount.Inc("mirror")
+		}
+	}
+}
+
+// The MultiTSDB sends every write to several timeseries databases, e.g.
+//
+//    [Archiver]
+//    TSDB=readingdb
+//    MirrorTSDB=quasar
+//
+// while migrating from ReadingDB to Quasar. The primary (TSDB=) answers all
+// reads; swapping TSDB and MirrorTSDB switches reads over to the other
+// database. Each mirror is written to by its own goroutine, so a mirror that
+// is slow or down does not hold up the primary or the other mirrors. Commits
+// that do not fit in a mirror's queue are dropped and counted in
+// giles_errors_total{component="mirror"}; a backfill (see backfill.go) can
+// fill in what a mirror missed. Deletes go to all of the databases.
+type MultiTSDB struct {
+	primary  *tsdbBackend
+	mirrors  []*tsdbBackend
+	backends map[string]*tsdbBackend
+}
+
+func NewMultiTSDB(primaryname string, primary TSDB) *MultiTSDB {
+	p := &tsdbBackend{name: primaryname, tsdb: primary}
+	return &MultiTSDB{primary: p, backends: map[string]*tsdbBackend{primaryname: p}}
+}
+
+// Adds a database that every write is also sent to
+func (m *MultiTSDB) AddMirror(name string, tsdb TSDB) error {
+	if _, found := m.backends[name]; found {
+		return fmt.Errorf("%v is already a timeseries database of this archiver", name)
+	}
+	b := &tsdbBackend{name: name, tsdb: tsdb, queue: make(chan *StreamBuf, mirrorQueueSize)}
+	m.mirrors = append(m.mirrors, b)
+	m.backends[name] = b
+	go b.run()
+	return nil
+}
+
+// Returns the named database, for backfills
+func (m *MultiTSDB) Backend(name string) (TSDB, error) {
+	b, found := m.backends[name]
+	if !found {
+		return nil, fmt.Errorf("%v is not a timeseries database of this archiver", name)
+	}
+	return b.tsdb, nil
+}
+
+// Returns the names of the databases, the primary first
+func (m *MultiTSDB) Names() []string {
+	names := []string{m.primary.name}
+	for _, b := range m.mirrors {
+		names = append(names, b.name)
+	}
+	return names
+}
+
+func (m *MultiTSDB) Add(sb *StreamBuf) bool {
+	for _, b := range m.mirrors {
+		// the StreamBuf is not changed once it is committed, so the
+		// mirrors can share its readings
+		select {
+		case b.queue <- &StreamBuf{uuid: sb.uuid, readings: sb.readings}:
+		default:
+			log.Error("Dropped %v readings of %v for %v, which is falling behind", len(sb.readings), sb.uuid, b.name)
+			errorCount.Inc("mirror")
+		}
+	}
+	return m.primary.tsdb.Add(sb)
+}
+
+func (m *MultiTSDB) Prev(uuids []string, ref uint64, limit int32, uot UnitOfTime) ([]SmapResponse, error) {
+	return m.primary.tsdb.Prev(uuids, ref, limit, uot)
+}
+
+func (m *MultiTSDB) Next(uuids []string, ref uint64, limit int32, uot UnitOfTime) ([]SmapResponse, error) {
+	return m.primary.tsdb.Next(uuids, ref, limit, uot)
+}
+
+func (m *MultiTSDB) GetData(uuids []string, start, end uint64, uot UnitOfTime) ([]SmapResponse, error) {
+	return m.primary.tsdb.GetData(uuids, start, end, uot)
+}
+
+// Deletes from all of the databases. Only an error from the primary is
+// returned; those from mirrors are logged
+func (m *MultiTSDB) Delete(uuids []string, start, end uint64, uot UnitOfTime) error {
+	for _, b := range m.mirrors {
+		if err := b.tsdb.Delete(uuids, start, end, uot); err != nil {
+			log.Error("Error deleting from %v: %v", b.name, err)
+			errorCount.Inc("mirror")
+		}
+	}
+	return m.primary.tsdb.Delete(uuids, start, end, uot)
+}
+
+func (m *MultiTSDB) GetConnection() (net.Conn, error) {
+	return m.primary.tsdb.GetConnection()
+}
+
+func (m *MultiTSDB) LiveConnections() int {
+	live := m.primary.tsdb.LiveConnections()
+	for _, b := range m.mirrors {
+		live += b.tsdb.LiveConnections()
+	}
+	return live
+}
+
+// Only the primary decides whether readings are refused, so that a mirror
+// that is down does not stop ingest
+func (m *MultiTSDB) Backlog() (int, bool) {
+	return m.primary.tsdb.Backlog()
+}
+
+func (m *MultiTSDB) Ping(timeout time.Duration) error {
+	return m.primary.tsdb.Ping(timeout)
+}
+
+func (m *MultiTSDB) AddStore(store *Store) {
+	m.primary.tsdb.AddStore(store)
+	for _, b := range m.mirrors {
+		b.tsdb.AddStore(store)
+	}
+}
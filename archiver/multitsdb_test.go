@@ -0,0 +1,147 @@
+package archiver
+
+import (
+	"math"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A TSDB that keeps readings in memory, in UOT_STORAGE
+type memTSDB struct {
+	TSDB
+	sync.Mutex
+	readings map[string][][]float64
+	down     bool
+}
+
+func newMemTSDB() *memTSDB {
+	return &memTSDB{readings: make(map[string][][]float64)}
+}
+
+func (m *memTSDB) Add(sb *StreamBuf) bool {
+	m.Lock()
+	defer m.Unlock()
+	if m.down {
+		return false
+	}
+	for _, rdg := range sb.readings {
+		m.readings[sb.uuid] = append(m.readings[sb.uuid], []float64{float64(rdg[0].(uint64)), rdg[1].(float64)})
+	}
+	return true
+}
+
+func (m *memTSDB) GetData(uuids []string, start, end uint64, uot UnitOfTime) ([]SmapResponse, error) {
+	m.Lock()
+	defer m.Unlock()
+	ret := []SmapResponse{}
+	for _, uuid := range uuids {
+		resp := SmapResponse{UUID: uuid, Readings: [][]float64{}}
+		for _, rdg := range m.readings[uuid] {
+			if ts := convertTime(uint64(rdg[0]), UOT_STORAGE, uot); ts >= start && ts <= end {
+				resp.Readings = append(resp.Readings, []float64{float64(ts), rdg[1]})
+			}
+		}
+		ret = append(ret, resp)
+	}
+	return ret, nil
+}
+
+func (m *memTSDB) Next(uuids []string, start uint64, limit int32, uot UnitOfTime) ([]SmapResponse, error) {
+	data, _ := m.GetData(uuids, start, math.MaxUint64, uot)
+	for i := range data {
+		data[i].Readings = sortedReadings(data[i].Readings)
+		if limit >= 0 && len(data[i].Readings) > int(limit) {
+			data[i].Readings = data[i].Readings[:limit]
+		}
+	}
+	return data, nil
+}
+
+func (m *memTSDB) Delete(uuids []string, start, end uint64, uot UnitOfTime) error {
+	m.Lock()
+	defer m.Unlock()
+	for _, uuid := range uuids {
+		kept := m.readings[uuid][:0]
+		for _, rdg := range m.readings[uuid] {
+			if ts := convertTime(uint64(rdg[0]), UOT_STORAGE, uot); ts < start || ts > end {
+				kept = append(kept, rdg)
+			}
+		}
+		m.readings[uuid] = kept
+	}
+	return nil
+}
+
+func (m *memTSDB) count(uuid string) int {
+	m.Lock()
+	defer m.Unlock()
+	return len(m.readings[uuid])
+}
+
+func TestMultiTSDB(t *testing.T) {
+	primary, mirror, broken := newMemTSDB(), newMemTSDB(), newMemTSDB()
+	broken.down = true
+	multi := NewMultiTSDB("readingdb", primary)
+	multi.AddMirror("quasar", mirror)
+	multi.AddMirror("other", broken)
+	if err := multi.AddMirror("quasar", newMemTSDB()); err == nil {
+		t.Error("Adding a mirror twice should give an error")
+	}
+
+	sb := &StreamBuf{uuid: "a", readings: [][]interface{}{{uint64(1000), float64(1)}, {uint64(2000), float64(2)}}}
+	if !multi.Add(sb) {
+		t.Error("A broken mirror should not fail writes to the primary")
+	}
+	if primary.count("a") != 2 {
+		t.Error("The primary should have 2 readings, not", primary.count("a"))
+	}
+	for i := 0; i < 100 && mirror.count("a") < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if mirror.count("a") != 2 {
+		t.Error("The mirror should have 2 readings, not", mirror.count("a"))
+	}
+
+	mirror.Add(&StreamBuf{uuid: "a", readings: [][]interface{}{{uint64(3000), float64(3)}}})
+	data, _ := multi.GetData([]string{"a"}, 0, 10000, UOT_MS)
+	if len(data) != 1 || len(data[0].Readings) != 2 {
+		t.Error("Reads should come from the primary, but gave", data)
+	}
+	if names := multi.Names(); len(names) != 3 || names[0] != "readingdb" {
+		t.Error("Wrong backend names", names)
+	}
+}
+
+func TestCopyReadings(t *testing.T) {
+	from, to := newMemTSDB(), newMemTSDB()
+	sb := &StreamBuf{uuid: "a"}
+	for i := 0; i < COALESCE_MAX+10; i++ {
+		sb.readings = append(sb.readings, []interface{}{uint64(i * 1000), float64(i)})
+	}
+	from.Add(sb)
+	copied, err := copyReadings(from, to, "a", 0, 1000*1000-1)
+	if err != nil || copied != 1000 || to.count("a") != 1000 {
+		t.Error("Should copy the first 1000 readings but copied", copied, err)
+	}
+	copied, err = copyReadings(from, to, "a", 1000*1000, uint64(COALESCE_MAX+10)*1000)
+	if err != nil || to.count("a") != COALESCE_MAX+10 {
+		t.Error("Should copy the rest of the readings but copied", copied, err)
+	}
+	to.down = true
+	if _, err := copyReadings(from, to, "a", 0, 1000); err == nil {
+		t.Error("Should give an error when the destination cannot be written")
+	}
+}
+
+func TestBackfillMalformedWhere(t *testing.T) {
+	multi := NewMultiTSDB("readingdb", newMemTSDB())
+	multi.AddMirror("quasar", newMemTSDB())
+	bj := NewBackfillJob(nil, multi)
+	if err := bj.Start(Backfill{From: "readingdb", To: "quasar", End: 1000, Where: "Metadata/Site"}); err == nil {
+		t.Error("A backfill with a malformed where clause should give an error")
+	}
+	if bj.Status() != nil {
+		t.Error("A backfill with a malformed where clause should not be started")
+	}
+}
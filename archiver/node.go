@@ -2,6 +2,9 @@ package archiver
 
 import (
 	"gopkg.in/mgo.v2/bson"
+	"math"
+	"regexp"
+	"strconv"
 	"strings"
 )
 
@@ -16,6 +19,12 @@ const (
 	HAS_NODE
 	EQ_NODE
 	NEQ_NODE
+	LT_NODE
+	GT_NODE
+	LE_NODE
+	GE_NODE
+	IN_NODE
+	REGEX_NODE
 	LEAF_NODE
 )
 
@@ -30,18 +39,92 @@ func getnodeType(inp string) nodeType_T {
 	case "like":
 		return LIKE_NODE
 	case "~":
-		return LIKE_NODE
+		return REGEX_NODE
 	case "has":
 		return HAS_NODE
 	case "=":
 		return EQ_NODE
 	case "!=":
 		return NEQ_NODE
+	case "<":
+		return LT_NODE
+	case ">":
+		return GT_NODE
+	case "<=":
+		return LE_NODE
+	case ">=":
+		return GE_NODE
+	case "in":
+		return IN_NODE
 	default:
 		return DEF_NODE
 	}
 }
 
+// A value in a where clause. Quoted values are always strings; unquoted
+// values are numbers or booleans if they read as one, and strings otherwise
+type literal struct {
+	value interface{}
+	// the value as written, without quotes
+	text string
+}
+
+func parseLiteral(token string) literal {
+	text := unquote(token)
+	if text != strings.TrimSpace(token) {
+		return literal{value: text, text: text}
+	}
+	if f, err := strconv.ParseFloat(text, 64); err == nil && !math.IsNaN(f) && !math.IsInf(f, 0) {
+		return literal{value: f, text: text}
+	}
+	if text == "true" || text == "false" {
+		return literal{value: text == "true", text: text}
+	}
+	return literal{value: text, text: text}
+}
+
+// The values that are equal to the literal. sMAP metadata is usually stored
+// as strings, so unquoted numbers and booleans also match their string form
+func (l literal) equals() []interface{} {
+	if _, ok := l.value.(string); ok {
+		return []interface{}{l.value}
+	}
+	return []interface{}{l.value, l.text}
+}
+
+// Translates a LIKE pattern, where % matches anything, to a regular
+// expression. Everything else matches literally
+func likeToRegex(pattern string) string {
+	parts := strings.Split(pattern, "%")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	return strings.Join(parts, ".*")
+}
+
+// The Mongo operators for the range comparisons
+var rangeOperators = map[nodeType_T]string{LT_NODE: "$lt", GT_NODE: "$gt", LE_NODE: "$lte", GE_NODE: "$gte"}
+
+// Matches the strings that hold numbers, e.g. "3" or "-2.5", which is how
+// sMAP metadata usually stores them
+const numericString = `^-?[0-9]+(\.[0-9]+)?$`
+
+// Compares field with value. Mongo only compares numbers with numbers and
+// strings with strings, so a number is also compared with the fields that
+// hold a number as a string, by value: Metadata/Floor >= 3 matches a Floor of
+// "10" but not "2". This needs MongoDB 4.0 or later. Quoted values compare
+// as strings, character by character ('10' < '3')
+func rangeQuery(field, op string, value interface{}) bson.M {
+	if _, ok := value.(float64); !ok {
+		return bson.M{field: bson.M{op: value}}
+	}
+	converted := bson.M{"$convert": bson.M{"input": "$" + field, "to": "double", "onError": nil, "onNull": nil}}
+	return bson.M{"$or": []bson.M{
+		{field: bson.M{op: value}},
+		{field: bson.M{"$regex": numericString}, "$expr": bson.M{op: []interface{}{converted, value}}},
+	}}
+}
+
 type node struct {
 	Type  nodeType_T
 	Left  interface{}
@@ -51,11 +134,29 @@ type node struct {
 func (n node) ToBson() bson.M {
 	switch n.Type {
 	case EQ_NODE:
-		return bson.M{n.Left.(string): n.Right.(string)}
-	case LIKE_NODE:
-		return bson.M{n.Left.(string): bson.M{"$regex": strings.Replace(n.Right.(string), "%", ".*", -1)}}
+		values := n.Right.(literal).equals()
+		if len(values) == 1 {
+			return bson.M{n.Left.(string): values[0]}
+		}
+		return bson.M{n.Left.(string): bson.M{"$in": values}}
 	case NEQ_NODE:
-		return bson.M{"$not": bson.M{n.Left.(string): n.Right.(string)}}
+		values := n.Right.(literal).equals()
+		if len(values) == 1 {
+			return bson.M{n.Left.(string): bson.M{"$ne": values[0]}}
+		}
+		return bson.M{n.Left.(string): bson.M{"$nin": values}}
+	case LT_NODE, GT_NODE, LE_NODE, GE_NODE:
+		return rangeQuery(n.Left.(string), rangeOperators[n.Type], n.Right.(literal).value)
+	case IN_NODE:
+		values := []interface{}{}
+		for _, l := range n.Right.([]literal) {
+			values = append(values, l.equals()...)
+		}
+		return bson.M{n.Left.(string): bson.M{"$in": values}}
+	case LIKE_NODE:
+		return bson.M{n.Left.(string): bson.M{"$regex": likeToRegex(n.Right.(string))}}
+	case REGEX_NODE:
+		return bson.M{n.Left.(string): bson.M{"$regex": n.Right.(string)}}
 	case AND_NODE:
 		return bson.M{"$and": []bson.M{n.Left.(node).ToBson(), n.Right.(node).ToBson()}}
 	case OR_NODE:
@@ -0,0 +1,136 @@
+package archiver
+
+import (
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"math"
+	"time"
+)
+
+// One reading as it is kept in the objects collection
+type objectReading struct {
+	UUID  string      `bson:"uuid"`
+	Time  int64       `bson:"time"`
+	Value interface{} `bson:"value"`
+}
+
+// The ObjectStore keeps the readings of streams whose Properties/ReadingType
+// is long, string or object in MongoDB, where they keep their exact value:
+// int64 for long streams, strings, and any JSON value for object streams
+// (e.g. event logs or discrete states). It answers the same queries as the
+// timeseries database, with timestamps in UOT_STORAGE on the way in and in
+// the unit of time of the query on the way out.
+type ObjectStore struct {
+	objects *mgo.Collection
+}
+
+func NewObjectStore(store *Store) *ObjectStore {
+	return &ObjectStore{objects: store.objects}
+}
+
+// Saves the readings of msg, whose timestamps are in UOT_STORAGE. A reading
+// replaces any earlier reading of the stream with the same timestamp
+func (obj *ObjectStore) Add(msg *SmapMessage) error {
+	defer observeMongo("objects_add", time.Now())
+	for _, rdg := range msg.Readings {
+		ts, ok := readingTime(rdg[0])
+		if !ok {
+			continue
+		}
+		_, err := obj.objects.Upsert(bson.M{"uuid": msg.UUID, "time": int64(ts)}, bson.M{"$set": bson.M{"value": rdg[1]}})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Retrieves the last [limit] readings before (and including) [ref] for each
+// of the streams. A negative limit returns all of them
+func (obj *ObjectStore) Prev(uuids []string, ref uint64, limit int32, uot UnitOfTime) ([]SmapObjectResponse, error) {
+	ref = convertTime(ref, uot, UOT_STORAGE)
+	return obj.find(uuids, bson.M{"$lte": int64(ref)}, "-time", limit, uot)
+}
+
+// Retrieves the first [limit] readings after (and including) [ref] for each
+// of the streams. A negative limit returns all of them
+func (obj *ObjectStore) Next(uuids []string, ref uint64, limit int32, uot UnitOfTime) ([]SmapObjectResponse, error) {
+	ref = convertTime(ref, uot, UOT_STORAGE)
+	return obj.find(uuids, bson.M{"$gte": int64(ref)}, "time", limit, uot)
+}
+
+// Retrieves all readings between (and including) [start] and [end] for each
+// of the streams
+func (obj *ObjectStore) GetData(uuids []string, start, end uint64, uot UnitOfTime) ([]SmapObjectResponse, error) {
+	if start > end {
+		start, end = end, start
+	}
+	start = convertTime(start, uot, UOT_STORAGE)
+	end = convertTime(end, uot, UOT_STORAGE)
+	return obj.find(uuids, bson.M{"$gte": int64(start), "$lte": int64(end)}, "time", -1, uot)
+}
+
+// Deletes all readings between (and including) [start] and [end] for each
+// of the streams
+func (obj *ObjectStore) Delete(uuids []string, start, end uint64, uot UnitOfTime) error {
+	if start > end {
+		start, end = end, start
+	}
+	start = convertTime(start, uot, UOT_STORAGE)
+	end = convertTime(end, uot, UOT_STORAGE)
+	if end > math.MaxInt64 {
+		end = math.MaxInt64
+	}
+	_, err := obj.objects.RemoveAll(bson.M{"uuid": bson.M{"$in": uuids}, "time": bson.M{"$gte": int64(start), "$lte": int64(end)}})
+	return err
+}
+
+// Runs a query on the times of each stream. The readings are returned in
+// ascending order whichever way they were sorted to apply the limit
+func (obj *ObjectStore) find(uuids []string, times bson.M, sort string, limit int32, uot UnitOfTime) ([]SmapObjectResponse, error) {
+	defer observeMongo("objects_find", time.Now())
+	ret := make([]SmapObjectResponse, 0, len(uuids))
+	for _, uuid := range uuids {
+		query := obj.objects.Find(bson.M{"uuid": uuid, "time": times}).Sort(sort)
+		if limit > 0 {
+			query = query.Limit(int(limit))
+		}
+		var found []objectReading
+		if err := query.All(&found); err != nil {
+			return ret, err
+		}
+		resp := SmapObjectResponse{UUID: uuid, Readings: make([][]interface{}, len(found))}
+		for i, rdg := range found {
+			if sort[0] == '-' {
+				i = len(found) - 1 - i
+			}
+			resp.Readings[i] = []interface{}{convertTime(uint64(rdg.Time), UOT_STORAGE, uot), rdg.Value}
+		}
+		ret = append(ret, resp)
+	}
+	return ret, nil
+}
+
+// Returns the value of a reading as it is stored for a stream of the given
+// reading type, or false if it is not a valid value for the type. Double
+// values go to the timeseries database, the others to the ObjectStore
+func storedValue(value interface{}, readingType string) (interface{}, bool) {
+	switch readingType {
+	case READINGTYPE_LONG:
+		switch v := value.(type) {
+		case int64:
+			return v, true
+		case uint64:
+			return int64(v), v <= math.MaxInt64
+		case float64:
+			return int64(v), v == math.Trunc(v) && math.Abs(v) < math.MaxInt64
+		}
+		return nil, false
+	case READINGTYPE_STRING:
+		v, ok := value.(string)
+		return v, ok
+	case READINGTYPE_OBJECT:
+		return value, value != nil
+	}
+	return readingValue(value)
+}
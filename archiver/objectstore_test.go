@@ -0,0 +1,66 @@
+package archiver
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParseReadingValue(t *testing.T) {
+	for _, tt := range []struct {
+		value       interface{}
+		readingType string
+		expected    interface{}
+	}{
+		{json.Number("9007199254740993"), "long", int64(9007199254740993)},
+		{json.Number("30"), "", int64(30)},
+		{json.Number("30"), "double", float64(30)},
+		{json.Number("30.5"), "", float64(30.5)},
+		{"open", "string", "open"},
+		{map[string]interface{}{"state": json.Number("3")}, "object", map[string]interface{}{"state": int64(3)}},
+	} {
+		val, err := ParseReadingValue(tt.value, tt.readingType)
+		if err != nil {
+			t.Error(tt.value, "should parse but gave", err)
+		} else if !reflect.DeepEqual(val, tt.expected) {
+			t.Errorf("%v should parse to %#v but gave %#v", tt.value, tt.expected, val)
+		}
+	}
+	if _, err := ParseReadingValue(json.Number("30.5"), "long"); err == nil {
+		t.Error("30.5 should not be a valid long reading")
+	}
+	if _, err := ParseReadingValue(nil, ""); err == nil {
+		t.Error("Readings without a value should give an error")
+	}
+}
+
+func TestStoredValue(t *testing.T) {
+	if val, ok := storedValue(int64(9007199254740993), READINGTYPE_LONG); !ok || val != int64(9007199254740993) {
+		t.Error("Long values should be kept exactly but gave", val)
+	}
+	if val, ok := storedValue(int64(30), READINGTYPE_DOUBLE); !ok || val != float64(30) {
+		t.Error("Double values should be float64 but gave", val)
+	}
+	for _, tt := range []struct {
+		value       interface{}
+		readingType string
+	}{
+		{"open", READINGTYPE_DOUBLE},
+		{float64(1.5), READINGTYPE_LONG},
+		{int64(1), READINGTYPE_STRING},
+		{nil, READINGTYPE_OBJECT},
+	} {
+		if _, ok := storedValue(tt.value, tt.readingType); ok {
+			t.Errorf("%#v should not be a valid %v value", tt.value, tt.readingType)
+		}
+	}
+
+	msg := &SmapMessage{UUID: "a", Readings: [][]interface{}{
+		[]interface{}{uint64(1), "closed"},
+		[]interface{}{uint64(2), float64(1)},
+	}}
+	stored := toStorage(msg, streamProps{uot: UOT_MS, readingType: READINGTYPE_STRING})
+	if len(stored.Readings) != 1 || stored.Readings[0][1] != "closed" || stored.Readings[0][0] != convertTime(1, UOT_MS, UOT_STORAGE) {
+		t.Error("Wrong storage readings for string stream", stored.Readings)
+	}
+}
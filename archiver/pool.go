@@ -6,9 +6,38 @@ import (
 	"time"
 )
 
+// bounds of the exponential backoff between attempts to reach the TSDB
+const (
+	reconnectMinBackoff = 100 * time.Millisecond
+	reconnectMaxBackoff = 30 * time.Second
+)
+
 type connection struct {
-	conn *net.Conn
-	In   chan *[]byte
+	sync.Mutex
+	conn net.Conn
+	// writes waiting to be sent, in order
+	queue []*[]byte
+	// signalled when something is added to queue
+	In chan bool
+	// set once the watchdog has given up the connection; writes must then
+	// go back through ConnectionMap.Add
+	closed bool
+}
+
+// Queues data to be written by the watchdog. Returns false if the
+// connection has been closed
+func (conn *connection) send(data *[]byte) bool {
+	conn.Lock()
+	defer conn.Unlock()
+	if conn.closed {
+		return false
+	}
+	conn.queue = append(conn.queue, data)
+	select {
+	case conn.In <- true:
+	default: // the watchdog has already been signalled
+	}
+	return true
 }
 
 // Giles can create a connection to readingdb for each UUID representing a timeseries. To avoid
@@ -17,72 +46,178 @@ type connection struct {
 // for its UUID within the time out, it closes the connection to readingdb, and refreshes
 // the timout when it receives a reading.
 //
+// If the timeseries database cannot be reached, or a write to it fails, the write and all
+// that follow are held in the backlog (see backlog.go), which a single goroutine replays
+// once the database is back, retrying with exponential backoff. Writes keep their order,
+// so each stream's readings arrive in the order they were received. Once the backlog is
+// full, writes are refused with ErrBacklogFull.
+//
 // Using the pool.ConnectionMap interface is by no means necessary, but it can help with
 // the parallelization of writes to the timeseries database
 type ConnectionMap struct {
 	sync.Mutex
 	streams   map[string]*connection
 	keepalive int
+	backlog   *writeBacklog
 }
 
-func NewConnectionMap(connectionkeepalive int) *ConnectionMap {
-	return &ConnectionMap{streams: map[string]*connection{}, keepalive: connectionkeepalive}
+// Creates a ConnectionMap whose backlog holds at most backlogsize bytes
+func NewConnectionMap(connectionkeepalive, backlogsize int) *ConnectionMap {
+	return &ConnectionMap{streams: map[string]*connection{}, keepalive: connectionkeepalive,
+		backlog: newWriteBacklog(backlogsize)}
 }
 
 // Sends data to the specified timeseries database instance. Assumes the
 // data is associated with the accompanying uuid so it can reuse that connection.
 // Calling cm.Add will create a connection if there isn't one, or send data
-// along a previously existing connection.
-func (cm *ConnectionMap) Add(uuid string, data *[]byte, tsdb TSDB) {
-	if conn := cm.streams[uuid]; conn != nil {
-		conn.In <- data
-	} else {
+// along a previously existing connection. If the database cannot be reached,
+// the data is held in the backlog; returns ErrBacklogFull if there is no room
+// for it there
+func (cm *ConnectionMap) Add(uuid string, data *[]byte, tsdb TSDB) error {
+	for {
 		cm.Lock()
-		defer cm.Unlock()
-		log.Notice("new conn for %v", uuid)
-		// start new watchdog
-		c, err := tsdb.GetConnection()
-		if err != nil {
-			log.Panic("Error connecting to TSDB")
+		// while there is a backlog, new writes wait behind it
+		if cm.backlog.active() {
+			cm.Unlock()
+			return cm.hold(tsdb, data)
 		}
-		conn = &connection{conn: &c, In: make(chan *[]byte)}
-		cm.streams[uuid] = conn
-		go cm.watchdog(uuid)
-		conn.In <- data
+		conn := cm.streams[uuid]
+		if conn == nil {
+			log.Notice("new conn for %v", uuid)
+			c, err := tsdb.GetConnection()
+			if err != nil {
+				cm.Unlock()
+				log.Error("Error connecting to TSDB: %v", err)
+				return cm.hold(tsdb, data)
+			}
+			// start new watchdog
+			conn = &connection{conn: c, In: make(chan bool, 1)}
+			cm.streams[uuid] = conn
+			go cm.watchdog(uuid, conn, tsdb)
+		}
+		cm.Unlock()
+		if conn.send(data) {
+			return nil
+		}
+		// the watchdog closed the connection in the meantime, so try again
+	}
+}
+
+// Puts writes in the backlog, starting the goroutine that replays it if it
+// was empty
+func (cm *ConnectionMap) hold(tsdb TSDB, data ...*[]byte) error {
+	started, err := cm.backlog.push(data...)
+	if started {
+		log.Warning("Holding writes until the TSDB can be reached again")
+		go cm.replay(tsdb)
 	}
+	return err
 }
 
-func (cm *ConnectionMap) watchdog(uuid string) {
-	var timeout <-chan time.Time
-	timer := time.NewTimer(time.Duration(cm.keepalive) * time.Second)
-	timeout = timer.C
-	conn := cm.streams[uuid]
+func (cm *ConnectionMap) watchdog(uuid string, conn *connection, tsdb TSDB) {
+	keepalive := time.Duration(cm.keepalive) * time.Second
+	timer := time.NewTimer(keepalive)
 	for {
-		if conn == nil {
-			return
-		}
 		select {
-		case data := <-conn.In:
-			timer.Reset(time.Duration(cm.keepalive) * time.Second)
-			timeout = timer.C
-			//TODO: fix this reference?
-			//pendingwritescounter.Mark()
-			_, err := (*conn.conn).Write(*data)
-			if err != nil {
-				log.Error("Error writing data to ReadingDB", err)
+		case <-conn.In:
+			timer.Reset(keepalive)
+			conn.Lock()
+			queue := conn.queue
+			conn.queue = nil
+			conn.Unlock()
+			for i, data := range queue {
+				if _, err := conn.conn.Write(*data); err != nil {
+					log.Error("Error writing data to TSDB: %v", err)
+					errorCount.Inc("tsdb")
+					cm.fail(uuid, conn, tsdb, queue[i:])
+					return
+				}
 			}
-		case <-timeout:
+		case <-timer.C:
+			conn.Lock()
+			if len(conn.queue) > 0 { // a write arrived just now
+				conn.Unlock()
+				timer.Reset(keepalive)
+				continue
+			}
+			conn.closed = true
+			conn.Unlock()
 			log.Notice("timeout for %v", uuid)
-			cm.Lock()
-			(*conn.conn).Close()
-			close(conn.In)
-			delete(cm.streams, uuid)
-			cm.Unlock()
+			cm.remove(uuid, conn)
+			return
+		}
+	}
+}
+
+// Gives up a connection whose write failed. The failed writes and any that
+// were queued behind them go to the backlog before anything else, so the
+// stream's readings stay in order
+func (cm *ConnectionMap) fail(uuid string, conn *connection, tsdb TSDB, failed []*[]byte) {
+	cm.Lock()
+	conn.Lock()
+	conn.closed = true
+	failed = append(failed, conn.queue...)
+	conn.queue = nil
+	cm.hold(tsdb, failed...)
+	conn.Unlock()
+	if cm.streams[uuid] == conn {
+		delete(cm.streams, uuid)
+	}
+	cm.Unlock()
+	conn.conn.Close()
+}
+
+func (cm *ConnectionMap) remove(uuid string, conn *connection) {
+	cm.Lock()
+	if cm.streams[uuid] == conn {
+		delete(cm.streams, uuid)
+	}
+	cm.Unlock()
+	conn.conn.Close()
+}
+
+// Replays the backlog over a single connection once the TSDB can be
+// reached, backing off exponentially between attempts
+func (cm *ConnectionMap) replay(tsdb TSDB) {
+	backoff := reconnectMinBackoff
+	for {
+		time.Sleep(backoff)
+		c, err := tsdb.GetConnection()
+		if err != nil {
+			log.Error("Error reconnecting to TSDB (retrying in %v): %v", backoff, err)
+			if backoff *= 2; backoff > reconnectMaxBackoff {
+				backoff = reconnectMaxBackoff
+			}
+			continue
+		}
+		backoff = reconnectMinBackoff
+		for {
+			data := cm.backlog.peek()
+			if data == nil {
+				break
+			}
+			if _, err = c.Write(*data); err != nil {
+				log.Error("Error replaying backlog to TSDB: %v", err)
+				errorCount.Inc("tsdb")
+				break
+			}
+			cm.backlog.pop()
+		}
+		c.Close()
+		if err == nil && cm.backlog.finish() {
+			log.Notice("TSDB is back and the write backlog has been replayed")
 			return
 		}
 	}
 }
 
 func (cm *ConnectionMap) LiveConnections() int {
+	cm.Lock()
+	defer cm.Unlock()
 	return len(cm.streams)
 }
+
+// Returns the number of bytes of writes in the backlog and whether it is full
+func (cm *ConnectionMap) Backlog() (int, bool) {
+	return cm.backlog.status()
+}
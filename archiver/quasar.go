@@ -8,6 +8,7 @@ import (
 	qsr "github.com/gtfierro/giles/internal/quasarcapnp"
 	"net"
 	"sync"
+	"time"
 )
 
 // This is a translator interface for Quasar
@@ -19,6 +20,8 @@ type QDB struct {
 	store      *Store
 	packetpool sync.Pool
 	bufferpool sync.Pool
+	// the unit of time of the timestamps kept in Quasar
+	uot UnitOfTime
 }
 
 type QuasarReading struct {
@@ -32,11 +35,13 @@ type QuasarReading struct {
 // seconds. All communicaton with Quasar is done over a TCP connection that
 // speaks Capn Proto (http://kentonv.github.io/capnproto/). Quasar can also
 // provide a direct HTTP interface, but we choose to implement only the Capn
-// Proto interface for more efficient transport.
-func NewQuasar(address *net.TCPAddr, connectionkeepalive int) *QDB {
+// Proto interface for more efficient transport. Timestamps are kept in Quasar
+// in units of uot
+func NewQuasar(address *net.TCPAddr, connectionkeepalive, backlogsize int, uot UnitOfTime) *QDB {
 	log.Notice("Conneting to Quasar at %v...", address.String())
 	return &QDB{addr: address,
-		cm: NewConnectionMap(connectionkeepalive),
+		uot: uot,
+		cm:  NewConnectionMap(connectionkeepalive, backlogsize),
 		packetpool: sync.Pool{
 			New: func() interface{} {
 				seg := capn.NewBuffer(nil)
@@ -59,7 +64,9 @@ func NewQuasar(address *net.TCPAddr, connectionkeepalive int) *QDB {
 	}
 }
 
-func (q *QDB) receive(conn *net.Conn, limit int32) (SmapResponse, error) {
+// Timestamps are kept in Quasar in q.uot. Query times and the timestamps of
+// the results are in the unit of time of the query
+func (q *QDB) receive(conn *net.Conn, limit int32, uot UnitOfTime) (SmapResponse, error) {
 	var sr = SmapResponse{}
 	seg, err := capn.ReadFromStream(*conn, nil)
 	if err != nil {
@@ -83,7 +90,7 @@ func (q *QDB) receive(conn *net.Conn, limit int32) (SmapResponse, error) {
 			if limit > -1 && int32(i) >= limit {
 				break
 			}
-			sr.Readings = append(sr.Readings, []float64{float64(rec.Time() * 1000), rec.Value()})
+			sr.Readings = append(sr.Readings, []float64{float64(convertTime(uint64(rec.Time()), q.uot, uot)), rec.Value()})
 		}
 		return sr, nil
 	}
@@ -101,7 +108,7 @@ func (q *QDB) Add(sb *StreamBuf) bool {
 	rl := qsr.NewRecordList(qr.seg, len(sb.readings))
 	rla := rl.ToArray()
 	for i, val := range sb.readings {
-		rla[i].SetTime(int64(val[0].(uint64)))
+		rla[i].SetTime(int64(convertTime(val[0].(uint64), UOT_STORAGE, q.uot)))
 		rla[i].SetValue(val[1].(float64))
 	}
 	qr.ins.SetValues(rl)
@@ -113,12 +120,35 @@ func (q *QDB) Add(sb *StreamBuf) bool {
 		return false
 	}
 	data := buf.Bytes()
-	q.cm.Add(sb.uuid, &data, q)
+	err = q.cm.Add(sb.uuid, &data, q)
 	q.packetpool.Put(qr)
-	return true
+	return err == nil
 }
 
-func (q *QDB) queryNearestValue(uuids []string, start uint64, limit int32, backwards bool) ([]SmapResponse, error) {
+// Checks that Quasar answers a nearest-value query (for the nil UUID) within
+// the given timeout. Any response will do
+func (q *QDB) Ping(timeout time.Duration) error {
+	conn, err := q.GetConnection()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	seg := capn.NewBuffer(nil)
+	req := qsr.NewRootRequest(seg)
+	qnv := qsr.NewCmdQueryNearestValue(seg)
+	qnv.SetBackward(true)
+	qnv.SetUuid(make([]byte, 16))
+	req.SetQueryNearestValue(qnv)
+	if _, err = seg.WriteTo(conn); err != nil {
+		return err
+	}
+	_, err = capn.ReadFromStream(conn, nil)
+	return err
+}
+
+func (q *QDB) queryNearestValue(uuids []string, start uint64, limit int32, backwards bool, uot UnitOfTime) ([]SmapResponse, error) {
+	start = convertTime(start, uot, q.uot)
 	var ret = make([]SmapResponse, len(uuids))
 	for i, uu := range uuids {
 		seg := capn.NewBuffer(nil)
@@ -138,7 +168,7 @@ func (q *QDB) queryNearestValue(uuids []string, start uint64, limit int32, backw
 		if err != nil {
 			return ret, err
 		}
-		sr, err := q.receive(&conn, limit)
+		sr, err := q.receive(&conn, limit, uot)
 		sr.UUID = uu
 		ret[i] = sr
 	}
@@ -149,19 +179,17 @@ func (q *QDB) queryNearestValue(uuids []string, start uint64, limit int32, backw
 // queries such as "the last 10 values before now". Currently, Prev and Next will
 // just return the single closest value
 func (q *QDB) Prev(uuids []string, start uint64, limit int32, uot UnitOfTime) ([]SmapResponse, error) {
-	start = convertTime(start, uot, UOT_MS)
-	return q.queryNearestValue(uuids, start, limit, true)
+	return q.queryNearestValue(uuids, start, limit, true, uot)
 }
 
 func (q *QDB) Next(uuids []string, start uint64, limit int32, uot UnitOfTime) ([]SmapResponse, error) {
-	start = convertTime(start, uot, UOT_MS)
-	return q.queryNearestValue(uuids, start, limit, false)
+	return q.queryNearestValue(uuids, start, limit, false, uot)
 }
 
 func (q *QDB) GetData(uuids []string, start uint64, end uint64, uot UnitOfTime) ([]SmapResponse, error) {
 	var ret = make([]SmapResponse, len(uuids))
-	start = convertTime(start, uot, UOT_MS)
-	end = convertTime(end, uot, UOT_MS)
+	start = convertTime(start, uot, q.uot)
+	end = convertTime(end, uot, q.uot)
 	for i, uu := range uuids {
 		seg := capn.NewBuffer(nil)
 		req := qsr.NewRootRequest(seg)
@@ -180,13 +208,47 @@ func (q *QDB) GetData(uuids []string, start uint64, end uint64, uot UnitOfTime)
 		if err != nil {
 			return ret, err
 		}
-		sr, err := q.receive(&conn, -1)
+		sr, err := q.receive(&conn, -1, uot)
 		sr.UUID = uu
 		ret[i] = sr
 	}
 	return ret, nil
 }
 
+func (q *QDB) Delete(uuids []string, start uint64, end uint64, uot UnitOfTime) error {
+	start = convertTime(start, uot, q.uot)
+	end = convertTime(end, uot, q.uot)
+	for _, uu := range uuids {
+		seg := capn.NewBuffer(nil)
+		req := qsr.NewRootRequest(seg)
+		del := qsr.NewCmdDeleteValues(seg)
+		uuid := uuidlib.Parse(uu)
+		del.SetUuid([]byte(uuid))
+		del.SetStartTime(int64(start))
+		del.SetEndTime(int64(end))
+		req.SetDeleteValues(del)
+		conn, err := q.GetConnection()
+		if err != nil {
+			log.Error("Error getting connection %v", err)
+			return err
+		}
+		_, err = seg.WriteTo(conn)
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		seg, err = capn.ReadFromStream(conn, nil)
+		conn.Close()
+		if err != nil {
+			return err
+		}
+		if resp := qsr.ReadRootResponse(seg); resp.StatusCode() != qsr.STATUSCODE_OK {
+			return errors.New("Error deleting from Quasar: " + resp.StatusCode().String())
+		}
+	}
+	return nil
+}
+
 func (q *QDB) GetConnection() (net.Conn, error) {
 	conn, err := net.DialTCP("tcp", nil, q.addr)
 	if err == nil {
@@ -196,7 +258,11 @@ func (q *QDB) GetConnection() (net.Conn, error) {
 }
 
 func (q *QDB) LiveConnections() int {
-	return 0
+	return q.cm.LiveConnections()
+}
+
+func (q *QDB) Backlog() (int, bool) {
+	return q.cm.Backlog()
 }
 
 func (q *QDB) AddStore(s *Store) {
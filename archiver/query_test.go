@@ -1,7 +1,9 @@
 package archiver
 
 import (
+	"gopkg.in/mgo.v2/bson"
 	"reflect"
+	"regexp"
 	"testing"
 )
 
@@ -58,3 +60,81 @@ func TestSimple(t *testing.T) {
 		t.Error(query, "\nshould have target", st_type, "but has target", reflect.TypeOf(ast.Target))
 	}
 }
+
+func TestBeforeNow(t *testing.T) {
+	var query string
+	var target *dataTarget
+
+	query = "select data before now where has uuid"
+	target = parse(query).Target.(*dataTarget)
+	if !target.RefIsNow {
+		t.Error(query, "\nshould have RefIsNow set")
+	}
+
+	query = "select data before now -1h where has uuid"
+	target = parse(query).Target.(*dataTarget)
+	if target.RefIsNow {
+		t.Error(query, "\nshould not have RefIsNow set")
+	}
+}
+
+func TestWhereClause(t *testing.T) {
+	for where, expected := range map[string]bson.M{
+		"Metadata/Type = 'Temp'":                         {"Metadata.Type": "Temp"},
+		"Metadata/Type = Temp":                           {"Metadata.Type": "Temp"},
+		"Metadata/Name = 'a=b'":                          {"Metadata.Name": "a=b"},
+		"Metadata/Name = \"it's\"":                       {"Metadata.Name": "it's"},
+		"Metadata/Floor = 3":                             {"Metadata.Floor": bson.M{"$in": []interface{}{float64(3), "3"}}},
+		"Metadata/Floor = '3'":                           {"Metadata.Floor": "3"},
+		"Metadata/Enabled = true":                        {"Metadata.Enabled": bson.M{"$in": []interface{}{true, "true"}}},
+		"Metadata/Type != 'Temp'":                        {"Metadata.Type": bson.M{"$ne": "Temp"}},
+		"Metadata/Floor != 3":                            {"Metadata.Floor": bson.M{"$nin": []interface{}{float64(3), "3"}}},
+		"Metadata/Floor >= 3":                            rangeQuery("Metadata.Floor", "$gte", float64(3)),
+		"Metadata/Floor>3":                               rangeQuery("Metadata.Floor", "$gt", float64(3)),
+		"Metadata/Floor < 2.5":                           rangeQuery("Metadata.Floor", "$lt", 2.5),
+		"Metadata/Floor <= '3'":                          {"Metadata.Floor": bson.M{"$lte": "3"}},
+		"Properties/UnitofMeasure in ('W','kW')":         {"Properties.UnitofMeasure": bson.M{"$in": []interface{}{"W", "kW"}}},
+		"Properties/UnitofMeasure in ( 'W', 'k, W' )":    {"Properties.UnitofMeasure": bson.M{"$in": []interface{}{"W", "k, W"}}},
+		"Metadata/Floor in (1, 2)":                       {"Metadata.Floor": bson.M{"$in": []interface{}{float64(1), "1", float64(2), "2"}}},
+		"Metadata/Name like 'a.b%'":                      {"Metadata.Name": bson.M{"$regex": "a\\.b.*"}},
+		"Metadata/Name ~ '^a.b'":                         {"Metadata.Name": bson.M{"$regex": "^a.b"}},
+		"has Metadata/Floor":                             {"Metadata.Floor": bson.M{"$exists": true}},
+		"Metadata/Floor >= 3 and Metadata/Type = 'Temp'": {"$and": []bson.M{rangeQuery("Metadata.Floor", "$gte", float64(3)), {"Metadata.Type": "Temp"}}},
+	} {
+		ast := parse("select * where " + where)
+		if res := ast.Where.ToBson(); !reflect.DeepEqual(res, expected) {
+			t.Error(where, "\nshould be", expected, "but is", res)
+		}
+	}
+
+	// numbers are also compared with the numbers stored as strings
+	expected := bson.M{"$or": []bson.M{
+		{"Metadata.Floor": bson.M{"$gte": float64(3)}},
+		{"Metadata.Floor": bson.M{"$regex": numericString}, "$expr": bson.M{"$gte": []interface{}{
+			bson.M{"$convert": bson.M{"input": "$Metadata.Floor", "to": "double", "onError": nil, "onNull": nil}}, float64(3)}}},
+	}}
+	if res := parse("select * where Metadata/Floor >= 3").Where.ToBson(); !reflect.DeepEqual(res, expected) {
+		t.Error("Metadata/Floor >= 3\nshould be", expected, "but is", res)
+	}
+	for _, where := range []string{"Metadata/Site", "Metadata/Site =", "has", "and Metadata/Site = 'a'", "Metadata/Site = 'a' or", "Metadata/Site is 'a'", "Metadata/Site = 'a' Metadata/Floor = 3"} {
+		tokens := tokenize(where)
+		if _, err := parseWhere(&tokens); err == nil {
+			t.Error("Malformed where clause", where, "should give an error")
+		}
+		if _, err := makeAST(tokenize("select * where " + where)); err == nil {
+			t.Error("Query with malformed where clause", where, "should give an error")
+		}
+	}
+
+	numeric := regexp.MustCompile(numericString)
+	for str, matches := range map[string]bool{"3": true, "10": true, "-2.5": true, "x": false, "3a": false, " 3": false, "": false} {
+		if numeric.MatchString(str) != matches {
+			t.Errorf("%q should be numeric: %v", str, matches)
+		}
+	}
+
+	target := parse("set Metadata/Name = 'Soda Hall' where has uuid").Target.(*setTarget)
+	if target.Updates["Metadata.Name"] != "Soda Hall" {
+		t.Error("Set values should be unquoted", target.Updates)
+	}
+}
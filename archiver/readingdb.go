@@ -3,8 +3,10 @@ package archiver
 import (
 	"code.google.com/p/goprotobuf/proto"
 	"encoding/binary"
+	"errors"
 	rdbp "github.com/gtfierro/giles/internal/readingdbproto"
 	"net"
+	"time"
 )
 
 var streamids = make(map[string]uint32)
@@ -33,32 +35,16 @@ type SmapResponse struct {
    We will probably want to queue up the serialization of a bunch
    and then write in bulk.
 */
-func NewMessage(sb *StreamBuf, store *Store) *Message {
+func NewMessage(sb *StreamBuf, store *Store, uot UnitOfTime) *Message {
 	m := &Message{}
-	var timestamp uint64
-	var value float64
-	var seqno uint64
 	var streamid uint32 = store.getStreamId(sb.uuid)
 	if streamid == 0 {
 		log.Error("error committing streamid")
 		return nil
 	}
-	var substream uint32 = 0
-
-	// create ReadingSet
-	readingset := &rdbp.ReadingSet{Streamid: &streamid,
-		Substream: &substream,
-		Data:      make([](*rdbp.Reading), len(sb.readings), len(sb.readings))}
-	// populate readings
-	for i, reading := range sb.readings {
-		timestamp = reading[0].(uint64)
-		value = reading[1].(float64)
-		seqno = uint64(i)
-		(*readingset).Data[i] = &rdbp.Reading{Timestamp: &timestamp, Seqno: &seqno, Value: &value}
-	}
 
 	// marshal for sending over wire
-	data, err := proto.Marshal(readingset)
+	data, err := proto.Marshal(newReadingSet(streamid, sb, uot))
 	if err != nil {
 		log.Panic("Error marshaling ReadingSet:", err)
 		return nil
@@ -71,6 +57,23 @@ func NewMessage(sb *StreamBuf, store *Store) *Message {
 	return m
 }
 
+// Builds the ReadingSet for the readings of sb, with their timestamps
+// converted from UOT_STORAGE to uot. Every reading gets its own timestamp,
+// seqno and value, as the set is only marshaled once it is full
+func newReadingSet(streamid uint32, sb *StreamBuf, uot UnitOfTime) *rdbp.ReadingSet {
+	var substream uint32 = 0
+	readingset := &rdbp.ReadingSet{Streamid: &streamid,
+		Substream: &substream,
+		Data:      make([](*rdbp.Reading), len(sb.readings), len(sb.readings))}
+	for i, reading := range sb.readings {
+		timestamp := convertTime(reading[0].(uint64), UOT_STORAGE, uot)
+		value := reading[1].(float64)
+		seqno := uint64(i)
+		readingset.Data[i] = &rdbp.Reading{Timestamp: &timestamp, Seqno: &seqno, Value: &value}
+	}
+	return readingset
+}
+
 func (m *Message) ToBytes() []byte {
 	onthewire := make([]byte, 8)
 	binary.BigEndian.PutUint32(onthewire, uint32(m.header.Type))
@@ -87,6 +90,8 @@ type RDB struct {
 	In    chan *[]byte
 	cm    *ConnectionMap
 	store *Store
+	// the unit of time of the timestamps kept in ReadingDB
+	uot UnitOfTime
 }
 
 // Create a new reference to a ReadingDB instance running at ip:port.
@@ -95,13 +100,14 @@ type RDB struct {
 // a TCP connection that speaks protobuf
 // (https://developers.google.com/protocol-buffers/). For a description and
 // implementation of ReadingDB protobuf, please see
-// https://github.com/gtfierro/giles/archiver/internal/readingdbproto
-func NewReadingDB(address *net.TCPAddr, connectionkeepalive int) *RDB {
+// https://github.com/gtfierro/giles/archiver/internal/readingdbproto.
+// Timestamps are kept in ReadingDB in units of uot
+func NewReadingDB(address *net.TCPAddr, connectionkeepalive, backlogsize int, uot UnitOfTime) *RDB {
 	log.Notice("Connecting to ReadingDB at %v...", address.String())
-	log.Notice("...connected!")
 	rdb := &RDB{addr: address,
-		In: make(chan *[]byte),
-		cm: NewConnectionMap(connectionkeepalive)}
+		In:  make(chan *[]byte),
+		cm:  NewConnectionMap(connectionkeepalive, backlogsize),
+		uot: uot}
 	return rdb
 }
 
@@ -125,16 +131,45 @@ func (rdb *RDB) Add(sb *StreamBuf) bool {
 	if sb.readings == nil || len(sb.readings) == 0 {
 		return false
 	}
-	m := NewMessage(sb, rdb.store)
+	m := NewMessage(sb, rdb.store, rdb.uot)
 
 	data := m.ToBytes()
-	rdb.cm.Add(sb.uuid, &data, rdb)
+	if err := rdb.cm.Add(sb.uuid, &data, rdb); err != nil {
+		return false
+	}
 
 	return true
 }
 
-// Sends a packet, constructs header, and then listens on that connection and returns the response
-func (rdb *RDB) sendAndReceive(payload []byte, msgtype rdbp.MessageType, conn *net.Conn) (SmapResponse, error) {
+// Checks that ReadingDB answers a nearest-value query (for stream id 0, which
+// Giles never assigns) within the given timeout
+func (rdb *RDB) Ping(timeout time.Duration) error {
+	conn, err := rdb.GetConnection()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	var sid, substream, n uint32 = 0, 0, 1
+	var ref uint64 = 0
+	var direction = rdbp.Nearest_PREV
+	query := &rdbp.Nearest{Streamid: &sid, Substream: &substream,
+		Reference: &ref, Direction: &direction, N: &n}
+	data, err := proto.Marshal(query)
+	if err != nil {
+		return err
+	}
+	m := &Message{header: &header{Type: rdbp.MessageType_NEAREST, Length: uint32(len(data))}, data: data}
+	if _, err = conn.Write(m.ToBytes()); err != nil {
+		return err
+	}
+	_, err = rdb.receiveResponse(&conn)
+	return err
+}
+
+// Sends a packet, constructs header, and then listens on that connection and
+// returns the response with its timestamps in units of uot
+func (rdb *RDB) sendAndReceive(payload []byte, msgtype rdbp.MessageType, conn *net.Conn, uot UnitOfTime) (SmapResponse, error) {
 	var sr SmapResponse
 	var err error
 	m := &Message{}
@@ -146,7 +181,7 @@ func (rdb *RDB) sendAndReceive(payload []byte, msgtype rdbp.MessageType, conn *n
 		log.Error("Error writing data to ReadingDB", err)
 		return sr, err
 	}
-	sr, err = rdb.receiveData(conn)
+	sr, err = rdb.receiveData(conn, uot)
 	return sr, err
 }
 
@@ -160,7 +195,7 @@ func (rdb *RDB) Prev(uuids []string, ref uint64, limit int32, query_uot UnitOfTi
 	var substream uint32 = 0
 	var direction = rdbp.Nearest_PREV
 	var sr SmapResponse
-	ref = convertTime(ref, query_uot, UOT_MS)
+	ref = convertTime(ref, query_uot, rdb.uot)
 
 	for _, uuid := range uuids {
 		conn, err := rdb.GetConnection()
@@ -172,7 +207,7 @@ func (rdb *RDB) Prev(uuids []string, ref uint64, limit int32, query_uot UnitOfTi
 		query := &rdbp.Nearest{Streamid: &sid, Substream: &substream,
 			Reference: &ref, Direction: &direction, N: &u_limit}
 		data, err = proto.Marshal(query)
-		sr, err = rdb.sendAndReceive(data, rdbp.MessageType_NEAREST, &conn)
+		sr, err = rdb.sendAndReceive(data, rdbp.MessageType_NEAREST, &conn, query_uot)
 		sr.UUID = uuid
 		retdata = append(retdata, sr)
 	}
@@ -189,7 +224,7 @@ func (rdb *RDB) Next(uuids []string, ref uint64, limit int32, query_uot UnitOfTi
 	var substream uint32 = 0
 	var direction = rdbp.Nearest_NEXT
 	var sr SmapResponse
-	ref = convertTime(ref, query_uot, UOT_MS)
+	ref = convertTime(ref, query_uot, rdb.uot)
 
 	for _, uuid := range uuids {
 		conn, err := rdb.GetConnection()
@@ -201,7 +236,7 @@ func (rdb *RDB) Next(uuids []string, ref uint64, limit int32, query_uot UnitOfTi
 		query := &rdbp.Nearest{Streamid: &sid, Substream: &substream,
 			Reference: &ref, Direction: &direction, N: &u_limit}
 		data, err = proto.Marshal(query)
-		sr, err = rdb.sendAndReceive(data, rdbp.MessageType_NEAREST, &conn)
+		sr, err = rdb.sendAndReceive(data, rdbp.MessageType_NEAREST, &conn, query_uot)
 		sr.UUID = uuid
 		retdata = append(retdata, sr)
 	}
@@ -214,8 +249,8 @@ func (rdb *RDB) GetData(uuids []string, start, end uint64, query_uot UnitOfTime)
 	if start > end {
 		start, end = end, start
 	}
-	start = convertTime(start, query_uot, UOT_MS)
-	end = convertTime(end, query_uot, UOT_MS)
+	start = convertTime(start, query_uot, rdb.uot)
+	end = convertTime(end, query_uot, rdb.uot)
 	var err error
 	var retdata = []SmapResponse{}
 	var data []byte
@@ -231,7 +266,7 @@ func (rdb *RDB) GetData(uuids []string, start, end uint64, query_uot UnitOfTime)
 		query := &rdbp.Query{Streamid: &sid, Substream: &substream,
 			Starttime: &start, Endtime: &end, Action: &action}
 		data, err = proto.Marshal(query)
-		sr, err = rdb.sendAndReceive(data, rdbp.MessageType_QUERY, &conn)
+		sr, err = rdb.sendAndReceive(data, rdbp.MessageType_QUERY, &conn, query_uot)
 		sr.UUID = uuid
 		retdata = append(retdata, sr)
 	}
@@ -239,14 +274,39 @@ func (rdb *RDB) GetData(uuids []string, start, end uint64, query_uot UnitOfTime)
 }
 
 /*
- * Listens for data coming from ReadingDB
+ * Listens for data coming from ReadingDB. ReadingDB holds timestamps in
+ * rdb.uot; they are returned in units of uot
 **/
-func (rdb *RDB) receiveData(conn *net.Conn) (SmapResponse, error) {
-	// buffer for received bytes
+func (rdb *RDB) receiveData(conn *net.Conn, uot UnitOfTime) (SmapResponse, error) {
 	var sr = SmapResponse{}
-	var err error
+	response, err := rdb.receiveResponse(conn)
+	if err != nil {
+		return sr, err
+	}
+	data := response.GetData()
+	if data == nil {
+		log.Error("No data returned from Readingdb")
+		return sr, err
+	}
+	//sr.UUID = uuid
+	sr.Readings = [][]float64{}
+	for _, rdg := range data.GetData() {
+		sr.Readings = append(sr.Readings, []float64{float64(convertTime(*rdg.Timestamp, rdb.uot, uot)), *rdg.Value})
+	}
+	return sr, err
+}
+
+// Reads one Response message from ReadingDB
+func (rdb *RDB) receiveResponse(conn *net.Conn) (*rdbp.Response, error) {
+	// buffer for received bytes
 	recv := make([]byte, 2048)
-	n, _ := (*conn).Read(recv)
+	n, err := (*conn).Read(recv)
+	if n < 8 {
+		if err == nil {
+			err = errors.New("Short response from ReadingDB")
+		}
+		return nil, err
+	}
 	recv = recv[:n] // truncate to the length of known valid data
 	// message type is first 4 bytes TODO: use it?
 	_ = binary.BigEndian.Uint32(recv[:4])
@@ -272,22 +332,53 @@ func (rdb *RDB) receiveData(conn *net.Conn) (SmapResponse, error) {
 	err = proto.Unmarshal(recv[8:msglen+8], response)
 	if err != nil {
 		log.Error("Error receiving data from Readingdb:", err)
-		return sr, err
+		return nil, err
 	}
-	data := response.GetData()
-	if data == nil {
-		log.Error("No data returned from Readingdb")
-		return sr, err
+	return response, nil
+}
+
+// Deletes all data between (and including) [start] and [end] for each of
+// the streams
+func (rdb *RDB) Delete(uuids []string, start, end uint64, query_uot UnitOfTime) error {
+	if start > end {
+		start, end = end, start
 	}
-	//sr.UUID = uuid
-	sr.Readings = [][]float64{}
-	for _, rdg := range data.GetData() {
-		//TODO: this *1000 should probably generalized for the unitoftime
-		sr.Readings = append(sr.Readings, []float64{float64(*rdg.Timestamp) * 1000, *rdg.Value})
+	start = convertTime(start, query_uot, rdb.uot)
+	end = convertTime(end, query_uot, rdb.uot)
+	var substream uint32 = 0
+	for _, uuid := range uuids {
+		conn, err := rdb.GetConnection()
+		if err != nil {
+			return err
+		}
+		sid := rdb.store.getStreamId(uuid)
+		del := &rdbp.Delete{Streamid: &sid, Substream: &substream, Starttime: &start, Endtime: &end}
+		data, err := proto.Marshal(del)
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		m := &Message{header: &header{Type: rdbp.MessageType_DELETE, Length: uint32(len(data))}, data: data}
+		if _, err = conn.Write(m.ToBytes()); err != nil {
+			conn.Close()
+			return err
+		}
+		response, err := rdb.receiveResponse(&conn)
+		conn.Close()
+		if err != nil {
+			return err
+		}
+		if response.GetError() != rdbp.Response_OK {
+			return errors.New("Error deleting from ReadingDB: " + response.GetError().String())
+		}
 	}
-	return sr, err
+	return nil
 }
 
 func (rdb *RDB) LiveConnections() int {
 	return rdb.cm.LiveConnections()
 }
+
+func (rdb *RDB) Backlog() (int, bool) {
+	return rdb.cm.Backlog()
+}
@@ -0,0 +1,31 @@
+package archiver
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	rdbp "github.com/gtfierro/giles/internal/readingdbproto"
+	"testing"
+)
+
+func TestNewReadingSet(t *testing.T) {
+	sb := &StreamBuf{uuid: "a", readings: [][]interface{}{
+		{convertTime(1000, UOT_MS, UOT_STORAGE), float64(1)},
+		{convertTime(2000, UOT_MS, UOT_STORAGE), float64(2)},
+		{convertTime(3000, UOT_MS, UOT_STORAGE), float64(3)},
+	}}
+	data, err := proto.Marshal(newReadingSet(7, sb, UOT_MS))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var readingset rdbp.ReadingSet
+	if err := proto.Unmarshal(data, &readingset); err != nil {
+		t.Fatal(err)
+	}
+	if readingset.GetStreamid() != 7 || len(readingset.Data) != 3 {
+		t.Fatal("Wrong reading set", readingset.String())
+	}
+	for i, reading := range readingset.Data {
+		if reading.GetTimestamp() != uint64(1000*(i+1)) || reading.GetValue() != float64(i+1) || reading.GetSeqno() != uint64(i) {
+			t.Error("Reading", i, "should keep its own timestamp, value and seqno, not", reading.String())
+		}
+	}
+}
@@ -0,0 +1,320 @@
+package archiver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HTTP header that marks a POST to /add as forwarded by another archiver. Its
+// value names the archiver it came from
+const ReplicaHeader = "X-Giles-Replica"
+
+// how many journal entries are forwarded in one request
+const replicationBatch = 500
+
+// bounds on the wait between attempts to reach the upstream archiver
+const (
+	minReplicationBackoff = time.Second
+	maxReplicationBackoff = time.Minute
+)
+
+// One message as it was accepted, kept in the journal collection until the
+// upstream archiver has it. Sequence numbers give the order of the journal
+type journalEntry struct {
+	Seq  uint64 `bson:"seq"`
+	Path string `bson:"path"`
+	// the message, as the sMAP JSON sent to /add
+	Message string `bson:"message"`
+}
+
+// A sMAP message in the form /add takes it
+type replicatedMessage struct {
+	UUID       string          `json:"uuid,omitempty"`
+	Readings   [][]interface{} `json:",omitempty"`
+	Contents   []string        `json:",omitempty"`
+	Metadata   bson.M          `json:",omitempty"`
+	Actuator   bson.M          `json:",omitempty"`
+	Properties bson.M          `json:",omitempty"`
+}
+
+func newReplicatedMessage(msg *SmapMessage) replicatedMessage {
+	return replicatedMessage{UUID: msg.UUID, Readings: msg.Readings, Contents: msg.Contents,
+		Metadata: msg.Metadata, Actuator: msg.Actuator, Properties: msg.Properties}
+}
+
+// The Replicator forwards what this archiver accepts to an upstream archiver,
+// e.g. from a field site with a flaky uplink:
+//
+//    [Replication]
+//    Enabled=true
+//    Upstream=http://archiver.example.com:8079
+//    Key=<api key on the upstream archiver>
+//
+// Every message accepted by AddData (readings and metadata alike) is written
+// to the journal collection in MongoDB before it is acknowledged, and a
+// goroutine POSTs the journal, in order and in batches of replicationBatch,
+// to the upstream's /add/<key>. How far the upstream has got is kept as a
+// cursor in the replication collection, so forwarding picks up where it left
+// off after a disconnect or a restart. Entries are removed from the journal
+// once they have been acknowledged.
+//
+// A batch whose acknowledgement is lost is sent again, so the upstream drops
+// the readings it already has for the same UUID and timestamp (see
+// Archiver.AddReplicated). Forwarding uses HTTP rather than MsgPack/TCP,
+// which does not acknowledge writes and so could not advance the cursor.
+// Tags changed through the query interface are not forwarded.
+type Replicator struct {
+	// held while writing to the journal, so that entries are inserted in
+	// the order of their sequence numbers
+	sync.Mutex
+	store    *Store
+	upstream string
+	key      string
+	source   string
+	client   *http.Client
+	// the last sequence number given out
+	seq  uint64
+	wake chan bool
+	// how far the upstream has got, and how the last attempt went
+	statuslock sync.Mutex
+	cursor     uint64
+	lastSent   time.Time
+	lastError  string
+}
+
+func NewReplicator(store *Store, upstream, key string) (*Replicator, error) {
+	if !strings.HasPrefix(upstream, "http://") && !strings.HasPrefix(upstream, "https://") {
+		return nil, fmt.Errorf("Upstream archiver should be an http:// or https:// URL, not %v", upstream)
+	}
+	upstream = strings.TrimRight(upstream, "/")
+	source, err := os.Hostname()
+	if err != nil {
+		source = "giles"
+	}
+	r := &Replicator{store: store, upstream: upstream, key: key, source: source,
+		client: &http.Client{Timeout: 30 * time.Second}, wake: make(chan bool, 1)}
+	if r.cursor, err = store.getReplicationCursor(upstream); err != nil {
+		return nil, err
+	}
+	if r.seq, err = store.maxJournalSeq(); err != nil {
+		return nil, err
+	}
+	if r.seq < r.cursor {
+		r.seq = r.cursor
+	}
+	return r, nil
+}
+
+// Writes the messages to the journal. Returns an error if they could not be
+// written, in which case they should not be acknowledged
+func (r *Replicator) Journal(readings map[string]*SmapMessage) error {
+	r.Lock()
+	defer r.Unlock()
+	entries := make([]interface{}, 0, len(readings))
+	seq := r.seq
+	for path, msg := range readings {
+		body, err := json.Marshal(newReplicatedMessage(msg))
+		if err != nil {
+			return fmt.Errorf("Could not journal %v: %v", path, err)
+		}
+		seq++
+		entries = append(entries, journalEntry{Seq: seq, Path: path, Message: string(body)})
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	// sequence numbers are not reused even if the insert fails partway
+	r.seq = seq
+	if err := r.store.appendJournal(entries); err != nil {
+		errorCount.Inc("replication")
+		return err
+	}
+	select {
+	case r.wake <- true:
+	default:
+	}
+	return nil
+}
+
+// Forwards the journal to the upstream archiver, forever
+func (r *Replicator) run() {
+	log.Notice("Forwarding to %v from entry %v", r.upstream, r.Cursor())
+	backoff := minReplicationBackoff
+	for {
+		entries, err := r.store.getJournal(r.Cursor(), replicationBatch)
+		if err == nil && len(entries) == 0 {
+			select {
+			case <-r.wake:
+			case <-time.After(10 * time.Second):
+			}
+			continue
+		}
+		if err == nil {
+			err = r.send(entries)
+		}
+		if err != nil {
+			log.Error("Error forwarding to %v (retrying in %v): %v", r.upstream, backoff, err)
+			errorCount.Inc("replication")
+			r.setStatus(0, err)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > maxReplicationBackoff {
+				backoff = maxReplicationBackoff
+			}
+			continue
+		}
+		backoff = minReplicationBackoff
+		last := entries[len(entries)-1].Seq
+		r.setStatus(last, nil)
+		// the journal is only trimmed once the cursor is safe, so at worst a
+		// restart sends a batch again
+		if err := r.store.saveReplicationCursor(r.upstream, last); err != nil {
+			log.Error("Error saving replication cursor: %v", err)
+			errorCount.Inc("replication")
+		} else if err := r.store.trimJournal(last); err != nil {
+			log.Error("Error trimming the replication journal: %v", err)
+			errorCount.Inc("replication")
+		}
+	}
+}
+
+// POSTs the entries to the upstream archiver's /add
+func (r *Replicator) send(entries []journalEntry) error {
+	body, err := json.Marshal(mergeJournal(entries))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", r.upstream+"/add/"+r.key, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(ReplicaHeader, r.source)
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("Upstream answered %v: %s", resp.Status, msg)
+	}
+	return nil
+}
+
+// Combines the entries into one /add body. Entries for the same path have
+// their readings appended in order, and later metadata, properties and
+// actuators override earlier ones key by key
+func mergeJournal(entries []journalEntry) map[string]*replicatedMessage {
+	merged := make(map[string]*replicatedMessage)
+	for _, entry := range entries {
+		var msg replicatedMessage
+		decoder := json.NewDecoder(strings.NewReader(entry.Message))
+		// keeps timestamps and values exactly as they were accepted
+		decoder.UseNumber()
+		if err := decoder.Decode(&msg); err != nil {
+			log.Error("Skipping journal entry %v for %v: %v", entry.Seq, entry.Path, err)
+			errorCount.Inc("replication")
+			continue
+		}
+		prev, found := merged[entry.Path]
+		if !found {
+			merged[entry.Path] = &msg
+			continue
+		}
+		if prev.UUID == "" {
+			prev.UUID = msg.UUID
+		}
+		prev.Readings = append(prev.Readings, msg.Readings...)
+		prev.Contents = append(prev.Contents, msg.Contents...)
+		prev.Metadata = mergeDocument(prev.Metadata, msg.Metadata)
+		prev.Actuator = mergeDocument(prev.Actuator, msg.Actuator)
+		prev.Properties = mergeDocument(prev.Properties, msg.Properties)
+	}
+	return merged
+}
+
+func mergeDocument(into, from bson.M) bson.M {
+	if into == nil {
+		return from
+	}
+	for k, v := range from {
+		into[k] = v
+	}
+	return into
+}
+
+// Returns the sequence number of the last journal entry the upstream has
+func (r *Replicator) Cursor() uint64 {
+	r.statuslock.Lock()
+	defer r.statuslock.Unlock()
+	return r.cursor
+}
+
+// Returns how many journal entries are waiting to be forwarded
+func (r *Replicator) Pending() uint64 {
+	r.Lock()
+	seq := r.seq
+	r.Unlock()
+	if cursor := r.Cursor(); seq > cursor {
+		return seq - cursor
+	}
+	return 0
+}
+
+// Records a successful forward up to cursor, or the error of a failed one
+func (r *Replicator) setStatus(cursor uint64, err error) {
+	r.statuslock.Lock()
+	defer r.statuslock.Unlock()
+	if err != nil {
+		r.lastError = err.Error()
+		return
+	}
+	r.cursor = cursor
+	r.lastSent = time.Now()
+	r.lastError = ""
+}
+
+// Describes how forwarding is going, for the SSH shell
+func (r *Replicator) Status() string {
+	pending := r.Pending()
+	r.statuslock.Lock()
+	defer r.statuslock.Unlock()
+	lines := []string{"upstream: " + r.upstream,
+		fmt.Sprintf("forwarded up to entry: %v", r.cursor),
+		fmt.Sprintf("entries waiting: %v", pending)}
+	if !r.lastSent.IsZero() {
+		lines = append(lines, "last forwarded: "+r.lastSent.String())
+	}
+	if r.lastError != "" {
+		lines = append(lines, "last error: "+r.lastError)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Removes the readings of msg whose timestamps, converted from uot to
+// UOT_STORAGE, are in stored. Readings without a valid timestamp are kept, so
+// that they are reported where they would have been. Returns how many were
+// removed
+func dropStoredReadings(msg *SmapMessage, uot UnitOfTime, stored map[uint64]bool) int {
+	kept := msg.Readings[:0]
+	for _, rdg := range msg.Readings {
+		if len(rdg) > 0 {
+			if ts, ok := readingTime(rdg[0]); ok && stored[convertTime(ts, uot, UOT_STORAGE)] {
+				continue
+			}
+		}
+		kept = append(kept, rdg)
+	}
+	dropped := len(msg.Readings) - len(kept)
+	msg.Readings = kept
+	return dropped
+}
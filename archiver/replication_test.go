@@ -0,0 +1,82 @@
+package archiver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func journalOf(t *testing.T, seq uint64, path string, msg replicatedMessage) journalEntry {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return journalEntry{Seq: seq, Path: path, Message: string(body)}
+}
+
+func TestReplicatorSend(t *testing.T) {
+	var received map[string]*SmapMessage
+	var source string
+	up := true
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if !up {
+			rw.WriteHeader(503)
+			return
+		}
+		if req.URL.Path != "/add/secret" {
+			t.Error("Should forward to /add/<key>, not", req.URL.Path)
+		}
+		source = req.Header.Get(ReplicaHeader)
+		var err error
+		if received, _, err = handleJSON(req.Body); err != nil {
+			t.Error("Upstream could not parse the forwarded messages:", err)
+		}
+	}))
+	defer upstream.Close()
+
+	r := &Replicator{upstream: upstream.URL, key: "secret", source: "site", client: http.DefaultClient}
+	entries := []journalEntry{
+		journalOf(t, 1, "/a", replicatedMessage{UUID: "a", Readings: [][]interface{}{{uint64(1429000000123456), float64(1.5)}},
+			Properties: map[string]interface{}{"UnitofTime": "us"}, Metadata: map[string]interface{}{"Site": "x"}}),
+		journalOf(t, 2, "/b", replicatedMessage{Metadata: map[string]interface{}{"Building": "y"}}),
+		journalOf(t, 3, "/a", replicatedMessage{UUID: "a", Readings: [][]interface{}{{uint64(1429000000123457), float64(2)}},
+			Metadata: map[string]interface{}{"Site": "z"}}),
+	}
+	if err := r.send(entries); err != nil {
+		t.Fatal("Send failed:", err)
+	}
+	if source != "site" {
+		t.Error("Forwarded requests should name their source, not", source)
+	}
+	a := received["/a"]
+	if a == nil || a.UUID != "a" || len(a.Readings) != 2 {
+		t.Fatal("Entries for the same path should be merged, but got", a)
+	}
+	if ts := a.Readings[0][0].(uint64); ts != 1429000000123456 {
+		t.Error("Timestamps should be forwarded exactly, but got", ts)
+	}
+	if a.Metadata["Site"] != "z" || a.Properties["UnitofTime"] != "us" {
+		t.Error("Later metadata should override earlier metadata, but got", a.Metadata, a.Properties)
+	}
+	if b := received["/b"]; b == nil || b.Metadata["Building"] != "y" {
+		t.Error("Metadata without readings should be forwarded, but got", b)
+	}
+
+	up = false
+	if err := r.send(entries); err == nil {
+		t.Error("A refused batch should give an error, so that it is sent again")
+	}
+}
+
+func TestDropStoredReadings(t *testing.T) {
+	msg := &SmapMessage{UUID: "a", Readings: [][]interface{}{
+		{uint64(1000), float64(1)}, {uint64(2000), float64(2)}, {"bad", float64(0)}, {uint64(3000), float64(3)}}}
+	stored := map[uint64]bool{convertTime(2000, UOT_MS, UOT_STORAGE): true, convertTime(3000, UOT_MS, UOT_STORAGE): true}
+	if dropped := dropStoredReadings(msg, UOT_MS, stored); dropped != 2 {
+		t.Error("Should drop the 2 readings that are already stored, not", dropped)
+	}
+	if len(msg.Readings) != 2 || msg.Readings[0][0] != uint64(1000) || msg.Readings[1][0] != "bad" {
+		t.Error("Wrong readings kept", msg.Readings)
+	}
+}
@@ -1,5 +1,12 @@
 package archiver
 
+import (
+	"gopkg.in/mgo.v2/bson"
+	"sort"
+	"sync"
+	"time"
+)
+
 // Subscriber is an interface that should be implemented by each protocol
 // adapter that wants to support sMAP republish pub-sub.
 type Subscriber interface {
@@ -20,13 +27,40 @@ type Subscriber interface {
 }
 
 type RepublishClient struct {
-	// the UUIDs we are interested in
+	sync.Mutex
+	// the UUIDs we are interested in, which are those matching where. They
+	// are guarded by the Republisher's lock
 	uuids []string
+	where bson.M
 	in    chan []byte
 	// a bool is sent on this channel when the client wants to be closed
 	notify <-chan bool
 	// this is how we handle writes back to the client
 	subscriber Subscriber
+	// while true, the client is being sent historic data and live messages
+	// are held in pending
+	replaying bool
+	pending   []*SmapMessage
+	// readings must satisfy these to be forwarded
+	predicates []valuePredicate
+	// if not nil, readings are aggregated before they are sent
+	downsample *downsampler
+}
+
+// Forwards a live message to the subscriber, or holds on to it if the
+// client is still being sent its replay
+func (rc *RepublishClient) send(msg *SmapMessage) {
+	rc.Lock()
+	defer rc.Unlock()
+	if rc.replaying {
+		rc.pending = append(rc.pending, msg)
+		return
+	}
+	if rc.downsample != nil {
+		rc.downsample.add(msg)
+		return
+	}
+	go rc.subscriber.Send(msg)
 }
 
 // The Giles Republisher is the core of the sMAP "pub-sub" mechanism. Each of
@@ -34,13 +68,23 @@ type RepublishClient struct {
 // able to handle pub-sub over their respective protocols by writing a small
 // shim to the core Archiver pub-sub API.
 type Republisher struct {
+	sync.RWMutex
 	clients     [](*RepublishClient)
 	subscribers map[string][](*RepublishClient)
-	store       *Store // store is added in archiver.go
+	// subscriptions on tag queries; see tagrepublish.go
+	tagclients      [](*tagClient)
+	metadataChanged chan bool
+	store           *Store     // store is added in archiver.go
+	tsdb            TSDB       // tsdb is added in archiver.go
+	coalescer       *Coalescer // coalescer is added in archiver.go
 }
 
 func NewRepublisher() *Republisher {
-	return &Republisher{clients: [](*RepublishClient){}, subscribers: make(map[string][](*RepublishClient))}
+	r := &Republisher{clients: [](*RepublishClient){},
+		subscribers:     make(map[string][](*RepublishClient)),
+		metadataChanged: make(chan bool, 1)}
+	go r.watchMetadata()
+	return r
 }
 
 // This is the Archiver API call. @s is a Subscriber, an interface that allows
@@ -48,44 +92,289 @@ func NewRepublisher() *Republisher {
 // Subscriber is wrapped in a RepublishClient internally so that the
 // Republisher can keep track of necessary state. @query is the query string
 // that describes what the client is subscribing to. This query should be a
-// valid sMAP query
+// valid sMAP where clause, optionally with a replay option (see
+// subscriptionQuery). When a replay is requested, the client is first sent
+// the matching historic data and then handed off to live data; readings that
+// arrive during the replay are held back and sent afterwards, skipping any
+// that the replay already covered. Tag queries are handed to
+// handleTagSubscriber, and the subscriber receives a MetadataDiff whenever
+// their results change. Value predicates and "every" windows are applied to
+// each message in Republish before it reaches the subscriber. The streams a
+// data subscription receives are looked up again whenever metadata changes,
+// so that it picks up the streams that start (or stop) matching its query.
 func (r *Republisher) HandleSubscriber(s Subscriber, query, apikey string) {
-	tokens := tokenize(query)
-	where := parseWhere(&tokens)
-	uuids, err := r.store.GetUUIDs(where.ToBson())
+	sub, err := parseSubscription(query)
 	if err != nil {
+		errorCount.Inc("republish")
 		s.SendError(err)
 		return
 	}
-	client := &RepublishClient{uuids: uuids, notify: s.GetNotify(), subscriber: s}
-	r.clients = append(r.clients, client)
-	for _, uuid := range uuids {
-		r.subscribers[uuid] = append(r.subscribers[uuid], client)
+	if sub.tags != nil {
+		r.handleTagSubscriber(s, sub, query)
+		return
 	}
+	uuids, err := r.store.GetUUIDs(sub.where.ToBson())
+	if err != nil {
+		errorCount.Inc("republish")
+		s.SendError(err)
+		return
+	}
+	client := &RepublishClient{uuids: uuids, where: sub.where.ToBson(), notify: s.GetNotify(), subscriber: s,
+		replaying: sub.replay != nil, predicates: sub.values}
+	done := make(chan bool)
+	if sub.every > 0 {
+		client.downsample = newDownsampler(sub.every, s)
+		go client.downsample.run(done)
+	}
+	r.addClient(client)
 	log.Info("New subscriber for query: %v", query)
-	log.Info("Clients: %v", len(r.clients))
+	log.Info("Clients: %v", r.NumClients())
+
+	if sub.replay != nil {
+		r.replay(client, sub.replay)
+	}
 
 	// wait for client to close connection, then tear down client
 	<-client.notify
+	close(done)
+	r.removeClient(client)
+}
+
+func (r *Republisher) addClient(client *RepublishClient) {
+	r.Lock()
+	defer r.Unlock()
+	r.clients = append(r.clients, client)
+	for _, uuid := range client.uuids {
+		r.subscribers[uuid] = append(r.subscribers[uuid], client)
+	}
+}
+
+func (r *Republisher) removeClient(client *RepublishClient) {
+	r.Lock()
+	defer r.Unlock()
 	for i, pubclient := range r.clients {
 		if pubclient == client {
 			r.clients = append(r.clients[:i], r.clients[i+1:]...)
 			break
 		}
 	}
-	for uuid, clientlist := range r.subscribers {
+	r.unsubscribe(client)
+}
+
+// Looks up the streams matching the query of each data client again, after
+// metadata has changed
+func (r *Republisher) refreshClients() {
+	r.RLock()
+	clients := make([]*RepublishClient, len(r.clients))
+	copy(clients, r.clients)
+	r.RUnlock()
+	for _, client := range clients {
+		uuids, err := r.store.GetUUIDs(client.where)
+		if err != nil {
+			log.Error("Error refreshing subscription: %v", err)
+			errorCount.Inc("republish")
+			continue
+		}
+		r.Lock()
+		for _, pubclient := range r.clients {
+			// the client might have gone away in the meantime
+			if pubclient == client {
+				r.unsubscribe(client)
+				client.uuids = uuids
+				for _, uuid := range uuids {
+					r.subscribers[uuid] = append(r.subscribers[uuid], client)
+				}
+				break
+			}
+		}
+		r.Unlock()
+	}
+}
+
+// Removes the client from the subscribers of its streams. Must be called
+// with the Republisher locked
+func (r *Republisher) unsubscribe(client *RepublishClient) {
+	for _, uuid := range client.uuids {
+		clientlist := r.subscribers[uuid]
 		for i, pubclient := range clientlist {
 			if pubclient == client {
 				clientlist = append(clientlist[:i], clientlist[i+1:]...)
+				break
 			}
 		}
-		r.subscribers[uuid] = clientlist
+		if len(clientlist) == 0 {
+			delete(r.subscribers, uuid)
+		} else {
+			r.subscribers[uuid] = clientlist
+		}
 	}
 }
 
-// Publish @msg to all clients subscribing to @msg.UUID
+// Returns the number of subscribed clients
+func (r *Republisher) NumClients() int {
+	r.RLock()
+	defer r.RUnlock()
+	return len(r.clients) + len(r.tagclients)
+}
+
+// Returns the number of live messages held back for clients that are still
+// being sent their replay
+func (r *Republisher) Pending() int {
+	r.RLock()
+	defer r.RUnlock()
+	pending := 0
+	for _, client := range r.clients {
+		client.Lock()
+		pending += len(client.pending)
+		client.Unlock()
+	}
+	return pending
+}
+
+// Sends the client the history described by spec, then the live messages
+// that were held back in the meantime, and finally switches it over to live
+// delivery. The history includes the readings that are still buffered in the
+// Coalescer, which arrived before the client but have not reached the TSDB.
+// Readings that have left the Coalescer but are still queued for the TSDB
+// (e.g. in the write backlog while it is unreachable) are not replayed
+func (r *Republisher) replay(client *RepublishClient, spec *replaySpec) {
+	var (
+		responses []SmapResponse
+		buffered  map[string][][]interface{}
+		err       error
+	)
+	now := time.Now()
+	r.RLock()
+	uuids := client.uuids
+	r.RUnlock()
+	// the buffered readings are taken first, so that those committed while
+	// we query the TSDB are found in one or the other
+	if r.coalescer != nil {
+		buffered = r.coalescer.Pending(uuids)
+	}
+	if spec.count > 0 {
+		responses, err = r.tsdb.Prev(uuids, timeToUnit(now, UOT_STORAGE), spec.count, UOT_STORAGE)
+	} else {
+		responses, err = r.tsdb.GetData(uuids, timeToUnit(now.Add(-spec.window), UOT_STORAGE), timeToUnit(now, UOT_STORAGE), UOT_STORAGE)
+	}
+	if err != nil {
+		log.Error("Error fetching replay data: %v", err)
+		errorCount.Inc("republish")
+		client.subscriber.SendError(err)
+	}
+	responses = mergeBuffered(responses, buffered, spec, timeToUnit(now.Add(-spec.window), UOT_STORAGE))
+	paths, err := r.store.GetPaths(uuids)
+	if err != nil {
+		log.Error("Error fetching paths for replay: %v", err)
+	}
+
+	// newest replayed timestamp for each stream
+	replayed := make(map[string]uint64, len(responses))
+	for _, resp := range responses {
+		if len(resp.Readings) == 0 {
+			continue
+		}
+		msg := &SmapMessage{UUID: resp.UUID, Path: paths[resp.UUID], Readings: make([][]interface{}, 0, len(resp.Readings))}
+		// replayed readings look like the live ones, in the stream's own unit of time
+		uot := r.store.streamUnitOfTime(resp.UUID)
+		for _, rdg := range resp.Readings {
+			ts := convertTime(uint64(rdg[0]), UOT_STORAGE, uot)
+			msg.Readings = append(msg.Readings, []interface{}{ts, rdg[1]})
+			if ts > replayed[resp.UUID] {
+				replayed[resp.UUID] = ts
+			}
+		}
+		if msg = filterReadings(msg, client.predicates); msg != nil {
+			client.subscriber.Send(msg)
+		}
+	}
+
+	client.Lock()
+	defer client.Unlock()
+	for _, msg := range client.pending {
+		if newest, found := replayed[msg.UUID]; found {
+			msg = readingsAfter(msg, newest)
+			if msg == nil {
+				continue
+			}
+		}
+		client.subscriber.Send(msg)
+	}
+	client.pending = nil
+	client.replaying = false
+}
+
+// Adds the readings buffered for each stream, whose timestamps are in
+// UOT_STORAGE, to those fetched from the TSDB for a replay, leaving out the
+// ones the TSDB already returned. Only the readings from start on are added
+// to window replays, and count replays are trimmed to the newest readings
+func mergeBuffered(responses []SmapResponse, buffered map[string][][]interface{}, spec *replaySpec, start uint64) []SmapResponse {
+	if len(buffered) == 0 {
+		return responses
+	}
+	index := make(map[string]int, len(responses))
+	for i, resp := range responses {
+		index[resp.UUID] = i
+	}
+	for uuid, readings := range buffered {
+		i, found := index[uuid]
+		if !found {
+			i = len(responses)
+			responses = append(responses, SmapResponse{UUID: uuid})
+		}
+		resp := &responses[i]
+		fetched := make(map[uint64]bool, len(resp.Readings))
+		for _, rdg := range resp.Readings {
+			fetched[uint64(rdg[0])] = true
+		}
+		for _, rdg := range readings {
+			ts, ok := readingTime(rdg[0])
+			if !ok || fetched[ts] || (spec.window > 0 && ts < start) {
+				continue
+			}
+			value, ok := readingValue(rdg[1])
+			if !ok {
+				continue
+			}
+			resp.Readings = append(resp.Readings, []float64{float64(ts), value})
+		}
+		sort.Sort(byTimestamp(resp.Readings))
+		if spec.count > 0 && len(resp.Readings) > int(spec.count) {
+			resp.Readings = resp.Readings[len(resp.Readings)-int(spec.count):]
+		}
+	}
+	return responses
+}
+
+// Returns a copy of msg containing only the readings newer than ts, or nil
+// if there are none. Messages without readings are returned unchanged
+func readingsAfter(msg *SmapMessage, ts uint64) *SmapMessage {
+	if len(msg.Readings) == 0 {
+		return msg
+	}
+	var newer [][]interface{}
+	for _, rdg := range msg.Readings {
+		if rdgtime, ok := readingTime(rdg[0]); ok && rdgtime <= ts {
+			continue
+		}
+		newer = append(newer, rdg)
+	}
+	if len(newer) == 0 {
+		return nil
+	}
+	copied := *msg
+	copied.Readings = newer
+	return &copied
+}
+
+// Publish @msg to all clients subscribing to @msg.UUID. Each client is only
+// sent the readings that satisfy its value predicates.
 func (r *Republisher) Republish(msg *SmapMessage) {
+	r.RLock()
+	defer r.RUnlock()
 	for _, client := range r.subscribers[msg.UUID] {
-		go client.subscriber.Send(msg)
+		if filtered := filterReadings(msg, client.predicates); filtered != nil {
+			client.send(filtered)
+		}
 	}
 }
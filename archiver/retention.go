@@ -0,0 +1,177 @@
+package archiver
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// An Expiry describes what the ExpiryJob does, or would do, to one stream
+type Expiry struct {
+	UUID      string
+	Path      string
+	Retention string
+	// readings before Cutoff are deleted
+	Cutoff time.Time
+	// the oldest reading of the stream, if it is older than Cutoff. Only
+	// filled in on dry runs
+	Oldest time.Time
+	// why the stream was skipped, if it was
+	Error string
+}
+
+// The metadata fields the ExpiryJob looks at
+type streamRetention struct {
+	UUID       string `bson:"uuid"`
+	Path       string `bson:"Path"`
+	Properties struct {
+		Retention interface{} `bson:"Retention"`
+	} `bson:"Properties"`
+}
+
+// The ExpiryJob enforces the retention periods that streams carry in their
+// metadata as Properties/Retention, e.g.
+//
+//    "Properties": {"Retention": "30d"}
+//
+// (see parseRetention for the accepted periods). On every run it deletes the
+// readings older than the period from the timeseries database, along with
+// the stream's rollups if rollups are enabled, and forgets its cached last
+// value if that has expired too, so /api/latest does not keep serving it.
+// Unlike the rollup retention policies, a stream's own Retention is a hard
+// limit: readings are deleted whether or not they have been rolled up. Properties/Retention takes
+// precedence over the policies in the [Rollups] and [Retention] sections of
+// the configuration.
+//
+// To go easy on the timeseries database, at most rate streams are handled
+// per second. A dry run reports what a run would delete without deleting
+// anything.
+type ExpiryJob struct {
+	sync.Mutex
+	store      *Store
+	tsdb       TSDB
+	rollups    *RollupService  // rollups is added in archiver.go
+	objects    *ObjectStore    // objects is added in archiver.go
+	lastvalues *LastValueCache // lastvalues is added in archiver.go
+	interval   time.Duration
+	rate       int
+}
+
+func NewExpiryJob(store *Store, tsdb TSDB, interval time.Duration, rate int) *ExpiryJob {
+	if rate <= 0 {
+		rate = 1
+	}
+	return &ExpiryJob{store: store, tsdb: tsdb, interval: interval, rate: rate}
+}
+
+// Expires data every interval forever
+func (ej *ExpiryJob) run() {
+	for {
+		time.Sleep(ej.interval)
+		if _, err := ej.Run(); err != nil {
+			log.Error("Error expiring data: %v", err)
+		}
+	}
+}
+
+// Deletes the readings that are past their stream's retention period and
+// returns what was deleted
+func (ej *ExpiryJob) Run() ([]*Expiry, error) {
+	return ej.expire(time.Now(), false)
+}
+
+// Reports what Run would delete
+func (ej *ExpiryJob) DryRun() ([]*Expiry, error) {
+	return ej.expire(time.Now(), true)
+}
+
+func (ej *ExpiryJob) expire(now time.Time, dryrun bool) ([]*Expiry, error) {
+	// only one run at a time
+	ej.Lock()
+	defer ej.Unlock()
+	expiries, err := ej.plan(now)
+	if err != nil {
+		return nil, err
+	}
+	limiter := time.NewTicker(time.Second / time.Duration(ej.rate))
+	defer limiter.Stop()
+	for _, exp := range expiries {
+		if exp.Error != "" {
+			continue
+		}
+		<-limiter.C
+		cutoff := uint64(exp.Cutoff.UnixNano() / int64(time.Millisecond))
+		if dryrun {
+			first, err := ej.tsdb.Next([]string{exp.UUID}, 0, 1, UOT_MS)
+			if err != nil {
+				exp.Error = err.Error()
+			} else if len(first) > 0 && len(first[0].Readings) > 0 && uint64(first[0].Readings[0][0]) < cutoff {
+				oldest := int64(first[0].Readings[0][0])
+				exp.Oldest = time.Unix(oldest/1000, (oldest%1000)*int64(time.Millisecond))
+			}
+			continue
+		}
+		ej.delete(exp, cutoff)
+	}
+	return expiries, nil
+}
+
+// Deletes the readings of the stream before cutoff (in ms), and its last
+// value if that is one of them, so that it is not served from the cache
+func (ej *ExpiryJob) delete(exp *Expiry, cutoff uint64) {
+	streams := []string{exp.UUID}
+	if ej.rollups != nil {
+		streams = append(streams, rollupStreams(exp.UUID)...)
+	}
+	if err := ej.tsdb.Delete(streams, 0, cutoff-1, UOT_MS); err != nil {
+		log.Error("Error expiring data of %v: %v", exp.UUID, err)
+		exp.Error = err.Error()
+	}
+	if ej.objects != nil {
+		if err := ej.objects.Delete([]string{exp.UUID}, 0, cutoff-1, UOT_MS); err != nil {
+			log.Error("Error expiring objects of %v: %v", exp.UUID, err)
+			exp.Error = err.Error()
+		}
+	}
+	if ej.lastvalues != nil {
+		ej.lastvalues.evict(exp.UUID, convertTime(cutoff, UOT_MS, UOT_STORAGE))
+	}
+}
+
+// Works out the cutoff of every stream that has a retention period
+func (ej *ExpiryJob) plan(now time.Time) ([]*Expiry, error) {
+	streams, err := ej.store.getStreamRetentions()
+	if err != nil {
+		return nil, err
+	}
+	expiries := make([]*Expiry, 0, len(streams))
+	for _, stream := range streams {
+		if exp := expiryFor(stream, now); exp != nil {
+			expiries = append(expiries, exp)
+		}
+	}
+	return expiries, nil
+}
+
+// Returns the Expiry of a stream, or nil if it is kept forever. Streams with
+// an invalid Retention get an Expiry with an Error
+func expiryFor(stream streamRetention, now time.Time) *Expiry {
+	exp := &Expiry{UUID: stream.UUID, Path: stream.Path}
+	period, ok := stream.Properties.Retention.(string)
+	if !ok {
+		exp.Retention = fmt.Sprintf("%v", stream.Properties.Retention)
+		exp.Error = "Retention must be a string like '30d'"
+		return exp
+	}
+	exp.Retention = period
+	retention, err := parseRetention(period)
+	if err != nil {
+		exp.Error = err.Error()
+		return exp
+	}
+	if retention == 0 {
+		return nil
+	}
+	exp.Cutoff = now.Add(-retention)
+	return exp
+}
@@ -0,0 +1,53 @@
+package archiver
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpiryFor(t *testing.T) {
+	now := time.Now()
+	stream := streamRetention{UUID: "a", Path: "/occupancy"}
+
+	stream.Properties.Retention = "30d"
+	exp := expiryFor(stream, now)
+	if exp == nil || exp.Error != "" || !exp.Cutoff.Equal(now.Add(-30*24*time.Hour)) {
+		t.Error("30d retention should cut off 30 days ago", exp)
+	}
+
+	stream.Properties.Retention = "forever"
+	if exp := expiryFor(stream, now); exp != nil {
+		t.Error("Streams kept forever should not expire", exp)
+	}
+
+	for _, retention := range []interface{}{"30", "soon", 30} {
+		stream.Properties.Retention = retention
+		if exp := expiryFor(stream, now); exp == nil || exp.Error == "" {
+			t.Error(retention, "should be reported as invalid", exp)
+		}
+	}
+}
+
+func TestExpiryEvictsLastValues(t *testing.T) {
+	mem := newMemTSDB()
+	lvc := NewLastValueCache()
+	for _, uuid := range []string{"a", "b"} {
+		msg := &SmapMessage{UUID: uuid, Readings: [][]interface{}{[]interface{}{uint64(1000), float64(1)}}}
+		if uuid == "b" {
+			msg.Readings = append(msg.Readings, []interface{}{uint64(5000), float64(2)})
+		}
+		lvc.Update(msg)
+	}
+	ej := &ExpiryJob{tsdb: mem, lastvalues: lvc}
+
+	// cutoffs are in ms, cached timestamps in UOT_STORAGE
+	for _, uuid := range []string{"a", "b"} {
+		ej.delete(&Expiry{UUID: uuid}, 3)
+	}
+	if rdg, found := lvc.Get("a"); found {
+		t.Error("Expired last value of a is still cached:", rdg)
+	}
+	if rdg, found := lvc.Get("b"); !found || rdg[0] != 5000 {
+		t.Error("Last value of b is newer than the cutoff and should be kept but got", rdg, found)
+	}
+}
@@ -0,0 +1,642 @@
+package archiver
+
+import (
+	uuidlib "code.google.com/p/go-uuid/uuid"
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	// how often new rollups are computed
+	rollupInterval = time.Minute
+	// how often retention policies are enforced
+	retentionInterval = time.Hour
+	// a window is only rolled up once it has been closed for this long, to
+	// give late readings a chance to arrive
+	rollupGrace = time.Minute
+	// the most raw data we fetch for one stream and tier in one pass
+	rollupMaxSpan = 24 * time.Hour
+)
+
+// A rollup tier summarizes each stream into windows of Width. Tiers are
+// listed finest first
+type rollupTier struct {
+	Name  string
+	Width time.Duration
+}
+
+var rollupTiers = []rollupTier{{"1m", time.Minute}, {"15m", 15 * time.Minute}, {"1h", time.Hour}}
+
+// Each tier keeps one rollup stream per aggregate
+var rollupAggregates = []string{"min", "mean", "max", "count"}
+
+// The rollup streams of a source stream get UUIDs derived from the source
+// UUID, the tier and the aggregate. They are written straight to the
+// timeseries database and have no metadata of their own, so they never match
+// a where clause
+func rollupStreamUUID(uuid, tier, aggregate string) string {
+	return uuidlib.NewSHA1(uuidlib.NameSpace_URL, []byte("giles/rollup/"+uuid+"/"+tier+"/"+aggregate)).String()
+}
+
+// All of the rollup streams of a source stream
+func rollupStreams(uuid string) []string {
+	var streams []string
+	for _, tier := range rollupTiers {
+		for _, aggregate := range rollupAggregates {
+			streams = append(streams, rollupStreamUUID(uuid, tier.Name, aggregate))
+		}
+	}
+	return streams
+}
+
+// One window of a rollup
+type rollupWindow struct {
+	start    uint64
+	min, max float64
+	sum      float64
+	count    float64
+}
+
+func (w *rollupWindow) mean() float64 {
+	return w.sum / w.count
+}
+
+// Summarizes readings ([timestamp, value] in any order) into windows of
+// width, aligned to multiples of width. The windows are returned in order
+func rollupWindows(readings [][]float64, width uint64) []*rollupWindow {
+	var windows []*rollupWindow
+	var current *rollupWindow
+	for _, rdg := range sortedReadings(readings) {
+		if len(rdg) < 2 || math.IsNaN(rdg[1]) {
+			continue
+		}
+		ts := uint64(rdg[0])
+		start := ts - ts%width
+		if current == nil || current.start != start {
+			current = &rollupWindow{start: start, min: rdg[1], max: rdg[1]}
+			windows = append(windows, current)
+		}
+		current.min = math.Min(current.min, rdg[1])
+		current.max = math.Max(current.max, rdg[1])
+		current.sum += rdg[1]
+		current.count++
+	}
+	return windows
+}
+
+// A retention policy overrides the default retention for the streams
+// matching its where clause. A zero duration keeps data forever
+type retentionPolicy struct {
+	name    string
+	where   bson.M
+	raw     time.Duration
+	rollups time.Duration
+}
+
+// Parses a retention period such as 90d, 12h or 2w. An empty string means
+// forever
+func parseRetention(period string) (time.Duration, error) {
+	if period == "" || period == "forever" {
+		return 0, nil
+	}
+	if len(period) > 1 && period[len(period)-1] == 'w' {
+		weeks, err := strconv.Atoi(period[:len(period)-1])
+		if err != nil || weeks <= 0 {
+			return 0, errors.New("Invalid retention period: " + period)
+		}
+		return time.Duration(weeks) * 7 * 24 * time.Hour, nil
+	}
+	d, err := parseIntoDuration("+" + period)
+	if err != nil || d <= 0 {
+		return 0, errors.New("Invalid retention period: " + period)
+	}
+	return d, nil
+}
+
+// The RollupService continuously computes 1 minute, 15 minute and 1 hour
+// min/mean/max/count rollups of every stream, and enforces the retention
+// policies for raw data and rollups.
+//
+// Rollups are computed in windows that have closed: the finest tier from the
+// raw data, and each coarser tier from the tier before it, so that the raw
+// data is only read once. How far each stream and tier has been rolled up
+// (its watermark) is kept in the metadata store so that the service resumes
+// where it left off. Readings that
+// arrive for a window that has already been rolled up are not reflected in
+// the rollup, except for imported readings, which move the watermarks back
+// (see rewindRollups). Raw data is never expired past the watermarks, so nothing is
+// deleted before it has been rolled up.
+//
+// Aggregation queries (apply window(...) to data in ...) whose window is a
+// multiple of a tier's width are answered from the coarsest such tier where
+// rollups exist (see windowQuery)
+type RollupService struct {
+	store *Store
+	tsdb  TSDB
+	// how long raw data and rollups are kept by default; 0 is forever
+	rawRetention    time.Duration
+	rollupRetention time.Duration
+	policies        []*retentionPolicy
+}
+
+func NewRollupService(store *Store, tsdb TSDB, c *Config) (*RollupService, error) {
+	var err error
+	rs := &RollupService{store: store, tsdb: tsdb}
+	if c.Rollups.RawRetention != nil {
+		if rs.rawRetention, err = parseRetention(*c.Rollups.RawRetention); err != nil {
+			return nil, err
+		}
+	}
+	if c.Rollups.RollupRetention != nil {
+		if rs.rollupRetention, err = parseRetention(*c.Rollups.RollupRetention); err != nil {
+			return nil, err
+		}
+	}
+	for name, def := range c.Retention {
+		policy := &retentionPolicy{name: name}
+		tokens := tokenize(def.Where)
+		if len(tokens) > 0 && tokens[0] == "where" {
+			tokens = tokens[1:]
+		}
+		if len(tokens) == 0 {
+			return nil, errors.New("Retention policy " + name + " needs a where clause")
+		}
+		where, err := parseWhere(&tokens)
+		if err != nil {
+			return nil, errors.New("Retention policy " + name + ": " + err.Error())
+		}
+		policy.where = where.ToBson()
+		if policy.raw, err = parseRetention(def.Raw); err != nil {
+			return nil, err
+		}
+		if policy.rollups, err = parseRetention(def.Rollups); err != nil {
+			return nil, err
+		}
+		rs.policies = append(rs.policies, policy)
+	}
+	return rs, nil
+}
+
+// Computes rollups and enforces retention forever
+func (rs *RollupService) run() {
+	retention := time.NewTicker(retentionInterval)
+	rollup := time.NewTicker(rollupInterval)
+	rs.rollupAll(time.Now())
+	for {
+		select {
+		case <-rollup.C:
+			rs.rollupAll(time.Now())
+		case <-retention.C:
+			rs.enforceRetention(time.Now())
+		}
+	}
+}
+
+// Brings the rollups of all streams up to date. The watermarks of all streams
+// are read at once, and only those that moved are saved
+func (rs *RollupService) rollupAll(now time.Time) {
+	uuids, err := rs.store.GetUUIDs(bson.M{})
+	if err != nil {
+		log.Error("Could not list streams for rollups: %v", err)
+		return
+	}
+	watermarks, err := rs.store.getRollupWatermarks()
+	if err != nil {
+		log.Error("Could not get rollup watermarks: %v", err)
+		return
+	}
+	for _, uuid := range uuids {
+		marks := watermarks[uuid]
+		if marks == nil {
+			marks = make(map[string]uint64, len(rollupTiers))
+		}
+		from := make(map[string]uint64, len(marks))
+		for tier, mark := range marks {
+			from[tier] = mark
+		}
+		for _, tier := range rs.rollupStream(uuid, marks, now) {
+			if err := rs.store.saveRollupWatermark(uuid, tier, from[tier], marks[tier]); err != nil {
+				log.Error("Could not save rollup watermark of %v (%v): %v", uuid, tier, err)
+			}
+		}
+	}
+}
+
+// Rolls up each tier of one stream from its watermark in marks, which are
+// updated. Returns the names of the tiers whose watermarks moved. A tier
+// that fails holds back the tiers after it, which are built from it
+func (rs *RollupService) rollupStream(uuid string, marks map[string]uint64, now time.Time) []string {
+	var moved []string
+	for i, tier := range rollupTiers {
+		var source *rollupTier
+		if i > 0 {
+			source = &rollupTiers[i-1]
+		}
+		advanced, err := rs.rollup(uuid, tier, source, marks, now)
+		if err != nil {
+			log.Error("Error rolling up %v (%v): %v", uuid, tier.Name, err)
+			break
+		}
+		if advanced {
+			moved = append(moved, tier.Name)
+		}
+	}
+	return moved
+}
+
+// Rolls up the closed windows of one stream and tier since its watermark in
+// marks. The windows are computed from the raw data if source is nil, and
+// otherwise from the rollups of the source tier, up to its watermark.
+// Returns whether the watermark moved
+func (rs *RollupService) rollup(uuid string, tier rollupTier, source *rollupTier, marks map[string]uint64, now time.Time) (bool, error) {
+	width := uint64(tier.Width / time.Millisecond)
+	watermark := marks[tier.Name]
+	if watermark == 0 {
+		// start at the stream's first reading, or the source tier's first window
+		first := uuid
+		if source != nil {
+			first = rollupStreamUUID(uuid, source.Name, "count")
+		}
+		data, err := rs.tsdb.Next([]string{first}, 0, 1, UOT_MS)
+		if err != nil {
+			return false, err
+		}
+		if len(data) == 0 || len(data[0].Readings) == 0 {
+			return false, nil
+		}
+		watermark = uint64(data[0].Readings[0][0])
+		watermark -= watermark % width
+	}
+	end := uint64(now.Add(-rollupGrace).UnixNano() / int64(time.Millisecond))
+	if source != nil && end > marks[source.Name] {
+		end = marks[source.Name]
+	}
+	end -= end % width
+	if maxend := watermark + uint64(rollupMaxSpan/time.Millisecond); end > maxend {
+		end = maxend
+	}
+	if end <= watermark {
+		return false, nil
+	}
+	var windows []*rollupWindow
+	if source == nil {
+		data, err := rs.tsdb.GetData([]string{uuid}, watermark, end-1, UOT_MS)
+		if err != nil {
+			return false, err
+		}
+		var readings [][]float64
+		for _, resp := range data {
+			readings = append(readings, resp.Readings...)
+		}
+		windows = rollupWindows(readings, width)
+	} else {
+		finer, err := rs.fetchRollups(uuid, *source, watermark, end-1)
+		if err != nil {
+			return false, err
+		}
+		windows = mergeRollups(finer, width)
+	}
+	// the watermark stays put if the rollups could not be written, so that
+	// the windows are rolled up again and their raw data is not expired
+	if len(windows) > 0 {
+		if err := rs.write(uuid, tier, windows); err != nil {
+			return false, err
+		}
+	}
+	marks[tier.Name] = end
+	return true, nil
+}
+
+// Returns where the watermark of tier has to move back to so that readings
+// from since (in ms) on are rolled up, which is the start of their window,
+// and false if the tier has not been rolled up that far
+func rewoundWatermark(tier rollupTier, watermark, since uint64) (uint64, bool) {
+	width := uint64(tier.Width / time.Millisecond)
+	start := since - since%width
+	return start, watermark > start
+}
+
+// Has readings of the stream from since (in ms) on, written in the past by
+// an import, rolled up again: in every tier that has been rolled up past
+// them, the rollups from their window on are deleted and the watermark is
+// moved back to that window
+func rewindRollups(store *Store, tsdb TSDB, uuid string, since uint64, now time.Time) error {
+	end := uint64(now.UnixNano() / int64(time.Millisecond))
+	for _, tier := range rollupTiers {
+		watermark, err := store.getRollupWatermark(uuid, tier.Name)
+		if err != nil {
+			return err
+		}
+		start, rewind := rewoundWatermark(tier, watermark, since)
+		if !rewind {
+			continue
+		}
+		streams := make([]string, 0, len(rollupAggregates))
+		for _, aggregate := range rollupAggregates {
+			streams = append(streams, rollupStreamUUID(uuid, tier.Name, aggregate))
+		}
+		if err := tsdb.Delete(streams, start, end, UOT_MS); err != nil {
+			return err
+		}
+		if err := store.rewindRollupWatermark(uuid, tier.Name, start); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Writes the windows to the rollup streams of each aggregate. Returns an
+// error if any of them was not taken by the TSDB
+func (rs *RollupService) write(uuid string, tier rollupTier, windows []*rollupWindow) error {
+	for _, aggregate := range rollupAggregates {
+		sb := &StreamBuf{uuid: rollupStreamUUID(uuid, tier.Name, aggregate),
+			readings: make([][]interface{}, 0, len(windows))}
+		for _, w := range windows {
+			var value float64
+			switch aggregate {
+			case "min":
+				value = w.min
+			case "mean":
+				value = w.mean()
+			case "max":
+				value = w.max
+			case "count":
+				value = w.count
+			}
+			sb.readings = append(sb.readings, []interface{}{convertTime(w.start, UOT_MS, UOT_STORAGE), value})
+		}
+		if !rs.tsdb.Add(sb) {
+			return fmt.Errorf("Could not write the %v %v rollups of %v", tier.Name, aggregate, uuid)
+		}
+	}
+	return nil
+}
+
+// Returns how long the raw data and the rollups of each stream are kept,
+// applying the shortest of the policies that match it. Streams with their
+// own Properties/Retention are left to the ExpiryJob
+func (rs *RollupService) retentions() (map[string]time.Duration, map[string]time.Duration, error) {
+	uuids, err := rs.store.GetUUIDs(bson.M{})
+	if err != nil {
+		return nil, nil, err
+	}
+	raw := make(map[string]time.Duration, len(uuids))
+	rollups := make(map[string]time.Duration, len(uuids))
+	for _, uuid := range uuids {
+		raw[uuid] = rs.rawRetention
+		rollups[uuid] = rs.rollupRetention
+	}
+	for _, policy := range rs.policies {
+		matches, err := rs.store.GetUUIDs(policy.where)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, uuid := range matches {
+			raw[uuid] = shorterRetention(raw[uuid], policy.raw)
+			rollups[uuid] = shorterRetention(rollups[uuid], policy.rollups)
+		}
+	}
+	own, err := rs.store.getStreamRetentions()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, stream := range own {
+		delete(raw, stream.UUID)
+		delete(rollups, stream.UUID)
+	}
+	return raw, rollups, nil
+}
+
+// the shorter of two retention periods, where 0 is forever
+func shorterRetention(a, b time.Duration) time.Duration {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// Deletes raw data and rollups that are older than their retention period.
+// Raw data that has not been rolled up by every tier yet is kept
+func (rs *RollupService) enforceRetention(now time.Time) {
+	raw, rollups, err := rs.retentions()
+	if err != nil {
+		log.Error("Could not resolve retention policies: %v", err)
+		return
+	}
+	nowms := uint64(now.UnixNano() / int64(time.Millisecond))
+	for uuid, retention := range raw {
+		if retention == 0 {
+			continue
+		}
+		cutoff := nowms - uint64(retention/time.Millisecond)
+		for _, tier := range rollupTiers {
+			watermark, err := rs.store.getRollupWatermark(uuid, tier.Name)
+			if err != nil {
+				log.Error("Could not get rollup watermark for %v: %v", uuid, err)
+				cutoff = 0
+				break
+			}
+			if watermark < cutoff {
+				cutoff = watermark
+			}
+		}
+		if cutoff == 0 {
+			continue
+		}
+		if err := rs.tsdb.Delete([]string{uuid}, 0, cutoff-1, UOT_MS); err != nil {
+			log.Error("Error expiring raw data of %v: %v", uuid, err)
+		}
+	}
+	for uuid, retention := range rollups {
+		if retention == 0 {
+			continue
+		}
+		cutoff := nowms - uint64(retention/time.Millisecond)
+		if err := rs.tsdb.Delete(rollupStreams(uuid), 0, cutoff-1, UOT_MS); err != nil {
+			log.Error("Error expiring rollups of %v: %v", uuid, err)
+		}
+	}
+}
+
+// Picks the coarsest tier whose width divides a window of size, if any
+func tierForWindow(size time.Duration) (rollupTier, bool) {
+	for i := len(rollupTiers) - 1; i >= 0; i-- {
+		if size >= rollupTiers[i].Width && size%rollupTiers[i].Width == 0 {
+			return rollupTiers[i], true
+		}
+	}
+	return rollupTier{}, false
+}
+
+// Answers the window operator call over the data of uuids between start and
+// end from the rollups, if there is a tier that fits the window. The part of
+// the range that has not been rolled up yet is computed from the raw data.
+// Returns false if the window cannot be answered from rollups, in which case
+// the caller should apply the operator to the raw data itself. The results
+// have timestamps in units of uot.
+func (rs *RollupService) windowQuery(uuids []string, start, end uint64, uot UnitOfTime, call *operatorCall) ([]SmapResponse, bool, error) {
+	if call.name != "window" {
+		return nil, false, nil
+	}
+	op := call.arg("op", 0, "mean")
+	switch op {
+	case "mean", "min", "max", "count", "sum":
+	default:
+		return nil, false, nil
+	}
+	field, found := windowFields[call.arg("field", 1, "minute")]
+	if !found {
+		return nil, false, nil
+	}
+	width, err := strconv.ParseFloat(call.arg("width", 2, "1"), 64)
+	if err != nil || width <= 0 {
+		return nil, false, nil
+	}
+	size := time.Duration(field * width * float64(time.Second))
+	tier, found := tierForWindow(size)
+	if !found {
+		return nil, false, nil
+	}
+	sizems := uint64(size / time.Millisecond)
+	if start > end {
+		start, end = end, start
+	}
+	start = convertTime(start, uot, UOT_MS)
+	end = convertTime(end, uot, UOT_MS)
+
+	result := make([]SmapResponse, 0, len(uuids))
+	for _, uuid := range uuids {
+		watermark, err := rs.store.getRollupWatermark(uuid, tier.Name)
+		if err != nil {
+			return nil, false, err
+		}
+		// rollups cover [start, split), raw data [split, end]
+		split := watermark - watermark%sizems
+		if split > end+1 {
+			split = end + 1
+		}
+		out := SmapResponse{UUID: uuid, Readings: [][]float64{}}
+		if split > start {
+			windows, err := rs.fetchRollups(uuid, tier, start, split-1)
+			if err != nil {
+				return nil, false, err
+			}
+			out.Readings = append(out.Readings, combineRollups(windows, sizems, op)...)
+		}
+		if split <= end {
+			rawstart := start
+			if split > rawstart {
+				rawstart = split
+			}
+			raw, err := rs.tsdb.GetData([]string{uuid}, rawstart, end, UOT_MS)
+			if err != nil {
+				return nil, false, err
+			}
+			windowed, err := windowOperator(call, &applyContext{uot: UOT_MS}, raw)
+			if err != nil {
+				return nil, false, err
+			}
+			for _, resp := range windowed {
+				out.Readings = append(out.Readings, resp.Readings...)
+			}
+		}
+		for _, rdg := range out.Readings {
+			rdg[0] = float64(convertTime(uint64(rdg[0]), UOT_MS, uot))
+		}
+		result = append(result, out)
+	}
+	return result, true, nil
+}
+
+// Reads back the rollup windows of a stream and tier between start and end
+func (rs *RollupService) fetchRollups(uuid string, tier rollupTier, start, end uint64) ([]*rollupWindow, error) {
+	byStart := make(map[uint64]*rollupWindow)
+	for _, aggregate := range rollupAggregates {
+		data, err := rs.tsdb.GetData([]string{rollupStreamUUID(uuid, tier.Name, aggregate)}, start, end, UOT_MS)
+		if err != nil {
+			return nil, err
+		}
+		for _, resp := range data {
+			for _, rdg := range resp.Readings {
+				ts := uint64(rdg[0])
+				w, found := byStart[ts]
+				if !found {
+					w = &rollupWindow{start: ts}
+					byStart[ts] = w
+				}
+				switch aggregate {
+				case "min":
+					w.min = rdg[1]
+				case "mean":
+					w.sum = rdg[1]
+				case "max":
+					w.max = rdg[1]
+				case "count":
+					w.count = rdg[1]
+				}
+			}
+		}
+	}
+	windows := make([]*rollupWindow, 0, len(byStart))
+	for _, w := range byStart {
+		// sum holds the mean until we know the count
+		w.sum *= w.count
+		windows = append(windows, w)
+	}
+	sort.Sort(byWindowStart(windows))
+	return windows, nil
+}
+
+type byWindowStart []*rollupWindow
+
+func (b byWindowStart) Len() int           { return len(b) }
+func (b byWindowStart) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byWindowStart) Less(i, j int) bool { return b[i].start < b[j].start }
+
+// Merges ordered rollup windows into windows of size
+func mergeRollups(windows []*rollupWindow, size uint64) []*rollupWindow {
+	var merged []*rollupWindow
+	var current *rollupWindow
+	for _, w := range windows {
+		if w.count == 0 {
+			continue
+		}
+		start := w.start - w.start%size
+		if current == nil || current.start != start {
+			current = &rollupWindow{start: start, min: w.min, max: w.max}
+			merged = append(merged, current)
+		}
+		current.min = math.Min(current.min, w.min)
+		current.max = math.Max(current.max, w.max)
+		current.sum += w.sum
+		current.count += w.count
+	}
+	return merged
+}
+
+// Merges ordered rollup windows into windows of size and reduces each with op
+func combineRollups(windows []*rollupWindow, size uint64, op string) [][]float64 {
+	var readings [][]float64
+	for _, w := range mergeRollups(windows, size) {
+		var value float64
+		switch op {
+		case "mean":
+			value = w.mean()
+		case "min":
+			value = w.min
+		case "max":
+			value = w.max
+		case "count":
+			value = w.count
+		case "sum":
+			value = w.sum
+		}
+		readings = append(readings, []float64{float64(w.start), value})
+	}
+	return readings
+}
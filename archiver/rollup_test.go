@@ -0,0 +1,139 @@
+package archiver
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRollupWindows(t *testing.T) {
+	windows := rollupWindows([][]float64{{60000, 4}, {0, 1}, {30000, 3}, {119999, 2}, {180000, 10}}, 60000)
+	if len(windows) != 3 {
+		t.Fatal("Should be 3 windows but there are", len(windows))
+	}
+	for i, expected := range []rollupWindow{{0, 1, 3, 4, 2}, {60000, 2, 4, 6, 2}, {180000, 10, 10, 10, 1}} {
+		if *windows[i] != expected {
+			t.Error("Window", i, "should be", expected, "but is", *windows[i])
+		}
+	}
+
+	// 1m rollups combined into 2m windows
+	for op, expected := range map[string][][]float64{
+		"mean":  {{0, 2.5}, {120000, 10}},
+		"min":   {{0, 1}, {120000, 10}},
+		"max":   {{0, 4}, {120000, 10}},
+		"count": {{0, 4}, {120000, 1}},
+		"sum":   {{0, 10}, {120000, 10}},
+	} {
+		if res := combineRollups(windows, 120000, op); !reflect.DeepEqual(res, expected) {
+			t.Error(op, "should be", expected, "but is", res)
+		}
+	}
+}
+
+func TestRollupStream(t *testing.T) {
+	mem := newMemTSDB()
+	rs := &RollupService{tsdb: mem}
+	// a reading every 10 seconds for two hours, starting at 1h
+	sb := &StreamBuf{uuid: "a"}
+	for ts := uint64(3600); ts < 3*3600; ts += 10 {
+		sb.readings = append(sb.readings, []interface{}{convertTime(ts, UOT_S, UOT_STORAGE), float64(1)})
+	}
+	mem.Add(sb)
+
+	marks := map[string]uint64{}
+	now := time.Unix(3*3600, 0).Add(rollupGrace)
+	if moved := rs.rollupStream("a", marks, now); len(moved) != len(rollupTiers) {
+		t.Error("Every tier should move but", moved, "did")
+	}
+	for _, tier := range rollupTiers {
+		if marks[tier.Name] != 3*3600*1000 {
+			t.Error("Tier", tier.Name, "should be rolled up to 3h but is at", marks[tier.Name])
+		}
+	}
+	counts, _ := mem.GetData([]string{rollupStreamUUID("a", "1h", "count")}, 0, 3*3600*1000, UOT_MS)
+	if !reflect.DeepEqual(counts[0].Readings, [][]float64{{3600000, 360}, {7200000, 360}}) {
+		t.Error("The hourly rollups should count 360 readings each but are", counts[0].Readings)
+	}
+	if moved := rs.rollupStream("a", marks, now); len(moved) != 0 {
+		t.Error("Nothing should move without new data, but", moved, "did")
+	}
+
+	// windows whose rollups are not written are rolled up again
+	mem.Lock()
+	mem.down = true
+	mem.Unlock()
+	marks = map[string]uint64{}
+	if moved := rs.rollupStream("a", marks, now); len(moved) != 0 || len(marks) != 0 {
+		t.Error("No tier should move when the rollups cannot be written, but", moved, "did:", marks)
+	}
+	mem.Lock()
+	mem.down = false
+	mem.Unlock()
+
+	// coarser tiers never get ahead of the tier they are built from
+	marks = map[string]uint64{"1m": 3600 * 1000}
+	rs.rollupStream("a", marks, now)
+	if marks["15m"] > marks["1m"] || marks["1h"] > marks["15m"] {
+		t.Error("Tiers should not get ahead of finer tiers:", marks)
+	}
+}
+
+func TestTierForWindow(t *testing.T) {
+	for size, expected := range map[time.Duration]string{
+		time.Minute:      "1m",
+		5 * time.Minute:  "1m",
+		30 * time.Minute: "15m",
+		45 * time.Minute: "15m",
+		2 * time.Hour:    "1h",
+		24 * time.Hour:   "1h",
+	} {
+		if tier, found := tierForWindow(size); !found || tier.Name != expected {
+			t.Error(size, "should use tier", expected, "but uses", tier.Name)
+		}
+	}
+	for _, size := range []time.Duration{30 * time.Second, 90 * time.Second} {
+		if tier, found := tierForWindow(size); found {
+			t.Error(size, "should not use a tier but uses", tier.Name)
+		}
+	}
+}
+
+func TestParseRetention(t *testing.T) {
+	for period, expected := range map[string]time.Duration{
+		"":        0,
+		"forever": 0,
+		"90d":     90 * 24 * time.Hour,
+		"12h":     12 * time.Hour,
+		"2w":      14 * 24 * time.Hour,
+	} {
+		if d, err := parseRetention(period); err != nil || d != expected {
+			t.Error(period, "should be", expected, "but is", d, err)
+		}
+	}
+	for _, period := range []string{"90", "-1d", "w", "soon"} {
+		if _, err := parseRetention(period); err == nil {
+			t.Error(period, "should give an error")
+		}
+	}
+	if shorterRetention(0, time.Hour) != time.Hour || shorterRetention(time.Hour, 0) != time.Hour ||
+		shorterRetention(2*time.Hour, time.Hour) != time.Hour {
+		t.Error("Wrong shorter retention")
+	}
+}
+
+func TestRewoundWatermark(t *testing.T) {
+	// imported readings from 00:20:30 on, with every tier rolled up to 02:00
+	since := uint64(20*60000 + 30000)
+	for i, expected := range []uint64{20 * 60000, 15 * 60000, 0} {
+		if start, rewind := rewoundWatermark(rollupTiers[i], 2*3600000, since); !rewind || start != expected {
+			t.Error("Tier", rollupTiers[i].Name, "should move back to", expected, "not", start, rewind)
+		}
+	}
+	if _, rewind := rewoundWatermark(rollupTiers[0], 20*60000, since); rewind {
+		t.Error("A tier that has not been rolled up past the readings should not move back")
+	}
+	if _, rewind := rewoundWatermark(rollupTiers[0], 0, since); rewind {
+		t.Error("A tier that has not been rolled up should not move back")
+	}
+}
@@ -0,0 +1,469 @@
+package archiver
+
+import (
+	uuidlib "code.google.com/p/go-uuid/uuid"
+	"encoding/json"
+	"errors"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how often we look for streams that have stopped reporting
+const staleCheckInterval = 10 * time.Second
+
+// how often each rule's where clause is re-resolved to pick up new streams
+const ruleRefreshInterval = time.Minute
+
+// A Rule raises an alert on the streams matched by Where whenever Condition
+// holds. Conditions are one of
+//
+//    value > 30      -- the reading crosses a threshold (any of > >= < <= = !=)
+//    rate > 0.5      -- the change per second between consecutive readings
+//    nodata 15m      -- no readings have arrived for the given duration
+//
+// Each time a rule starts or stops holding for a stream, the archiver writes
+// a reading (1 when firing, 0 when resolved) to an alert stream for that rule
+// and stream, which can be queried and subscribed to like any other. If
+// Webhook is set, the event is also POSTed there as JSON, with the same
+// retries and dead letter log as webhook subscriptions (see Webhook).
+type Rule struct {
+	Name      string `bson:"name"`
+	Where     string `bson:"where"`
+	Condition string `bson:"condition"`
+	Webhook   string `bson:"webhook,omitempty" json:",omitempty"`
+}
+
+// The JSON body sent to rule webhooks
+type AlertEvent struct {
+	Rule      string
+	Condition string
+	// the stream the rule fired for, and the alert stream recording it
+	UUID       string
+	AlertUUID  string
+	State      string
+	Time       int64
+	Value      float64
+	SourcePath string `json:",omitempty"`
+}
+
+const (
+	ALERT_FIRING   = "firing"
+	ALERT_RESOLVED = "resolved"
+)
+
+type conditionKind uint
+
+const (
+	THRESHOLD_CONDITION conditionKind = iota
+	RATE_CONDITION
+	NODATA_CONDITION
+)
+
+type condition struct {
+	kind      conditionKind
+	predicate valuePredicate
+	nodata    time.Duration
+}
+
+func parseCondition(cond string) (*condition, error) {
+	tokens := tokenize(cond)
+	if len(tokens) == 0 {
+		return nil, errors.New("Rule needs a condition")
+	}
+	switch tokens[0] {
+	case "value", "rate":
+		vp, num, err := parseComparison(tokens[1:])
+		if err != nil {
+			return nil, err
+		}
+		if num != len(tokens)-1 {
+			return nil, errors.New("Unexpected tokens after condition: " + strings.Join(tokens[num+1:], " "))
+		}
+		c := &condition{kind: THRESHOLD_CONDITION, predicate: vp}
+		if tokens[0] == "rate" {
+			c.kind = RATE_CONDITION
+		}
+		return c, nil
+	case "nodata":
+		if len(tokens) != 2 {
+			return nil, errors.New("WRONG ARGS: nodata <duration>")
+		}
+		d, err := parseEvery(tokens[1])
+		if err != nil {
+			return nil, err
+		}
+		return &condition{kind: NODATA_CONDITION, nodata: d}, nil
+	}
+	return nil, errors.New("Conditions must start with value, rate or nodata, not " + tokens[0])
+}
+
+// what a rule remembers about each of the streams it watches
+type ruleState struct {
+	firing bool
+	// wall clock time of the last reading, for nodata rules
+	lastSeen time.Time
+	// the previous reading, for rate rules
+	haveLast  bool
+	lastTime  uint64
+	lastValue float64
+	uot       UnitOfTime
+	path      string
+}
+
+type activeRule struct {
+	Rule
+	cond    *condition
+	where   bson.M
+	streams map[string]*ruleState
+}
+
+// The RuleEngine evaluates the registered rules against the readings that
+// pass through Archiver.AddData and watches for streams that go quiet.
+// Rules are persisted in the metadata store and loaded on startup.
+type RuleEngine struct {
+	sync.Mutex
+	rules  map[string]*activeRule
+	byuuid map[string][]*activeRule
+	store  *Store
+	// called with the alert stream readings we generate; set in archiver.go
+	emit   func(map[string]*SmapMessage)
+	client *http.Client
+}
+
+func NewRuleEngine(store *Store) *RuleEngine {
+	re := &RuleEngine{rules: make(map[string]*activeRule),
+		byuuid: make(map[string][]*activeRule),
+		store:  store,
+		client: &http.Client{Timeout: 10 * time.Second}}
+	rules, err := store.getRules()
+	if err != nil {
+		log.Error("Could not load rules: %v", err)
+	}
+	for _, rule := range rules {
+		ar, err := newActiveRule(rule)
+		if err != nil {
+			log.Error("Skipping invalid rule %v: %v", rule.Name, err)
+			continue
+		}
+		re.rules[rule.Name] = ar
+	}
+	return re
+}
+
+// Returned by AddRule when the rule cannot be parsed, e.g. because of a
+// malformed where clause. The handlers turn it into an HTTP 400
+type InvalidRuleError struct {
+	Reason string
+}
+
+func (e *InvalidRuleError) Error() string {
+	return "Invalid rule: " + e.Reason
+}
+
+func newActiveRule(rule Rule) (*activeRule, error) {
+	if rule.Name == "" {
+		return nil, errors.New("Rule needs a name")
+	}
+	cond, err := parseCondition(rule.Condition)
+	if err != nil {
+		return nil, err
+	}
+	tokens := tokenize(rule.Where)
+	if len(tokens) > 0 && tokens[0] == "where" {
+		tokens = tokens[1:]
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("Rule needs a where clause")
+	}
+	whereNode, err := parseWhere(&tokens)
+	if err != nil {
+		return nil, err
+	}
+	// never alert on alert streams
+	where := bson.M{"$and": []bson.M{whereNode.ToBson(), bson.M{"Metadata.Type": bson.M{"$ne": "Alert"}}}}
+	return &activeRule{Rule: rule, cond: cond, where: where, streams: make(map[string]*ruleState)}, nil
+}
+
+// Periodically re-resolves the rules' where clauses and checks nodata rules
+func (re *RuleEngine) run() {
+	re.refresh()
+	stale := time.NewTicker(staleCheckInterval)
+	refresh := time.NewTicker(ruleRefreshInterval)
+	for {
+		select {
+		case <-stale.C:
+			re.checkStale(time.Now())
+		case <-refresh.C:
+			re.refresh()
+		}
+	}
+}
+
+// Validates and saves a new rule and starts evaluating it
+func (re *RuleEngine) AddRule(rule Rule) error {
+	ar, err := newActiveRule(rule)
+	if err != nil {
+		return &InvalidRuleError{Reason: err.Error()}
+	}
+	re.Lock()
+	_, found := re.rules[rule.Name]
+	re.Unlock()
+	if found {
+		return errors.New("A rule named " + rule.Name + " already exists")
+	}
+	if err := re.store.saveRule(rule); err != nil {
+		return err
+	}
+	re.Lock()
+	re.rules[rule.Name] = ar
+	re.Unlock()
+	re.refresh()
+	return nil
+}
+
+// Stops evaluating and deletes the named rule
+func (re *RuleEngine) RemoveRule(name string) error {
+	re.Lock()
+	_, found := re.rules[name]
+	re.Unlock()
+	if !found {
+		return errors.New("No rule named " + name)
+	}
+	if err := re.store.removeRule(name); err != nil {
+		return err
+	}
+	re.Lock()
+	delete(re.rules, name)
+	re.Unlock()
+	re.refresh()
+	return nil
+}
+
+// Returns the registered rules
+func (re *RuleEngine) Rules() []Rule {
+	re.Lock()
+	defer re.Unlock()
+	rules := make([]Rule, 0, len(re.rules))
+	for _, ar := range re.rules {
+		rules = append(rules, ar.Rule)
+	}
+	return rules
+}
+
+// Resolves each rule's where clause to the streams it watches. Streams that
+// are new to a rule start their nodata timer now.
+func (re *RuleEngine) refresh() {
+	re.Lock()
+	rules := make([]*activeRule, 0, len(re.rules))
+	for _, ar := range re.rules {
+		rules = append(rules, ar)
+	}
+	re.Unlock()
+
+	matches := make(map[*activeRule][]string, len(rules))
+	units := make(map[string]UnitOfTime)
+	for _, ar := range rules {
+		uuids, err := re.store.GetUUIDs(ar.where)
+		if err != nil {
+			log.Error("Error resolving streams for rule %v: %v", ar.Name, err)
+			continue
+		}
+		matches[ar] = uuids
+		for _, uuid := range uuids {
+			re.Lock()
+			_, known := ar.streams[uuid]
+			re.Unlock()
+			if _, found := units[uuid]; !known && !found {
+				units[uuid] = unitOfTimeFromString(re.store.GetUnitofTime(uuid))
+			}
+		}
+	}
+
+	now := time.Now()
+	re.Lock()
+	defer re.Unlock()
+	byuuid := make(map[string][]*activeRule)
+	for _, ar := range re.rules {
+		uuids, found := matches[ar]
+		if !found {
+			// added while we were resolving, or the lookup failed; keep what we had
+			for uuid := range ar.streams {
+				byuuid[uuid] = append(byuuid[uuid], ar)
+			}
+			continue
+		}
+		streams := make(map[string]*ruleState, len(uuids))
+		for _, uuid := range uuids {
+			if state, found := ar.streams[uuid]; found {
+				streams[uuid] = state
+			} else if uot, found := units[uuid]; found {
+				streams[uuid] = &ruleState{lastSeen: now, uot: uot}
+			} else {
+				streams[uuid] = &ruleState{lastSeen: now, uot: UOT_MS}
+			}
+			byuuid[uuid] = append(byuuid[uuid], ar)
+		}
+		ar.streams = streams
+	}
+	re.byuuid = byuuid
+}
+
+// Evaluates the rules watching msg's stream against its readings
+func (re *RuleEngine) Evaluate(msg *SmapMessage) {
+	var events []*AlertEvent
+	now := time.Now()
+	re.Lock()
+	for _, ar := range re.byuuid[msg.UUID] {
+		state := ar.streams[msg.UUID]
+		if state == nil {
+			continue
+		}
+		if msg.Path != "" {
+			state.path = msg.Path
+		}
+		if uot, ok := msg.Properties["UnitofTime"].(string); ok {
+			state.uot = unitOfTimeFromString(uot)
+		}
+		if ev := ar.evaluate(msg, state, now); ev != nil {
+			events = append(events, ev)
+		}
+	}
+	re.Unlock()
+	re.fire(events)
+}
+
+// updates the state of one stream for this rule, and returns an event if the
+// rule started or stopped holding
+func (ar *activeRule) evaluate(msg *SmapMessage, state *ruleState, now time.Time) *AlertEvent {
+	if len(msg.Readings) == 0 {
+		return nil
+	}
+	if ar.cond.kind == NODATA_CONDITION {
+		state.lastSeen = now
+		if state.firing {
+			state.firing = false
+			return ar.event(msg.UUID, state, ALERT_RESOLVED, 0, now)
+		}
+		return nil
+	}
+	wasFiring := state.firing
+	var value float64
+	for _, rdg := range msg.Readings {
+		if len(rdg) < 2 {
+			continue
+		}
+		ts, ok := readingTime(rdg[0])
+		if !ok {
+			continue
+		}
+		val, ok := readingValue(rdg[1])
+		if !ok {
+			continue
+		}
+		switch ar.cond.kind {
+		case THRESHOLD_CONDITION:
+			state.firing = ar.cond.predicate.matches(val)
+			value = val
+		case RATE_CONDITION:
+			if state.haveLast && ts > state.lastTime {
+				seconds := float64(ts-state.lastTime) / float64(convertTime(1, UOT_S, state.uot))
+				value = (val - state.lastValue) / seconds
+				state.firing = ar.cond.predicate.matches(value)
+			}
+			state.haveLast, state.lastTime, state.lastValue = true, ts, val
+		}
+	}
+	if state.firing == wasFiring {
+		return nil
+	}
+	if state.firing {
+		return ar.event(msg.UUID, state, ALERT_FIRING, value, now)
+	}
+	return ar.event(msg.UUID, state, ALERT_RESOLVED, value, now)
+}
+
+// Fires nodata rules for streams we have not heard from in time
+func (re *RuleEngine) checkStale(now time.Time) {
+	var events []*AlertEvent
+	re.Lock()
+	for _, ar := range re.rules {
+		if ar.cond.kind != NODATA_CONDITION {
+			continue
+		}
+		for uuid, state := range ar.streams {
+			if !state.firing && now.Sub(state.lastSeen) >= ar.cond.nodata {
+				state.firing = true
+				events = append(events, ar.event(uuid, state, ALERT_FIRING, 0, now))
+			}
+		}
+	}
+	re.Unlock()
+	re.fire(events)
+}
+
+func (ar *activeRule) event(uuid string, state *ruleState, status string, value float64, now time.Time) *AlertEvent {
+	return &AlertEvent{Rule: ar.Name, Condition: ar.Condition, UUID: uuid,
+		AlertUUID:  alertStreamUUID(ar.Name, uuid),
+		State:      status,
+		Time:       now.UnixNano() / int64(time.Millisecond),
+		Value:      value,
+		SourcePath: state.path}
+}
+
+// Writes the events to their alert streams and calls the rules' webhooks
+func (re *RuleEngine) fire(events []*AlertEvent) {
+	if len(events) == 0 {
+		return
+	}
+	messages := make(map[string]*SmapMessage, len(events))
+	for _, ev := range events {
+		log.Notice("Rule %v %v for %v", ev.Rule, ev.State, ev.UUID)
+		msg := alertMessage(ev)
+		messages[msg.Path] = msg
+		re.Lock()
+		ar, found := re.rules[ev.Rule]
+		re.Unlock()
+		if found && ar.Webhook != "" {
+			go re.callWebhook(ar.Webhook, ev)
+		}
+	}
+	if re.emit != nil {
+		re.emit(messages)
+	}
+}
+
+func (re *RuleEngine) callWebhook(url string, ev *AlertEvent) {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		log.Error("Error marshalling alert event: %v", err)
+		return
+	}
+	if err := postWithRetry(re.client, url, "", body, nil); err != nil {
+		log.Error("Giving up on webhook %v for rule %v: %v", url, ev.Rule, err)
+		re.store.saveDeadLetter(DeadLetter{Webhook: "rule:" + ev.Rule, URL: url, Body: string(body),
+			Error: err.Error(), Time: time.Now()})
+	}
+}
+
+// Alert streams get a UUID derived from the rule and the stream it watches,
+// so the same alert always lands in the same stream
+func alertStreamUUID(rule, uuid string) string {
+	return uuidlib.NewSHA1(uuidlib.NameSpace_URL, []byte("giles/alert/"+rule+"/"+uuid)).String()
+}
+
+// The sMAP message recording an alert event in its alert stream
+func alertMessage(ev *AlertEvent) *SmapMessage {
+	var value float64
+	if ev.State == ALERT_FIRING {
+		value = 1
+	}
+	return &SmapMessage{UUID: ev.AlertUUID,
+		Path:     "/alerts/" + ev.Rule + "/" + ev.UUID,
+		Readings: [][]interface{}{[]interface{}{uint64(ev.Time), value}},
+		Metadata: bson.M{"Type": "Alert", "Rule": ev.Rule, "Condition": ev.Condition,
+			"SourceUUID": ev.UUID},
+		Properties: bson.M{"UnitofTime": "ms"}}
+}
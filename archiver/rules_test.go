@@ -0,0 +1,118 @@
+package archiver
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCondition(t *testing.T) {
+	for cond, kind := range map[string]conditionKind{
+		"value > 30":  THRESHOLD_CONDITION,
+		"value <= -2": THRESHOLD_CONDITION,
+		"rate > 0.5":  RATE_CONDITION,
+		"nodata 15m":  NODATA_CONDITION,
+	} {
+		c, err := parseCondition(cond)
+		if err != nil {
+			t.Error(cond, "\ngave error", err)
+			continue
+		}
+		if c.kind != kind {
+			t.Error(cond, "\nhas wrong kind", c.kind)
+		}
+	}
+	c, _ := parseCondition("nodata 15m")
+	if c.nodata != 15*time.Minute {
+		t.Error("nodata 15m has wrong duration", c.nodata)
+	}
+	for _, cond := range []string{"", "value", "value > hot", "value > 30 and", "nodata", "nodata -5m", "temp > 30"} {
+		if _, err := parseCondition(cond); err == nil {
+			t.Error(cond, "\nshould give an error")
+		}
+	}
+}
+
+func reading(ts uint64, value float64) *SmapMessage {
+	return &SmapMessage{UUID: "a", Readings: [][]interface{}{[]interface{}{ts, value}}}
+}
+
+func TestEvaluateThreshold(t *testing.T) {
+	ar, err := newActiveRule(Rule{Name: "hot", Condition: "value > 30", Where: "Metadata/Type = 'Temp'"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := &ruleState{uot: UOT_MS}
+	now := time.Now()
+	if ev := ar.evaluate(reading(1, 20), state, now); ev != nil {
+		t.Error("Rule should not fire for 20 but got", ev)
+	}
+	ev := ar.evaluate(reading(2, 40), state, now)
+	if ev == nil || ev.State != ALERT_FIRING || ev.Value != 40 {
+		t.Error("Rule should fire for 40 but got", ev)
+	}
+	if ev := ar.evaluate(reading(3, 50), state, now); ev != nil {
+		t.Error("Rule should only fire once but got", ev)
+	}
+	ev = ar.evaluate(reading(4, 10), state, now)
+	if ev == nil || ev.State != ALERT_RESOLVED {
+		t.Error("Rule should resolve for 10 but got", ev)
+	}
+}
+
+func TestMalformedRule(t *testing.T) {
+	for _, where := range []string{"Metadata/Site", "Metadata/Site =", "Metadata/Site = 'a' and"} {
+		if _, err := newActiveRule(Rule{Name: "r", Condition: "value > 1", Where: where}); err == nil {
+			t.Error("Rule with where clause", where, "should give an error")
+		}
+	}
+	re := &RuleEngine{rules: make(map[string]*activeRule)}
+	if err := re.AddRule(Rule{Name: "r", Condition: "value > 1", Where: "Metadata/Site"}); err == nil {
+		t.Error("Adding a malformed rule should give an error")
+	} else if _, ok := err.(*InvalidRuleError); !ok {
+		t.Error("Adding a malformed rule should give an InvalidRuleError, not", err)
+	}
+}
+
+func TestEvaluateRate(t *testing.T) {
+	ar, _ := newActiveRule(Rule{Name: "rising", Condition: "rate > 1", Where: "has uuid"})
+	state := &ruleState{uot: UOT_MS}
+	now := time.Now()
+	ar.evaluate(reading(1000, 10), state, now)
+	// 1 per second
+	if ev := ar.evaluate(reading(2000, 11), state, now); ev != nil {
+		t.Error("Rule should not fire at rate 1 but got", ev)
+	}
+	// 5 per second
+	ev := ar.evaluate(reading(3000, 16), state, now)
+	if ev == nil || ev.State != ALERT_FIRING || ev.Value != 5 {
+		t.Error("Rule should fire at rate 5 but got", ev)
+	}
+}
+
+func TestCheckStale(t *testing.T) {
+	re := &RuleEngine{rules: make(map[string]*activeRule), byuuid: make(map[string][]*activeRule)}
+	var emitted map[string]*SmapMessage
+	re.emit = func(msgs map[string]*SmapMessage) { emitted = msgs }
+	ar, _ := newActiveRule(Rule{Name: "dead", Condition: "nodata 15m", Where: "has uuid"})
+	start := time.Now()
+	ar.streams["a"] = &ruleState{lastSeen: start}
+	re.rules[ar.Name] = ar
+	re.byuuid["a"] = []*activeRule{ar}
+
+	re.checkStale(start.Add(10 * time.Minute))
+	if emitted != nil {
+		t.Error("Rule should not fire after 10 minutes but emitted", emitted)
+	}
+	re.checkStale(start.Add(20 * time.Minute))
+	msg := emitted["/alerts/dead/a"]
+	if msg == nil || msg.UUID != alertStreamUUID("dead", "a") || msg.Readings[0][1] != float64(1) {
+		t.Error("Rule should fire after 20 minutes but emitted", emitted)
+	}
+
+	emitted = nil
+	re.Evaluate(reading(1, 1))
+	msg = emitted["/alerts/dead/a"]
+	if msg == nil || msg.Readings[0][1] != float64(0) {
+		t.Error("Rule should resolve when data arrives but emitted", emitted)
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // The SSHConfigServer offers a command-line based alternative to the PowerDB2 administration interface.
@@ -45,8 +46,48 @@ import (
 //		delkey <name> <email> -- deletes the key associated with the given name and email
 //		delkey <key> -- deletes the given key
 //		owner <key> -- retrieves owner (name, email) for given key
+//		actuation <key> <on|off> -- allows or forbids the key to actuate streams
+//
+//		[[Alerting Rules]]
+//		addrule <name> <condition> [webhook <url>] where <where clause> -- registers a new rule
+//		listrules -- lists all rules
+//		delrule <name> -- deletes the named rule
+//
+//		[[Webhooks]]
+//		addwebhook <name> <url> [secret <secret>] where <where clause> -- pushes matching readings to url
+//		listwebhooks -- lists all webhooks
+//		delwebhook <name> -- deletes the named webhook
+//		deadletters <name> [<count>] -- shows the most recent failed deliveries for a webhook or rule:<name>
+//
+//		[[Virtual Streams]]
+//		addvirtual <name> = <expression> -- defines a stream computed from other streams
+//		listvirtual -- lists all virtual streams
+//		delvirtual <name> -- stops computing the named virtual stream
+//
+//		[[Data Expiry]]
+//		expire dryrun -- reports what would be deleted under each stream's Properties/Retention
+//		expire -- deletes the readings that are past their stream's Properties/Retention now
+//
+//		[[Backfill]]
+//		backfill <from> <to> <start> <end> [where <where clause>] -- copies readings between two timeseries databases
+//		backfill status -- reports the progress of the running or last backfill
+//		backfill stop -- stops the running backfill
+//
+//		[[Replication]]
+//		replication -- reports how far forwarding to the upstream archiver has got
+//
+//		[[Cluster]]
+//		cluster -- lists the nodes of the cluster and whether they answer
+//		cluster owner <uuid> -- shows which node owns a stream
 type SSHConfigServer struct {
 	store              *Store
+	rules              *RuleEngine     // rules is added in archiver.go
+	webhooks           *WebhookManager // webhooks is added in archiver.go
+	virtual            *VirtualStreams // virtual is added in archiver.go
+	expiry             *ExpiryJob      // expiry is added in archiver.go
+	backfill           *BackfillJob    // backfill is added in archiver.go
+	replicator         *Replicator     // replicator is added in archiver.go
+	cluster            *Cluster        // cluster is added in archiver.go
 	port               string
 	authorizedKeysFile string
 	config             *ssh.ServerConfig
@@ -230,6 +271,51 @@ func (scs *SSHConfigServer) handleInput(term *terminal.Terminal, channel *ssh.Ch
 	case strings.HasPrefix(line, "owner"):
 		owner := scs.owner(line)
 		scs.writeLines(term, owner)
+	case strings.HasPrefix(line, "actuation"):
+		success := scs.actuation(line)
+		scs.writeLines(term, success)
+	case strings.HasPrefix(line, "addrule"):
+		success := scs.addrule(line)
+		scs.writeLines(term, success)
+	case strings.HasPrefix(line, "listrules"):
+		rules := scs.listrules(line)
+		scs.writeLines(term, rules)
+	case strings.HasPrefix(line, "delrule"):
+		success := scs.delrule(line)
+		scs.writeLines(term, success)
+	case strings.HasPrefix(line, "addwebhook"):
+		success := scs.addwebhook(line)
+		scs.writeLines(term, success)
+	case strings.HasPrefix(line, "listwebhooks"):
+		hooks := scs.listwebhooks(line)
+		scs.writeLines(term, hooks)
+	case strings.HasPrefix(line, "delwebhook"):
+		success := scs.delwebhook(line)
+		scs.writeLines(term, success)
+	case strings.HasPrefix(line, "deadletters"):
+		letters := scs.deadletters(line)
+		scs.writeLines(term, letters)
+	case strings.HasPrefix(line, "addvirtual"):
+		success := scs.addvirtual(line)
+		scs.writeLines(term, success)
+	case strings.HasPrefix(line, "listvirtual"):
+		defs := scs.listvirtual(line)
+		scs.writeLines(term, defs)
+	case strings.HasPrefix(line, "delvirtual"):
+		success := scs.delvirtual(line)
+		scs.writeLines(term, success)
+	case strings.HasPrefix(line, "expire"):
+		report := scs.expire(line)
+		scs.writeLines(term, report)
+	case strings.HasPrefix(line, "backfill"):
+		report := scs.backfillCommand(line)
+		scs.writeLines(term, report)
+	case strings.HasPrefix(line, "replication"):
+		report := scs.replication(line)
+		scs.writeLines(term, report)
+	case strings.HasPrefix(line, "cluster"):
+		report := scs.clusterCommand(line)
+		scs.writeLines(term, report)
 	default:
 		scs.writeLines(term, strings.Join([]string{fmt.Sprintf("Invalid command (%v)", line), help}, "\n"))
 	}
@@ -350,6 +436,329 @@ func (scs *SSHConfigServer) owner(line string) string {
 	return fmt.Sprintf("name: %s\nemail: %s", resp["name"], resp["email"])
 }
 
+func (scs *SSHConfigServer) actuation(line string) string {
+	args := strings.Split(line, " ")
+	if len(args) != 3 || (args[2] != "on" && args[2] != "off") {
+		return "WRONG ARGS: actuation <key> <on|off>"
+	}
+	resp, err := scs.store.setActuation(args[1], args[2] == "on")
+	if err != nil {
+		return err.Error()
+	}
+	return resp
+}
+
+func (scs *SSHConfigServer) addrule(line string) string {
+	var rule Rule
+	usage := "WRONG ARGS: addrule <name> <condition> [webhook <url>] where <where clause>"
+	wherepos := strings.Index(line, " where ")
+	if wherepos < 0 {
+		return usage
+	}
+	args := strings.Fields(line[:wherepos])
+	if len(args) < 3 {
+		return usage
+	}
+	rule.Name = args[1]
+	args = args[2:]
+	if len(args) > 2 && args[len(args)-2] == "webhook" {
+		rule.Webhook = args[len(args)-1]
+		args = args[:len(args)-2]
+	}
+	rule.Condition = strings.Join(args, " ")
+	rule.Where = strings.TrimSpace(line[wherepos+len(" where "):])
+	if err := scs.rules.AddRule(rule); err != nil {
+		return err.Error()
+	}
+	return "Added rule " + rule.Name
+}
+
+func (scs *SSHConfigServer) listrules(line string) string {
+	rules := scs.rules.Rules()
+	if len(rules) == 0 {
+		return "No rules"
+	}
+	ret := make([]string, len(rules))
+	for i, rule := range rules {
+		desc := []string{"name: " + rule.Name,
+			"condition: " + rule.Condition,
+			"where: " + rule.Where}
+		if rule.Webhook != "" {
+			desc = append(desc, "webhook: "+rule.Webhook)
+		}
+		ret[i] = strings.Join(append(desc, "----------"), "\n")
+	}
+	return strings.Join(ret, "\n")
+}
+
+func (scs *SSHConfigServer) delrule(line string) string {
+	args := strings.Split(line, " ")
+	if len(args) != 2 {
+		return "WRONG ARGS: delrule <name>"
+	}
+	if err := scs.rules.RemoveRule(args[1]); err != nil {
+		return err.Error()
+	}
+	return "Deleted rule " + args[1]
+}
+
+func (scs *SSHConfigServer) addwebhook(line string) string {
+	var hook Webhook
+	usage := "WRONG ARGS: addwebhook <name> <url> [secret <secret>] where <where clause>"
+	wherepos := strings.Index(line, " where ")
+	if wherepos < 0 {
+		return usage
+	}
+	args := strings.Fields(line[:wherepos])
+	switch len(args) {
+	case 3:
+	case 5:
+		if args[3] != "secret" {
+			return usage
+		}
+		hook.Secret = args[4]
+	default:
+		return usage
+	}
+	hook.Name = args[1]
+	hook.URL = args[2]
+	hook.Query = strings.TrimSpace(line[wherepos+len(" where "):])
+	if err := scs.webhooks.AddWebhook(hook); err != nil {
+		return err.Error()
+	}
+	return "Added webhook " + hook.Name
+}
+
+func (scs *SSHConfigServer) listwebhooks(line string) string {
+	hooks := scs.webhooks.Webhooks()
+	if len(hooks) == 0 {
+		return "No webhooks"
+	}
+	ret := make([]string, len(hooks))
+	for i, hook := range hooks {
+		ret[i] = strings.Join([]string{"name: " + hook.Name,
+			"url: " + hook.URL,
+			"where: " + hook.Query,
+			"----------"}, "\n")
+	}
+	return strings.Join(ret, "\n")
+}
+
+func (scs *SSHConfigServer) delwebhook(line string) string {
+	args := strings.Split(line, " ")
+	if len(args) != 2 {
+		return "WRONG ARGS: delwebhook <name>"
+	}
+	if err := scs.webhooks.RemoveWebhook(args[1]); err != nil {
+		return err.Error()
+	}
+	return "Deleted webhook " + args[1]
+}
+
+func (scs *SSHConfigServer) deadletters(line string) string {
+	var err error
+	limit := 10
+	args := strings.Split(line, " ")
+	if len(args) < 2 || len(args) > 3 {
+		return "WRONG ARGS: deadletters <name> [<count>]"
+	}
+	if len(args) == 3 {
+		if limit, err = strconv.Atoi(args[2]); err != nil {
+			return "BAD COUNT: deadletters <name> [<count>]"
+		}
+	}
+	letters, err := scs.webhooks.DeadLetters(args[1], limit)
+	if err != nil {
+		return err.Error()
+	}
+	if len(letters) == 0 {
+		return "No failed deliveries for " + args[1]
+	}
+	ret := make([]string, len(letters))
+	for i, letter := range letters {
+		ret[i] = strings.Join([]string{"time: " + letter.Time.String(),
+			"url: " + letter.URL,
+			"error: " + letter.Error,
+			"body: " + letter.Body,
+			"----------"}, "\n")
+	}
+	return strings.Join(ret, "\n")
+}
+
+func (scs *SSHConfigServer) addvirtual(line string) string {
+	var def VirtualStream
+	parts := strings.SplitN(strings.TrimPrefix(line, "addvirtual"), "=", 2)
+	if len(parts) != 2 {
+		return "WRONG ARGS: addvirtual <name> = <expression>"
+	}
+	def.Name = strings.TrimSpace(parts[0])
+	def.Expression = strings.TrimSpace(parts[1])
+	if err := scs.virtual.Add(def); err != nil {
+		return err.Error()
+	}
+	return "Added virtual stream " + def.Name + " with uuid " + virtualStreamUUID(def.Name)
+}
+
+func (scs *SSHConfigServer) listvirtual(line string) string {
+	defs := scs.virtual.List()
+	if len(defs) == 0 {
+		return "No virtual streams"
+	}
+	ret := make([]string, len(defs))
+	for i, def := range defs {
+		ret[i] = strings.Join([]string{"name: " + def.Name,
+			"uuid: " + virtualStreamUUID(def.Name),
+			"expression: " + def.Expression,
+			"----------"}, "\n")
+	}
+	return strings.Join(ret, "\n")
+}
+
+func (scs *SSHConfigServer) delvirtual(line string) string {
+	args := strings.Split(line, " ")
+	if len(args) != 2 {
+		return "WRONG ARGS: delvirtual <name>"
+	}
+	if err := scs.virtual.Remove(args[1]); err != nil {
+		return err.Error()
+	}
+	return "Deleted virtual stream " + args[1]
+}
+
+func (scs *SSHConfigServer) expire(line string) string {
+	var (
+		expiries []*Expiry
+		err      error
+	)
+	args := strings.Split(line, " ")
+	if len(args) > 2 || (len(args) == 2 && args[1] != "dryrun") {
+		return "WRONG ARGS: expire [dryrun]"
+	}
+	if scs.expiry == nil {
+		return "Expiry is not enabled (see [Expiry] in giles.cfg)"
+	}
+	dryrun := len(args) == 2
+	if dryrun {
+		expiries, err = scs.expiry.DryRun()
+	} else {
+		expiries, err = scs.expiry.Run()
+	}
+	if err != nil {
+		return err.Error()
+	}
+	if len(expiries) == 0 {
+		return "No streams have a Properties/Retention"
+	}
+	ret := make([]string, len(expiries))
+	for i, exp := range expiries {
+		lines := []string{"uuid: " + exp.UUID,
+			"path: " + exp.Path,
+			"retention: " + exp.Retention}
+		switch {
+		case exp.Error != "":
+			lines = append(lines, "error: "+exp.Error)
+		case !dryrun:
+			lines = append(lines, "deleted readings before: "+exp.Cutoff.String())
+		case exp.Oldest.IsZero():
+			lines = append(lines, "nothing to delete before: "+exp.Cutoff.String())
+		default:
+			lines = append(lines, "would delete readings from "+exp.Oldest.String()+" to "+exp.Cutoff.String())
+		}
+		ret[i] = strings.Join(append(lines, "----------"), "\n")
+	}
+	return strings.Join(ret, "\n")
+}
+
+func (scs *SSHConfigServer) backfillCommand(line string) string {
+	usage := "WRONG ARGS: backfill <from> <to> <start> <end> [where <where clause>] | backfill status | backfill stop"
+	var where string
+	if wherepos := strings.Index(line, " where "); wherepos >= 0 {
+		where = strings.TrimSpace(line[wherepos+len(" where "):])
+		line = line[:wherepos]
+	}
+	args := strings.Fields(line)
+	switch {
+	case len(args) == 2 && args[1] == "status":
+		bf := scs.backfill.Status()
+		if bf == nil {
+			return "No backfill has been run"
+		}
+		return formatBackfill(bf)
+	case len(args) == 2 && args[1] == "stop":
+		if err := scs.backfill.Stop(); err != nil {
+			return err.Error()
+		}
+		return "Stopping backfill"
+	case len(args) != 5:
+		return usage
+	}
+	start, err := parseBackfillTime(args[3])
+	if err != nil {
+		return err.Error()
+	}
+	end, err := parseBackfillTime(args[4])
+	if err != nil {
+		return err.Error()
+	}
+	bf := Backfill{From: args[1], To: args[2], Start: start, End: end, Where: where}
+	if err := scs.backfill.Start(bf); err != nil {
+		return err.Error()
+	}
+	return "Started backfill from " + bf.From + " to " + bf.To + " (see backfill status)"
+}
+
+func (scs *SSHConfigServer) replication(line string) string {
+	if scs.replicator == nil {
+		return "Replication is not enabled (see [Replication] in giles.cfg)"
+	}
+	return scs.replicator.Status()
+}
+
+func (scs *SSHConfigServer) clusterCommand(line string) string {
+	if scs.cluster == nil {
+		return "This archiver is not part of a cluster (see [Cluster] in giles.cfg)"
+	}
+	args := strings.Fields(line)
+	switch {
+	case len(args) == 1:
+		return scs.cluster.Status()
+	case len(args) == 3 && args[1] == "owner":
+		return args[2] + " is owned by " + scs.cluster.Owner(args[2])
+	}
+	return "WRONG ARGS: cluster | cluster owner <uuid>"
+}
+
+// Backfill times are in milliseconds, or "now"
+func parseBackfillTime(s string) (uint64, error) {
+	if s == "now" {
+		return timeToUnit(time.Now(), UOT_MS), nil
+	}
+	t, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Backfill times are in milliseconds or now, not %v", s)
+	}
+	return t, nil
+}
+
+func formatBackfill(bf *Backfill) string {
+	lines := []string{"from: " + bf.From,
+		"to: " + bf.To,
+		"where: " + bf.Where,
+		fmt.Sprintf("range: %v to %v", bf.Start, bf.End),
+		fmt.Sprintf("streams: %v of %v", bf.StreamsDone, bf.Streams),
+		fmt.Sprintf("readings copied: %v", bf.Readings),
+		"began: " + bf.Began.String()}
+	switch {
+	case bf.Finished.IsZero():
+		lines = append(lines, fmt.Sprintf("copying: %v at %v", bf.Current, bf.CurrentAt))
+	case bf.Error != "":
+		lines = append(lines, "error: "+bf.Error, "stopped: "+bf.Finished.String())
+	default:
+		lines = append(lines, "finished: "+bf.Finished.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
 var greeting = `
 Welcome to SSSHSCS, the sMAP SSH Server Configuration Shell!
      ______   ___   ___    _____  ________  ______
@@ -377,4 +786,40 @@ listkeys <email> -- list all API keys and names for the given email
 delkey <name> <email> -- deletes the key associated with the given name and email
 delkey <key> -- deletes the given key
 owner <key> -- retrieves owner (name, email) for given key
+actuation <key> <on|off> -- allows or forbids the key to actuate streams
+
+[[Alerting Rules]]
+addrule <name> <condition> [webhook <url>] where <where clause> -- registers a new rule
+	conditions: value > 30 | rate > 0.5 | nodata 15m
+listrules -- lists all rules
+delrule <name> -- deletes the named rule
+
+[[Webhooks]]
+addwebhook <name> <url> [secret <secret>] where <where clause> -- pushes matching readings to url
+listwebhooks -- lists all webhooks
+delwebhook <name> -- deletes the named webhook
+deadletters <name> [<count>] -- shows the most recent failed deliveries for a webhook or rule:<name>
+
+[[Virtual Streams]]
+addvirtual <name> = <expression> -- defines a stream computed from other streams
+	e.g. addvirtual temp_f = stream(Path = '/building/temp_c') * 9/5 + 32
+listvirtual -- lists all virtual streams
+delvirtual <name> -- stops computing the named virtual stream
+
+[[Data Expiry]]
+expire dryrun -- reports what would be deleted under each stream's Properties/Retention
+expire -- deletes the readings that are past their stream's Properties/Retention now
+
+[[Backfill]]
+backfill <from> <to> <start> <end> [where <where clause>] -- copies readings between two timeseries databases
+	times are in milliseconds or now, e.g. backfill readingdb quasar 0 now where Path like '/building/%'
+backfill status -- reports the progress of the running or last backfill
+backfill stop -- stops the running backfill
+
+[[Replication]]
+replication -- reports how far forwarding to the upstream archiver has got
+
+[[Cluster]]
+cluster -- lists the nodes of the cluster and whether they answer
+cluster owner <uuid> -- shows which node owns a stream
 `
@@ -0,0 +1,338 @@
+package archiver
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A parsed republish query. Besides the where clause that selects the
+// streams, a subscription can carry options that change what the
+// Republisher delivers:
+//
+//    replay 100 where Metadata/Site = 'Soda Hall'
+//    Metadata/Site = 'Soda Hall' replay 1h
+//
+// The first sends the last 100 readings of each matching stream before
+// switching to live data; the second sends the last hour.
+//
+// Data subscriptions can also restrict which readings are delivered:
+//
+//    select data where Metadata/Type = 'Temp' and value > 30 every 10s
+//
+// Only readings whose value satisfies every "value" predicate are forwarded,
+// and "every" replaces the forwarded readings with one reading per stream
+// per window, holding the mean of the window's values. Value predicates can
+// only be joined to the rest of the where clause with "and".
+//
+// A subscription can also be a full select query. Data queries (select data
+// before now where ...) behave like their where clause; tag queries (select
+// distinct Metadata/HVACZone where ...) subscribe to changes in the query
+// results rather than to readings.
+type subscriptionQuery struct {
+	where  *node
+	replay *replaySpec
+	// set for tag queries
+	tags *tagsTarget
+	// readings must satisfy all of these to be forwarded
+	values []valuePredicate
+	// if non-zero, readings are aggregated into windows of this length
+	every time.Duration
+}
+
+// How much history to send a new subscriber. Exactly one of count and
+// window is set
+type replaySpec struct {
+	count  int32
+	window time.Duration
+}
+
+func parseSubscription(query string) (*subscriptionQuery, error) {
+	var err error
+	sq := &subscriptionQuery{}
+	tokens := tokenize(query)
+	if len(tokens) >= 2 && tokens[0] == "replay" {
+		if sq.replay, err = parseReplay(tokens[1]); err != nil {
+			return sq, err
+		}
+		tokens = tokens[2:]
+	} else if len(tokens) >= 2 && tokens[len(tokens)-2] == "replay" {
+		if sq.replay, err = parseReplay(tokens[len(tokens)-1]); err != nil {
+			return sq, err
+		}
+		tokens = tokens[:len(tokens)-2]
+	}
+	if len(tokens) >= 2 && tokens[len(tokens)-2] == "every" {
+		if sq.every, err = parseEvery(tokens[len(tokens)-1]); err != nil {
+			return sq, err
+		}
+		tokens = tokens[:len(tokens)-2]
+	}
+	if tokens, sq.values, err = extractValuePredicates(tokens); err != nil {
+		return sq, err
+	}
+	if sq.replay != nil && sq.every > 0 {
+		return sq, errors.New("Replay cannot be combined with every")
+	}
+	// "select data where ..." is accepted as a plain where clause
+	if len(tokens) >= 3 && tokens[0] == "select" && tokens[1] == "data" && tokens[2] == "where" {
+		tokens = tokens[3:]
+	}
+	if len(tokens) > 0 && tokens[0] == "select" {
+		ast, err := makeAST(tokens)
+		if err != nil {
+			return sq, err
+		}
+		sq.where = ast.Where
+		if ast.TargetType == TAGS_TARGET {
+			if sq.replay != nil {
+				return sq, errors.New("Replay is only supported for data subscriptions")
+			}
+			if len(sq.values) > 0 || sq.every > 0 {
+				return sq, errors.New("Value predicates and every are only supported for data subscriptions")
+			}
+			sq.tags = ast.Target.(*tagsTarget)
+		}
+		return sq, nil
+	}
+	if len(tokens) > 0 && tokens[0] == "where" {
+		tokens = tokens[1:]
+	}
+	if sq.where, err = parseWhere(&tokens); err != nil {
+		return sq, err
+	}
+	return sq, nil
+}
+
+// Parses the argument to "replay", which is either a number of readings
+// (e.g. 100) or a duration (e.g. 1h, 30m, 2d)
+func parseReplay(spec string) (*replaySpec, error) {
+	if count, err := strconv.ParseUint(spec, 10, 31); err == nil {
+		if count == 0 {
+			return nil, errors.New("Replay count must be positive")
+		}
+		return &replaySpec{count: int32(count)}, nil
+	}
+	if !strings.HasPrefix(spec, "-") && !strings.HasPrefix(spec, "+") {
+		spec = "+" + spec
+	}
+	window, err := parseIntoDuration(spec)
+	if err != nil {
+		return nil, err
+	}
+	if window <= 0 {
+		return nil, errors.New("Replay window must be positive")
+	}
+	return &replaySpec{window: window}, nil
+}
+
+// Parses the argument to "every", a positive duration such as 10s or 5m
+func parseEvery(spec string) (time.Duration, error) {
+	if !strings.HasPrefix(spec, "-") && !strings.HasPrefix(spec, "+") {
+		spec = "+" + spec
+	}
+	every, err := parseIntoDuration(spec)
+	if err != nil {
+		return 0, err
+	}
+	if every <= 0 {
+		return 0, errors.New("Every must be a positive duration")
+	}
+	return every, nil
+}
+
+// A condition on the value of a reading, e.g. value > 30
+type valuePredicate struct {
+	op        string
+	threshold float64
+}
+
+func (vp valuePredicate) matches(value float64) bool {
+	switch vp.op {
+	case ">":
+		return value > vp.threshold
+	case ">=":
+		return value >= vp.threshold
+	case "<":
+		return value < vp.threshold
+	case "<=":
+		return value <= vp.threshold
+	case "=":
+		return value == vp.threshold
+	case "!=":
+		return value != vp.threshold
+	}
+	return false
+}
+
+// Parses "<op> <number>" from the start of tokens, e.g. the "> 30" of
+// "value > 30". Returns the comparison and the number of tokens it used
+func parseComparison(tokens []string) (valuePredicate, int, error) {
+	var vp valuePredicate
+	if len(tokens) < 2 {
+		return vp, 0, errors.New("Incomplete comparison")
+	}
+	op := tokens[0]
+	switch op {
+	case ">", ">=", "<", "<=", "=", "!=":
+	default:
+		return vp, 0, errors.New("Invalid comparison " + op)
+	}
+	threshold, err := strconv.ParseFloat(tokens[1], 64)
+	if err != nil {
+		return vp, 0, errors.New("Must compare against a number, not " + tokens[1])
+	}
+	return valuePredicate{op: op, threshold: threshold}, 2, nil
+}
+
+// Removes the "value <op> <number>" clauses (and the "and" joining them to
+// the rest of the query) from the tokens, returning the remaining tokens and
+// the predicates
+func extractValuePredicates(tokens []string) ([]string, []valuePredicate, error) {
+	var (
+		remaining  []string
+		predicates []valuePredicate
+	)
+	for pos := 0; pos < len(tokens); pos++ {
+		// "value" is only a predicate where a clause can start, so that
+		// e.g. Metadata/Name = value still compares a tag
+		startsClause := pos == 0 || tokens[pos-1] == "and" || tokens[pos-1] == "or" || tokens[pos-1] == "where"
+		if tokens[pos] != "value" || !startsClause {
+			remaining = append(remaining, tokens[pos])
+			continue
+		}
+		vp, num, err := parseComparison(tokens[pos+1:])
+		if err != nil {
+			return tokens, nil, err
+		}
+		predicates = append(predicates, vp)
+		pos += num
+
+		// drop the conjunction that joined this predicate to the query
+		if len(remaining) > 0 && (remaining[len(remaining)-1] == "and" || remaining[len(remaining)-1] == "or") {
+			if remaining[len(remaining)-1] == "or" {
+				return tokens, nil, errors.New("Value predicates can only be combined with 'and'")
+			}
+			remaining = remaining[:len(remaining)-1]
+		} else if pos+1 < len(tokens) && (tokens[pos+1] == "and" || tokens[pos+1] == "or") {
+			if tokens[pos+1] == "or" {
+				return tokens, nil, errors.New("Value predicates can only be combined with 'and'")
+			}
+			pos++
+		}
+	}
+	return remaining, predicates, nil
+}
+
+// Returns a copy of msg holding only the readings that satisfy all of the
+// predicates, or nil if there are none. Messages without readings are
+// returned unchanged
+func filterReadings(msg *SmapMessage, predicates []valuePredicate) *SmapMessage {
+	if len(predicates) == 0 || len(msg.Readings) == 0 {
+		return msg
+	}
+	var matched [][]interface{}
+Readings:
+	for _, rdg := range msg.Readings {
+		if len(rdg) < 2 {
+			continue
+		}
+		value, ok := readingValue(rdg[1])
+		if !ok {
+			continue
+		}
+		for _, vp := range predicates {
+			if !vp.matches(value) {
+				continue Readings
+			}
+		}
+		matched = append(matched, rdg)
+	}
+	if len(matched) == 0 {
+		return nil
+	}
+	copied := *msg
+	copied.Readings = matched
+	return &copied
+}
+
+// Collects the readings a client receives and, once per window, sends one
+// reading per stream: the mean of the window's values, stamped with the
+// timestamp of the newest reading in the window.
+type downsampler struct {
+	sync.Mutex
+	every      time.Duration
+	subscriber Subscriber
+	windows    map[string]*window
+}
+
+type window struct {
+	path   string
+	sum    float64
+	count  int
+	newest uint64
+}
+
+func newDownsampler(every time.Duration, subscriber Subscriber) *downsampler {
+	return &downsampler{every: every, subscriber: subscriber, windows: make(map[string]*window)}
+}
+
+func (ds *downsampler) add(msg *SmapMessage) {
+	ds.Lock()
+	defer ds.Unlock()
+	for _, rdg := range msg.Readings {
+		if len(rdg) < 2 {
+			continue
+		}
+		ts, ok := readingTime(rdg[0])
+		if !ok {
+			continue
+		}
+		value, ok := readingValue(rdg[1])
+		if !ok {
+			continue
+		}
+		w, found := ds.windows[msg.UUID]
+		if !found {
+			w = &window{}
+			ds.windows[msg.UUID] = w
+		}
+		w.path = msg.Path
+		w.sum += value
+		w.count++
+		if ts > w.newest {
+			w.newest = ts
+		}
+	}
+}
+
+// Closes the current window and returns the aggregated messages
+func (ds *downsampler) flush() []*SmapMessage {
+	ds.Lock()
+	defer ds.Unlock()
+	msgs := make([]*SmapMessage, 0, len(ds.windows))
+	for uuid, w := range ds.windows {
+		msgs = append(msgs, &SmapMessage{UUID: uuid, Path: w.path,
+			Readings: [][]interface{}{[]interface{}{w.newest, w.sum / float64(w.count)}}})
+	}
+	ds.windows = make(map[string]*window)
+	return msgs
+}
+
+// Sends the aggregated readings at the end of every window until done is closed
+func (ds *downsampler) run(done <-chan bool) {
+	ticker := time.NewTicker(ds.every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, msg := range ds.flush() {
+				ds.subscriber.Send(msg)
+			}
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package archiver
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSubscription(t *testing.T) {
+	var query string
+	var sub *subscriptionQuery
+	var err error
+
+	query = "Metadata/Site = 'Soda Hall'"
+	sub, err = parseSubscription(query)
+	if err != nil {
+		t.Error(query, "\ngave error", err)
+	}
+	if sub.replay != nil {
+		t.Error(query, "\nshould not have a replay")
+	}
+	if sub.where.ToBson()["Metadata.Site"] != "Soda Hall" {
+		t.Error(query, "\nhas wrong where clause", sub.where.ToBson())
+	}
+
+	query = "replay 100 where Metadata/Site = 'Soda Hall'"
+	sub, err = parseSubscription(query)
+	if err != nil {
+		t.Error(query, "\ngave error", err)
+	}
+	if sub.replay == nil || sub.replay.count != 100 {
+		t.Error(query, "\nshould replay 100 readings but has", sub.replay)
+	}
+	if sub.where.ToBson()["Metadata.Site"] != "Soda Hall" {
+		t.Error(query, "\nhas wrong where clause", sub.where.ToBson())
+	}
+
+	query = "Metadata/Site = 'Soda Hall' replay 1h"
+	sub, err = parseSubscription(query)
+	if err != nil {
+		t.Error(query, "\ngave error", err)
+	}
+	if sub.replay == nil || sub.replay.window != time.Hour {
+		t.Error(query, "\nshould replay 1h but has", sub.replay)
+	}
+
+	query = "replay -1h where has uuid"
+	if _, err = parseSubscription(query); err == nil {
+		t.Error(query, "\nshould give an error")
+	}
+}
+
+func TestReadingsAfter(t *testing.T) {
+	msg := &SmapMessage{UUID: "a", Readings: [][]interface{}{
+		[]interface{}{uint64(1), float64(1)},
+		[]interface{}{uint64(2), float64(2)},
+		[]interface{}{uint64(3), float64(3)},
+	}}
+	newer := readingsAfter(msg, 2)
+	if newer == nil || len(newer.Readings) != 1 || newer.Readings[0][0] != uint64(3) {
+		t.Error("Should only keep reading 3 but got", newer)
+	}
+	if len(msg.Readings) != 3 {
+		t.Error("Original message should be unchanged")
+	}
+	if readingsAfter(msg, 3) != nil {
+		t.Error("Should not keep any readings")
+	}
+}
+
+func TestMergeBuffered(t *testing.T) {
+	fetched := []SmapResponse{{UUID: "a", Readings: [][]float64{{1, 1}, {2, 2}}}}
+	buffered := map[string][][]interface{}{
+		"a": {{uint64(2), float64(2)}, {uint64(4), float64(4)}, {uint64(3), float64(3)}},
+		"b": {{uint64(1), float64(1)}, {uint64(5), float64(5)}},
+	}
+	merged := mergeBuffered(fetched, buffered, &replaySpec{count: 3}, 0)
+	if len(merged) != 2 {
+		t.Fatal("Streams with only buffered readings should be replayed but got", merged)
+	}
+	if rdgs := merged[0].Readings; len(rdgs) != 3 || rdgs[0][0] != 2 || rdgs[1][0] != 3 || rdgs[2][0] != 4 {
+		t.Error("Should replay the newest 3 readings of a in order but got", rdgs)
+	}
+
+	merged = mergeBuffered(nil, buffered, &replaySpec{window: time.Hour}, 4)
+	for _, resp := range merged {
+		if len(resp.Readings) != 1 || resp.Readings[0][0] < 4 {
+			t.Error("Should only replay the buffered readings inside the window but got", resp)
+		}
+	}
+}
+
+func TestValueSubscription(t *testing.T) {
+	var query string
+	var sub *subscriptionQuery
+	var err error
+
+	query = "select data where Metadata/Type = 'Temp' and value > 30 every 10s"
+	sub, err = parseSubscription(query)
+	if err != nil {
+		t.Fatal(query, "\ngave error", err)
+	}
+	if sub.every != 10*time.Second {
+		t.Error(query, "\nshould have a 10s window but has", sub.every)
+	}
+	if len(sub.values) != 1 || sub.values[0] != (valuePredicate{op: ">", threshold: 30}) {
+		t.Error(query, "\nhas wrong value predicates", sub.values)
+	}
+	if where := sub.where.ToBson(); len(where) != 1 || where["Metadata.Type"] != "Temp" {
+		t.Error(query, "\nhas wrong where clause", where)
+	}
+
+	query = "value >= 10 and value < 20 and Metadata/Type = 'Temp'"
+	sub, err = parseSubscription(query)
+	if err != nil {
+		t.Fatal(query, "\ngave error", err)
+	}
+	if len(sub.values) != 2 || sub.values[0].op != ">=" || sub.values[1].op != "<" {
+		t.Error(query, "\nhas wrong value predicates", sub.values)
+	}
+	if where := sub.where.ToBson(); len(where) != 1 || where["Metadata.Type"] != "Temp" {
+		t.Error(query, "\nhas wrong where clause", where)
+	}
+
+	for _, query = range []string{
+		"Metadata/Type = 'Temp' or value > 30",
+		"Metadata/Type = 'Temp' and value > high",
+		"Metadata/Type = 'Temp' and value < = 30",
+		"Metadata/Type = 'Temp' every 0s",
+		"replay 10 where Metadata/Type = 'Temp' every 10s",
+	} {
+		if _, err = parseSubscription(query); err == nil {
+			t.Error(query, "\nshould give an error")
+		}
+	}
+}
+
+func TestFilterReadings(t *testing.T) {
+	msg := &SmapMessage{UUID: "a", Readings: [][]interface{}{
+		[]interface{}{uint64(1), float64(10)},
+		[]interface{}{uint64(2), float64(40)},
+	}}
+	filtered := filterReadings(msg, []valuePredicate{{op: ">", threshold: 30}})
+	if filtered == nil || len(filtered.Readings) != 1 || filtered.Readings[0][1] != float64(40) {
+		t.Error("Should only keep the reading above 30 but got", filtered)
+	}
+	if filterReadings(msg, []valuePredicate{{op: ">", threshold: 50}}) != nil {
+		t.Error("No readings should match value > 50")
+	}
+	if len(msg.Readings) != 2 {
+		t.Error("Filtering should not modify the original message")
+	}
+}
+
+func TestDownsampler(t *testing.T) {
+	ds := newDownsampler(time.Second, nil)
+	ds.add(&SmapMessage{UUID: "a", Path: "/a", Readings: [][]interface{}{
+		[]interface{}{uint64(1), float64(10)},
+		[]interface{}{uint64(3), float64(30)},
+	}})
+	ds.add(&SmapMessage{UUID: "a", Path: "/a", Readings: [][]interface{}{[]interface{}{uint64(2), float64(20)}}})
+	msgs := ds.flush()
+	if len(msgs) != 1 {
+		t.Fatal("Should have one aggregated message but have", len(msgs))
+	}
+	if rdg := msgs[0].Readings[0]; rdg[0] != uint64(3) || rdg[1] != float64(20) {
+		t.Error("Aggregated reading should be [3 20] but is", rdg)
+	}
+	if len(ds.flush()) != 0 {
+		t.Error("Empty windows should not produce readings")
+	}
+}
@@ -0,0 +1,226 @@
+package archiver
+
+import (
+	"encoding/json"
+	"errors"
+	"gopkg.in/mgo.v2/bson"
+	"reflect"
+)
+
+// TagSubscriber is implemented by Subscribers that can receive the results
+// of tag (metadata) subscriptions such as "select distinct Metadata/HVACZone".
+// Subscribers that only implement Subscriber can still subscribe to data.
+type TagSubscriber interface {
+	Subscriber
+	// Called by the Republisher whenever the results of the client's tag
+	// query change. The first diff a client receives lists the full results
+	// of its query as additions
+	SendDiff(*MetadataDiff)
+}
+
+// Describes how the results of a tag query changed. For "select distinct"
+// queries, only AddedValues and RemovedValues are used.
+type MetadataDiff struct {
+	// streams that now match the query, with the tags the query selects
+	Added map[string]bson.M `json:",omitempty"`
+	// UUIDs of streams that no longer match the query
+	Removed []string `json:",omitempty"`
+	// for streams that matched before and still match, the selected tags
+	// whose values changed, keyed by UUID. Tags that were removed map to nil
+	Changed map[string]bson.M `json:",omitempty"`
+	// distinct values that appeared in or disappeared from the results
+	AddedValues   []interface{} `json:",omitempty"`
+	RemovedValues []interface{} `json:",omitempty"`
+}
+
+func (d *MetadataDiff) IsEmpty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0 &&
+		len(d.AddedValues) == 0 && len(d.RemovedValues) == 0
+}
+
+type tagClient struct {
+	subscriber TagSubscriber
+	target     *tagsTarget
+	where      bson.M
+	// the last results we sent, as uuid -> flattened tags, or for distinct
+	// queries, as a set of JSON-encoded values
+	streams map[string]bson.M
+	values  map[string]interface{}
+}
+
+// Registers a subscription on a tag query, sends the current results and
+// waits for the client to go away
+func (r *Republisher) handleTagSubscriber(s Subscriber, sub *subscriptionQuery, query string) {
+	ts, ok := s.(TagSubscriber)
+	if !ok {
+		s.SendError(errors.New("This interface does not support metadata subscriptions"))
+		return
+	}
+	client := &tagClient{subscriber: ts, target: sub.tags, where: sub.where.ToBson(),
+		streams: map[string]bson.M{}, values: map[string]interface{}{}}
+	r.Lock()
+	r.tagclients = append(r.tagclients, client)
+	r.Unlock()
+	log.Info("New metadata subscriber for query: %v", query)
+	r.MetadataChanged()
+
+	<-s.GetNotify()
+	r.Lock()
+	for i, tc := range r.tagclients {
+		if tc == client {
+			r.tagclients = append(r.tagclients[:i], r.tagclients[i+1:]...)
+			break
+		}
+	}
+	r.Unlock()
+}
+
+// Tells the Republisher that stream metadata may have changed, so that tag
+// subscriptions are re-evaluated and data subscriptions are given the
+// streams that now match their queries. Re-evaluation happens in the background;
+// calls that arrive while it is running are coalesced into one more pass.
+func (r *Republisher) MetadataChanged() {
+	select {
+	case r.metadataChanged <- true:
+	default:
+	}
+}
+
+func (r *Republisher) watchMetadata() {
+	for range r.metadataChanged {
+		r.RLock()
+		clients := make([]*tagClient, len(r.tagclients))
+		copy(clients, r.tagclients)
+		r.RUnlock()
+		for _, client := range clients {
+			diff, err := client.update(r.store)
+			if err != nil {
+				log.Error("Error evaluating metadata subscription: %v", err)
+				client.subscriber.SendError(err)
+				continue
+			}
+			if !diff.IsEmpty() {
+				client.subscriber.SendDiff(diff)
+			}
+		}
+		r.refreshClients()
+	}
+}
+
+// Re-runs the client's query and returns how the results differ from what
+// the client was last sent
+func (tc *tagClient) update(store *Store) (*MetadataDiff, error) {
+	target := tc.target.ToBson()
+	if tc.target.Distinct {
+		values, err := store.GetTags(target, true, tc.target.Contents[0], tc.where)
+		if err != nil {
+			return nil, err
+		}
+		current := make(map[string]interface{}, len(values))
+		for _, val := range values {
+			key, _ := json.Marshal(val)
+			current[string(key)] = val
+		}
+		diff := diffValues(tc.values, current)
+		tc.values = current
+		return diff, nil
+	}
+
+	if len(target) > 0 {
+		target["uuid"] = 1
+	}
+	docs, err := store.GetTags(target, false, "", tc.where)
+	if err != nil {
+		return nil, err
+	}
+	current := make(map[string]bson.M, len(docs))
+	for _, doc := range docs {
+		var m bson.M
+		switch d := doc.(type) {
+		case bson.M:
+			m = d
+		case map[string]interface{}:
+			m = bson.M(d)
+		default:
+			continue
+		}
+		uuid, ok := m["uuid"].(string)
+		if !ok {
+			continue
+		}
+		current[uuid] = flattenTags("", m)
+	}
+	diff := diffStreams(tc.streams, current)
+	tc.streams = current
+	return diff, nil
+}
+
+func diffValues(old, current map[string]interface{}) *MetadataDiff {
+	diff := &MetadataDiff{}
+	for key, val := range current {
+		if _, found := old[key]; !found {
+			diff.AddedValues = append(diff.AddedValues, val)
+		}
+	}
+	for key, val := range old {
+		if _, found := current[key]; !found {
+			diff.RemovedValues = append(diff.RemovedValues, val)
+		}
+	}
+	return diff
+}
+
+func diffStreams(old, current map[string]bson.M) *MetadataDiff {
+	diff := &MetadataDiff{Added: map[string]bson.M{}, Changed: map[string]bson.M{}}
+	for uuid, tags := range current {
+		oldtags, found := old[uuid]
+		if !found {
+			diff.Added[uuid] = tags
+			continue
+		}
+		changed := bson.M{}
+		for key, val := range tags {
+			if oldval, found := oldtags[key]; !found || !reflect.DeepEqual(oldval, val) {
+				changed[key] = val
+			}
+		}
+		for key := range oldtags {
+			if _, found := tags[key]; !found {
+				changed[key] = nil
+			}
+		}
+		if len(changed) > 0 {
+			diff.Changed[uuid] = changed
+		}
+	}
+	for uuid := range old {
+		if _, found := current[uuid]; !found {
+			diff.Removed = append(diff.Removed, uuid)
+		}
+	}
+	return diff
+}
+
+// Turns nested documents into a single level map with "/"-separated keys,
+// e.g. {"Metadata": {"Site": "x"}} becomes {"Metadata/Site": "x"}
+func flattenTags(prefix string, doc map[string]interface{}) bson.M {
+	ret := bson.M{}
+	for key, val := range doc {
+		if prefix != "" {
+			key = prefix + "/" + key
+		}
+		switch v := val.(type) {
+		case bson.M:
+			for k, v2 := range flattenTags(key, v) {
+				ret[k] = v2
+			}
+		case map[string]interface{}:
+			for k, v2 := range flattenTags(key, v) {
+				ret[k] = v2
+			}
+		default:
+			ret[key] = val
+		}
+	}
+	return ret
+}
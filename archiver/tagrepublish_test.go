@@ -0,0 +1,67 @@
+package archiver
+
+import (
+	"gopkg.in/mgo.v2/bson"
+	"testing"
+)
+
+func TestTagSubscription(t *testing.T) {
+	query := "select distinct Metadata/HVACZone where Metadata/Site = 'Soda Hall'"
+	sub, err := parseSubscription(query)
+	if err != nil {
+		t.Fatal(query, "\ngave error", err)
+	}
+	if sub.tags == nil || !sub.tags.Distinct {
+		t.Error(query, "\nshould be a distinct tag subscription")
+	}
+	if sub.where.ToBson()["Metadata.Site"] != "Soda Hall" {
+		t.Error(query, "\nhas wrong where clause", sub.where.ToBson())
+	}
+
+	query = "select Metadata/HVACZone where has uuid replay 10"
+	if _, err = parseSubscription(query); err == nil {
+		t.Error(query, "\nshould give an error")
+	}
+}
+
+func TestDiffStreams(t *testing.T) {
+	old := map[string]bson.M{
+		"a": bson.M{"Metadata/Room": "410"},
+		"b": bson.M{"Metadata/Room": "411", "Metadata/Floor": "4"},
+	}
+	current := map[string]bson.M{
+		"b": bson.M{"Metadata/Room": "412"},
+		"c": bson.M{"Metadata/Room": "413"},
+	}
+	diff := diffStreams(old, current)
+	if len(diff.Added) != 1 || diff.Added["c"]["Metadata/Room"] != "413" {
+		t.Error("c should be added but got", diff.Added)
+	}
+	if !isStringSliceEqual(diff.Removed, []string{"a"}) {
+		t.Error("a should be removed but got", diff.Removed)
+	}
+	changed := diff.Changed["b"]
+	if len(changed) != 2 || changed["Metadata/Room"] != "412" || changed["Metadata/Floor"] != nil {
+		t.Error("b should have changed Room and removed Floor but got", changed)
+	}
+	if !diffStreams(current, current).IsEmpty() {
+		t.Error("Identical results should give an empty diff")
+	}
+}
+
+func TestDiffValues(t *testing.T) {
+	diff := diffValues(map[string]interface{}{`"a"`: "a", `"b"`: "b"}, map[string]interface{}{`"b"`: "b", `"c"`: "c"})
+	if len(diff.AddedValues) != 1 || diff.AddedValues[0] != "c" {
+		t.Error("c should be added but got", diff.AddedValues)
+	}
+	if len(diff.RemovedValues) != 1 || diff.RemovedValues[0] != "a" {
+		t.Error("a should be removed but got", diff.RemovedValues)
+	}
+}
+
+func TestFlattenTags(t *testing.T) {
+	flat := flattenTags("", bson.M{"uuid": "a", "Metadata": bson.M{"Site": "Soda", "Location": map[string]interface{}{"Room": "410"}}})
+	if flat["uuid"] != "a" || flat["Metadata/Site"] != "Soda" || flat["Metadata/Location/Room"] != "410" || len(flat) != 3 {
+		t.Error("Wrong flattened tags", flat)
+	}
+}
@@ -8,60 +8,175 @@ import (
 	"time"
 )
 
-var supported_formats = []string{"1/2/2006", "1-2-2006", "1/2/2006 04:15", "1-2-2006 04:15", "2006-1-2 15:04:05"}
+// Absolute times without a zone of their own are read in the query's time
+// zone. RFC 3339 times are tried first
+var supported_formats = []string{"2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-1-2 15:04:05", "2006-01-02",
+	"1/2/2006 15:04", "1-2-2006 15:04", "1/2/2006", "1-2-2006"}
 
-// Takes a string specifying a time, and returns a canonical Time object representing that string.
-// To consider: should this instead return the kind of timestamp expected by ReadingDB? Or can that
-// be handled by another method? I think the latter is the way to go on this, that way I can use
-// this method for displaying and the like
+// offsets like -1h, +2w or -1mo. Longer units come first so that e.g. "min"
+// is not read as "m" followed by "in"
+var timeOffset = regexp.MustCompile("^([-+][0-9]+)(years|year|yr|y|months|month|mo|weeks|week|w|days|day|d|hours|hour|hr|h|minutes|minute|min|m|seconds|second|sec|s)")
+
+// Unix epoch times, in ms unless given a unit
+var epochTime = regexp.MustCompile("^([0-9]+)(ns|us|ms|s)?$")
+
+// the words a relative time can start with
+var relativeTimes = []string{"now", "today", "yesterday", "startof("}
+
+// Takes the portions of a time expression and returns the time it refers
+// to, reading it in the server's local time zone. See parseTime
+func handleTime(portions []string) (time.Time, error) {
+	return parseTime(strings.Join(portions, " "), time.Local, time.Now())
+}
+
+// Parses a time expression into the time it refers to. now is the current
+// time, and loc is the time zone that times without a zone of their own and
+// calendar alignments are read in. An expression is a base time followed by
+// any number of offsets:
 //
-// Need to support the following:
-// now
-// now -1h
-// now +1h -10m
-// %m/%d/%Y
-// %m-%d-%Y
-// %m/%d/%Y %M:%H
-// %m-%d-%Y %M:%H
-// %Y-%m-%dT%H:%M:%S
+//    now
+//    today, yesterday (midnight at the start of the day)
+//    startof(minute|hour|day|week|month|year) (weeks start on Monday)
+//    2015-01-02T15:04:05-08:00 (RFC 3339)
+//    2015-01-02 15:04:05, 2015-01-02, 1/2/2015 15:04, 1/2/2015, 1-2-2015
+//    1420070400s, 1420070400000ms, 1420070400000 (Unix epoch, ms by default; also us, ns)
 //
-// Go time layout: Mon Jan 2 15:04:05 -0700 MST 2006
-// * 01/02/2006
-// * 01-02-2006
-// * 01/02/2006 04:15
-// * 01-02-2006 04:15
-// * 2006-01-02 15:04:05
-func handleTime(portions []string) (time.Time, error) {
-	ret := time.Now()
-	idx := len(portions) - 1
-	portions[idx] = strings.Replace(portions[idx], ")", "", -1)
-	isNowToken := regexp.MustCompile("now")
-	// check if parsing relative timestamps
-	if isNowToken.MatchString(portions[0]) {
-		for _, val := range portions[1:] {
-			// parse the relative duration
-			dur, err := parseIntoDuration(val)
-			if err != nil {
-				return ret, err
-			}
-			// adjust the time by the duration amount
-			ret = ret.Add(dur)
+// Offsets are a signed number and a unit, e.g. -1h or +2w:
+//
+//    s, m, h (seconds, minutes, hours; also sec, min, hr, ...)
+//    d, w (calendar days and weeks)
+//    mo, y (calendar months and years)
+//
+// so "startof(month) -1mo" is the start of last month. Anything else is an error
+func parseTime(expr string, loc *time.Location, now time.Time) (time.Time, error) {
+	expr = strings.TrimSpace(expr)
+	now = now.In(loc)
+	for _, word := range relativeTimes {
+		if !strings.HasPrefix(expr, word) {
+			continue
 		}
-	} else {
-		portions[0] = strings.Replace(portions[idx], "(", "", -1)
-		portions[0] = strings.Replace(portions[idx], ",", "", -1)
-		timestring := strings.Join(portions, " ")
-		log.Debug("parsing", timestring)
-		for _, format := range supported_formats {
-			t, err := time.Parse(format, timestring)
-			if err != nil {
-				continue
+		baselen := len(word)
+		if word == "startof(" {
+			end := strings.Index(expr, ")")
+			if end < 0 {
+				return now, errors.New("Missing ) in " + expr)
 			}
-			ret = t
-			break
+			baselen = end + 1
+		}
+		base, err := relativeTime(expr[:baselen], now)
+		if err != nil {
+			return now, err
 		}
+		return applyOffsets(base, expr[baselen:])
 	}
-	return ret, nil
+	// the base of an absolute time can contain spaces, so try the longest
+	// base that leaves only offsets
+	fields := strings.Fields(expr)
+	for k := len(fields); k > 0; k-- {
+		base, err := absoluteTime(strings.Join(fields[:k], " "), loc)
+		if err != nil {
+			continue
+		}
+		return applyOffsets(base, strings.Join(fields[k:], ""))
+	}
+	return now, errors.New("Could not parse time: " + expr)
+}
+
+func relativeTime(base string, now time.Time) (time.Time, error) {
+	switch base {
+	case "now":
+		return now, nil
+	case "today":
+		return startOf(now, "day")
+	case "yesterday":
+		today, err := startOf(now, "day")
+		return today.AddDate(0, 0, -1), err
+	}
+	return startOf(now, strings.TrimSpace(base[len("startof(") : len(base)-1]))
+}
+
+// Returns the start of the unit (minute, hour, day, week, month or year) of
+// the calendar that t falls in, in t's time zone
+func startOf(t time.Time, unit string) (time.Time, error) {
+	y, mo, d := t.Date()
+	loc := t.Location()
+	switch unit {
+	case "minute":
+		return time.Date(y, mo, d, t.Hour(), t.Minute(), 0, 0, loc), nil
+	case "hour":
+		return time.Date(y, mo, d, t.Hour(), 0, 0, 0, loc), nil
+	case "day":
+		return time.Date(y, mo, d, 0, 0, 0, 0, loc), nil
+	case "week":
+		// days since Monday
+		since := (int(t.Weekday()) + 6) % 7
+		return time.Date(y, mo, d-since, 0, 0, 0, 0, loc), nil
+	case "month":
+		return time.Date(y, mo, 1, 0, 0, 0, 0, loc), nil
+	case "year":
+		return time.Date(y, 1, 1, 0, 0, 0, 0, loc), nil
+	}
+	return t, errors.New("Cannot align to " + unit + "; use minute, hour, day, week, month or year")
+}
+
+func absoluteTime(base string, loc *time.Location) (time.Time, error) {
+	if m := epochTime.FindStringSubmatch(base); m != nil {
+		epoch, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		switch m[2] {
+		case "s":
+			return time.Unix(epoch, 0).In(loc), nil
+		case "us":
+			return time.Unix(0, epoch*int64(time.Microsecond)).In(loc), nil
+		case "ns":
+			return time.Unix(0, epoch).In(loc), nil
+		}
+		return time.Unix(0, epoch*int64(time.Millisecond)).In(loc), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, base); err == nil {
+		return t, nil
+	}
+	for _, format := range supported_formats {
+		if t, err := time.ParseInLocation(format, base, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.New("Could not parse time: " + base)
+}
+
+// Applies offsets such as "-1h+5m" (spaces already removed) to t
+func applyOffsets(t time.Time, offsets string) (time.Time, error) {
+	offsets = strings.Replace(offsets, " ", "", -1)
+	for offsets != "" {
+		m := timeOffset.FindStringSubmatch(offsets)
+		if m == nil {
+			return t, errors.New("Invalid time offset: " + offsets)
+		}
+		n, err := strconv.Atoi(m[1])
+		if err != nil {
+			return t, err
+		}
+		switch m[2] {
+		case "y", "yr", "year", "years":
+			t = t.AddDate(n, 0, 0)
+		case "mo", "month", "months":
+			t = t.AddDate(0, n, 0)
+		case "w", "week", "weeks":
+			t = t.AddDate(0, 0, 7*n)
+		case "d", "day", "days":
+			t = t.AddDate(0, 0, n)
+		case "h", "hr", "hour", "hours":
+			t = t.Add(time.Duration(n) * time.Hour)
+		case "m", "min", "minute", "minutes":
+			t = t.Add(time.Duration(n) * time.Minute)
+		case "s", "sec", "second", "seconds":
+			t = t.Add(time.Duration(n) * time.Second)
+		}
+		offsets = offsets[len(m[0]):]
+	}
+	return t, nil
 }
 
 // Takes a duration string like -1d, +5minutes, etc and returns a time.Duration object
@@ -103,13 +218,48 @@ func parseIntoDuration(str string) (time.Duration, error) {
 	return d, nil
 }
 
+// Parses the UnitofTime property of a stream (ns, us, ms or s). Anything
+// else is treated as milliseconds, the sMAP default
+func unitOfTimeFromString(uot string) UnitOfTime {
+	switch uot {
+	case "ns":
+		return UOT_NS
+	case "us":
+		return UOT_US
+	case "s":
+		return UOT_S
+	}
+	return UOT_MS
+}
+
+// Parses the units clause of a query, which must be one of ns, us, ms or s
+func parseUnitOfTime(uot string) (UnitOfTime, error) {
+	switch uot {
+	case "ns", "us", "ms", "s":
+		return unitOfTimeFromString(uot), nil
+	}
+	return UOT_MS, errors.New("Unit of time must be ns, us, ms or s, not " + uot)
+}
+
+var unitmultiplier = map[UnitOfTime]uint64{
+	UOT_NS: 1000000000,
+	UOT_US: 1000000,
+	UOT_MS: 1000,
+	UOT_S:  1}
+
 // Takes a timestamp with accompanying unit of time 'stream_uot' and
-// converts it to the unit of time 'target_uot'
+// converts it to the unit of time 'target_uot'. Converting to a finer unit
+// multiplies and to a coarser one divides, so nothing is lost that the
+// target unit can represent
 func convertTime(time uint64, stream_uot, target_uot UnitOfTime) uint64 {
-	unitmultiplier := map[UnitOfTime]uint64{
-		UOT_NS: 1000000000,
-		UOT_US: 1000000,
-		UOT_MS: 1000,
-		UOT_S:  1}
-	return time / unitmultiplier[stream_uot] * unitmultiplier[target_uot]
+	from, to := unitmultiplier[stream_uot], unitmultiplier[target_uot]
+	if to >= from {
+		return time * (to / from)
+	}
+	return time / (from / to)
+}
+
+// Returns t as a timestamp in the given unit of time
+func timeToUnit(t time.Time, uot UnitOfTime) uint64 {
+	return convertTime(uint64(t.UnixNano()), UOT_NS, uot)
 }
@@ -136,3 +136,129 @@ func TestHandleTime(t *testing.T) {
 		t.Error(parsedtime, "should be before", shouldbe)
 	}
 }
+
+func TestParseTime(t *testing.T) {
+	la, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		t.Skip("No time zone database:", err)
+	}
+	// a Wednesday
+	now := time.Date(2015, 3, 18, 15, 30, 10, 0, la)
+	for expr, expected := range map[string]time.Time{
+		"now":                       now,
+		"now -1h":                   now.Add(-time.Hour),
+		"now-1h+5m":                 now.Add(-55 * time.Minute),
+		"now -2w":                   time.Date(2015, 3, 4, 15, 30, 10, 0, la),
+		"now -1mo":                  time.Date(2015, 2, 18, 15, 30, 10, 0, la),
+		"now +1y":                   time.Date(2016, 3, 18, 15, 30, 10, 0, la),
+		"now -1min":                 now.Add(-time.Minute),
+		"today":                     time.Date(2015, 3, 18, 0, 0, 0, 0, la),
+		"yesterday":                 time.Date(2015, 3, 17, 0, 0, 0, 0, la),
+		"startof(hour)":             time.Date(2015, 3, 18, 15, 0, 0, 0, la),
+		"startof(week)":             time.Date(2015, 3, 16, 0, 0, 0, 0, la),
+		"startof(month) -1mo":       time.Date(2015, 2, 1, 0, 0, 0, 0, la),
+		"startof(year)":             time.Date(2015, 1, 1, 0, 0, 0, 0, la),
+		"2015-01-02T15:04:05Z":      time.Date(2015, 1, 2, 15, 4, 5, 0, time.UTC),
+		"2015-01-02T15:04:05-08:00": time.Date(2015, 1, 2, 15, 4, 5, 0, la),
+		"2015-01-02 15:04:05":       time.Date(2015, 1, 2, 15, 4, 5, 0, la),
+		"2015-01-02 15:04:05 +1d":   time.Date(2015, 1, 3, 15, 4, 5, 0, la),
+		"2015-01-02":                time.Date(2015, 1, 2, 0, 0, 0, 0, la),
+		"1/2/2015 10:05":            time.Date(2015, 1, 2, 10, 5, 0, 0, la),
+		"1-2-2015":                  time.Date(2015, 1, 2, 0, 0, 0, 0, la),
+		"1420070400s":               time.Unix(1420070400, 0),
+		"1420070400123ms":           time.Unix(1420070400, 123000000),
+		"1420070400123":             time.Unix(1420070400, 123000000),
+		"1420070400000000us -1h":    time.Unix(1420066800, 0),
+	} {
+		res, err := parseTime(expr, la, now)
+		if err != nil {
+			t.Error(expr, "\ngave error", err)
+		} else if !res.Equal(expected) {
+			t.Error(expr, "\nshould be", expected, "but is", res)
+		}
+	}
+
+	for _, expr := range []string{"", "later", "now -1", "now -1fortnight", "startof(decade)", "startof(day", "13/45/2015", "2015-01-02 15:04:05 soon"} {
+		if _, err := parseTime(expr, la, now); err == nil {
+			t.Error(expr, "\nshould give an error")
+		}
+	}
+}
+
+func TestDataTargetTimes(t *testing.T) {
+	ast, err := parseQuery("select data in ('2015-01-02 00:00:00', startof(day)) tz 'America/Los_Angeles' where has uuid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := ast.Target.(*dataTarget)
+	if target.Timezone != "America/Los_Angeles" {
+		t.Error("Timezone should be America/Los_Angeles but is", target.Timezone)
+	}
+	if target.Start.Unix() != 1420185600 {
+		t.Error("Start should be midnight in Los Angeles but is", target.Start)
+	}
+	if target.End.After(time.Now()) {
+		t.Error("End should be the start of today but is", target.End)
+	}
+
+	for _, q := range []string{"select data in (later, now) where has uuid", "select data in (now) where has uuid",
+		"select data before now tz 'Nowhere/Special' where has uuid", "select data before now tz"} {
+		if _, err := parseQuery(q); err == nil {
+			t.Error(q, "\nshould give an error")
+		}
+	}
+}
+
+func TestConvertTime(t *testing.T) {
+	for _, tt := range []struct {
+		ts       uint64
+		from, to UnitOfTime
+		expected uint64
+	}{
+		{1420185600, UOT_S, UOT_MS, 1420185600000},
+		{1420185600123, UOT_MS, UOT_US, 1420185600123000},
+		{1420185600123456789, UOT_NS, UOT_US, 1420185600123456},
+		{1420185600123456, UOT_US, UOT_S, 1420185600},
+		{1420185600123, UOT_MS, UOT_MS, 1420185600123},
+	} {
+		if res := convertTime(tt.ts, tt.from, tt.to); res != tt.expected {
+			t.Error("Converting", tt.ts, "should give", tt.expected, "but gave", res)
+		}
+	}
+	if res := timeToUnit(time.Unix(1420185600, 5000), UOT_US); res != 1420185600000005 {
+		t.Error("Wrong time in microseconds", res)
+	}
+}
+
+func TestQueryUnits(t *testing.T) {
+	ast, err := parseQuery("select data before now units us where has uuid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uot := ast.Target.(*dataTarget).UnitOfTime; uot != UOT_US {
+		t.Error("Unit of time should be us but is", uot)
+	}
+	ast, _ = parseQuery("select data before now where has uuid")
+	if uot := ast.Target.(*dataTarget).UnitOfTime; uot != UOT_MS {
+		t.Error("Unit of time should default to ms but is", uot)
+	}
+	for _, q := range []string{"select data before now units fortnights where has uuid", "select data before now units"} {
+		if _, err := parseQuery(q); err == nil {
+			t.Error(q, "\nshould give an error")
+		}
+	}
+}
+
+func TestToStorage(t *testing.T) {
+	msg := &SmapMessage{UUID: "a", Readings: [][]interface{}{
+		[]interface{}{uint64(1420185600), float64(1)},
+		[]interface{}{"bad", float64(2)},
+	}}
+	stored := toStorage(msg, streamProps{uot: UOT_S, readingType: READINGTYPE_DOUBLE})
+	if len(stored.Readings) != 1 || stored.Readings[0][0] != convertTime(1420185600, UOT_S, UOT_STORAGE) {
+		t.Error("Wrong storage readings", stored.Readings)
+	}
+	if msg.Readings[0][0] != uint64(1420185600) {
+		t.Error("The original message should be left alone but is", msg.Readings)
+	}
+}
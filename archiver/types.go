@@ -58,3 +58,38 @@ const (
 	// seconds 1
 	UOT_S
 )
+
+// The unit of time readings are kept in inside the archiver. Readings are
+// converted to it from their stream's Properties/UnitofTime on the way in,
+// and queries convert them to the unit of time they ask for on the way out.
+// The timeseries databases convert it to the unit they keep timestamps in
+// (see StorageUnitofTime in giles.cfg)
+const UOT_STORAGE = UOT_US
+
+// Values of Properties/ReadingType. Readings of double streams are kept in
+// the timeseries database; readings of the other types are kept exactly as
+// they were received in the ObjectStore
+const (
+	READINGTYPE_DOUBLE = "double"
+	READINGTYPE_LONG   = "long"
+	READINGTYPE_STRING = "string"
+	READINGTYPE_OBJECT = "object"
+)
+
+// Parses Properties/ReadingType. Anything unknown is treated as double, the
+// sMAP default
+func readingTypeFromString(rt string) string {
+	switch rt {
+	case READINGTYPE_LONG, READINGTYPE_STRING, READINGTYPE_OBJECT:
+		return rt
+	}
+	return READINGTYPE_DOUBLE
+}
+
+// Struct representing readings of streams that are not doubles, to and from
+// the ObjectStore. Values are int64 for long streams, strings, or any JSON
+// value for object streams
+type SmapObjectResponse struct {
+	Readings [][]interface{}
+	UUID     string `json:"uuid"`
+}
@@ -12,6 +12,15 @@ func cleantagstring(inp string) string {
 	return tmp
 }
 
+// Removes the quotes around a quoted string (and any surrounding whitespace)
+func unquote(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) >= 2 && (s[0] == '\'' || s[0] == '"') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
 // Go doesn't provide min for uint32
 func min(a, b uint32) uint32 {
 	if a < b {
@@ -0,0 +1,251 @@
+package archiver
+
+import (
+	uuidlib "code.google.com/p/go-uuid/uuid"
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// What happens to readings of double streams whose value is NaN or infinite
+const (
+	NONFINITE_REJECT = "reject"
+	NONFINITE_DROP   = "drop"
+	NONFINITE_KEEP   = "keep"
+)
+
+// The problems found with incoming messages, by path
+type ValidationErrors map[string][]string
+
+func (v ValidationErrors) Add(path, format string, args ...interface{}) {
+	v[path] = append(v[path], fmt.Sprintf(format, args...))
+}
+
+// Returned by AddData when some of the messages were not valid, or, in a
+// cluster, could not be handed to the node that owns their stream. The others
+// have been taken, so they should not be sent again
+type IngestError struct {
+	// how many messages were taken
+	Accepted int `json:"accepted"`
+	// the problems with each message that was refused, by path
+	Rejected ValidationErrors `json:"rejected"`
+}
+
+func newIngestError() *IngestError {
+	return &IngestError{Rejected: make(ValidationErrors)}
+}
+
+func (e *IngestError) Error() string {
+	paths := make([]string, 0, len(e.Rejected))
+	for path := range e.Rejected {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	problems := make([]string, len(paths))
+	for i, path := range paths {
+		problems[i] = path + ": " + strings.Join(e.Rejected[path], "; ")
+	}
+	return fmt.Sprintf("%v messages were rejected (%v were accepted): %v", len(paths), e.Accepted, strings.Join(problems, ", "))
+}
+
+// Adds the problems found while decoding messages, before they reached
+// AddData, to the error AddData returned for the rest of them. accepted is
+// how many messages were given to AddData
+func WithDecodeErrors(err error, invalid ValidationErrors, accepted int) error {
+	if len(invalid) == 0 {
+		return err
+	}
+	report, ok := err.(*IngestError)
+	if !ok {
+		if err != nil && err != ErrDuplicateReadings {
+			// nothing was taken
+			return err
+		}
+		report = newIngestError()
+		report.Accepted = accepted
+	}
+	for path, problems := range invalid {
+		report.Rejected[path] = append(report.Rejected[path], problems...)
+	}
+	return report
+}
+
+// Returns the report as an error, or nil if nothing was rejected
+func (e *IngestError) err() error {
+	if len(e.Rejected) == 0 {
+		return nil
+	}
+	return e
+}
+
+// Checks incoming messages before any of them is taken, so that a driver
+// that sends something wrong is told which of its streams it was and what
+// was wrong with it, and the rest of its messages are still taken:
+//
+//    [Validation]
+//    Earliest=1971-01-01
+//    MaxFuture=365d
+//    NonFinite=reject
+//
+// A message is refused if its UUID is not a UUID, if it has readings but no
+// UUID, if one of its readings is not a [time, value] pair whose value suits
+// the stream's ReadingType, if a timestamp is before Earliest or more than
+// MaxFuture ahead of the archiver's clock (which is what timestamps in the
+// wrong UnitofTime look like), or if a key of its Metadata, Properties or
+// Actuator could not be stored (empty, starting with $ or containing a .).
+// NaN and infinite values of double streams are refused, dropped or kept
+// according to NonFinite.
+type validator struct {
+	// bounds on timestamps, in UOT_STORAGE and relative to now
+	earliest  uint64
+	maxFuture time.Duration
+	nonFinite string
+}
+
+func newValidator(c *Config) (*validator, error) {
+	v := &validator{maxFuture: 365 * 24 * time.Hour, nonFinite: NONFINITE_REJECT}
+	earliest := time.Date(1971, 1, 1, 0, 0, 0, 0, time.UTC)
+	if c.Validation.Earliest != nil {
+		t, err := time.Parse("2006-01-02", *c.Validation.Earliest)
+		if err != nil {
+			return nil, fmt.Errorf("Earliest should be a date like 1971-01-01, not %v", *c.Validation.Earliest)
+		}
+		earliest = t
+	}
+	v.earliest = timeToUnit(earliest, UOT_STORAGE)
+	if c.Validation.MaxFuture != nil {
+		d, err := parseRetention(*c.Validation.MaxFuture)
+		if err != nil || d == 0 {
+			return nil, fmt.Errorf("Invalid MaxFuture %v", *c.Validation.MaxFuture)
+		}
+		v.maxFuture = d
+	}
+	if c.Validation.NonFinite != nil {
+		switch *c.Validation.NonFinite {
+		case NONFINITE_REJECT, NONFINITE_DROP, NONFINITE_KEEP:
+			v.nonFinite = *c.Validation.NonFinite
+		default:
+			return nil, fmt.Errorf("NonFinite should be %v, %v or %v, not %v", NONFINITE_REJECT, NONFINITE_DROP, NONFINITE_KEEP, *c.Validation.NonFinite)
+		}
+	}
+	return v, nil
+}
+
+// Returns what is wrong with msg, whose stream has the given properties, as
+// of now. NaN and infinite values that are dropped are removed from msg
+func (v *validator) check(path string, msg *SmapMessage, props streamProps, now time.Time) []string {
+	var problems []string
+	if !strings.HasPrefix(path, "/") {
+		problems = append(problems, "path should start with /")
+	}
+	if msg.UUID != "" && uuidlib.Parse(msg.UUID) == nil {
+		problems = append(problems, fmt.Sprintf("uuid %q is not a UUID", msg.UUID))
+	} else if msg.UUID == "" && len(msg.Readings) > 0 {
+		problems = append(problems, "readings without a uuid")
+	}
+	problems = append(problems, checkKeys("Metadata", msg.Metadata)...)
+	problems = append(problems, checkKeys("Properties", msg.Properties)...)
+	problems = append(problems, checkKeys("Actuator", msg.Actuator)...)
+
+	earliest, latest := v.bounds(props.uot, now)
+	kept := make([][]interface{}, 0, len(msg.Readings))
+	for i, rdg := range msg.Readings {
+		if len(rdg) != 2 {
+			problems = append(problems, fmt.Sprintf("reading %v is not a [time, value] pair", i))
+			continue
+		}
+		if ts, ok := readingTime(rdg[0]); !ok {
+			problems = append(problems, fmt.Sprintf("reading %v: timestamp %v is not a number", i, rdg[0]))
+		} else if negativeTime(rdg[0]) || ts < earliest || ts > latest {
+			problems = append(problems, fmt.Sprintf("reading %v: timestamp %v is not between %v and %v in the stream's UnitofTime", i, rdg[0], earliest, latest))
+		}
+		if rdg[1] == nil {
+			problems = append(problems, fmt.Sprintf("reading %v has no value", i))
+			continue
+		}
+		if _, ok := storedValue(rdg[1], props.readingType); !ok {
+			problems = append(problems, fmt.Sprintf("reading %v: value %v is not a valid %v", i, rdg[1], props.readingType))
+			continue
+		}
+		if f, ok := rdg[1].(float64); ok && props.readingType == READINGTYPE_DOUBLE && (math.IsNaN(f) || math.IsInf(f, 0)) {
+			switch v.nonFinite {
+			case NONFINITE_REJECT:
+				problems = append(problems, fmt.Sprintf("reading %v: value %v is not finite", i, f))
+			case NONFINITE_DROP:
+				continue
+			}
+		}
+		kept = append(kept, rdg)
+	}
+	if len(problems) == 0 && len(kept) < len(msg.Readings) {
+		msg.Readings = kept
+	}
+	return problems
+}
+
+// Returns the earliest and latest timestamps, in uot, that are taken as of
+// now. The bounds are converted to the stream's unit rather than the other
+// way round, which could overflow
+func (v *validator) bounds(uot UnitOfTime, now time.Time) (uint64, uint64) {
+	return convertTime(v.earliest, UOT_STORAGE, uot), convertTime(timeToUnit(now.Add(v.maxFuture), UOT_STORAGE), UOT_STORAGE, uot)
+}
+
+func negativeTime(ts interface{}) bool {
+	switch t := ts.(type) {
+	case int64:
+		return t < 0
+	case float64:
+		return t < 0
+	}
+	return false
+}
+
+// Checks that the keys of doc, and of the documents inside it, can be
+// stored in MongoDB
+func checkKeys(name string, doc bson.M) []string {
+	var problems []string
+	for key, value := range doc {
+		switch {
+		case key == "":
+			problems = append(problems, name+" has an empty key")
+		case strings.HasPrefix(key, "$"):
+			problems = append(problems, fmt.Sprintf("%v key %q starts with $", name, key))
+		case strings.ContainsAny(key, ".\x00"):
+			problems = append(problems, fmt.Sprintf("%v key %q contains a . or NUL", name, key))
+		}
+		switch inner := value.(type) {
+		case bson.M:
+			problems = append(problems, checkKeys(name+"/"+key, inner)...)
+		case map[string]interface{}:
+			problems = append(problems, checkKeys(name+"/"+key, bson.M(inner))...)
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+// Removes the messages that are not valid from readings, and records them in
+// report. The properties of each stream are looked up without caching those
+// sent along with a message, as it might be refused
+func (a *Archiver) validate(protocol string, readings map[string]*SmapMessage, report *IngestError) {
+	now := time.Now()
+	for path, msg := range readings {
+		props := streamProps{uot: UOT_MS, readingType: READINGTYPE_DOUBLE}
+		if msg.UUID != "" {
+			props = a.store.streamProperties(msg.UUID)
+		}
+		if msg.Properties != nil {
+			props = props.update(msg.Properties)
+		}
+		if problems := a.validator.check(path, msg, props, now); len(problems) > 0 {
+			log.Warning("Rejected %v (%v): %v", path, msg.UUID, strings.Join(problems, "; "))
+			invalidMessages.Inc(protocol)
+			report.Rejected[path] = append(report.Rejected[path], problems...)
+			delete(readings, path)
+		}
+	}
+	report.Accepted += len(readings)
+}
@@ -0,0 +1,69 @@
+package archiver
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestValidatorCheck(t *testing.T) {
+	v, err := newValidator(&Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2015, 4, 14, 0, 0, 0, 0, time.UTC)
+	double := streamProps{uot: UOT_MS, readingType: READINGTYPE_DOUBLE}
+	uuid := "b86df176-6b40-5d58-8f29-3b85f5cfbf1e"
+	for _, test := range []struct {
+		path  string
+		msg   *SmapMessage
+		props streamProps
+		valid bool
+	}{
+		{"/s", &SmapMessage{UUID: uuid, Readings: [][]interface{}{{uint64(1429000000000), float64(1)}}}, double, true},
+		{"/s", &SmapMessage{UUID: uuid, Readings: [][]interface{}{{uint64(1429000000), float64(1)}}}, streamProps{uot: UOT_S, readingType: READINGTYPE_DOUBLE}, true},
+		// seconds sent as milliseconds land in 1970
+		{"/s", &SmapMessage{UUID: uuid, Readings: [][]interface{}{{uint64(1429000000), float64(1)}}}, double, false},
+		{"/s", &SmapMessage{UUID: uuid, Readings: [][]interface{}{{uint64(1429000000000000), float64(1)}}}, double, false},
+		{"/s", &SmapMessage{UUID: uuid, Readings: [][]interface{}{{int64(-1), float64(1)}}}, double, false},
+		{"/s", &SmapMessage{UUID: "sensor-1", Readings: [][]interface{}{{uint64(1429000000000), float64(1)}}}, double, false},
+		{"/s", &SmapMessage{Readings: [][]interface{}{{uint64(1429000000000), float64(1)}}}, double, false},
+		{"s", &SmapMessage{UUID: uuid}, double, false},
+		{"/s", &SmapMessage{UUID: uuid, Readings: [][]interface{}{{uint64(1429000000000)}}}, double, false},
+		{"/s", &SmapMessage{UUID: uuid, Readings: [][]interface{}{{uint64(1429000000000), "on"}}}, double, false},
+		{"/s", &SmapMessage{UUID: uuid, Readings: [][]interface{}{{uint64(1429000000000), "on"}}}, streamProps{uot: UOT_MS, readingType: READINGTYPE_STRING}, true},
+		{"/s", &SmapMessage{UUID: uuid, Readings: [][]interface{}{{uint64(1429000000000), math.NaN()}}}, double, false},
+		{"/", &SmapMessage{Metadata: map[string]interface{}{"Site": map[string]interface{}{"Building.Floor": "1"}}}, double, false},
+		{"/", &SmapMessage{Properties: map[string]interface{}{"$set": "x"}}, double, false},
+		{"/", &SmapMessage{Metadata: map[string]interface{}{"Site": "x"}}, double, true},
+	} {
+		if problems := v.check(test.path, test.msg, test.props, now); (len(problems) == 0) != test.valid {
+			t.Errorf("%v %+v should be valid: %v, but got %v", test.path, test.msg, test.valid, problems)
+		}
+	}
+
+	v.nonFinite = NONFINITE_DROP
+	msg := &SmapMessage{UUID: uuid, Readings: [][]interface{}{{uint64(1429000000000), math.Inf(1)}, {uint64(1429000000001), float64(2)}}}
+	if problems := v.check("/s", msg, double, now); len(problems) != 0 || len(msg.Readings) != 1 {
+		t.Error("Infinite values should be dropped, leaving", msg.Readings, problems)
+	}
+}
+
+func TestWithDecodeErrors(t *testing.T) {
+	invalid := ValidationErrors{}
+	invalid.Add("/bad", "reading %v is not a [time, value] pair", 0)
+	err := WithDecodeErrors(nil, invalid, 3)
+	report, ok := err.(*IngestError)
+	if !ok || report.Accepted != 3 || len(report.Rejected["/bad"]) != 1 {
+		t.Fatal("Messages that could not be decoded should be reported, not", err)
+	}
+	report = newIngestError()
+	report.Accepted = 1
+	report.Rejected.Add("/other", "uuid %q is not a UUID", "x")
+	if err := WithDecodeErrors(report, invalid, 2); err != report || len(report.Rejected) != 2 || report.Accepted != 1 {
+		t.Error("Problems should be added to the report, not", err)
+	}
+	if err := WithDecodeErrors(ErrBacklogFull, invalid, 3); err != ErrBacklogFull {
+		t.Error("When nothing was taken the error should be kept, not", err)
+	}
+}
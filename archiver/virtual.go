@@ -0,0 +1,622 @@
+package archiver
+
+import (
+	uuidlib "code.google.com/p/go-uuid/uuid"
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// how often the where clauses of virtual streams are re-resolved
+const virtualRefreshInterval = time.Minute
+
+// A VirtualStream is a stream whose readings are computed from other streams.
+// Expressions are built from numbers, + - * / and parentheses, and
+//
+//    stream(<where>)  -- the value of the single stream matching the where clause
+//    sum(<where>), mean(<where>), min(<where>), max(<where>), count(<where>)
+//                     -- aggregates over the latest values of all matching streams
+//    <name>           -- the value of another virtual stream
+//
+// For example
+//
+//    temp_f = stream(Path = '/building/temp_c') * 9/5 + 32
+//    total_power = sum(Metadata/Panel = 'A' and Metadata/Type = 'Power')
+//
+// Virtual streams are materialized: whenever one of its inputs receives a
+// reading, the expression is evaluated with that reading and the latest
+// known values of the other inputs, and the result is stored as a reading of
+// the virtual stream with the same timestamp. A virtual stream therefore has
+// its own UUID and metadata (under Metadata/Virtual) and can be queried and
+// subscribed to like any other stream. Its unit of time is milliseconds.
+type VirtualStream struct {
+	Name       string `bson:"name"`
+	Expression string `bson:"expression"`
+	// extra metadata for the stream, e.g. {"Type": "Power"}
+	Metadata bson.M `bson:"metadata,omitempty" json:",omitempty"`
+}
+
+// returned by expressions when an input has no value yet
+var errNoValue = errors.New("Input has no value")
+
+// An exprNode is a node in a parsed virtual stream expression. Values are
+// looked up by stream UUID
+type exprNode interface {
+	eval(value func(uuid string) (float64, bool)) (float64, error)
+}
+
+type numberNode float64
+
+func (n numberNode) eval(value func(string) (float64, bool)) (float64, error) {
+	return float64(n), nil
+}
+
+type negNode struct {
+	operand exprNode
+}
+
+func (n *negNode) eval(value func(string) (float64, bool)) (float64, error) {
+	v, err := n.operand.eval(value)
+	return -v, err
+}
+
+type binaryNode struct {
+	op          byte
+	left, right exprNode
+}
+
+func (n *binaryNode) eval(value func(string) (float64, bool)) (float64, error) {
+	l, err := n.left.eval(value)
+	if err != nil {
+		return 0, err
+	}
+	r, err := n.right.eval(value)
+	if err != nil {
+		return 0, err
+	}
+	switch n.op {
+	case '+':
+		return l + r, nil
+	case '-':
+		return l - r, nil
+	case '*':
+		return l * r, nil
+	case '/':
+		if r == 0 {
+			return 0, errors.New("Division by zero")
+		}
+		return l / r, nil
+	}
+	return 0, fmt.Errorf("Unknown operator %c", n.op)
+}
+
+// The streams matched by a where clause inside an expression
+type streamSet struct {
+	where bson.M
+	uuids []string
+}
+
+// stream(<where>), or an aggregate over the streams matching a where clause
+type streamsNode struct {
+	fn  string
+	set *streamSet
+}
+
+func (n *streamsNode) eval(value func(string) (float64, bool)) (float64, error) {
+	if n.fn == "stream" {
+		if len(n.set.uuids) != 1 {
+			return 0, fmt.Errorf("stream() matched %v streams instead of 1", len(n.set.uuids))
+		}
+		if v, found := value(n.set.uuids[0]); found {
+			return v, nil
+		}
+		return 0, errNoValue
+	}
+	var (
+		result float64
+		count  int
+	)
+	for _, uuid := range n.set.uuids {
+		v, found := value(uuid)
+		if !found {
+			continue
+		}
+		switch {
+		case count == 0:
+			result = v
+		case n.fn == "sum" || n.fn == "mean":
+			result += v
+		case n.fn == "min":
+			result = math.Min(result, v)
+		case n.fn == "max":
+			result = math.Max(result, v)
+		}
+		count++
+	}
+	if n.fn == "count" {
+		return float64(count), nil
+	}
+	if count == 0 {
+		return 0, errNoValue
+	}
+	if n.fn == "mean" {
+		result /= float64(count)
+	}
+	return result, nil
+}
+
+// a reference to another virtual stream by name
+type virtualRefNode struct {
+	name string
+}
+
+func (n *virtualRefNode) eval(value func(string) (float64, bool)) (float64, error) {
+	if v, found := value(virtualStreamUUID(n.name)); found {
+		return v, nil
+	}
+	return 0, errNoValue
+}
+
+// Parses a virtual stream expression. Returns the expression along with the
+// stream sets and virtual stream names it refers to
+func parseExpression(expr string) (exprNode, []*streamSet, []string, error) {
+	p := &exprParser{input: expr}
+	node, err := p.parseSum()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.input) {
+		return nil, nil, nil, fmt.Errorf("Unexpected %q at position %v", p.input[p.pos:], p.pos)
+	}
+	return node, p.sets, p.refs, nil
+}
+
+type exprParser struct {
+	input string
+	pos   int
+	sets  []*streamSet
+	refs  []string
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.input) && unicode.IsSpace(rune(p.input[p.pos])) {
+		p.pos++
+	}
+}
+
+// returns the next non-space character without consuming it, or 0 at the end
+func (p *exprParser) peek() byte {
+	p.skipSpace()
+	if p.pos == len(p.input) {
+		return 0
+	}
+	return p.input[p.pos]
+}
+
+// sum := product (('+' | '-') product)*
+func (p *exprParser) parseSum() (exprNode, error) {
+	left, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		if op != '+' && op != '-' {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: op, left: left, right: right}
+	}
+}
+
+// product := factor (('*' | '/') factor)*
+func (p *exprParser) parseProduct() (exprNode, error) {
+	left, err := p.parseFactor()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		if op != '*' && op != '/' {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: op, left: left, right: right}
+	}
+}
+
+// factor := number | '-' factor | '(' sum ')' | function '(' where ')' | name
+func (p *exprParser) parseFactor() (exprNode, error) {
+	c := p.peek()
+	switch {
+	case c == 0:
+		return nil, errors.New("Unexpected end of expression")
+	case c == '-':
+		p.pos++
+		operand, err := p.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+		return &negNode{operand: operand}, nil
+	case c == '(':
+		p.pos++
+		node, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, errors.New("Missing ) in expression")
+		}
+		p.pos++
+		return node, nil
+	case c == '.' || (c >= '0' && c <= '9'):
+		start := p.pos
+		for p.pos < len(p.input) && (p.input[p.pos] == '.' || (p.input[p.pos] >= '0' && p.input[p.pos] <= '9')) {
+			p.pos++
+		}
+		num, err := strconv.ParseFloat(p.input[start:p.pos], 64)
+		if err != nil {
+			return nil, err
+		}
+		return numberNode(num), nil
+	case c == '_' || unicode.IsLetter(rune(c)):
+		start := p.pos
+		for p.pos < len(p.input) && (p.input[p.pos] == '_' || unicode.IsLetter(rune(p.input[p.pos])) || unicode.IsDigit(rune(p.input[p.pos]))) {
+			p.pos++
+		}
+		name := p.input[start:p.pos]
+		if p.peek() != '(' {
+			p.refs = append(p.refs, name)
+			return &virtualRefNode{name: name}, nil
+		}
+		switch name {
+		case "stream", "sum", "mean", "min", "max", "count":
+		default:
+			return nil, errors.New("Unknown function " + name)
+		}
+		where, err := p.parseWhereArg()
+		if err != nil {
+			return nil, err
+		}
+		set := &streamSet{where: where}
+		p.sets = append(p.sets, set)
+		return &streamsNode{fn: name, set: set}, nil
+	}
+	return nil, fmt.Errorf("Unexpected %q at position %v", c, p.pos)
+}
+
+// parses the parenthesized where clause of a function. Parentheses inside
+// quotes do not count
+func (p *exprParser) parseWhereArg() (bson.M, error) {
+	p.pos++ // the opening (
+	start := p.pos
+	depth := 1
+	var quote byte
+	for ; p.pos < len(p.input); p.pos++ {
+		c := p.input[p.pos]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		}
+		if depth == 0 {
+			break
+		}
+	}
+	if depth != 0 {
+		return nil, errors.New("Missing ) in expression")
+	}
+	tokens := tokenize(p.input[start:p.pos])
+	p.pos++ // the closing )
+	if len(tokens) == 0 {
+		return nil, errors.New("Functions need a where clause")
+	}
+	where, err := parseWhere(&tokens)
+	if err != nil {
+		return nil, err
+	}
+	// virtual streams only depend on each other by name, which lets us
+	// check for cycles
+	return bson.M{"$and": []bson.M{where.ToBson(), bson.M{"Metadata.Virtual": bson.M{"$exists": false}}}}, nil
+}
+
+// Virtual streams get a UUID derived from their name
+func virtualStreamUUID(name string) string {
+	return uuidlib.NewSHA1(uuidlib.NameSpace_URL, []byte("giles/virtual/"+name)).String()
+}
+
+type activeVirtual struct {
+	VirtualStream
+	uuid string
+	expr exprNode
+	sets []*streamSet
+	refs []string
+}
+
+func newActiveVirtual(vs VirtualStream) (*activeVirtual, error) {
+	if vs.Name == "" || strings.ContainsAny(vs.Name, " /") {
+		return nil, errors.New("Virtual streams need a name without spaces or slashes")
+	}
+	expr, sets, refs, err := parseExpression(vs.Expression)
+	if err != nil {
+		return nil, err
+	}
+	return &activeVirtual{VirtualStream: vs, uuid: virtualStreamUUID(vs.Name), expr: expr, sets: sets, refs: refs}, nil
+}
+
+// The sMAP message describing a virtual stream
+func (av *activeVirtual) message() *SmapMessage {
+	metadata := bson.M{}
+	for k, v := range av.Metadata {
+		metadata[k] = v
+	}
+	metadata["Virtual"] = bson.M{"Name": av.Name, "Expression": av.Expression}
+	return &SmapMessage{UUID: av.uuid, Path: "/virtual/" + av.Name,
+		Metadata: metadata, Properties: bson.M{"UnitofTime": "ms"}}
+}
+
+// The VirtualStreams engine keeps track of the virtual streams and computes
+// their readings as their inputs pass through Archiver.AddData. Definitions
+// are persisted in the metadata store.
+type VirtualStreams struct {
+	sync.Mutex
+	streams map[string]*activeVirtual
+	// input UUID -> the virtual streams that use it
+	byuuid map[string][]*activeVirtual
+	// unit of time of the inputs
+	units      map[string]UnitOfTime
+	store      *Store
+	lastvalues *LastValueCache
+	// called with the computed readings; set in archiver.go
+	emit func(map[string]*SmapMessage)
+}
+
+func NewVirtualStreams(store *Store, lastvalues *LastValueCache) *VirtualStreams {
+	vs := &VirtualStreams{streams: make(map[string]*activeVirtual),
+		byuuid:     make(map[string][]*activeVirtual),
+		units:      make(map[string]UnitOfTime),
+		store:      store,
+		lastvalues: lastvalues}
+	defs, err := store.getVirtualStreams()
+	if err != nil {
+		log.Error("Could not load virtual streams: %v", err)
+	}
+	for _, def := range defs {
+		av, err := newActiveVirtual(def)
+		if err != nil {
+			log.Error("Skipping invalid virtual stream %v: %v", def.Name, err)
+			continue
+		}
+		vs.streams[def.Name] = av
+	}
+	return vs
+}
+
+// Periodically re-resolves the where clauses of the virtual streams
+func (vs *VirtualStreams) run() {
+	vs.refresh()
+	for range time.Tick(virtualRefreshInterval) {
+		vs.refresh()
+	}
+}
+
+// Validates, saves and starts computing a new virtual stream
+func (vs *VirtualStreams) Add(def VirtualStream) error {
+	av, err := newActiveVirtual(def)
+	if err != nil {
+		return err
+	}
+	vs.Lock()
+	if _, found := vs.streams[def.Name]; found {
+		vs.Unlock()
+		return errors.New("A virtual stream named " + def.Name + " already exists")
+	}
+	// virtual streams can only refer to streams that already exist, so
+	// there can be no cycles
+	for _, ref := range av.refs {
+		if _, found := vs.streams[ref]; !found {
+			vs.Unlock()
+			return errors.New("No virtual stream named " + ref)
+		}
+	}
+	vs.Unlock()
+	if err := vs.store.saveVirtualStream(def); err != nil {
+		return err
+	}
+	vs.Lock()
+	vs.streams[def.Name] = av
+	vs.Unlock()
+	vs.refresh()
+	if vs.emit != nil {
+		msg := av.message()
+		vs.emit(map[string]*SmapMessage{msg.Path: msg})
+	}
+	return nil
+}
+
+// Stops computing and deletes the named virtual stream. Its stored readings
+// and metadata are kept
+func (vs *VirtualStreams) Remove(name string) error {
+	vs.Lock()
+	if _, found := vs.streams[name]; !found {
+		vs.Unlock()
+		return errors.New("No virtual stream named " + name)
+	}
+	for _, av := range vs.streams {
+		for _, ref := range av.refs {
+			if ref == name {
+				vs.Unlock()
+				return errors.New("Virtual stream " + av.Name + " depends on " + name)
+			}
+		}
+	}
+	vs.Unlock()
+	if err := vs.store.removeVirtualStream(name); err != nil {
+		return err
+	}
+	vs.Lock()
+	delete(vs.streams, name)
+	vs.Unlock()
+	vs.refresh()
+	return nil
+}
+
+// Returns the definitions of all virtual streams
+func (vs *VirtualStreams) List() []VirtualStream {
+	vs.Lock()
+	defer vs.Unlock()
+	defs := make([]VirtualStream, 0, len(vs.streams))
+	for _, av := range vs.streams {
+		defs = append(defs, av.VirtualStream)
+	}
+	return defs
+}
+
+// Resolves the where clauses of all virtual streams and rebuilds the map of
+// inputs to virtual streams
+func (vs *VirtualStreams) refresh() {
+	vs.Lock()
+	streams := make([]*activeVirtual, 0, len(vs.streams))
+	for _, av := range vs.streams {
+		streams = append(streams, av)
+	}
+	vs.Unlock()
+
+	resolved := make(map[*streamSet][]string)
+	units := make(map[string]UnitOfTime)
+	for _, av := range streams {
+		for _, set := range av.sets {
+			uuids, err := vs.store.GetUUIDs(set.where)
+			if err != nil {
+				log.Error("Error resolving inputs of virtual stream %v: %v", av.Name, err)
+				continue
+			}
+			resolved[set] = uuids
+			for _, uuid := range uuids {
+				vs.Lock()
+				_, known := vs.units[uuid]
+				vs.Unlock()
+				if _, found := units[uuid]; !known && !found {
+					units[uuid] = unitOfTimeFromString(vs.store.GetUnitofTime(uuid))
+				}
+			}
+		}
+	}
+
+	vs.Lock()
+	defer vs.Unlock()
+	for uuid, uot := range units {
+		vs.units[uuid] = uot
+	}
+	byuuid := make(map[string][]*activeVirtual)
+	for _, av := range vs.streams {
+		inputs := make(map[string]bool)
+		for _, set := range av.sets {
+			if uuids, found := resolved[set]; found {
+				set.uuids = uuids
+			}
+			for _, uuid := range set.uuids {
+				inputs[uuid] = true
+			}
+		}
+		for _, ref := range av.refs {
+			inputs[virtualStreamUUID(ref)] = true
+		}
+		for uuid := range inputs {
+			byuuid[uuid] = append(byuuid[uuid], av)
+		}
+	}
+	vs.byuuid = byuuid
+}
+
+// Computes the readings of the virtual streams that use msg's stream. Each
+// reading in msg gives one reading of each such virtual stream
+func (vs *VirtualStreams) Evaluate(msg *SmapMessage) {
+	vs.Lock()
+	affected := vs.byuuid[msg.UUID]
+	uot, found := vs.units[msg.UUID]
+	if unit, ok := msg.Properties["UnitofTime"].(string); ok {
+		uot = unitOfTimeFromString(unit)
+		vs.units[msg.UUID] = uot
+	} else if !found {
+		uot = UOT_MS
+	}
+	vs.Unlock()
+	if len(affected) == 0 {
+		return
+	}
+
+	output := make(map[string]*SmapMessage, len(affected))
+	for _, rdg := range msg.Readings {
+		if len(rdg) < 2 {
+			continue
+		}
+		ts, ok := readingTime(rdg[0])
+		if !ok {
+			continue
+		}
+		current, ok := readingValue(rdg[1])
+		if !ok {
+			continue
+		}
+		value := func(uuid string) (float64, bool) {
+			if uuid == msg.UUID {
+				return current, true
+			}
+			rdg, found := vs.lastvalues.Get(uuid)
+			if !found {
+				return 0, false
+			}
+			return rdg[1], true
+		}
+		for _, av := range affected {
+			result, err := av.expr.eval(value)
+			if err == errNoValue {
+				continue
+			} else if err != nil {
+				log.Warning("Could not compute virtual stream %v: %v", av.Name, err)
+				continue
+			}
+			if math.IsNaN(result) || math.IsInf(result, 0) {
+				continue
+			}
+			out, found := output[av.Name]
+			if !found {
+				// metadata was saved when the stream was added
+				out = &SmapMessage{UUID: av.uuid, Path: "/virtual/" + av.Name}
+				output[av.Name] = out
+			}
+			out.Readings = append(out.Readings, []interface{}{convertTime(ts, uot, UOT_MS), result})
+		}
+	}
+	if len(output) == 0 || vs.emit == nil {
+		return
+	}
+	messages := make(map[string]*SmapMessage, len(output))
+	for _, out := range output {
+		messages[out.Path] = out
+	}
+	vs.emit(messages)
+}
@@ -0,0 +1,94 @@
+package archiver
+
+import (
+	"gopkg.in/mgo.v2/bson"
+	"testing"
+)
+
+func TestParseExpression(t *testing.T) {
+	values := map[string]float64{"a": 10, "b": 20, "c": 30, virtualStreamUUID("other"): 7}
+	lookup := func(uuid string) (float64, bool) {
+		v, found := values[uuid]
+		return v, found
+	}
+	for expr, expected := range map[string]float64{
+		"1 + 2 * 3":                     7,
+		"(1 + 2) * 3":                   9,
+		"100 * 9/5 + 32":                212,
+		"-2 - -3":                       1,
+		"stream(uuid = 'a') * 9/5 + 32": 50,
+		"sum(Metadata/Panel = 'A')":     60,
+		"mean(Metadata/Panel = 'A')":    20,
+		"min(Metadata/Panel = 'A')":     10,
+		"max(Metadata/Panel = 'A')":     30,
+		"count(Metadata/Panel = 'A')":   3,
+		"other * 2":                     14,
+	} {
+		node, sets, _, err := parseExpression(expr)
+		if err != nil {
+			t.Error(expr, "\ngave error", err)
+			continue
+		}
+		for _, set := range sets {
+			if set.where["$and"].([]bson.M)[0]["uuid"] == "a" {
+				set.uuids = []string{"a"}
+			} else {
+				set.uuids = []string{"a", "b", "c"}
+			}
+		}
+		res, err := node.eval(lookup)
+		if err != nil {
+			t.Error(expr, "\ngave error", err)
+		} else if res != expected {
+			t.Error(expr, "\nshould be", expected, "but is", res)
+		}
+	}
+
+	_, sets, refs, _ := parseExpression("sum(Metadata/Name = 'a (b)') + other")
+	if len(sets) != 1 || sets[0].where["$and"].([]bson.M)[0]["Metadata.Name"] != "a (b)" {
+		t.Error("Parentheses inside quotes should be part of the where clause", sets[0].where)
+	}
+	if !isStringSliceEqual(refs, []string{"other"}) {
+		t.Error("Should refer to other but refers to", refs)
+	}
+
+	for _, expr := range []string{"", "1 +", "(1 + 2", "avg(has uuid)", "sum()", "1 2", "sum(has uuid", "stream(Metadata/Site) * 2", "sum(Metadata/Site =)"} {
+		if _, _, _, err := parseExpression(expr); err == nil {
+			t.Error(expr, "\nshould give an error")
+		}
+	}
+}
+
+func TestVirtualStreamsEvaluate(t *testing.T) {
+	lvc := NewLastValueCache()
+	lvc.Update(&SmapMessage{UUID: "b", Readings: [][]interface{}{[]interface{}{uint64(1), float64(5)}}})
+	vs := &VirtualStreams{streams: make(map[string]*activeVirtual), byuuid: make(map[string][]*activeVirtual),
+		units: map[string]UnitOfTime{"a": UOT_S}, lastvalues: lvc}
+	var emitted map[string]*SmapMessage
+	vs.emit = func(msgs map[string]*SmapMessage) { emitted = msgs }
+
+	av, err := newActiveVirtual(VirtualStream{Name: "total", Expression: "sum(has Metadata/Power)"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	av.sets[0].uuids = []string{"a", "b"}
+	vs.streams[av.Name] = av
+	vs.byuuid["a"] = []*activeVirtual{av}
+	vs.byuuid["b"] = []*activeVirtual{av}
+
+	vs.Evaluate(&SmapMessage{UUID: "a", Readings: [][]interface{}{
+		[]interface{}{uint64(10), float64(1)},
+		[]interface{}{uint64(11), float64(2)},
+	}})
+	msg := emitted["/virtual/total"]
+	if msg == nil || msg.UUID != virtualStreamUUID("total") {
+		t.Fatal("Should emit a reading for total but emitted", emitted)
+	}
+	if len(msg.Readings) != 2 || msg.Readings[0][0] != uint64(10000) || msg.Readings[0][1] != float64(6) || msg.Readings[1][1] != float64(7) {
+		t.Error("Wrong readings for total", msg.Readings)
+	}
+
+	if _, err := newActiveVirtual(VirtualStream{Name: "a/b", Expression: "1"}); err == nil {
+		t.Error("Names with slashes should give an error")
+	}
+}
@@ -0,0 +1,423 @@
+package archiver
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// a batch is sent when it holds this many readings...
+	webhookBatchSize = 500
+	// ...or when it is this old, whichever comes first
+	webhookBatchInterval = 5 * time.Second
+	// how many batches may wait for delivery before new ones are dead-lettered
+	webhookQueueSize = 100
+	// deliveries are dead-lettered after this many attempts
+	webhookMaxAttempts = 8
+	// the header carrying the hex HMAC-SHA256 of the body, if the webhook has a secret
+	webhookSignatureHeader = "X-Giles-Signature"
+)
+
+// failed deliveries are retried with exponential backoff starting here
+var webhookInitialBackoff = time.Second
+
+// A Webhook pushes the readings of the streams matching Query to URL. Query is
+// a republish query (see subscriptionQuery), so it can use value predicates
+// and "every" windows. Readings are POSTed in batches, in the same JSON format
+// as the HTTP republish interface:
+//
+//    {"/sensor0": {"Readings": [[1351043674000, 0], ...], "uuid": "..."}}
+//
+// If Secret is set, each request carries the header
+//
+//    X-Giles-Signature: sha256=<hex HMAC-SHA256 of the body keyed with Secret>
+//
+// Webhooks are saved in the metadata store and resume when Giles restarts.
+// The streams they deliver are those matching Query at the time, so streams
+// created later are picked up. Batches are journaled in the metadata store
+// until they have been delivered, and those that were waiting when Giles
+// stopped are delivered once it restarts. Readings that had not been batched
+// yet (at most webhookBatchInterval's worth) are lost. Batches that cannot be
+// delivered are recorded in the dead letter log.
+type Webhook struct {
+	Name   string `bson:"name"`
+	URL    string `bson:"url"`
+	Query  string `bson:"query"`
+	Secret string `bson:"secret,omitempty" json:",omitempty"`
+}
+
+// A delivery we gave up on
+type DeadLetter struct {
+	Webhook string    `bson:"webhook"`
+	URL     string    `bson:"url"`
+	Body    string    `bson:"body"`
+	Error   string    `bson:"error"`
+	Time    time.Time `bson:"time"`
+}
+
+func (w *Webhook) validate() error {
+	if w.Name == "" {
+		return errors.New("Webhook needs a name")
+	}
+	u, err := url.Parse(w.URL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("Webhook URL must be http or https: " + w.URL)
+	}
+	sub, err := parseSubscription(w.Query)
+	if err != nil {
+		return err
+	}
+	if sub.tags != nil {
+		return errors.New("Webhooks only support data subscriptions")
+	}
+	if sub.replay != nil {
+		return errors.New("Webhooks do not support replay")
+	}
+	return nil
+}
+
+// A batch waiting for delivery, as journaled in the metadata store
+type webhookBatch struct {
+	ID      bson.ObjectId `bson:"_id"`
+	Webhook string        `bson:"webhook"`
+	Body    []byte        `bson:"body"`
+}
+
+// The WebhookSubscriber is the Subscriber for one Webhook. It collects the
+// messages the Republisher sends it into batches, which are delivered in
+// order by a single goroutine.
+type WebhookSubscriber struct {
+	sync.Mutex
+	hook    Webhook
+	batch   map[string]*SmapReading
+	count   int
+	batches chan *webhookBatch
+	// journaled batches left over from before a restart, which are
+	// delivered first
+	pending []*webhookBatch
+	// set once batches is closed
+	closed bool
+	notify chan bool
+	done   chan bool
+	client *http.Client
+	store  *Store
+}
+
+func newWebhookSubscriber(hook Webhook, store *Store) *WebhookSubscriber {
+	return &WebhookSubscriber{hook: hook,
+		batch:   make(map[string]*SmapReading),
+		batches: make(chan *webhookBatch, webhookQueueSize),
+		notify:  make(chan bool, 1),
+		done:    make(chan bool),
+		client:  &http.Client{Timeout: 30 * time.Second},
+		store:   store}
+}
+
+func (ws *WebhookSubscriber) Send(msg *SmapMessage) {
+	if len(msg.Readings) == 0 {
+		return
+	}
+	ws.Lock()
+	key := msg.Path
+	if key == "" {
+		key = msg.UUID
+	}
+	if rdg, found := ws.batch[key]; found {
+		rdg.Readings = append(rdg.Readings, msg.Readings...)
+	} else {
+		ws.batch[key] = &SmapReading{UUID: msg.UUID, Readings: append([][]interface{}{}, msg.Readings...)}
+	}
+	ws.count += len(msg.Readings)
+	full := ws.count >= webhookBatchSize
+	ws.Unlock()
+	if full {
+		ws.flush()
+	}
+}
+
+func (ws *WebhookSubscriber) SendError(e error) {
+	log.Error("Error on webhook %v: %v", ws.hook.Name, e)
+}
+
+func (ws *WebhookSubscriber) GetNotify() <-chan bool {
+	return ws.notify
+}
+
+// Journals the current batch and queues it for delivery
+func (ws *WebhookSubscriber) flush() {
+	ws.Lock()
+	if ws.count == 0 {
+		ws.Unlock()
+		return
+	}
+	body, err := json.Marshal(ws.batch)
+	ws.batch = make(map[string]*SmapReading)
+	ws.count = 0
+	ws.Unlock()
+	if err != nil {
+		log.Error("Error marshalling webhook batch: %v", err)
+		return
+	}
+	batch := &webhookBatch{ID: bson.NewObjectId(), Webhook: ws.hook.Name, Body: body}
+	if ws.store != nil {
+		if err := ws.store.saveWebhookBatch(batch); err != nil {
+			log.Error("Could not journal batch for webhook %v: %v", ws.hook.Name, err)
+		}
+	}
+	ws.Lock()
+	queued := false
+	if !ws.closed {
+		select {
+		case ws.batches <- batch:
+			queued = true
+		default:
+		}
+	}
+	ws.Unlock()
+	if !queued {
+		ws.deadLetter(batch, errors.New("Delivery queue is full or webhook was removed"))
+	}
+}
+
+// Sends batches until the webhook is stopped
+func (ws *WebhookSubscriber) run() {
+	go ws.deliver()
+	ticker := time.NewTicker(webhookBatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ws.flush()
+		case <-ws.done:
+			ws.flush()
+			ws.Lock()
+			ws.closed = true
+			close(ws.batches)
+			ws.Unlock()
+			return
+		}
+	}
+}
+
+func (ws *WebhookSubscriber) deliver() {
+	for _, batch := range ws.pending {
+		ws.send(batch)
+	}
+	ws.pending = nil
+	for batch := range ws.batches {
+		ws.send(batch)
+	}
+}
+
+// Delivers the batch, or dead-letters it, and removes it from the journal.
+// Once the webhook is stopped, batches are dead-lettered without being sent
+func (ws *WebhookSubscriber) send(batch *webhookBatch) {
+	select {
+	case <-ws.done:
+		ws.deadLetter(batch, errors.New("Webhook was removed"))
+		return
+	default:
+	}
+	if err := postWithRetry(ws.client, ws.hook.URL, ws.hook.Secret, batch.Body, ws.done); err != nil {
+		log.Error("Giving up on delivery to webhook %v: %v", ws.hook.Name, err)
+		ws.deadLetter(batch, err)
+		return
+	}
+	if ws.store != nil {
+		ws.store.removeWebhookBatch(batch.ID)
+	}
+}
+
+func (ws *WebhookSubscriber) deadLetter(batch *webhookBatch, err error) {
+	errorCount.Inc("webhook")
+	if ws.store == nil {
+		return
+	}
+	ws.store.saveDeadLetter(DeadLetter{Webhook: ws.hook.Name, URL: ws.hook.URL, Body: string(batch.Body),
+		Error: err.Error(), Time: time.Now()})
+	ws.store.removeWebhookBatch(batch.ID)
+}
+
+// Unsubscribes the webhook and stops delivery. Batches that are still waiting,
+// including the one being collected, are dead-lettered
+func (ws *WebhookSubscriber) stop() {
+	close(ws.done)
+	ws.notify <- true
+}
+
+// POSTs body to url, retrying with exponential backoff on connection errors
+// and 5xx/429 responses. Other responses are not retried. Retries end early
+// if stop is closed.
+func postWithRetry(client *http.Client, target, secret string, body []byte, stop <-chan bool) error {
+	var err error
+	backoff := webhookInitialBackoff
+	for attempt := 1; attempt <= webhookMaxAttempts; attempt++ {
+		var retry bool
+		if retry, err = post(client, target, secret, body); err == nil {
+			return nil
+		} else if !retry {
+			return err
+		}
+		log.Warning("Delivery to %v failed (attempt %v): %v", target, attempt, err)
+		if attempt == webhookMaxAttempts {
+			break
+		}
+		select {
+		case <-time.After(backoff):
+		case <-stop:
+			return fmt.Errorf("Webhook stopped after %v attempts: %v", attempt, err)
+		}
+		backoff *= 2
+	}
+	return fmt.Errorf("Failed after %v attempts: %v", webhookMaxAttempts, err)
+}
+
+// makes one delivery attempt, returning whether a failure is worth retrying
+func post(client *http.Client, target, secret string, body []byte) (bool, error) {
+	req, err := http.NewRequest("POST", target, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if secret != "" {
+		req.Header.Set(webhookSignatureHeader, "sha256="+signBody(secret, body))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode >= 500 || resp.StatusCode == 429:
+		return true, errors.New(resp.Status)
+	}
+	return false, errors.New(resp.Status)
+}
+
+// hex HMAC-SHA256 of body keyed with secret
+func signBody(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// The WebhookManager subscribes the saved webhooks to the Republisher on
+// startup and handles adding and removing them
+type WebhookManager struct {
+	sync.Mutex
+	store       *Store
+	republisher *Republisher
+	hooks       map[string]*WebhookSubscriber
+}
+
+func NewWebhookManager(store *Store, republisher *Republisher) *WebhookManager {
+	return &WebhookManager{store: store, republisher: republisher, hooks: make(map[string]*WebhookSubscriber)}
+}
+
+// Returns the number of batches waiting for delivery across all webhooks
+func (wm *WebhookManager) Queued() int {
+	wm.Lock()
+	defer wm.Unlock()
+	queued := 0
+	for _, ws := range wm.hooks {
+		queued += len(ws.batches)
+	}
+	return queued
+}
+
+// Starts delivery for all saved webhooks, beginning with the batches that
+// were journaled but not delivered before Giles stopped
+func (wm *WebhookManager) start() {
+	hooks, err := wm.store.getWebhooks()
+	if err != nil {
+		log.Error("Could not load webhooks: %v", err)
+		return
+	}
+	for _, hook := range hooks {
+		pending, err := wm.store.getWebhookBatches(hook.Name)
+		if err != nil {
+			log.Error("Could not load journaled batches for webhook %v: %v", hook.Name, err)
+		} else if len(pending) > 0 {
+			log.Notice("Resuming delivery of %v batches to webhook %v", len(pending), hook.Name)
+		}
+		wm.subscribe(hook, pending)
+	}
+	log.Notice("Started %v webhooks", len(hooks))
+}
+
+func (wm *WebhookManager) subscribe(hook Webhook, pending []*webhookBatch) {
+	ws := newWebhookSubscriber(hook, wm.store)
+	ws.pending = pending
+	wm.Lock()
+	wm.hooks[hook.Name] = ws
+	wm.Unlock()
+	go ws.run()
+	go wm.republisher.HandleSubscriber(ws, hook.Query, "")
+}
+
+// Validates, saves and starts a new webhook
+func (wm *WebhookManager) AddWebhook(hook Webhook) error {
+	if err := hook.validate(); err != nil {
+		return err
+	}
+	wm.Lock()
+	_, found := wm.hooks[hook.Name]
+	wm.Unlock()
+	if found {
+		return errors.New("A webhook named " + hook.Name + " already exists")
+	}
+	if err := wm.store.saveWebhook(hook); err != nil {
+		return err
+	}
+	wm.subscribe(hook, nil)
+	return nil
+}
+
+// Stops and deletes the named webhook
+func (wm *WebhookManager) RemoveWebhook(name string) error {
+	wm.Lock()
+	ws, found := wm.hooks[name]
+	delete(wm.hooks, name)
+	wm.Unlock()
+	if !found {
+		return errors.New("No webhook named " + name)
+	}
+	ws.stop()
+	if err := wm.store.removeWebhookBatches(name); err != nil {
+		log.Error("Could not remove journaled batches for webhook %v: %v", name, err)
+	}
+	return wm.store.removeWebhook(name)
+}
+
+// Returns the registered webhooks. Secrets are not included
+func (wm *WebhookManager) Webhooks() []Webhook {
+	wm.Lock()
+	defer wm.Unlock()
+	hooks := make([]Webhook, 0, len(wm.hooks))
+	for _, ws := range wm.hooks {
+		hook := ws.hook
+		hook.Secret = ""
+		hooks = append(hooks, hook)
+	}
+	return hooks
+}
+
+// Returns the most recent dead letters for the named webhook, newest first
+func (wm *WebhookManager) DeadLetters(name string, limit int) ([]DeadLetter, error) {
+	return wm.store.getDeadLetters(name, limit)
+}
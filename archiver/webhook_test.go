@@ -0,0 +1,112 @@
+package archiver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebhookValidate(t *testing.T) {
+	good := Webhook{Name: "a", URL: "http://localhost/hook", Query: "Metadata/Type = 'Temp' and value > 30"}
+	if err := good.validate(); err != nil {
+		t.Error(good, "\ngave error", err)
+	}
+	for _, hook := range []Webhook{
+		{Name: "", URL: "http://localhost/hook", Query: "has uuid"},
+		{Name: "a", URL: "ftp://localhost/hook", Query: "has uuid"},
+		{Name: "a", URL: "http://localhost/hook", Query: "replay 10 where has uuid"},
+		{Name: "a", URL: "http://localhost/hook", Query: "select distinct Metadata/Site where has uuid"},
+	} {
+		if err := hook.validate(); err == nil {
+			t.Error(hook, "\nshould give an error")
+		}
+	}
+}
+
+func TestWebhookValidateMalformedQuery(t *testing.T) {
+	for _, query := range []string{"Metadata/Site =", "Metadata/Site", "Metadata/Site = 'a' and"} {
+		hook := Webhook{Name: "a", URL: "http://localhost/hook", Query: query}
+		if err := hook.validate(); err == nil {
+			t.Error(query, "should give an error")
+		}
+	}
+}
+
+func TestWebhookStopDeadLetters(t *testing.T) {
+	posts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		posts++
+		ioutil.ReadAll(req.Body)
+	}))
+	defer server.Close()
+	ws := newWebhookSubscriber(Webhook{Name: "a", URL: server.URL}, nil)
+	ws.Send(&SmapMessage{UUID: "u1", Path: "/s1", Readings: [][]interface{}{[]interface{}{uint64(1), float64(1)}}})
+	ws.flush()
+	close(ws.done)
+	close(ws.batches)
+	ws.deliver()
+	if posts != 0 {
+		t.Error("Batches waiting when the webhook is stopped should not be sent, but", posts, "were")
+	}
+}
+
+func TestWebhookBatch(t *testing.T) {
+	ws := newWebhookSubscriber(Webhook{Name: "a"}, nil)
+	ws.Send(&SmapMessage{UUID: "u1", Path: "/s1", Readings: [][]interface{}{[]interface{}{uint64(1), float64(1)}}})
+	ws.Send(&SmapMessage{UUID: "u1", Path: "/s1", Readings: [][]interface{}{[]interface{}{uint64(2), float64(2)}}})
+	ws.Send(&SmapMessage{UUID: "u2", Path: "/s2", Readings: [][]interface{}{[]interface{}{uint64(1), float64(3)}}})
+	ws.flush()
+	var batch map[string]SmapReading
+	if err := json.Unmarshal((<-ws.batches).Body, &batch); err != nil {
+		t.Fatal(err)
+	}
+	if len(batch) != 2 || len(batch["/s1"].Readings) != 2 || batch["/s2"].UUID != "u2" {
+		t.Error("Wrong batch", batch)
+	}
+	ws.flush()
+	select {
+	case body := <-ws.batches:
+		t.Error("Empty batch should not be sent but got", string(body.Body))
+	default:
+	}
+}
+
+func TestPostWithRetry(t *testing.T) {
+	webhookInitialBackoff = time.Millisecond
+	attempts := 0
+	var signature string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		attempts++
+		signature = req.Header.Get(webhookSignatureHeader)
+		ioutil.ReadAll(req.Body)
+		if attempts < 3 {
+			rw.WriteHeader(503)
+		}
+	}))
+	defer server.Close()
+
+	body := []byte(`{"a": 1}`)
+	if err := postWithRetry(http.DefaultClient, server.URL, "secret", body, nil); err != nil {
+		t.Error("Delivery should succeed on the third attempt but got", err)
+	}
+	if attempts != 3 {
+		t.Error("Should take 3 attempts but took", attempts)
+	}
+	if signature != "sha256="+signBody("secret", body) {
+		t.Error("Wrong signature", signature)
+	}
+
+	// client errors are not retried
+	rejecting := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		attempts++
+		rw.WriteHeader(400)
+	}))
+	defer rejecting.Close()
+	attempts = 0
+	if err := postWithRetry(http.DefaultClient, rejecting.URL, "", body, nil); err == nil || attempts != 1 {
+		t.Error("400 should fail without retrying but got", err, "after", attempts, "attempts")
+	}
+}
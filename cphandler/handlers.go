@@ -24,8 +24,11 @@ func Handle(a *archiver.Archiver, port int) {
 	conn, err := net.ListenUDP("udp", addr)
 	if err != nil {
 		log.Error("Error on listening: %v", err)
+		a.ListenerFailed("capnproto", err)
+		return
 	}
 	log.Notice("Starting CapnProto on %v", addr.String())
+	a.ListenerStarted("capnproto")
 	defer conn.Close()
 	for {
 		buf := make([]byte, 4096)
@@ -53,7 +56,7 @@ func Handle(a *archiver.Archiver, port int) {
 
 func AddReadings(a *archiver.Archiver, req Request) {
 	smapmsgs := CapnpToStruct(req.WriteData().Messages().ToArray())
-	a.AddData(smapmsgs, req.Apikey())
+	a.AddDataFrom("capnp", smapmsgs, req.Apikey())
 }
 
 func DoQuery(a *archiver.Archiver, req Request) {
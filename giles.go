@@ -19,6 +19,9 @@ var configfile = flag.String("c", "giles.cfg", "Path to Giles configuration file
 
 func main() {
 	flag.Parse()
+	if flag.Arg(0) == "import" {
+		os.Exit(runImport(flag.Args()[1:]))
+	}
 	config := archiver.LoadConfig(*configfile)
 	archiver.PrintConfig(config)
 
@@ -0,0 +1,43 @@
+package httphandler
+
+import (
+	"encoding/json"
+	"github.com/gtfierro/giles/archiver"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+)
+
+// Sets the actuator of the stream with the given UUID. The body is a JSON
+// object such as
+//    {"Value": 1}
+// and the API key, which needs the actuation permission and must be the key
+// the stream was written with, is given as the "key" query parameter.
+// Refused actuations give a 403 when the key may not actuate the stream and
+// a 400 when the stream is not an actuator or does not take the value
+func ActuateHandler(a *archiver.Archiver, rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	defer req.Body.Close()
+	var cmd struct {
+		Value interface{}
+	}
+	if err := json.NewDecoder(req.Body).Decode(&cmd); err != nil {
+		log.Error("Error decoding actuation: %v", err)
+		rw.WriteHeader(400)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	err := a.Actuate(ps.ByName("uuid"), cmd.Value, unescape(req.URL.Query().Get("key")))
+	if refused, ok := err.(*archiver.ActuationError); ok {
+		if refused.Forbidden {
+			rw.WriteHeader(403)
+		} else {
+			rw.WriteHeader(400)
+		}
+		rw.Write([]byte(err.Error()))
+		return
+	} else if err != nil {
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	rw.WriteHeader(200)
+}
@@ -35,8 +35,28 @@ func Handle(a *archiver.Archiver, port int) {
 	r := httprouter.New()
 	r.POST("/add/:key", curryhandler(a, AddReadingHandler))
 	r.POST("/republish", curryhandler(a, RepublishHandler))
+	r.GET("/api/republish/sse", curryhandler(a, SSERepublishHandler))
 	r.POST("/api/query", curryhandler(a, QueryHandler))
+	r.POST("/api/latest", curryhandler(a, LatestHandler))
+	r.POST("/api/cluster/query", curryhandler(a, ClusterQueryHandler))
+	r.POST("/api/cluster/latest", curryhandler(a, ClusterLatestHandler))
 	r.GET("/api/tags/uuid/:uuid", curryhandler(a, TagsHandler))
+	r.GET("/api/rules", curryhandler(a, ListRulesHandler))
+	r.POST("/api/rules", curryhandler(a, AddRuleHandler))
+	r.DELETE("/api/rules/:name", curryhandler(a, DeleteRuleHandler))
+	r.GET("/api/webhooks", curryhandler(a, ListWebhooksHandler))
+	r.POST("/api/webhooks", curryhandler(a, AddWebhookHandler))
+	r.DELETE("/api/webhooks/:name", curryhandler(a, DeleteWebhookHandler))
+	r.GET("/api/virtual", curryhandler(a, ListVirtualStreamsHandler))
+	r.POST("/api/virtual", curryhandler(a, AddVirtualStreamHandler))
+	r.DELETE("/api/virtual/:name", curryhandler(a, DeleteVirtualStreamHandler))
+	r.POST("/api/actuate/:uuid", curryhandler(a, ActuateHandler))
+	r.POST("/api/import", curryhandler(a, StartImportHandler))
+	r.POST("/api/import/:id", curryhandler(a, ImportChunkHandler))
+	r.GET("/api/import/:id", curryhandler(a, ImportStatusHandler))
+	r.GET("/metrics", curryhandler(a, MetricsHandler))
+	r.GET("/healthz", curryhandler(a, HealthHandler))
+	r.GET("/readyz", curryhandler(a, ReadyHandler))
 
 	address, err := net.ResolveTCPAddr("tcp4", "0.0.0.0:"+strconv.Itoa(port))
 	if err != nil {
@@ -48,7 +68,14 @@ func Handle(a *archiver.Archiver, port int) {
 	srv := &http.Server{
 		Addr: address.String(),
 	}
-	srv.ListenAndServe()
+	listener, err := net.Listen("tcp", address.String())
+	if err != nil {
+		log.Error("Error on listening: %v", err)
+		a.ListenerFailed("http", err)
+		return
+	}
+	a.ListenerStarted("http")
+	a.ListenerFailed("http", srv.Serve(listener))
 }
 
 func curryhandler(a *archiver.Archiver, f func(*archiver.Archiver, http.ResponseWriter, *http.Request, httprouter.Params)) func(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
@@ -83,19 +110,58 @@ func curryhandler(a *archiver.Archiver, f func(*archiver.Archiver, http.Response
 //          "uuid" : "d24325e6-1d7d-11e2-ad69-a7c2fa8dba61"
 //      }
 //    }
+//
+// Messages that are not valid are refused with a 400 that lists what is
+// wrong with each of them by path; the other messages have been taken:
+//
+//    {"accepted": 199, "rejected": {"/sensor7": ["uuid \"abc\" is not a UUID"]}}
+//
+// A 503 means the timeseries database is down and the readings should be
+// sent again later; a 500 that they, or some of them, could not be saved.
 func AddReadingHandler(a *archiver.Archiver, rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 	//TODO: add transaction coalescing
 	defer req.Body.Close()
 	apikey := ps.ByName("key")
-	messages, err := handleJSON(req.Body)
+	messages, invalid, err := handleJSON(req.Body)
 	if err != nil {
 		log.Error("Error handling JSON: %v", err)
-		rw.WriteHeader(500)
+		rw.WriteHeader(400)
 		rw.Write([]byte(err.Error()))
 		return
 	}
-	err = a.AddData(messages, apikey)
-	if err != nil {
+	// from another archiver that forwards to this one
+	if source := req.Header.Get(archiver.ReplicaHeader); source != "" {
+		// refusing part of a batch would have it sent again forever
+		if len(invalid) > 0 {
+			log.Error("Dropped messages from %v that could not be parsed: %v", source, invalid)
+		}
+		if node := req.Header.Get(archiver.ClusterHeader); node != "" {
+			err = a.AddClusterReplicated(node, source, messages, apikey)
+		} else {
+			err = a.AddReplicated(source, messages, apikey)
+		}
+	} else if node := req.Header.Get(archiver.ClusterHeader); node != "" {
+		err = archiver.WithDecodeErrors(a.AddClusterData(node, messages, apikey), invalid, len(messages))
+	} else {
+		err = archiver.WithDecodeErrors(a.AddDataFrom("http", messages, apikey), invalid, len(messages))
+	}
+	if report, ok := err.(*archiver.IngestError); ok {
+		// the other messages were taken, so the driver should only fix
+		// and send again the ones listed
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(400)
+		json.NewEncoder(rw).Encode(report)
+		return
+	} else if err == archiver.ErrBacklogFull {
+		rw.Header().Set("Retry-After", "30")
+		rw.WriteHeader(503)
+		rw.Write([]byte(err.Error()))
+		return
+	} else if err == archiver.ErrDuplicateReadings {
+		rw.WriteHeader(409)
+		rw.Write([]byte(err.Error()))
+		return
+	} else if err != nil {
 		rw.WriteHeader(500)
 		rw.Write([]byte(err.Error()))
 		return
@@ -137,6 +203,115 @@ func QueryHandler(a *archiver.Archiver, rw http.ResponseWriter, req *http.Reques
 	rw.Write(res)
 }
 
+// Receives POST request which contains a where clause (e.g. Metadata/Type = 'Temperature')
+// and returns the most recent reading for every matching stream. These are served from the
+// archiver's last value cache, so polling many streams does not touch the timeseries database.
+// A where clause that cannot be parsed is refused with a 400
+func LatestHandler(a *archiver.Archiver, rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	defer req.Body.Close()
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	key := unescape(ps.ByName("key"))
+	where, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		log.Error("Error reading query: %v", err)
+	}
+	res, err := a.HandleLatest(string(where), key)
+	if _, ok := err.(*archiver.WhereError); ok {
+		rw.WriteHeader(400)
+		rw.Write([]byte(err.Error()))
+		return
+	} else if err != nil {
+		log.Error("Error evaluating latest query: %v", err)
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	rw.WriteHeader(200)
+	rw.Write(res)
+}
+
+// Answers a query from another node of the cluster from this node's streams
+// (see archiver.Cluster). The API key is in the "key" URL parameter
+func ClusterQueryHandler(a *archiver.Archiver, rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	defer req.Body.Close()
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	stringquery, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		log.Error("Error reading query: %v", err)
+	}
+	res, err := a.HandleClusterQuery(string(stringquery), req.URL.Query().Get("key"))
+	if err != nil {
+		log.Error("Error evaluating query for %v: %v", req.Header.Get(archiver.ClusterHeader), err)
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	rw.WriteHeader(200)
+	rw.Write(res)
+}
+
+// Answers a latest query from another node of the cluster from this node's
+// streams
+func ClusterLatestHandler(a *archiver.Archiver, rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	defer req.Body.Close()
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	where, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		log.Error("Error reading query: %v", err)
+	}
+	res, err := a.HandleClusterLatest(string(where), req.URL.Query().Get("key"))
+	if _, ok := err.(*archiver.WhereError); ok {
+		rw.WriteHeader(400)
+		rw.Write([]byte(err.Error()))
+		return
+	} else if err != nil {
+		log.Error("Error evaluating latest query for %v: %v", req.Header.Get(archiver.ClusterHeader), err)
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	rw.WriteHeader(200)
+	rw.Write(res)
+}
+
+// Serves the archiver's internal metrics in the Prometheus text format, for
+// scraping by Prometheus or anything else that reads it
+func MetricsHandler(a *archiver.Archiver, rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	rw.WriteHeader(200)
+	a.WriteMetrics(rw)
+}
+
+// Liveness check: returns the archiver's HealthReport as JSON, with status
+// 200 if it is healthy and 503 otherwise
+func HealthHandler(a *archiver.Archiver, rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	writeHealthReport(rw, a.Health())
+}
+
+// Readiness check: like HealthHandler, but also checks that the metadata
+// store and timeseries database answer
+func ReadyHandler(a *archiver.Archiver, rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	writeHealthReport(rw, a.Ready())
+}
+
+func writeHealthReport(rw http.ResponseWriter, report *archiver.HealthReport) {
+	rw.Header().Set("Content-Type", "application/json")
+	res, err := json.Marshal(report)
+	if err != nil {
+		log.Error("Error encoding health report: %v", err)
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	if report.Healthy() {
+		rw.WriteHeader(200)
+	} else {
+		rw.WriteHeader(503)
+	}
+	rw.Write(res)
+}
+
 /**
  * Returns metadata for a uuid. A limited GET alternative to the POST query handler
 **/
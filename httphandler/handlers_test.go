@@ -0,0 +1,24 @@
+package httphandler
+
+import (
+	"github.com/gtfierro/giles/archiver"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLatestMalformedWhere(t *testing.T) {
+	for _, where := range []string{"Metadata/Site", "where Metadata/Site =", "Metadata/Site = 'a' or"} {
+		rw := httptest.NewRecorder()
+		// the where clause is refused before the archiver's stores are needed
+		LatestHandler(&archiver.Archiver{}, rw, httptest.NewRequest("POST", "/api/latest", strings.NewReader(where)), nil)
+		if rw.Code != 400 {
+			t.Error(where, "should be refused with a 400, not", rw.Code)
+		}
+		rw = httptest.NewRecorder()
+		ClusterLatestHandler(&archiver.Archiver{}, rw, httptest.NewRequest("POST", "/api/cluster/latest", strings.NewReader(where)), nil)
+		if rw.Code != 400 {
+			t.Error(where, "should be refused by a node with a 400, not", rw.Code)
+		}
+	}
+}
@@ -23,7 +23,7 @@ func BenchmarkAddReading1(b *testing.B) {
 	var jsonstringshort = `
 	{
 		"/fast/sensor0": {
-			"Readings": [[9182731928374, 30]],
+			"Readings": [[1429000000000, 30]],
 			"uuid": "b86df176-6b40-5d58-8f29-3b85f5cfbf1e"
 		}
 	}`
@@ -62,7 +62,7 @@ func BenchmarkAddReadingFull1(b *testing.B) {
 					"other": "value"
 				}
 			},
-			"Readings": [[9182731928374, 30]],
+			"Readings": [[1429000000, 30]],
 			"uuid": "b86df176-6b40-5d58-8f29-3b85f5cfbf1e"
 		}
 	}`
@@ -0,0 +1,118 @@
+package httphandler
+
+import (
+	"encoding/json"
+	"github.com/gtfierro/giles/archiver"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"strconv"
+)
+
+// Starts a bulk import of historic readings. The body describes the data
+// and the streams it goes to (see archiver.Import), e.g.
+//    {
+//      "Format": "csv",
+//      "Columns": ["time", "AHU-1 SAT"],
+//      "UnitofTime": "s",
+//      "Streams": {"AHU-1 SAT": {"Path": "/ahu1/sat", "uuid": "..."}}
+//    }
+// and the API key is given as the "key" query parameter. Answers with the
+// import, whose ID names it in the calls below
+func StartImportHandler(a *archiver.Archiver, rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	defer req.Body.Close()
+	var imp archiver.Import
+	if err := json.NewDecoder(req.Body).Decode(&imp); err != nil {
+		log.Error("Error decoding import: %v", err)
+		rw.WriteHeader(400)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	started, err := a.StartImport(imp, unescape(req.URL.Query().Get("key")))
+	if err == archiver.ErrImportForbidden {
+		rw.WriteHeader(403)
+		rw.Write([]byte(err.Error()))
+		return
+	} else if err != nil {
+		rw.WriteHeader(400)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	writeImport(rw, 200, started)
+}
+
+// Takes a chunk of the lines of an import. The "offset" query parameter is
+// the number of the chunk's first line in the data, counting from 0. Answers
+// with the import's progress; a chunk that starts after the last line
+// written is refused with a 409, one with lines that are not valid with a
+// 400 that lists them, one sent with the wrong API key with a 403, and any
+// chunk with a 503 while the timeseries database cannot be reached
+func ImportChunkHandler(a *archiver.Archiver, rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	defer req.Body.Close()
+	offset, err := strconv.ParseUint(req.URL.Query().Get("offset"), 10, 64)
+	if err != nil {
+		rw.WriteHeader(400)
+		rw.Write([]byte("offset should be the number of the first line of the chunk"))
+		return
+	}
+	imp, err := a.ImportChunk(ps.ByName("id"), offset, req.Body, unescape(req.URL.Query().Get("key")))
+	switch err.(type) {
+	case nil:
+		writeImport(rw, 200, imp)
+		return
+	case *archiver.ImportError:
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(400)
+		json.NewEncoder(rw).Encode(err)
+		return
+	}
+	switch err {
+	case archiver.ErrImportGap:
+		writeImport(rw, 409, imp)
+	case archiver.ErrNoSuchImport:
+		rw.WriteHeader(404)
+		rw.Write([]byte(err.Error()))
+	case archiver.ErrImportForbidden:
+		rw.WriteHeader(403)
+		rw.Write([]byte(err.Error()))
+	case archiver.ErrBacklogFull, archiver.ErrImportHeld:
+		rw.Header().Set("Retry-After", "30")
+		rw.WriteHeader(503)
+		rw.Write([]byte(err.Error()))
+	default:
+		log.Error("Error importing chunk of %v: %v", ps.ByName("id"), err)
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+	}
+}
+
+// Returns the progress of an import
+func ImportStatusHandler(a *archiver.Archiver, rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	imp, err := a.ImportStatus(ps.ByName("id"), unescape(req.URL.Query().Get("key")))
+	if err == archiver.ErrNoSuchImport {
+		rw.WriteHeader(404)
+		rw.Write([]byte(err.Error()))
+		return
+	} else if err == archiver.ErrImportForbidden {
+		rw.WriteHeader(403)
+		rw.Write([]byte(err.Error()))
+		return
+	} else if err != nil {
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	writeImport(rw, 200, imp)
+}
+
+func writeImport(rw http.ResponseWriter, status int, imp *archiver.Import) {
+	res, err := json.Marshal(imp)
+	if err != nil {
+		log.Error("Error converting to json: %v", err)
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	rw.Write(res)
+}
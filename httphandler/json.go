@@ -2,7 +2,6 @@ package httphandler
 
 import (
 	"encoding/json"
-	"errors"
 	simplejson "github.com/bitly/go-simplejson"
 	"github.com/gtfierro/giles/archiver"
 	"gopkg.in/mgo.v2/bson"
@@ -22,31 +21,44 @@ import (
 This should not do any fancy sMAP-related work; that's a job for the store. Here we just return the
 object-versions of all the data.
 */
-func handleJSON(r io.Reader) (map[string]*archiver.SmapMessage, error) {
+func handleJSON(r io.Reader) (map[string]*archiver.SmapMessage, archiver.ValidationErrors, error) {
 	/*
 	 * we receive a bunch of top-level keys that we don't know, so we unmarshal them into a
-	 * map, and then parse each of the internal objects individually
+	 * map, and then parse each of the internal objects individually. A path whose object
+	 * cannot be parsed is left out and its problems returned, so that the others can still
+	 * be taken
 	 */
 
 	decoder := json.NewDecoder(r)
 	decoder.UseNumber()
-	var e error
 	var rawmessage map[string]*json.RawMessage
 	var decodedjson = map[string]*archiver.SmapMessage{}
+	var invalid = archiver.ValidationErrors{}
 	err := decoder.Decode(&rawmessage)
 	if err != nil {
-		return decodedjson, err
+		return decodedjson, invalid, err
 	}
 
 	for path, reading := range rawmessage {
-
+		if reading == nil {
+			invalid.Add(path, "not a sMAP object")
+			continue
+		}
 		js, err := simplejson.NewJson([]byte(*reading))
 		if err != nil {
-			e = err
+			invalid.Add(path, "not a sMAP object: %v", err)
+			continue
+		}
+		if _, err := js.Map(); err != nil {
+			invalid.Add(path, "not a sMAP object")
+			continue
 		}
 
 		// get uuid
 		uuid := js.Get("uuid").MustString("")
+		if raw, found := js.CheckGet("uuid"); found && uuid == "" {
+			invalid.Add(path, "uuid %v is not a string", raw.Interface())
+		}
 
 		message := &archiver.SmapMessage{Path: path, UUID: uuid, Contents: []string{}}
 
@@ -58,9 +70,11 @@ func handleJSON(r io.Reader) (map[string]*archiver.SmapMessage, error) {
 
 		// get contents
 		contents := js.Get("Contents").MustArray()
-		if len(contents) > 0 {
-			for _, arg := range contents {
-				message.Contents = append(message.Contents, arg.(string))
+		for _, arg := range contents {
+			if resource, ok := arg.(string); ok {
+				message.Contents = append(message.Contents, resource)
+			} else {
+				invalid.Add(path, "Contents entry %v is not a string", arg)
 			}
 		}
 
@@ -72,26 +86,30 @@ func handleJSON(r io.Reader) (map[string]*archiver.SmapMessage, error) {
 
 		// get readings
 		readingarray := js.Get("Readings").MustArray()
-		srs := make([][]interface{}, len(readingarray))
+		srs := make([][]interface{}, 0, len(readingarray))
 		for idx, readings := range readingarray {
-			reading := readings.([]interface{})
+			reading, ok := readings.([]interface{})
+			if !ok || len(reading) != 2 {
+				invalid.Add(path, "reading %v is not a [time, value] pair", idx)
+				continue
+			}
 			ts_num, ok := reading[0].(json.Number)
 			if !ok {
-				return decodedjson, errors.New("Timestamp is not a number")
+				invalid.Add(path, "reading %v: timestamp %v is not a number", idx, reading[0])
+				continue
 			}
 			ts, e := strconv.ParseUint(string(ts_num), 10, 64)
 			if e != nil {
-				return decodedjson, e
+				invalid.Add(path, "reading %v: timestamp %v is not a non-negative integer", idx, ts_num)
+				continue
 			}
-			val_num, ok := reading[1].(json.Number)
-			if !ok {
-				return decodedjson, errors.New("Value is not a number")
-			}
-			val, e := strconv.ParseFloat(string(val_num), 64)
+			readingtype, _ := message.Properties["ReadingType"].(string)
+			val, e := archiver.ParseReadingValue(reading[1], readingtype)
 			if e != nil {
-				return decodedjson, e
+				invalid.Add(path, "reading %v: %v", idx, e)
+				continue
 			}
-			srs[idx] = []interface{}{ts, val}
+			srs = append(srs, []interface{}{ts, val})
 		}
 		message.Readings = srs
 
@@ -100,8 +118,9 @@ func handleJSON(r io.Reader) (map[string]*archiver.SmapMessage, error) {
 		if actuator != nil {
 			message.Actuator = bson.M(actuator)
 		}
-		decodedjson[path] = message
-
+		if len(invalid[path]) == 0 {
+			decodedjson[path] = message
+		}
 	}
-	return decodedjson, e
+	return decodedjson, invalid, nil
 }
@@ -58,3 +58,26 @@ func BenchmarkDecodeJSONShort(b *testing.B) {
 		handleJSON(readershort)
 	}
 }
+
+func TestHandleJSONInvalid(t *testing.T) {
+	body := `
+{
+    "/good": {"Readings": [[1429000000000, 1]], "uuid": "b86df176-6b40-5d58-8f29-3b85f5cfbf1e"},
+    "/badtime": {"Readings": [["yesterday", 1]], "uuid": "b86df176-6b40-5d58-8f29-3b85f5cfbf1f"},
+    "/badpair": {"Readings": [[1429000000000]], "uuid": "b86df176-6b40-5d58-8f29-3b85f5cfbf20"},
+    "/baduuid": {"Readings": [[1429000000000, 1]], "uuid": 42},
+    "/notobject": 3
+}`
+	messages, invalid, err := handleJSON(strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages["/good"] == nil {
+		t.Error("Only the valid message should be decoded, not", messages)
+	}
+	for _, path := range []string{"/badtime", "/badpair", "/baduuid", "/notobject"} {
+		if len(invalid[path]) == 0 {
+			t.Error("The problem with", path, "should be reported, but got", invalid)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package httphandler
+
+import (
+	"encoding/json"
+	"github.com/gtfierro/giles/archiver"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+)
+
+// Returns the registered alerting rules as a JSON list
+func ListRulesHandler(a *archiver.Archiver, rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	rw.Header().Set("Content-Type", "application/json")
+	res, err := json.Marshal(a.Rules())
+	if err != nil {
+		log.Error("Error converting to json: %v", err)
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	rw.WriteHeader(200)
+	rw.Write(res)
+}
+
+// Registers a new alerting rule. The body is a JSON object such as
+//    {
+//      "Name": "boiler-overheat",
+//      "Where": "Metadata/Type = 'Boiler Temperature'",
+//      "Condition": "value > 90",
+//      "Webhook": "http://example.com/alerts"
+//    }
+// and the API key is given as the "key" query parameter
+func AddRuleHandler(a *archiver.Archiver, rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	defer req.Body.Close()
+	var rule archiver.Rule
+	if err := json.NewDecoder(req.Body).Decode(&rule); err != nil {
+		log.Error("Error decoding rule: %v", err)
+		rw.WriteHeader(400)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	err := a.AddRule(rule, unescape(req.URL.Query().Get("key")))
+	if _, ok := err.(*archiver.InvalidRuleError); ok {
+		rw.WriteHeader(400)
+		rw.Write([]byte(err.Error()))
+		return
+	} else if err != nil {
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	rw.WriteHeader(200)
+}
+
+// Deletes the named alerting rule
+func DeleteRuleHandler(a *archiver.Archiver, rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	if err := a.RemoveRule(ps.ByName("name"), unescape(req.URL.Query().Get("key"))); err != nil {
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	rw.WriteHeader(200)
+}
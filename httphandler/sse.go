@@ -0,0 +1,380 @@
+package httphandler
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gtfierro/giles/archiver"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// how often a comment line is written to idle event streams so that
+	// proxies do not time out the connection
+	sseHeartbeat = 15 * time.Second
+	// how many events each query keeps around for clients that reconnect
+	// with a Last-Event-ID
+	sseHistorySize = 1024
+	// how long a query's stream outlives its last client. Reconnecting
+	// within this window replays everything that was missed
+	sseLinger = 60 * time.Second
+	// how many events can be queued for a single slow client before it is
+	// disconnected (it can reconnect and replay from its last event ID)
+	sseClientBuffer = 256
+)
+
+type sseEvent struct {
+	id    string
+	event string
+	data  []byte
+}
+
+// writes the event in text/event-stream framing
+func (ev sseEvent) writeTo(rw http.ResponseWriter) error {
+	var err error
+	if ev.id != "" {
+		if _, err = fmt.Fprintf(rw, "id: %s\n", ev.id); err != nil {
+			return err
+		}
+	}
+	if ev.event != "" {
+		if _, err = fmt.Fprintf(rw, "event: %s\n", ev.event); err != nil {
+			return err
+		}
+	}
+	for _, line := range strings.Split(string(ev.data), "\n") {
+		if _, err = fmt.Fprintf(rw, "data: %s\n", line); err != nil {
+			return err
+		}
+	}
+	_, err = rw.Write([]byte{'\n'})
+	return err
+}
+
+type sseClient struct {
+	events chan sseEvent
+}
+
+// An sseStream is started for each event-stream client that subscribes,
+// and is shared with the clients that reconnect with one of its event IDs.
+// It is the archiver.Subscriber for the client's query: every message it
+// receives is numbered, kept in a bounded history and fanned out to the
+// attached clients. Giving each new client its own stream means that each
+// gets its own replay, if the query asks for one.
+//
+// Event IDs have the form <epoch>-<sequence>. The epoch identifies this
+// particular stream, so an ID handed out by an earlier stream (e.g. before
+// the stream lingered out) is never mistaken for one of ours.
+type sseStream struct {
+	sync.Mutex
+	key     string
+	epoch   int64
+	seqno   uint64
+	history []sseEvent
+	clients map[*sseClient]bool
+	notify  chan bool
+	linger  *time.Timer
+	closed  bool
+}
+
+func newSSEStream(key string) *sseStream {
+	return &sseStream{key: key,
+		epoch:   time.Now().UnixNano(),
+		history: make([]sseEvent, 0, sseHistorySize),
+		clients: make(map[*sseClient]bool),
+		notify:  make(chan bool, 1)}
+}
+
+// called when we receive a new message
+func (s *sseStream) Send(msg *archiver.SmapMessage) {
+	towrite := map[string]interface{}{msg.Path: archiver.SmapReading{Readings: msg.Readings, UUID: msg.UUID}}
+	bytes, err := json.Marshal(towrite)
+	if err != nil {
+		log.Error("Error marshalling republish message: %v", err)
+		return
+	}
+	s.publish("", bytes)
+}
+
+// tag subscription results are sent as "metadata" events
+func (s *sseStream) SendDiff(diff *archiver.MetadataDiff) {
+	bytes, err := json.Marshal(diff)
+	if err != nil {
+		log.Error("Error marshalling metadata diff: %v", err)
+		return
+	}
+	s.publish("metadata", bytes)
+}
+
+func (s *sseStream) SendError(e error) {
+	s.publish("error", []byte(e.Error()))
+}
+
+func (s *sseStream) GetNotify() <-chan bool {
+	return s.notify
+}
+
+// numbers the event, records it in the history and forwards it to every
+// attached client. Clients that cannot keep up are dropped.
+func (s *sseStream) publish(event string, data []byte) {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return
+	}
+	s.seqno++
+	ev := sseEvent{id: fmt.Sprintf("%d-%d", s.epoch, s.seqno), event: event, data: data}
+	if len(s.history) == sseHistorySize {
+		s.history = append(s.history[:0], s.history[1:]...)
+	}
+	s.history = append(s.history, ev)
+	for client := range s.clients {
+		select {
+		case client.events <- ev:
+		default:
+			log.Warning("Dropping slow event-stream client for %v", s.key)
+			delete(s.clients, client)
+			close(client.events)
+		}
+	}
+}
+
+// Registers a new client and returns the buffered events it missed since
+// lastid. If lastid is empty, nothing is replayed. If lastid comes from a
+// different stream, everything we have buffered is replayed. A client that
+// attaches after the stream has closed is sent the errors that closed it
+func (s *sseStream) attach(lastid string) (*sseClient, []sseEvent) {
+	s.Lock()
+	defer s.Unlock()
+	client := &sseClient{events: make(chan sseEvent, sseClientBuffer)}
+	if s.closed {
+		close(client.events)
+		var errs []sseEvent
+		for _, ev := range s.history {
+			if ev.event == "error" {
+				errs = append(errs, ev)
+			}
+		}
+		return client, errs
+	}
+	if s.linger != nil {
+		s.linger.Stop()
+		s.linger = nil
+	}
+	s.clients[client] = true
+	return client, s.since(lastid)
+}
+
+func (s *sseStream) since(lastid string) []sseEvent {
+	if lastid == "" {
+		return nil
+	}
+	var replay []sseEvent
+	parts := strings.SplitN(lastid, "-", 2)
+	epoch, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || len(parts) != 2 || epoch != s.epoch {
+		replay = make([]sseEvent, len(s.history))
+		copy(replay, s.history)
+		return replay
+	}
+	seqno, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return nil
+	}
+	// history holds the contiguous sequence numbers ending at s.seqno
+	first := s.seqno - uint64(len(s.history)) + 1
+	if seqno+1 < first {
+		seqno = first - 1 // the client missed more than we kept
+	}
+	if seqno >= s.seqno {
+		return nil
+	}
+	missed := s.history[seqno+1-first:]
+	replay = make([]sseEvent, len(missed))
+	copy(replay, missed)
+	return replay
+}
+
+// Removes the client. Once the last client has gone, the stream lingers for
+// sseLinger before unsubscribing from the archiver
+func (s *sseStream) detach(client *sseClient, onexpire func()) {
+	s.Lock()
+	defer s.Unlock()
+	if _, found := s.clients[client]; found {
+		delete(s.clients, client)
+		close(client.events)
+	}
+	if len(s.clients) > 0 || s.closed || s.linger != nil {
+		return
+	}
+	s.linger = time.AfterFunc(sseLinger, func() {
+		s.Lock()
+		if len(s.clients) > 0 || s.closed {
+			s.Unlock()
+			return
+		}
+		s.Unlock()
+		onexpire()
+	})
+}
+
+// Marks the stream as finished and disconnects all clients
+func (s *sseStream) close() {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	for client := range s.clients {
+		delete(s.clients, client)
+		close(client.events)
+	}
+	select {
+	case s.notify <- true:
+	default:
+	}
+}
+
+// Keeps track of the live sseStreams, keyed by API key, query and epoch
+type sseBroker struct {
+	sync.Mutex
+	streams map[string]*sseStream
+}
+
+var sse = &sseBroker{streams: make(map[string]*sseStream)}
+
+// Returns the stream that handed out lastid for the given query, or else
+// a new stream subscribed to the archiver. Streams for other nodes of the
+// cluster only carry the readings of this node's streams, so they are kept
+// apart
+func (b *sseBroker) get(a *archiver.Archiver, query, apikey, lastid string, fromnode bool) *sseStream {
+	b.Lock()
+	defer b.Unlock()
+	s, found := b.find(query, apikey, lastid, fromnode)
+	if found {
+		return s
+	}
+	b.streams[s.key] = s
+	go func() {
+		if fromnode {
+			a.HandleClusterSubscriber(s, query, apikey)
+		} else {
+			a.HandleSubscriber(s, query, apikey)
+		}
+		b.remove(s)
+	}()
+	return s
+}
+
+// Returns the live stream that handed out lastid, or a new stream that has
+// not been added to the broker yet. Must be called with the broker locked
+func (b *sseBroker) find(query, apikey, lastid string, fromnode bool) (*sseStream, bool) {
+	prefix := apikey + "|" + query + "|"
+	if fromnode {
+		prefix = "cluster|" + prefix
+	}
+	if lastid != "" {
+		epoch := strings.SplitN(lastid, "-", 2)[0]
+		if s, found := b.streams[prefix+epoch]; found {
+			return s, true
+		}
+	}
+	s := newSSEStream("")
+	s.key = prefix + strconv.FormatInt(s.epoch, 10)
+	return s, false
+}
+
+func (b *sseBroker) remove(s *sseStream) {
+	b.Lock()
+	if b.streams[s.key] == s {
+		delete(b.streams, s.key)
+	}
+	b.Unlock()
+	s.close()
+}
+
+// Subscribes the requester to the query given in the "q" URL parameter and
+// streams matching readings back as Server-Sent Events
+// (http://www.w3.org/TR/eventsource/). Each message is the same JSON object
+// that the /republish endpoint writes, carried in the data field of an event
+// with an ID. Each new client is sent the replay its query asks for (see
+// archiver.Republisher.HandleSubscriber). Clients that reconnect with a
+// Last-Event-ID header (or a lastEventId URL parameter, for polyfills that
+// cannot set headers) are instead first sent every buffered event they
+// missed. Errors are sent as events of type
+// "error", and a comment line is written every 15 seconds to keep idle
+// connections alive.
+//
+//    GET /api/republish/sse?q=Metadata/Site='Soda Hall'&key=<apikey>
+func SSERepublishHandler(a *archiver.Archiver, rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		rw.WriteHeader(500)
+		rw.Write([]byte("Streaming is not supported"))
+		return
+	}
+	params := req.URL.Query()
+	query := params.Get("q")
+	if query == "" {
+		rw.WriteHeader(400)
+		rw.Write([]byte("Missing query parameter q"))
+		return
+	}
+	// the query is checked before the stream is opened, as errors found
+	// once it is open would only reach the client as events, to which
+	// EventSource responds by reconnecting
+	if err := a.CheckSubscription(query); err != nil {
+		rw.WriteHeader(400)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	apikey := unescape(params.Get("key"))
+	lastid := req.Header.Get("Last-Event-ID")
+	if lastid == "" {
+		lastid = params.Get("lastEventId")
+	}
+
+	stream := sse.get(a, query, apikey, lastid, req.Header.Get(archiver.ClusterHeader) != "")
+	client, replay := stream.attach(lastid)
+	defer stream.detach(client, func() { sse.remove(stream) })
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.Header().Set("Connection", "keep-alive")
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	rw.WriteHeader(200)
+	for _, ev := range replay {
+		if err := ev.writeTo(rw); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	notify := rw.(http.CloseNotifier).CloseNotify()
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case ev, ok := <-client.events:
+			if !ok {
+				return
+			}
+			if err := ev.writeTo(rw); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-heartbeat.C:
+			if _, err := rw.Write([]byte(": heartbeat\n\n")); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-notify:
+			return
+		}
+	}
+}
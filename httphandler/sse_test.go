@@ -0,0 +1,110 @@
+package httphandler
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestSSEReplay(t *testing.T) {
+	s := newSSEStream("test")
+	for i := 0; i < 5; i++ {
+		s.publish("", []byte(fmt.Sprintf("%d", i)))
+	}
+	client, replay := s.attach("")
+	if len(replay) != 0 {
+		t.Error("Fresh client should not get a replay but got", len(replay))
+	}
+	s.detach(client, func() {})
+
+	lastid := fmt.Sprintf("%d-%d", s.epoch, 2)
+	client, replay = s.attach(lastid)
+	if len(replay) != 3 {
+		t.Fatal("Client at event 2 should replay 3 events but got", len(replay))
+	}
+	if string(replay[0].data) != "2" || string(replay[2].data) != "4" {
+		t.Error("Replayed wrong events", string(replay[0].data), string(replay[2].data))
+	}
+
+	s.publish("", []byte("5"))
+	ev := <-client.events
+	if string(ev.data) != "5" || ev.id != fmt.Sprintf("%d-%d", s.epoch, 6) {
+		t.Error("Live event should be 5 with seqno 6 but is", string(ev.data), ev.id)
+	}
+
+	_, replay = s.attach(fmt.Sprintf("%d-%d", s.epoch, 6))
+	if len(replay) != 0 {
+		t.Error("Up-to-date client should not get a replay but got", len(replay))
+	}
+
+	_, replay = s.attach("1-1")
+	if len(replay) != 6 {
+		t.Error("Client from another stream should replay all 6 events but got", len(replay))
+	}
+}
+
+func TestSSEHistoryBound(t *testing.T) {
+	s := newSSEStream("test")
+	for i := 0; i < sseHistorySize+10; i++ {
+		s.publish("", []byte(fmt.Sprintf("%d", i)))
+	}
+	if len(s.history) != sseHistorySize {
+		t.Error("History should be bounded to", sseHistorySize, "but is", len(s.history))
+	}
+	_, replay := s.attach(fmt.Sprintf("%d-%d", s.epoch, 1))
+	if len(replay) != sseHistorySize {
+		t.Error("Client too far behind should replay the whole history but got", len(replay))
+	}
+	if string(replay[0].data) != "10" {
+		t.Error("Oldest buffered event should be 10 but is", string(replay[0].data))
+	}
+}
+
+func TestSSEClosedStream(t *testing.T) {
+	s := newSSEStream("test")
+	s.publish("", []byte("1"))
+	s.SendError(fmt.Errorf("no such stream"))
+	s.close()
+	client, replay := s.attach("")
+	if _, ok := <-client.events; ok {
+		t.Error("Client of a closed stream should not get live events")
+	}
+	if len(replay) != 1 || replay[0].event != "error" || string(replay[0].data) != "no such stream" {
+		t.Error("Client of a closed stream should be sent its error but got", replay)
+	}
+}
+
+func TestSSEMalformedQuery(t *testing.T) {
+	for _, query := range []string{"Metadata/Site", "Metadata/Site =", "Metadata/Site = 'a' and"} {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/api/republish/sse?q="+url.QueryEscape(query), nil)
+		// the query is refused before the archiver is needed
+		SSERepublishHandler(nil, rw, req, nil)
+		if rw.Code != 400 {
+			t.Error(query, "should be refused with a 400, not", rw.Code)
+		}
+	}
+}
+
+func TestSSEBrokerFind(t *testing.T) {
+	b := &sseBroker{streams: make(map[string]*sseStream)}
+	s, found := b.find("has uuid", "key", "", false)
+	if found {
+		t.Fatal("A client without an event ID should get a new stream")
+	}
+	b.streams[s.key] = s
+	if other, found := b.find("has uuid", "key", "", false); found || other == s {
+		t.Error("Each new client should get its own stream")
+	}
+	lastid := fmt.Sprintf("%d-%d", s.epoch, 3)
+	if same, found := b.find("has uuid", "key", lastid, false); !found || same != s {
+		t.Error("A client reconnecting with an event ID should get the stream that sent it")
+	}
+	if _, found := b.find("has uuid", "other", lastid, false); found {
+		t.Error("Streams should not be shared between API keys")
+	}
+	if _, found := b.find("has uuid", "key", lastid, true); found {
+		t.Error("Streams for other nodes of the cluster should be kept apart")
+	}
+}
@@ -34,6 +34,21 @@ func (hs HTTPSubscriber) Send(msg *archiver.SmapMessage) {
 		flusher.Flush()
 	}
 }
+
+// called when the results of a tag subscription change
+func (hs HTTPSubscriber) SendDiff(diff *archiver.MetadataDiff) {
+	bytes, err := json.Marshal(diff)
+	if err != nil {
+		hs.rw.WriteHeader(500)
+	} else {
+		hs.rw.Write(bytes)
+		hs.rw.Write([]byte{'\n', '\n'})
+	}
+	if flusher, ok := hs.rw.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
 func (hs HTTPSubscriber) SendError(e error) {
 	hs.rw.WriteHeader(500)
 	hs.rw.Write([]byte(e.Error()))
@@ -0,0 +1,56 @@
+package httphandler
+
+import (
+	"encoding/json"
+	"github.com/gtfierro/giles/archiver"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+)
+
+// Returns the definitions of the virtual streams as a JSON list
+func ListVirtualStreamsHandler(a *archiver.Archiver, rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	rw.Header().Set("Content-Type", "application/json")
+	res, err := json.Marshal(a.VirtualStreams())
+	if err != nil {
+		log.Error("Error converting to json: %v", err)
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	rw.WriteHeader(200)
+	rw.Write(res)
+}
+
+// Defines a new virtual stream. The body is a JSON object such as
+//    {
+//      "Name": "temp_f",
+//      "Expression": "stream(Path = '/building/temp_c') * 9/5 + 32",
+//      "Metadata": {"Type": "Temperature", "Units": "F"}
+//    }
+// and the API key is given as the "key" query parameter
+func AddVirtualStreamHandler(a *archiver.Archiver, rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	defer req.Body.Close()
+	var def archiver.VirtualStream
+	if err := json.NewDecoder(req.Body).Decode(&def); err != nil {
+		log.Error("Error decoding virtual stream: %v", err)
+		rw.WriteHeader(400)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	if err := a.AddVirtualStream(def, unescape(req.URL.Query().Get("key"))); err != nil {
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	rw.WriteHeader(200)
+}
+
+// Stops computing the named virtual stream
+func DeleteVirtualStreamHandler(a *archiver.Archiver, rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	if err := a.RemoveVirtualStream(ps.ByName("name"), unescape(req.URL.Query().Get("key"))); err != nil {
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	rw.WriteHeader(200)
+}
@@ -0,0 +1,57 @@
+package httphandler
+
+import (
+	"encoding/json"
+	"github.com/gtfierro/giles/archiver"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+)
+
+// Returns the registered webhooks as a JSON list. Secrets are not included
+func ListWebhooksHandler(a *archiver.Archiver, rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	rw.Header().Set("Content-Type", "application/json")
+	res, err := json.Marshal(a.Webhooks())
+	if err != nil {
+		log.Error("Error converting to json: %v", err)
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	rw.WriteHeader(200)
+	rw.Write(res)
+}
+
+// Registers a new webhook. The body is a JSON object such as
+//    {
+//      "Name": "workorders",
+//      "URL": "https://example.com/giles",
+//      "Query": "Metadata/Type = 'Temp' and value > 30",
+//      "Secret": "shared secret used to sign deliveries"
+//    }
+// and the API key is given as the "key" query parameter
+func AddWebhookHandler(a *archiver.Archiver, rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	defer req.Body.Close()
+	var hook archiver.Webhook
+	if err := json.NewDecoder(req.Body).Decode(&hook); err != nil {
+		log.Error("Error decoding webhook: %v", err)
+		rw.WriteHeader(400)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	if err := a.AddWebhook(hook, unescape(req.URL.Query().Get("key"))); err != nil {
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	rw.WriteHeader(200)
+}
+
+// Stops and deletes the named webhook
+func DeleteWebhookHandler(a *archiver.Archiver, rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	if err := a.RemoveWebhook(ps.ByName("name"), unescape(req.URL.Query().Get("key"))); err != nil {
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	rw.WriteHeader(200)
+}
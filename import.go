@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/gtfierro/giles/archiver"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// how long to wait before sending a chunk again when the archiver cannot
+// take it yet
+const importRetry = 30 * time.Second
+
+var importUsage = `usage: giles import [flags] file...
+
+Imports historic readings from CSV or sMAP JSON lines files through the
+/api/import endpoint of a running archiver. The metadata file is a JSON
+object that gives the stream of each CSV column (by the column's name in the
+header, or by the file's name without its extension for files of
+<timestamp><delim><value> lines) or of each path of a JSON lines file:
+
+    {"AHU-1 SAT": {"Path": "/ahu1/sat", "uuid": "...", "Metadata": {"Site": "Soda"}}}
+
+Keys like "Metadata/Site" are read as nested keys. The import of each file
+is recorded in <file>.import, so that running the same command again resumes
+it; remove that file to import the file again.
+
+`
+
+// Runs the import subcommand and returns the exit status
+func runImport(args []string) int {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	archiverURL := flags.String("url", "http://localhost:8079", "URL of the archiver's HTTP interface")
+	apikey := flags.String("key", "", "API key that may write the streams")
+	metadata := flags.String("metadata", "", "JSON file with the stream of each column or path")
+	format := flags.String("format", "", "csv or json (by default, json for .json, .jsonl and .ndjson files and csv otherwise)")
+	delimiter := flags.String("delimiter", ",", "CSV delimiter")
+	header := flags.Bool("header", false, "CSV files start with a line naming their columns")
+	uot := flags.String("uot", "ms", "unit of integer timestamps: s, ms, us or ns")
+	timeformat := flags.String("timeformat", "", "Go time layout of CSV timestamps that are not integers, e.g. \"2006-01-02 15:04:05\"")
+	timezone := flags.String("timezone", "", "time zone of CSV timestamps read with -timeformat (by default the archiver's)")
+	chunk := flags.Int("chunk", 10000, "lines sent in each request")
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, importUsage)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 || *metadata == "" {
+		flags.Usage()
+		return 2
+	}
+	streams, err := readImportMetadata(*metadata)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading %v: %v\n", *metadata, err)
+		return 1
+	}
+	client := &importClient{url: strings.TrimRight(*archiverURL, "/"), key: *apikey, http: &http.Client{Timeout: 5 * time.Minute}}
+	for _, file := range flags.Args() {
+		imp := archiver.Import{Format: *format, Delimiter: *delimiter, UnitofTime: *uot, TimeFormat: *timeformat, Timezone: *timezone}
+		if imp.Format == "" {
+			imp.Format = archiver.IMPORT_CSV
+			switch filepath.Ext(file) {
+			case ".json", ".jsonl", ".ndjson":
+				imp.Format = archiver.IMPORT_JSON
+			}
+		}
+		if err := client.importFile(file, imp, streams, *header, *chunk); err != nil {
+			fmt.Fprintf(os.Stderr, "Error importing %v: %v\n", file, err)
+			return 1
+		}
+	}
+	return 0
+}
+
+// Reads the metadata file, nesting keys like "Metadata/Site"
+func readImportMetadata(filename string) (map[string]*archiver.ImportStream, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]map[string]interface{}
+	if err := json.Unmarshal(contents, &raw); err != nil {
+		return nil, err
+	}
+	streams := make(map[string]*archiver.ImportStream, len(raw))
+	for name, flat := range raw {
+		nested := make(map[string]interface{})
+		for key, value := range flat {
+			doc := nested
+			parts := strings.Split(key, "/")
+			for _, part := range parts[:len(parts)-1] {
+				inner, ok := doc[part].(map[string]interface{})
+				if !ok {
+					inner = make(map[string]interface{})
+					doc[part] = inner
+				}
+				doc = inner
+			}
+			doc[parts[len(parts)-1]] = value
+		}
+		// reuse the JSON decoding of ImportStream
+		body, _ := json.Marshal(nested)
+		var stream archiver.ImportStream
+		if err := json.Unmarshal(body, &stream); err != nil {
+			return nil, fmt.Errorf("%v: %v", name, err)
+		}
+		streams[name] = &stream
+	}
+	return streams, nil
+}
+
+type importClient struct {
+	url  string
+	key  string
+	http *http.Client
+}
+
+// Imports a file, resuming the import recorded in its .import file if there
+// is one
+func (c *importClient) importFile(file string, imp archiver.Import, streams map[string]*archiver.ImportStream, header bool, chunk int) error {
+	statefile := file + ".import"
+	var progress *archiver.Import
+	if id, err := ioutil.ReadFile(statefile); err == nil {
+		if progress, err = c.status(strings.TrimSpace(string(id))); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "%v: resuming import %v at line %v\n", file, progress.ID, progress.Lines)
+	} else {
+		columns, err := importColumns(file, imp, header)
+		if err != nil {
+			return err
+		}
+		imp.Columns = columns
+		imp.Streams = streams
+		if imp.Format == archiver.IMPORT_CSV {
+			// only the streams of this file's columns
+			imp.Streams = make(map[string]*archiver.ImportStream)
+			for _, name := range columns[1:] {
+				if stream, found := streams[name]; found {
+					imp.Streams[name] = stream
+				}
+			}
+		}
+		if progress, err = c.start(imp); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(statefile, []byte(progress.ID+"\n"), 0644); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "%v: started import %v\n", file, progress.ID)
+	}
+
+	began, startReadings := time.Now(), progress.Readings
+	for {
+		done, err := c.send(file, progress, header, chunk, func(p *archiver.Import) {
+			rate := float64(p.Readings-startReadings) / time.Since(began).Seconds()
+			fmt.Fprintf(os.Stderr, "%v: %v lines, %v readings (%.0f readings/s)\n", file, p.Lines, p.Readings, rate)
+		})
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+		// the archiver has got somewhere else than we thought, so start
+		// again from there
+		if progress, err = c.status(progress.ID); err != nil {
+			return err
+		}
+	}
+}
+
+// Returns the names of the columns of a CSV file, the first of which holds
+// the timestamps
+func importColumns(file string, imp archiver.Import, header bool) ([]string, error) {
+	if imp.Format != archiver.IMPORT_CSV {
+		return nil, nil
+	}
+	if !header {
+		name := filepath.Base(file)
+		return []string{"time", strings.TrimSuffix(name, filepath.Ext(name))}, nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	reader := csv.NewReader(f)
+	reader.Comma = importDelimiter(&imp)
+	reader.FieldsPerRecord = -1
+	columns, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("Could not read the header: %v", err)
+	}
+	for i := range columns {
+		columns[i] = strings.TrimSpace(columns[i])
+	}
+	return columns, nil
+}
+
+// Sends the file in chunks from where the import has got to. Returns false
+// if the archiver refused a chunk because it had got somewhere else
+func (c *importClient) send(file string, progress *archiver.Import, header bool, chunk int, report func(*archiver.Import)) (bool, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	lines := newLineReader(f, progress, header)
+	for offset := uint64(0); ; {
+		body, n, err := lines.read(chunk)
+		if err != nil {
+			return false, err
+		}
+		if n == 0 {
+			return true, nil
+		}
+		if offset+uint64(n) <= progress.Lines {
+			// already imported
+			offset += uint64(n)
+			continue
+		}
+		for {
+			imp, retry, err := c.chunk(progress.ID, offset, body)
+			if err == errImportMoved {
+				return false, nil
+			} else if err != nil {
+				return false, err
+			}
+			if !retry {
+				progress = imp
+				break
+			}
+			time.Sleep(importRetry)
+		}
+		offset += uint64(n)
+		report(progress)
+	}
+}
+
+// Reads a file a chunk of lines at a time: CSV records, re-encoded so that
+// the archiver counts them the same way, or JSON lines
+type lineReader struct {
+	csv   *csv.Reader
+	comma rune
+	text  *bufio.Reader
+}
+
+func newLineReader(r io.Reader, imp *archiver.Import, header bool) *lineReader {
+	if imp.Format != archiver.IMPORT_CSV {
+		return &lineReader{text: bufio.NewReader(r)}
+	}
+	lr := &lineReader{csv: csv.NewReader(r), comma: importDelimiter(imp)}
+	lr.csv.Comma = lr.comma
+	lr.csv.FieldsPerRecord = -1
+	if header {
+		lr.csv.Read()
+	}
+	return lr
+}
+
+func importDelimiter(imp *archiver.Import) rune {
+	if imp.Delimiter == "" {
+		return ','
+	}
+	return []rune(imp.Delimiter)[0]
+}
+
+// Returns up to n lines and how many there are
+func (lr *lineReader) read(n int) ([]byte, int, error) {
+	var buf bytes.Buffer
+	count := 0
+	if lr.csv != nil {
+		writer := csv.NewWriter(&buf)
+		writer.Comma = lr.comma
+		for ; count < n; count++ {
+			record, err := lr.csv.Read()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, 0, err
+			}
+			writer.Write(record)
+		}
+		writer.Flush()
+		return buf.Bytes(), count, writer.Error()
+	}
+	for ; count < n; count++ {
+		line, err := lr.text.ReadString('\n')
+		if err == io.EOF && line == "" {
+			break
+		} else if err != nil && err != io.EOF {
+			return nil, 0, err
+		}
+		buf.WriteString(line)
+		if !strings.HasSuffix(line, "\n") {
+			buf.WriteString("\n")
+		}
+	}
+	return buf.Bytes(), count, nil
+}
+
+var errImportMoved = errors.New("The import is not where it was thought to be")
+
+func (c *importClient) endpoint(path string, params url.Values) string {
+	params.Set("key", c.key)
+	return c.url + path + "?" + params.Encode()
+}
+
+func (c *importClient) start(imp archiver.Import) (*archiver.Import, error) {
+	body, err := json.Marshal(imp)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.http.Post(c.endpoint("/api/import", url.Values{}), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	return decodeImport(resp)
+}
+
+func (c *importClient) status(id string) (*archiver.Import, error) {
+	resp, err := c.http.Get(c.endpoint("/api/import/"+id, url.Values{}))
+	if err != nil {
+		return nil, err
+	}
+	return decodeImport(resp)
+}
+
+// Sends a chunk and returns the progress of the import, or true if the
+// chunk should be sent again later
+func (c *importClient) chunk(id string, offset uint64, body []byte) (*archiver.Import, bool, error) {
+	params := url.Values{"offset": []string{strconv.FormatUint(offset, 10)}}
+	resp, err := c.http.Post(c.endpoint("/api/import/"+id, params), "text/plain", bytes.NewReader(body))
+	if err != nil {
+		// the archiver may have written the chunk, which is sent again
+		fmt.Fprintf(os.Stderr, "Error sending lines from %v (retrying): %v\n", offset, err)
+		return nil, true, nil
+	}
+	switch resp.StatusCode {
+	case 409:
+		resp.Body.Close()
+		return nil, false, errImportMoved
+	case 503:
+		resp.Body.Close()
+		fmt.Fprintf(os.Stderr, "The archiver cannot take readings yet, retrying in %v\n", importRetry)
+		return nil, true, nil
+	case 400:
+		defer resp.Body.Close()
+		var refused archiver.ImportError
+		if json.NewDecoder(resp.Body).Decode(&refused) == nil && len(refused.Problems) > 0 {
+			return nil, false, fmt.Errorf("Lines from %v were refused:\n  %v", offset, strings.Join(refused.Problems, "\n  "))
+		}
+	}
+	imp, err := decodeImport(resp)
+	return imp, false, err
+}
+
+func decodeImport(resp *http.Response) (*archiver.Import, error) {
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Archiver answered %v: %s", resp.Status, body)
+	}
+	var imp archiver.Import
+	if err := json.Unmarshal(body, &imp); err != nil {
+		return nil, err
+	}
+	return &imp, nil
+}
@@ -10,6 +10,7 @@ const (
 	TAG_GET
 	TAG_SET
 	QUERY
+	ERROR
 )
 
 // ^^ to be continued ...
@@ -22,6 +23,28 @@ func ParseHeader(input *[]byte, offset int) (MessageType, int) {
 	return DATA_WRITE, packetlength
 }
 
+// Returns a packet with the msgpack map {"error": err}, which is sent back to
+// clients whose packets were refused (e.g. with archiver.ErrBacklogFull)
+func EncodeError(err error) []byte {
+	msg := err.Error()
+	if len(msg) > 0xffff-20 {
+		msg = msg[:0xffff-20]
+	}
+	packet := []byte{0, 0, ERROR, 0x81, 0xa5, 'e', 'r', 'r', 'o', 'r'}
+	switch n := len(msg); {
+	case n < 32:
+		packet = append(packet, 0xa0|byte(n))
+	case n < 256:
+		packet = append(packet, 0xd9, byte(n))
+	default:
+		packet = append(packet, 0xda, byte(n>>8), byte(n))
+	}
+	packet = append(packet, msg...)
+	packet[0] = byte(len(packet))
+	packet[1] = byte(len(packet) >> 8)
+	return packet
+}
+
 func getUintLE(input *[]byte, offset, length int) uint64 {
 	var value uint64
 	for i := 0; i < length; i++ {
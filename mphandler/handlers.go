@@ -28,6 +28,18 @@
 // Packet length is 2 bytes. Afterwards comes a single byte that contains the
 // packet type (this will be a value from a predetermined Enum that will be
 // described below. Following this header comes the actual packet contents
+//
+// A packet with an Actuate key is an actuation command rather than readings:
+//
+//      {"uuid": "...", "key": "<apikey with actuation permission>", "Actuate": 1}
+//
+// See Archiver.Actuate
+//
+// If a packet is refused, e.g. because the timeseries database is down and
+// Giles cannot hold any more readings for it, a packet of type ERROR
+// containing {"error": "<reason>"} is sent back over the same connection (or
+// to the sending address for UDP). Clients should hold on to their readings
+// and try again later.
 package mphandler
 
 import (
@@ -56,9 +68,12 @@ func HandleTCP(a *archiver.Archiver, port int) {
 	listener, err := net.ListenTCP("tcp", tcpaddr)
 	if err != nil {
 		log.Error("Error on listening: %v", err)
+		a.ListenerFailed("msgpack-tcp", err)
+		return
 	}
 
 	log.Notice("Starting MsgPack on TCP %v", tcpaddr.String())
+	a.ListenerStarted("msgpack-tcp")
 
 	for {
 		conn, err := listener.Accept()
@@ -78,9 +93,12 @@ func HandleUDP(a *archiver.Archiver, port int) {
 	conn, err := net.ListenUDP("udp6", udpaddr)
 	if err != nil {
 		log.Error("Error on listening (%v)", err)
+		a.ListenerFailed("msgpack-udp", err)
+		return
 	}
 
 	log.Notice("Starting MsgPack on UDP %v", udpaddr.String())
+	a.ListenerStarted("msgpack-udp")
 	for {
 		buf := make([]byte, 1024)
 		n, fromaddr, err := conn.ReadFrom(buf)
@@ -88,14 +106,34 @@ func HandleUDP(a *archiver.Archiver, port int) {
 			log.Error("Problem reading connection %v (%v)", fromaddr, err)
 		}
 		if n > 0 {
-			go handleUDPConn(a, buf[:n])
+			go func(buf []byte, fromaddr net.Addr) {
+				if err := handleUDPConn(a, buf); err != nil {
+					conn.WriteTo(EncodeError(err), fromaddr)
+				}
+			}(buf[:n], fromaddr)
 		}
 	}
 }
 
-func handleUDPConn(a *archiver.Archiver, buf []byte) {
+func handleUDPConn(a *archiver.Archiver, buf []byte) error {
 	_, decoded := msgpack.Decode(&buf, 0)
-	AddReadings(a, decoded.(map[string]interface{}))
+	return handleMessage(a, decoded.(map[string]interface{}))
+}
+
+// Dispatches a decoded packet to AddReadings or Actuate
+func handleMessage(a *archiver.Archiver, md map[string]interface{}) error {
+	if value, found := md["Actuate"]; found {
+		return Actuate(a, md, value)
+	}
+	return AddReadings(a, md)
+}
+
+// Handles a packet from a TCP connection, sending back an error packet if
+// it is refused
+func handleConnMessage(a *archiver.Archiver, conn net.Conn, md map[string]interface{}) {
+	if err := handleMessage(a, md); err != nil {
+		conn.Write(EncodeError(err))
+	}
 }
 
 // How do we efficiently handle lots of packets on a single connection?
@@ -139,7 +177,7 @@ func handleConn(a *archiver.Archiver, conn net.Conn) {
 				offset = leftover
 			}
 			_, decoded := msgpack.Decode(&dec, 0)
-			AddReadings(a, decoded.(map[string]interface{}))
+			handleConnMessage(a, conn, decoded.(map[string]interface{}))
 			old = old[:cap(old)]
 			readalready = 0
 			leftover = 0
@@ -165,7 +203,7 @@ func handleConn(a *archiver.Archiver, conn net.Conn) {
 				packetlength -= 3
 				if offset+packetlength <= BUFFER_SIZE { // still have room
 					newoffset, decoded := msgpack.Decode(&buf, offset)
-					AddReadings(a, decoded.(map[string]interface{}))
+					handleConnMessage(a, conn, decoded.(map[string]interface{}))
 					offset = newoffset
 				} else { // not enough!
 					copy(old, buf[offset:])
@@ -179,7 +217,7 @@ func handleConn(a *archiver.Archiver, conn net.Conn) {
 }
 
 //TODO: check for malformed
-func AddReadings(a *archiver.Archiver, md map[string]interface{}) {
+func AddReadings(a *archiver.Archiver, md map[string]interface{}) error {
 	ret := map[string]*archiver.SmapMessage{}
 	sm := &archiver.SmapMessage{Path: md["Path"].(string),
 		UUID:     md["uuid"].(string),
@@ -192,12 +230,23 @@ func AddReadings(a *archiver.Archiver, md map[string]interface{}) {
 		} else {
 			timestamp = uint64(rdg.([]interface{})[0].(int64))
 		}
-		if reading, ok := rdg.([]interface{})[1].(int64); ok {
-			sm.Readings = append(sm.Readings, []interface{}{timestamp, float64(reading)})
-		} else if freading, ok := rdg.([]interface{})[1].(float64); ok {
-			sm.Readings = append(sm.Readings, []interface{}{timestamp, freading})
+		// integers stay int64 so that long streams keep their exact value;
+		// strings and maps are kept for string and object streams
+		switch value := rdg.([]interface{})[1].(type) {
+		case int64, float64, string, map[string]interface{}:
+			sm.Readings = append(sm.Readings, []interface{}{timestamp, value})
 		}
 	}
 	ret[sm.Path] = sm
-	a.AddData(ret, md["key"].(string))
+	return a.AddDataFrom("msgpack", ret, md["key"].(string))
+}
+
+func Actuate(a *archiver.Archiver, md map[string]interface{}, value interface{}) error {
+	uuid, _ := md["uuid"].(string)
+	key, _ := md["key"].(string)
+	err := a.Actuate(uuid, value, key)
+	if err != nil {
+		log.Error("Error actuating %v: %v", uuid, err)
+	}
+	return err
 }
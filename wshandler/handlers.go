@@ -48,7 +48,14 @@ func Handle(a *archiver.Archiver, port int) {
 	srv := &http.Server{
 		Addr: address.String(),
 	}
-	srv.ListenAndServe()
+	listener, err := net.Listen("tcp", address.String())
+	if err != nil {
+		log.Error("Error on listening: %v", err)
+		a.ListenerFailed("websockets", err)
+		return
+	}
+	a.ListenerStarted("websockets")
+	a.ListenerFailed("websockets", srv.Serve(listener))
 }
 
 var upgrader = &websocket.Upgrader{
@@ -88,7 +95,7 @@ func WsAddReadingHandler(a *archiver.Archiver, rw http.ResponseWriter, req *http
 		return
 	}
 	log.Debug("msgtype: %v, msg: %v, err: %v", msgtype, msg, err)
-	err = a.AddData(messages, apikey)
+	err = a.AddDataFrom("websocket", messages, apikey)
 	if err != nil {
 		ws.WriteJSON(map[string]string{"error": err.Error()})
 		return
@@ -84,7 +84,8 @@ func handleJSON(r io.Reader) (map[string]*archiver.SmapMessage, error) {
 			if e != nil {
 				return decodedjson, e
 			}
-			val, e := strconv.ParseFloat(string(reading[1].(json.Number)), 64)
+			readingtype, _ := message.Properties["ReadingType"].(string)
+			val, e := archiver.ParseReadingValue(reading[1], readingtype)
 			if e != nil {
 				return decodedjson, e
 			}
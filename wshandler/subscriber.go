@@ -36,6 +36,11 @@ func (wss WSSubscriber) Send(msg *archiver.SmapMessage) {
 	}
 }
 
+func (wss WSSubscriber) SendDiff(diff *archiver.MetadataDiff) {
+	b, _ := json.Marshal(diff)
+	wss.outbound <- b
+}
+
 func (wss WSSubscriber) SendError(e error) {
 	log.Error("WS error", e.Error())
 	//wss.ws.WriteMessage(websocket.TextMessage, []byte(e.Error()))